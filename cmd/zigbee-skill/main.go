@@ -1,22 +1,25 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
+	"github.com/urmzd/zigbee-skill/pkg/adapter"
 	"github.com/urmzd/zigbee-skill/pkg/app"
 	"github.com/urmzd/zigbee-skill/pkg/config"
 	"github.com/urmzd/zigbee-skill/pkg/daemon"
 	"github.com/urmzd/zigbee-skill/pkg/device"
 	"github.com/urmzd/zigbee-skill/pkg/device/schema"
-	"github.com/urmzd/zigbee-skill/pkg/zigbee"
+	"github.com/urmzd/zigbee-skill/pkg/history"
 	"gopkg.in/natefinch/lumberjack.v2"
 )
 
@@ -32,6 +35,7 @@ var (
 	logPath          string
 	daemonForeground bool
 	noCache          bool
+	networkName      string
 )
 
 // Shared app instance initialised by PersistentPreRunE.
@@ -105,9 +109,12 @@ func rootCmd() *cobra.Command {
 			ctx := cmd.Context()
 			if noCache {
 				ctx = device.WithNoCache(ctx)
-				// store updated ctx back
-				cmd.SetContext(ctx)
 			}
+			if networkName != "" {
+				ctx = device.WithNetwork(ctx, networkName)
+			}
+			// store updated ctx back
+			cmd.SetContext(ctx)
 
 			// Auto-detect running daemon and route through it.
 			if running, _, _ := daemon.IsRunning(pidPath); running {
@@ -116,6 +123,7 @@ func rootCmd() *cobra.Command {
 					Controller: client,
 					Events:     daemon.NewDaemonEventSubscriber(socketPath),
 					Validator:  schema.NewValidator(),
+					History:    client,
 				}
 				return nil
 			}
@@ -127,6 +135,13 @@ func rootCmd() *cobra.Command {
 			}
 			return nil
 		},
+		// Save last-known device state and release the adapter after one-shot
+		// commands.
+		PersistentPostRun: func(cmd *cobra.Command, args []string) {
+			if sharedApp != nil {
+				sharedApp.Close()
+			}
+		},
 	}
 
 	// Persistent global flags.
@@ -138,9 +153,11 @@ func rootCmd() *cobra.Command {
 	pf.StringVar(&logPath, "log", daemon.DefaultLogPath, "Daemon log file")
 	pf.BoolVar(&daemonForeground, "daemon-foreground", false, "Run as foreground daemon (internal)")
 	pf.BoolVar(&noCache, "no-cache", false, "Bypass cached device state")
+	pf.StringVar(&networkName, "network", "", "Network to act on when several adapters are configured")
 	_ = pf.MarkHidden("daemon-foreground")
 
 	root.AddCommand(
+		adaptersCmd(),
 		healthCmd(),
 		daemonCmd(),
 		devicesCmd(),
@@ -162,14 +179,48 @@ func skipAppInit(cmd *cobra.Command) bool {
 	}
 	if len(names) >= 2 {
 		switch names[1] {
-		case "daemon", "network", "update", "version":
+		case "adapters", "daemon", "update", "version":
 			return true
+		case "network":
+			// reset talks to the adapter directly; the rest go through the app/daemon.
+			return len(names) >= 3 && names[2] == "reset"
 		}
 	}
 	// Also skip if --daemon-foreground is set (handled inline).
 	return daemonForeground
 }
 
+// --- adapters ---
+
+func adaptersCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "adapters",
+		Short: "Find Zigbee adapters on serial ports",
+	}
+	cmd.AddCommand(adaptersListCmd())
+	return cmd
+}
+
+func adaptersListCmd() *cobra.Command {
+	var noProbe bool
+	cmd := &cobra.Command{
+		Use:   "list",
+		Short: "List USB serial ports and identify Zigbee adapters",
+		Long: "List USB serial ports with their VID/PID and product string, name recognised adapters " +
+			"and probe each port for a ZNP, deCONZ or EZSP adapter. Stop the daemon first: a port " +
+			"it holds cannot be probed.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ports, err := adapter.List(!noProbe)
+			if err != nil {
+				return err
+			}
+			return output(map[string]any{"adapters": ports, "count": len(ports)})
+		},
+	}
+	cmd.Flags().BoolVar(&noProbe, "no-probe", false, "Only read USB descriptors; do not open the ports")
+	return cmd
+}
+
 // --- health ---
 
 func healthCmd() *cobra.Command {
@@ -177,23 +228,32 @@ func healthCmd() *cobra.Command {
 		Use:   "health",
 		Short: "Check controller health",
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return cmdHealth(sharedApp)
+			return cmdHealth(cmd.Context(), sharedApp)
 		},
 	}
 }
 
-func cmdHealth(a *app.App) error {
+func cmdHealth(ctx context.Context, a *app.App) error {
 	status := "healthy"
 	controller := "connected"
-	if !a.Controller.IsConnected() {
+	connected := a.Controller.IsConnected()
+	if !connected {
 		status = "unhealthy"
 		controller = "disconnected"
 	}
-	return output(map[string]any{
+	result := map[string]any{
 		"status":     status,
 		"controller": controller,
 		"timestamp":  time.Now().UTC().Format(time.RFC3339),
-	})
+	}
+	if inspector, ok := a.Controller.(device.NetworkInspector); ok && connected {
+		if info, err := inspector.NetworkInfo(ctx); err == nil {
+			result["network"] = info
+		} else {
+			result["network_error"] = err.Error()
+		}
+	}
+	return output(result)
 }
 
 // --- daemon ---
@@ -304,6 +364,8 @@ func devicesCmd() *cobra.Command {
 		devicesClearCmd(),
 		devicesStateCmd(),
 		devicesSetCmd(),
+		devicesHistoryCmd(),
+		devicesWatchCmd(),
 	)
 	return cmd
 }
@@ -321,8 +383,11 @@ func devicesListCmd() *cobra.Command {
 			states := make([]map[string]any, 0, len(devices))
 			for i := range devices {
 				d := deviceJSON(&devices[i])
-				st, err := sharedApp.Controller.GetDeviceState(ctx, devices[i].Name)
-				if err == nil {
+				// Backends report the last-known state with each device; only
+				// ask the device when there is none or --no-cache is set.
+				if len(devices[i].State) > 0 && !noCache {
+					d["state"] = devices[i].State
+				} else if st, err := sharedApp.Controller.GetDeviceState(ctx, devices[i].Name); err == nil {
 					d["state"] = st
 				}
 				states = append(states, d)
@@ -455,6 +520,108 @@ func devicesSetCmd() *cobra.Command {
 	}
 }
 
+func devicesHistoryCmd() *cobra.Command {
+	var since, until, property, format string
+	cmd := &cobra.Command{
+		Use:   "history <name>",
+		Short: "Show recorded state changes and events",
+		Long: "Show a device's recorded state changes and events, oldest first.\n" +
+			"--since and --until take a duration before now (24h, 7d) or an RFC 3339 time.",
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if sharedApp.History == nil {
+				return fmt.Errorf("device history: %w", device.ErrUnsupported)
+			}
+			if format != "json" && format != "csv" {
+				return fmt.Errorf("--format must be json or csv")
+			}
+			now := time.Now()
+			q := history.Query{Property: property}
+			var err error
+			if q.Since, err = parseTimeArg(since, now); err != nil {
+				return fmt.Errorf("--since: %w", err)
+			}
+			if q.Until, err = parseTimeArg(until, now); err != nil {
+				return fmt.Errorf("--until: %w", err)
+			}
+			recs, err := sharedApp.History.History(cmd.Context(), args[0], q)
+			if err != nil {
+				return fmt.Errorf("device history: %w", err)
+			}
+			if format == "csv" {
+				return history.WriteCSV(os.Stdout, recs)
+			}
+			return output(map[string]any{"device": args[0], "records": recs, "count": len(recs)})
+		},
+	}
+	cmd.Flags().StringVar(&since, "since", "24h", "Start of the range: duration ago or RFC 3339 time")
+	cmd.Flags().StringVar(&until, "until", "", "End of the range (default now)")
+	cmd.Flags().StringVar(&property, "property", "", "Only changes of this state property (e.g. temperature)")
+	cmd.Flags().StringVar(&format, "format", "json", "Output format: json or csv")
+	return cmd
+}
+
+func devicesWatchCmd() *cobra.Command {
+	var types []string
+	cmd := &cobra.Command{
+		Use:   "watch [name...]",
+		Short: "Stream device events as NDJSON",
+		Long: "Print events as they happen, one JSON object per line, until interrupted.\n" +
+			"Without names every device is watched. Event types: state_changed, device_joined,\n" +
+			"device_left, device_rejected, device_online, device_offline, interview,\n" +
+			"command_result, coordinator_disconnected, coordinator_reconnected.\n" +
+			"An events_dropped line reports how many events were lost when output fell behind.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt)
+			defer stop()
+			filter := device.EventFilter{Types: types}
+			for _, id := range args {
+				d, err := sharedApp.Controller.GetDevice(ctx, id)
+				if err != nil {
+					return fmt.Errorf("get device: %w", err)
+				}
+				filter.Devices = append(filter.Devices, d.ID)
+			}
+
+			ch := sharedApp.Events.Subscribe(filter)
+			defer sharedApp.Events.Unsubscribe(ch)
+
+			enc := json.NewEncoder(os.Stdout)
+			for {
+				select {
+				case ev, ok := <-ch:
+					if !ok {
+						return nil
+					}
+					if err := enc.Encode(ev); err != nil {
+						return err
+					}
+				case <-ctx.Done():
+					return nil
+				}
+			}
+		},
+	}
+	cmd.Flags().StringSliceVar(&types, "type", nil, "Only events of these types (repeatable or comma-separated)")
+	return cmd
+}
+
+// parseTimeArg reads a duration before now or an RFC 3339 time. Empty yields
+// the zero time.
+func parseTimeArg(s string, now time.Time) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	d, err := history.ParseDuration(s)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return now.Add(-d), nil
+}
+
 // --- discovery ---
 
 func discoveryCmd() *cobra.Command {
@@ -469,17 +636,42 @@ func discoveryCmd() *cobra.Command {
 func discoveryStartCmd() *cobra.Command {
 	var duration int
 	var waitFor int
+	var installCode, installIEEE, via string
 	cmd := &cobra.Command{
 		Use:   "start",
 		Short: "Start pairing mode",
 		RunE: func(cmd *cobra.Command, args []string) error {
 			ctx := cmd.Context()
-			if err := sharedApp.Controller.PermitJoin(ctx, true, duration); err != nil {
-				return fmt.Errorf("start discovery: %w", err)
+			if installCode != "" {
+				joiner, ok := sharedApp.Controller.(device.InstallCodeJoiner)
+				if !ok {
+					return fmt.Errorf("install code: %w", device.ErrUnsupported)
+				}
+				ieee, err := joiner.AddInstallCode(ctx, installIEEE, installCode)
+				if err != nil {
+					return fmt.Errorf("install code: %w", err)
+				}
+				fmt.Fprintf(os.Stderr, "Install code key loaded for %s.\n", ieee)
+			}
+			if via != "" {
+				joiner, ok := sharedApp.Controller.(device.TargetedJoiner)
+				if !ok {
+					return fmt.Errorf("start discovery via %s: %w", via, device.ErrUnsupported)
+				}
+				if err := joiner.PermitJoinVia(ctx, via, duration); err != nil {
+					return fmt.Errorf("start discovery via %s: %w", via, err)
+				}
+				fmt.Fprintf(os.Stderr, "Pairing mode enabled via %s for %d seconds. Waiting for devices...\n", via, duration)
+			} else {
+				if err := sharedApp.Controller.PermitJoin(ctx, true, duration); err != nil {
+					return fmt.Errorf("start discovery: %w", err)
+				}
+				fmt.Fprintf(os.Stderr, "Pairing mode enabled for %d seconds. Waiting for devices...\n", duration)
 			}
-			fmt.Fprintf(os.Stderr, "Pairing mode enabled for %d seconds. Waiting for devices...\n", duration)
 
-			ch := sharedApp.Events.Subscribe()
+			ch := sharedApp.Events.Subscribe(device.EventFilter{Types: []string{
+				device.EventDeviceJoined, device.EventDeviceLeft, device.EventDeviceRejected,
+			}})
 			defer sharedApp.Events.Unsubscribe(ch)
 
 			timer := time.NewTimer(time.Duration(duration) * time.Second)
@@ -494,10 +686,14 @@ func discoveryStartCmd() *cobra.Command {
 			for {
 				select {
 				case ev := <-ch:
-					if ev.Type == "device_joined" && ev.Device != nil {
+					if ev.Type == device.EventDeviceJoined && ev.Device != nil {
 						if !seen[ev.Device.ID] {
 							seen[ev.Device.ID] = true
-							fmt.Fprintf(os.Stderr, "Device joined: %s (%s)\n", ev.Device.ID, ev.Device.Name)
+							if ev.Parent != "" {
+								fmt.Fprintf(os.Stderr, "Device joined: %s (%s) via %s\n", ev.Device.ID, ev.Device.Name, ev.Parent)
+							} else {
+								fmt.Fprintf(os.Stderr, "Device joined: %s (%s)\n", ev.Device.ID, ev.Device.Name)
+							}
 							if waitFor > 0 && len(seen) >= waitFor {
 								fmt.Fprintf(os.Stderr, "Reached --wait-for %d. Finishing discovery.\n", waitFor)
 								time.Sleep(20 * time.Second)
@@ -505,8 +701,10 @@ func discoveryStartCmd() *cobra.Command {
 								break loop
 							}
 						}
-					} else if ev.Type == "device_left" && ev.Device != nil {
+					} else if ev.Type == device.EventDeviceLeft && ev.Device != nil {
 						fmt.Fprintf(os.Stderr, "Device left: %s\n", ev.Device.ID)
+					} else if ev.Type == device.EventDeviceRejected && ev.Device != nil {
+						fmt.Fprintf(os.Stderr, "Device rejected: %s (%s)\n", ev.Device.ID, ev.Reason)
 					}
 				case <-timer.C:
 					fmt.Fprintf(os.Stderr, "Discovery finished. %d device(s) joined.\n", len(seen))
@@ -531,6 +729,9 @@ func discoveryStartCmd() *cobra.Command {
 	}
 	cmd.Flags().IntVar(&duration, "duration", 120, "Pairing window in seconds")
 	cmd.Flags().IntVar(&waitFor, "wait-for", 0, "Stop after N devices have joined")
+	cmd.Flags().StringVar(&installCode, "install-code", "", "Join a device with its install code (hex, DSK or QR payload)")
+	cmd.Flags().StringVar(&via, "via", "", "Open joining only on this router (IEEE address or name), or \"all\" for every router")
+	cmd.Flags().StringVar(&installIEEE, "ieee", "", "IEEE address of the install-code device (optional if the QR payload includes it)")
 	return cmd
 }
 
@@ -555,7 +756,274 @@ func networkCmd() *cobra.Command {
 		Use:   "network",
 		Short: "Manage the Zigbee network",
 	}
-	cmd.AddCommand(networkResetCmd())
+	cmd.AddCommand(networkResetCmd(), networkInfoCmd(), networkMapCmd(), networkBackupCmd(), networkRestoreCmd(),
+		networkFormCmd(), networkChangeChannelCmd(), networkScanCmd(),
+		networkKeysCmd(), networkRotateKeyCmd())
+	return cmd
+}
+
+func networkInfoCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "info",
+		Short: "Show channel, PAN ID, coordinator and adapter firmware details",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			inspector, ok := sharedApp.Controller.(device.NetworkInspector)
+			if !ok {
+				return fmt.Errorf("network info: %w", device.ErrUnsupported)
+			}
+			info, err := inspector.NetworkInfo(cmd.Context())
+			if err != nil {
+				return fmt.Errorf("network info: %w", err)
+			}
+			return output(map[string]any{"network": info})
+		},
+	}
+}
+
+func networkMapCmd() *cobra.Command {
+	var format string
+	cmd := &cobra.Command{
+		Use:   "map",
+		Short: "Crawl neighbor and routing tables and print the network topology",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			mapper, ok := sharedApp.Controller.(device.TopologyMapper)
+			if !ok {
+				return fmt.Errorf("network map: %w", device.ErrUnsupported)
+			}
+			fmt.Fprintln(os.Stderr, "Crawling network topology, this can take a while...")
+			m, err := mapper.NetworkMap(cmd.Context())
+			if err != nil {
+				return fmt.Errorf("network map: %w", err)
+			}
+			switch format {
+			case "json":
+				return output(m)
+			case "dot":
+				fmt.Print(m.DOT())
+			case "mermaid":
+				fmt.Print(m.Mermaid())
+			default:
+				return fmt.Errorf("unknown format %q (expected json, dot or mermaid)", format)
+			}
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&format, "format", "json", "Output format: json, dot or mermaid")
+	return cmd
+}
+
+func networkFormCmd() *cobra.Command {
+	var opts device.FormOptions
+	var txPower int
+	cmd := &cobra.Command{
+		Use:   "form",
+		Short: "Form a new network with explicit parameters (replaces the current network)",
+		Long: `Form a new network. Unset parameters are chosen automatically: the quietest
+channel from an energy scan, random PAN IDs and a random network key.
+The resulting settings are saved to zigbee-skill.yaml and reused whenever the
+network has to be formed again.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			former, ok := sharedApp.Controller.(device.NetworkFormer)
+			if !ok {
+				return fmt.Errorf("network form: %w", device.ErrUnsupported)
+			}
+			if cmd.Flags().Changed("tx-power") {
+				opts.TxPower = &txPower
+			}
+			info, err := former.FormNetwork(cmd.Context(), opts)
+			if err != nil {
+				return fmt.Errorf("network form: %w", err)
+			}
+			return output(map[string]any{"network": info})
+		},
+	}
+	cmd.Flags().IntVar(&opts.Channel, "channel", 0, "Channel 11-26 (default: quietest by energy scan)")
+	cmd.Flags().StringVar(&opts.PanID, "pan-id", "", "PAN ID in hex, e.g. 0x1a62 (default: random)")
+	cmd.Flags().StringVar(&opts.ExtendedPanID, "ext-pan-id", "", "Extended PAN ID, e.g. dd:dd:dd:dd:dd:dd:dd:dd (default: random)")
+	cmd.Flags().StringVar(&opts.NetworkKey, "network-key", "", "Network key as 32 hex digits (default: random)")
+	cmd.Flags().IntVar(&txPower, "tx-power", 3, "Radio transmit power in dBm")
+	return cmd
+}
+
+func networkChangeChannelCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "change-channel <channel>",
+		Short: "Move the network to another channel without re-pairing devices",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			channel, err := strconv.Atoi(args[0])
+			if err != nil {
+				return fmt.Errorf("invalid channel %q", args[0])
+			}
+			former, ok := sharedApp.Controller.(device.NetworkFormer)
+			if !ok {
+				return fmt.Errorf("change channel: %w", device.ErrUnsupported)
+			}
+			fmt.Fprintln(os.Stderr, "Broadcasting channel change, devices follow within about 10 seconds...")
+			if err := former.ChangeChannel(cmd.Context(), channel); err != nil {
+				return fmt.Errorf("change channel: %w", err)
+			}
+			return output(map[string]any{"success": true, "channel": channel})
+		},
+	}
+}
+
+func networkScanCmd() *cobra.Command {
+	var channels []int
+	var duration int
+	cmd := &cobra.Command{
+		Use:   "scan",
+		Short: "Survey channels for interference or neighbouring networks",
+	}
+	cmd.PersistentFlags().IntSliceVar(&channels, "channels", nil, "Channels to scan, e.g. 11,15,20,25 (default: 11-26)")
+	cmd.PersistentFlags().IntVar(&duration, "duration", 0, "Scan duration exponent 1-14, (2^n+1)*15.36ms per channel (default: 4 energy, 3 active)")
+
+	energy := &cobra.Command{
+		Use:   "energy",
+		Short: "Measure energy (RSSI) on each channel; lower is quieter",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			scanner, ok := sharedApp.Controller.(device.ChannelScanner)
+			if !ok {
+				return fmt.Errorf("energy scan: %w", device.ErrUnsupported)
+			}
+			results, err := scanner.EnergyScan(cmd.Context(), channels, duration)
+			if err != nil {
+				return fmt.Errorf("energy scan: %w", err)
+			}
+			result := map[string]any{"channels": results}
+			if len(results) > 0 {
+				quietest := results[0]
+				for _, r := range results[1:] {
+					if r.RSSI < quietest.RSSI {
+						quietest = r
+					}
+				}
+				result["quietest"] = quietest.Channel
+			}
+			return output(result)
+		},
+	}
+	active := &cobra.Command{
+		Use:   "active",
+		Short: "List neighbouring Zigbee networks (PANs) that answer beacon requests",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			scanner, ok := sharedApp.Controller.(device.ChannelScanner)
+			if !ok {
+				return fmt.Errorf("active scan: %w", device.ErrUnsupported)
+			}
+			networks, err := scanner.ActiveScan(cmd.Context(), channels, duration)
+			if err != nil {
+				return fmt.Errorf("active scan: %w", err)
+			}
+			return output(map[string]any{"networks": networks})
+		},
+	}
+	cmd.AddCommand(energy, active)
+	return cmd
+}
+
+func networkKeysCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "keys",
+		Short: "Show network key sequence and frame counter, and each device's TC link key status",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			km, ok := sharedApp.Controller.(device.KeyManager)
+			if !ok {
+				return fmt.Errorf("network keys: %w", device.ErrUnsupported)
+			}
+			t, err := km.KeyTable(cmd.Context())
+			if err != nil {
+				return fmt.Errorf("network keys: %w", err)
+			}
+			return output(t)
+		},
+	}
+}
+
+func networkRotateKeyCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "rotate-key",
+		Short: "Distribute a new network key and switch the network to it",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			km, ok := sharedApp.Controller.(device.KeyManager)
+			if !ok {
+				return fmt.Errorf("rotate key: %w", device.ErrUnsupported)
+			}
+			fmt.Fprintln(os.Stderr, "Broadcasting next network key, switching in 30 seconds...")
+			rot, err := km.RotateNetworkKey(cmd.Context())
+			if err != nil {
+				return fmt.Errorf("rotate key: %w", err)
+			}
+			return output(map[string]any{"success": true, "rotation": rot})
+		},
+	}
+}
+
+func networkBackupCmd() *cobra.Command {
+	var outPath string
+	cmd := &cobra.Command{
+		Use:   "backup",
+		Short: "Export network parameters, keys and frame counters (Open Coordinator Backup JSON)",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			backuper, ok := sharedApp.Controller.(device.NetworkBackuper)
+			if !ok {
+				return fmt.Errorf("network backup: %w", device.ErrUnsupported)
+			}
+			b, err := backuper.BackupNetwork(cmd.Context())
+			if err != nil {
+				return fmt.Errorf("network backup: %w", err)
+			}
+			if outPath == "" {
+				return output(b)
+			}
+			data, err := json.MarshalIndent(b, "", "  ")
+			if err != nil {
+				return err
+			}
+			// The backup holds the network key; keep it private.
+			if err := os.WriteFile(outPath, append(data, '\n'), 0o600); err != nil {
+				return fmt.Errorf("write backup: %w", err)
+			}
+			return output(map[string]any{"success": true, "path": outPath, "devices": len(b.Devices)})
+		},
+	}
+	cmd.Flags().StringVarP(&outPath, "output", "o", "", "Write the backup to this file instead of stdout")
+	return cmd
+}
+
+func networkRestoreCmd() *cobra.Command {
+	var overwriteIEEE bool
+	cmd := &cobra.Command{
+		Use:   "restore <file>",
+		Short: "Re-form the network from a backup file (replaces the current network)",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			backuper, ok := sharedApp.Controller.(device.NetworkBackuper)
+			if !ok {
+				return fmt.Errorf("network restore: %w", device.ErrUnsupported)
+			}
+			data, err := os.ReadFile(args[0])
+			if err != nil {
+				return fmt.Errorf("read backup: %w", err)
+			}
+			var b device.NetworkBackup
+			if err := json.Unmarshal(data, &b); err != nil {
+				return fmt.Errorf("parse backup: %w", err)
+			}
+			if err := b.Validate(); err != nil {
+				return err
+			}
+			if err := backuper.RestoreNetwork(cmd.Context(), &b, overwriteIEEE); err != nil {
+				return fmt.Errorf("network restore: %w", err)
+			}
+			return output(map[string]any{
+				"success": true,
+				"channel": b.Channel,
+				"pan_id":  b.PanID,
+			})
+		},
+	}
+	cmd.Flags().BoolVar(&overwriteIEEE, "overwrite-ieee", false, "Rewrite the adapter IEEE address to match the backup (write-once on most adapters)")
 	return cmd
 }
 
@@ -564,23 +1032,50 @@ func networkResetCmd() *cobra.Command {
 		Use:   "reset",
 		Short: "Clear Zigbee network (forms fresh on next start)",
 		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, cfgErr := config.Load(configPath)
 			port := serialPort
-			if port == "" {
-				cfg, err := config.Load(configPath)
-				if err == nil {
-					port = cfg.Serial.Port
+			var protocol string
+			var network *config.NetworkConfig
+			if cfgErr == nil {
+				serial := &cfg.Serial
+				network = &cfg.Network
+				if len(cfg.Adapters) > 0 {
+					ac := findAdapter(cfg, networkName)
+					if ac == nil {
+						return fmt.Errorf("several adapters configured: choose one with --network")
+					}
+					serial, network = &ac.Serial, &ac.Network
 				}
+				if strings.EqualFold(serial.Adapter, app.AdapterSimulated) {
+					return fmt.Errorf("network reset: simulated adapter: %w", device.ErrUnsupported)
+				}
+				if port == "" {
+					port = serial.Port
+				}
+				protocol = serial.Adapter
 			}
 			if port == "" {
 				return fmt.Errorf("serial port required: use --port or set serial.port in config")
 			}
-			c, err := zigbee.NewController(port)
-			if err != nil {
-				return fmt.Errorf("connect to adapter: %w", err)
+			if strings.EqualFold(port, app.PortAuto) {
+				p, err := adapter.Detect()
+				if err != nil {
+					return err
+				}
+				port = p.Path
+				if protocol == "" || strings.EqualFold(protocol, app.AdapterAuto) {
+					protocol = p.Protocol
+				}
 			}
-			defer c.Close()
-			if err := c.ResetNetwork(); err != nil {
-				return fmt.Errorf("reset network: %w", err)
+			if err := app.ResetNetwork(port, protocol); err != nil {
+				return err
+			}
+			// Forget saved network settings, otherwise the same network would be formed again.
+			if network != nil && *network != (config.NetworkConfig{}) {
+				*network = config.NetworkConfig{}
+				if err := cfg.Save(); err != nil {
+					return fmt.Errorf("save config: %w", err)
+				}
 			}
 			return output(map[string]any{
 				"success": true,
@@ -590,6 +1085,16 @@ func networkResetCmd() *cobra.Command {
 	}
 }
 
+// findAdapter returns the declared adapter with the given name, or nil.
+func findAdapter(cfg *config.Config, name string) *config.AdapterConfig {
+	for i := range cfg.Adapters {
+		if cfg.Adapters[i].Name == name {
+			return &cfg.Adapters[i]
+		}
+	}
+	return nil
+}
+
 // --- version ---
 
 func versionCmd() *cobra.Command {
@@ -609,6 +1114,13 @@ func deviceJSON(d *device.Device) map[string]any {
 		"ieee_address":  d.ID,
 		"friendly_name": d.Name,
 		"type":          d.Type,
+		"available":     d.Available,
+	}
+	if !d.LastSeen.IsZero() {
+		m["last_seen"] = d.LastSeen.UTC().Format(time.RFC3339)
+	}
+	if d.LinkQuality != nil {
+		m["linkquality"] = *d.LinkQuality
 	}
 	if d.Manufacturer != "" {
 		m["manufacturer"] = d.Manufacturer
@@ -619,6 +1131,15 @@ func deviceJSON(d *device.Device) map[string]any {
 	if d.StateSchema != nil {
 		m["state_schema"] = d.StateSchema
 	}
+	if d.Exposes != nil {
+		m["exposes"] = d.Exposes
+	}
+	if !d.StateUpdatedAt.IsZero() {
+		m["state_updated_at"] = d.StateUpdatedAt.UTC().Format(time.RFC3339)
+	}
+	if d.StateStale {
+		m["state_stale"] = true
+	}
 	return m
 }
 
@@ -0,0 +1,137 @@
+// Package adapter finds Zigbee coordinator adapters on the host's serial
+// ports by USB fingerprint and by probing each supported protocol.
+package adapter
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"github.com/urmzd/zigbee-skill/pkg/deconz"
+	"github.com/urmzd/zigbee-skill/pkg/zigbee"
+	"github.com/urmzd/zigbee-skill/pkg/znp"
+)
+
+// Serial protocols spoken by supported adapters.
+const (
+	ProtocolEZSP   = "ezsp"
+	ProtocolZNP    = "znp"
+	ProtocolDeCONZ = "deconz"
+)
+
+// Port is a serial port and what is known about the adapter behind it.
+type Port struct {
+	Path         string `json:"port"`
+	VID          string `json:"vid,omitempty"`
+	PID          string `json:"pid,omitempty"`
+	Product      string `json:"product,omitempty"`
+	SerialNumber string `json:"serial_number,omitempty"`
+	// Adapter names a recognised adapter model.
+	Adapter string `json:"adapter,omitempty"`
+	// Protocol is the protocol the adapter answered, or the one its model
+	// normally speaks when it was not probed.
+	Protocol string `json:"protocol,omitempty"`
+	// Confirmed is set when the adapter answered a probe in Protocol.
+	Confirmed bool `json:"confirmed"`
+}
+
+// fingerprint identifies an adapter model from its USB descriptors. Several
+// adapters share a USB bridge chip, so product, when set, must also match.
+type fingerprint struct {
+	vid, pid string
+	product  string // case-insensitive substring of the product string
+	name     string
+	protocol string
+}
+
+// fingerprints is checked in order; the first match wins.
+var fingerprints = []fingerprint{
+	{"1A86", "55D4", "dongle plus v2", "Sonoff Zigbee 3.0 USB Dongle Plus-E", ProtocolEZSP},
+	{"10C4", "EA60", "skyconnect", "Home Assistant SkyConnect", ProtocolEZSP},
+	{"10C4", "EA60", "zbt-1", "Home Assistant Connect ZBT-1", ProtocolEZSP},
+	{"10C4", "EA60", "sonoff zigbee 3.0 usb dongle plus", "Sonoff Zigbee 3.0 USB Dongle Plus-P", ProtocolZNP},
+	{"1CF1", "0030", "", "ConBee II", ProtocolDeCONZ},
+	{"0403", "6015", "conbee iii", "ConBee III", ProtocolDeCONZ},
+	{"0403", "6015", "conbee", "ConBee", ProtocolDeCONZ},
+}
+
+// identify fills in the adapter model and expected protocol from p's USB
+// descriptors.
+func identify(p *Port) {
+	product := strings.ToLower(p.Product)
+	for _, f := range fingerprints {
+		if f.vid == p.VID && f.pid == p.PID && strings.Contains(product, f.product) {
+			p.Adapter, p.Protocol = f.name, f.protocol
+			return
+		}
+	}
+}
+
+// probers answer whether an adapter speaking the protocol is on a port.
+var probers = map[string]func(path string) bool{
+	ProtocolZNP:    znp.Probe,
+	ProtocolDeCONZ: deconz.Probe,
+	ProtocolEZSP:   zigbee.ProbeASH,
+}
+
+// probeOrder tries the fast, unambiguous probes first: a ZNP ping and a
+// deCONZ version request are answered immediately, while ASH RST resets the
+// NCP and takes over a second.
+var probeOrder = []string{ProtocolZNP, ProtocolDeCONZ, ProtocolEZSP}
+
+// Probe asks the adapter on p.Path which protocol it speaks, trying the
+// protocol expected from its fingerprint first. It returns false when
+// nothing answers, including when another process holds the port.
+func Probe(p *Port) bool {
+	order := probeOrder
+	if p.Protocol != "" {
+		order = append([]string{p.Protocol}, probeOrder...)
+	}
+	for i, proto := range order {
+		if i > 0 && proto == p.Protocol {
+			continue
+		}
+		if probers[proto](p.Path) {
+			p.Protocol, p.Confirmed = proto, true
+			return true
+		}
+	}
+	return false
+}
+
+// List enumerates USB serial ports and identifies known adapters. When probe
+// is set each port is also probed; this opens the ports and resets EZSP NCPs,
+// so it should not be used while a controller is running.
+func List(probe bool) ([]Port, error) {
+	ports, err := usbPorts()
+	if err != nil {
+		return nil, fmt.Errorf("enumerate serial ports: %w", err)
+	}
+	for i := range ports {
+		identify(&ports[i])
+		if probe {
+			Probe(&ports[i])
+		}
+	}
+	sort.Slice(ports, func(i, j int) bool { return ports[i].Path < ports[j].Path })
+	return ports, nil
+}
+
+// Detect finds the port of a responding Zigbee adapter. Recognised adapter
+// models are probed before unknown USB serial ports.
+func Detect() (*Port, error) {
+	ports, err := List(false)
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(ports, func(i, j int) bool { return ports[i].Adapter != "" && ports[j].Adapter == "" })
+	for i := range ports {
+		p := &ports[i]
+		if Probe(p) {
+			log.Info().Str("port", p.Path).Str("adapter", p.Adapter).Str("protocol", p.Protocol).Msg("Detected Zigbee adapter")
+			return p, nil
+		}
+	}
+	return nil, fmt.Errorf("no Zigbee adapter found on %d USB serial port(s)", len(ports))
+}
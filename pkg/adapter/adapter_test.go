@@ -0,0 +1,58 @@
+package adapter
+
+import "testing"
+
+func TestIdentify(t *testing.T) {
+	tests := []struct {
+		vid, pid, product string
+		adapter, protocol string
+	}{
+		{"10C4", "EA60", "Sonoff Zigbee 3.0 USB Dongle Plus", "Sonoff Zigbee 3.0 USB Dongle Plus-P", ProtocolZNP},
+		{"10C4", "EA60", "SkyConnect v1.0", "Home Assistant SkyConnect", ProtocolEZSP},
+		{"1A86", "55D4", "SONOFF Zigbee 3.0 USB Dongle Plus V2", "Sonoff Zigbee 3.0 USB Dongle Plus-E", ProtocolEZSP},
+		{"1CF1", "0030", "", "ConBee II", ProtocolDeCONZ},
+		{"0403", "6015", "ConBee III", "ConBee III", ProtocolDeCONZ},
+		{"10C4", "EA60", "CP2102 USB to UART Bridge Controller", "", ""},
+		{"0403", "6015", "FT231X USB UART", "", ""},
+		{"1A86", "55D4", "USB Single Serial", "", ""},
+	}
+	for _, tt := range tests {
+		p := Port{VID: tt.vid, PID: tt.pid, Product: tt.product}
+		identify(&p)
+		if p.Adapter != tt.adapter || p.Protocol != tt.protocol {
+			t.Errorf("%s:%s %q = %q/%q, want %q/%q", tt.vid, tt.pid, tt.product, p.Adapter, p.Protocol, tt.adapter, tt.protocol)
+		}
+	}
+}
+
+func TestProbeTriesFingerprintFirst(t *testing.T) {
+	saved := probers
+	defer func() { probers = saved }()
+
+	var tried []string
+	answer := func(proto string, ok bool) func(string) bool {
+		return func(string) bool {
+			tried = append(tried, proto)
+			return ok
+		}
+	}
+	probers = map[string]func(string) bool{
+		ProtocolZNP:    answer(ProtocolZNP, false),
+		ProtocolDeCONZ: answer(ProtocolDeCONZ, false),
+		ProtocolEZSP:   answer(ProtocolEZSP, true),
+	}
+
+	p := Port{Path: "/dev/ttyUSB0", Protocol: ProtocolDeCONZ}
+	if !Probe(&p) || p.Protocol != ProtocolEZSP || !p.Confirmed {
+		t.Fatalf("probe = %+v", p)
+	}
+	want := []string{ProtocolDeCONZ, ProtocolZNP, ProtocolEZSP}
+	if len(tried) != len(want) {
+		t.Fatalf("tried %v, want %v", tried, want)
+	}
+	for i := range want {
+		if tried[i] != want[i] {
+			t.Fatalf("tried %v, want %v", tried, want)
+		}
+	}
+}
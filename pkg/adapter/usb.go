@@ -0,0 +1,37 @@
+//go:build !darwin || cgo
+
+package adapter
+
+import (
+	"runtime"
+	"strings"
+
+	"go.bug.st/serial/enumerator"
+)
+
+// usbPorts lists USB serial ports with their USB descriptors.
+func usbPorts() ([]Port, error) {
+	details, err := enumerator.GetDetailedPortsList()
+	if err != nil {
+		return nil, err
+	}
+	ports := make([]Port, 0, len(details))
+	for _, d := range details {
+		if !d.IsUSB {
+			continue
+		}
+		// macOS lists every device twice; the callout (cu.*) node is the one
+		// that opens without waiting for carrier detect.
+		if runtime.GOOS == "darwin" && strings.HasPrefix(d.Name, "/dev/tty.") {
+			continue
+		}
+		ports = append(ports, Port{
+			Path:         d.Name,
+			VID:          strings.ToUpper(d.VID),
+			PID:          strings.ToUpper(d.PID),
+			Product:      d.Product,
+			SerialNumber: d.SerialNumber,
+		})
+	}
+	return ports, nil
+}
@@ -0,0 +1,31 @@
+//go:build darwin && !cgo
+
+package adapter
+
+import "path/filepath"
+
+// usbDeviceGlobs match the callout nodes macOS creates for USB serial
+// bridges: CDC ACM, FTDI and CH34x/CH910x, and Silicon Labs CP210x.
+var usbDeviceGlobs = []string{
+	"/dev/cu.usbmodem*",
+	"/dev/cu.usbserial*",
+	"/dev/cu.wchusbserial*",
+	"/dev/cu.SLAB_USBtoUART*",
+}
+
+// usbPorts lists USB serial ports by device name. Reading USB descriptors on
+// macOS needs IOKit through cgo, so without it ports are not identified and
+// can only be found by probing.
+func usbPorts() ([]Port, error) {
+	var ports []Port
+	for _, glob := range usbDeviceGlobs {
+		paths, err := filepath.Glob(glob)
+		if err != nil {
+			return nil, err
+		}
+		for _, path := range paths {
+			ports = append(ports, Port{Path: path})
+		}
+	}
+	return ports, nil
+}
@@ -5,13 +5,19 @@ import (
 	"encoding/hex"
 	"fmt"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/rs/zerolog/log"
+	"github.com/urmzd/zigbee-skill/pkg/adapter"
 	"github.com/urmzd/zigbee-skill/pkg/config"
+	"github.com/urmzd/zigbee-skill/pkg/deconz"
 	"github.com/urmzd/zigbee-skill/pkg/device"
 	"github.com/urmzd/zigbee-skill/pkg/device/schema"
+	"github.com/urmzd/zigbee-skill/pkg/history"
+	"github.com/urmzd/zigbee-skill/pkg/simulated"
 	zigbee "github.com/urmzd/zigbee-skill/pkg/zigbee"
+	"github.com/urmzd/zigbee-skill/pkg/znp"
 )
 
 // App holds the shared core services used by the CLI.
@@ -20,11 +26,31 @@ type App struct {
 	Controller device.Controller
 	Events     device.EventSubscriber
 	Validator  *schema.Validator
+	// History answers device history queries; nil when history is disabled
+	// or no adapter is running.
+	History history.Reader
+
+	states    *config.StateFile
+	store     *history.Store
+	backends  []backend
+	stop      chan struct{}
+	closeOnce sync.Once
 }
 
+// Last-known state is flushed to the state file every stateFlushInterval.
+// After a restart, restored (stale) state is re-read from devices every
+// staleRefreshInterval until it is confirmed or staleRefreshTimeout passes.
+const (
+	stateFlushInterval   = time.Minute
+	staleRefreshInterval = 30 * time.Second
+	staleRefreshTimeout  = 15 * time.Minute
+)
+
 // New initializes the config, controller, and validator.
-// If serialPort is empty, the config's serial.port is used.
-// If neither is set, a null controller is used.
+// If serialPort is empty, the config's serial.port is used; "auto" detects
+// the adapter. If neither is set, a null controller is used. When the config
+// declares several adapters, each runs its own backend behind a
+// device.Registry and serialPort is ignored.
 func New(_ context.Context, configPath, serialPort string) (*App, error) {
 	cfg, err := config.Load(configPath)
 	if err != nil {
@@ -32,110 +58,536 @@ func New(_ context.Context, configPath, serialPort string) (*App, error) {
 	}
 	log.Info().Str("path", cfg.Path()).Msg("Config loaded")
 
-	if serialPort == "" {
-		serialPort = cfg.Serial.Port
+	states, err := config.LoadState(cfg.StatePath())
+	if err != nil {
+		log.Warn().Err(err).Msg("Ignoring unreadable device state file")
+	}
+
+	// Settings the configured protocol can't enforce fail before any
+	// adapter is opened.
+	if len(cfg.Adapters) == 0 {
+		if err := checkJoinSettings(cfg.Serial.Adapter, cfg.Security, cfg.JoinPolicy); err != nil {
+			return nil, err
+		}
+	}
+	for _, ac := range cfg.Adapters {
+		if err := checkJoinSettings(ac.Serial.Adapter, ac.Security, ac.JoinPolicy); err != nil {
+			return nil, fmt.Errorf("adapter %q: %w", ac.Name, err)
+		}
 	}
 
 	var controller device.Controller
 	var events device.EventSubscriber
+	var backends []backend
 
-	if serialPort != "" {
-		zbController, err := zigbee.NewController(serialPort)
-		if err != nil {
-			log.Warn().Err(err).Str("port", serialPort).Msg("Zigbee controller unavailable, using null controller")
-			controller = device.NewNullController()
-			events = device.NewNullEventSubscriber()
-		} else {
-			if entries := configToLoadEntries(cfg); len(entries) > 0 {
-				zbController.LoadDevices(entries)
-				log.Info().Int("count", len(entries)).Msg("Loaded persisted devices (NodeID assigned on rejoin)")
+	if len(cfg.Adapters) > 0 {
+		reg := device.NewRegistry()
+		for i := range cfg.Adapters {
+			ac := &cfg.Adapters[i]
+			settings := adapterSettings{
+				index:      i,
+				serial:     &ac.Serial,
+				network:    &ac.Network,
+				security:   ac.Security,
+				joinPolicy: ac.JoinPolicy,
+				devices:    &ac.Devices,
+				simulation: &ac.Simulation,
 			}
-
-			// Wire persistence: save config when devices change
-			zbController.SetOnDeviceChange(func() {
-				syncDevicesToConfig(zbController, cfg)
-				if err := cfg.Save(); err != nil {
-					log.Error().Err(err).Msg("Failed to save config after device change")
-				}
-			})
-
-			// Persist serial port to config if not already set
-			if cfg.Serial.Port == "" {
-				cfg.Serial.Port = serialPort
-				_ = cfg.Save()
+			var c device.Controller = device.NewNullController()
+			var ev device.EventSubscriber = device.NewNullEventSubscriber()
+			if b := startBackend(cfg, states, settings, ac.Serial.Port); b != nil {
+				c, ev = b, b
+				backends = append(backends, b)
+			}
+			if err := reg.Register(ac.Name, c, ev); err != nil {
+				reg.Close()
+				return nil, fmt.Errorf("adapter %q: %w", ac.Name, err)
 			}
-
-			controller = zbController
-			events = zbController
 		}
+		controller, events = reg, reg
 	} else {
-		controller = device.NewNullController()
-		events = device.NewNullEventSubscriber()
+		if serialPort == "" {
+			serialPort = cfg.Serial.Port
+		}
+		settings := adapterSettings{
+			index:      -1,
+			serial:     &cfg.Serial,
+			network:    &cfg.Network,
+			security:   cfg.Security,
+			joinPolicy: cfg.JoinPolicy,
+			devices:    &cfg.Devices,
+			simulation: &cfg.Simulation,
+		}
+		if b := startBackend(cfg, states, settings, serialPort); b != nil {
+			controller, events = b, b
+			backends = append(backends, b)
+		} else {
+			controller = device.NewNullController()
+			events = device.NewNullEventSubscriber()
+		}
 	}
 
-	return &App{
+	a := &App{
 		Config:     cfg,
 		Controller: controller,
 		Events:     events,
 		Validator:  schema.NewValidator(),
-	}, nil
+		states:     states,
+		backends:   backends,
+		stop:       make(chan struct{}),
+	}
+	if len(backends) > 0 {
+		go a.flushStates()
+		go a.refreshStale()
+	}
+	if len(backends) > 0 && !cfg.History.Disabled {
+		if store, err := openHistory(cfg); err != nil {
+			log.Warn().Err(err).Msg("Device history unavailable")
+		} else {
+			a.store = store
+			a.History = &historyReader{store: store, controller: controller}
+			for _, b := range backends {
+				a.recordHistory(b)
+			}
+			go a.compactHistory()
+		}
+	}
+	return a, nil
+}
+
+// adapterSettings points at one adapter's settings inside the config, so a
+// backend's device and network changes are saved where they were loaded from.
+// The pointers are read-only once backends run; changes go through the
+// config's Update methods with index.
+type adapterSettings struct {
+	index      int // into cfg.Adapters, or -1 for the top-level settings
+	serial     *config.SerialConfig
+	network    *config.NetworkConfig
+	security   config.SecurityConfig
+	joinPolicy config.JoinPolicyConfig
+	devices    *[]config.DeviceEntry
+	simulation *config.SimulationConfig
+}
+
+// startBackend opens the adapter on serialPort, loads its persisted devices
+// with their last-known state and wires persistence. It returns nil when no port is set or the adapter is
+// unavailable. The simulated adapter needs no port.
+func startBackend(cfg *config.Config, states *config.StateFile, s adapterSettings, serialPort string) backend {
+	protocol := strings.ToLower(s.serial.Adapter)
+	if protocol == AdapterSimulated {
+		serialPort = ""
+	} else if strings.EqualFold(serialPort, PortAuto) {
+		serialPort = ""
+		if p, err := adapter.Detect(); err != nil {
+			log.Warn().Err(err).Msg("Zigbee adapter auto-detection failed, using null controller")
+		} else {
+			serialPort = p.Path
+			if protocol == "" || protocol == AdapterAuto {
+				protocol = p.Protocol
+			}
+		}
+	}
+	if serialPort == "" && protocol != AdapterSimulated {
+		return nil
+	}
+
+	zbController, err := openBackend(s, serialPort, protocol)
+	if err != nil {
+		log.Warn().Err(err).Str("port", serialPort).Msg("Zigbee controller unavailable, using null controller")
+		return nil
+	}
+	if entries := configToLoadEntries(*s.devices, states); len(entries) > 0 {
+		zbController.LoadDevices(entries)
+		log.Info().Int("count", len(entries)).Msg("Loaded persisted devices (NodeID assigned on rejoin)")
+	}
+
+	// The simulated adapter pairs its declared devices itself; record them so
+	// their names and state are restored on the next start.
+	if len(zbController.ExportDevices()) != len(*s.devices) {
+		syncDevicesToConfig(cfg, s.index, zbController)
+		if err := cfg.Save(); err != nil {
+			log.Error().Err(err).Msg("Failed to save config after loading devices")
+		}
+	}
+
+	// Wire persistence: save config when devices change
+	zbController.SetOnDeviceChange(func() {
+		syncDevicesToConfig(cfg, s.index, zbController)
+		if err := cfg.Save(); err != nil {
+			log.Error().Err(err).Msg("Failed to save config after device change")
+		}
+	})
+
+	// Persist network settings after formation, restore or channel change
+	zbController.SetOnNetworkChange(func(opts device.FormOptions) {
+		cfg.UpdateNetwork(s.index, formOptionsToNetwork(opts))
+		if err := cfg.Save(); err != nil {
+			log.Error().Err(err).Msg("Failed to save config after network change")
+		}
+	})
+
+	// Persist serial port to config if not already set
+	if s.serial.Port == "" && serialPort != "" {
+		cfg.UpdateSerialPort(s.index, serialPort)
+		_ = cfg.Save()
+	}
+	return zbController
+}
+
+// Adapter protocols accepted in serial.adapter.
+const (
+	AdapterAuto   = "auto"
+	AdapterEZSP   = adapter.ProtocolEZSP
+	AdapterZNP    = adapter.ProtocolZNP
+	AdapterDeCONZ = adapter.ProtocolDeCONZ
+	// AdapterSimulated runs the virtual devices declared under simulation.
+	AdapterSimulated = "simulated"
+)
+
+// PortAuto in serial.port or --port detects the adapter's port at startup.
+const PortAuto = "auto"
+
+// backend is a coordinator controller whose devices and network settings are
+// persisted to the config file.
+type backend interface {
+	device.Controller
+	device.EventSubscriber
+	LoadDevices(entries []zigbee.LoadEntry)
+	ExportDevices() []zigbee.ExportedDevice
+	SetOnDeviceChange(fn func())
+	SetOnNetworkChange(fn func(device.FormOptions))
+	SetOnStateChange(fn func(string, device.DeviceState))
+}
+
+// openBackend opens the controller for the adapter protocol, probing the port
+// when it is "auto". Unset means EZSP, so existing setups start without
+// sending ZNP and deCONZ frames to their adapter.
+func openBackend(s adapterSettings, serialPort, protocol string) (backend, error) {
+	if protocol == "" {
+		protocol = AdapterEZSP
+	}
+	if protocol == AdapterAuto {
+		p := adapter.Port{Path: serialPort}
+		protocol = AdapterEZSP
+		if adapter.Probe(&p) {
+			protocol = p.Protocol
+		}
+		log.Info().Str("adapter", protocol).Msg("Detected adapter protocol")
+	}
+
+	if err := checkJoinSettings(protocol, s.security, s.joinPolicy); err != nil {
+		return nil, err
+	}
+
+	form := networkToFormOptions(*s.network)
+	switch protocol {
+	case AdapterSimulated:
+		c, err := simulated.NewController(simulationOptions(*s.simulation))
+		if err != nil {
+			return nil, err
+		}
+		return c, nil
+	case AdapterZNP:
+		c, err := znp.NewController(serialPort, znp.Options{Form: form})
+		if err != nil {
+			return nil, err
+		}
+		return c, nil
+	case AdapterDeCONZ:
+		c, err := deconz.NewController(serialPort, deconz.Options{Form: form})
+		if err != nil {
+			return nil, err
+		}
+		return c, nil
+	case AdapterEZSP:
+		c, err := zigbee.NewController(serialPort, zigbee.Options{
+			Form:               form,
+			RequireInstallCode: s.security.RequireInstallCode,
+			JoinPolicy: zigbee.JoinPolicy{
+				Allow:         s.joinPolicy.Allow,
+				Deny:          s.joinPolicy.Deny,
+				MaxNewDevices: s.joinPolicy.MaxNewDevices,
+			},
+			ASH: zigbee.ASHConfig{
+				WindowSize:          s.serial.WindowSize,
+				SoftwareFlowControl: s.serial.FlowControl == "software",
+			},
+		})
+		if err != nil {
+			return nil, err
+		}
+		return c, nil
+	default:
+		return nil, fmt.Errorf("unknown serial.adapter %q (want %s, %s, %s, %s or %s)", s.serial.Adapter, AdapterEZSP, AdapterZNP, AdapterDeCONZ, AdapterSimulated, AdapterAuto)
+	}
+}
+
+// checkJoinSettings rejects the security and join policy settings for
+// protocols whose backend does not enforce them, so they aren't silently
+// ignored.
+func checkJoinSettings(protocol string, sec config.SecurityConfig, jp config.JoinPolicyConfig) error {
+	protocol = strings.ToLower(protocol)
+	if protocol != AdapterZNP && protocol != AdapterDeCONZ {
+		return nil
+	}
+	if sec.RequireInstallCode {
+		return fmt.Errorf("security.require_install_code with %s adapter: %w", protocol, device.ErrUnsupported)
+	}
+	if len(jp.Allow) > 0 || len(jp.Deny) > 0 || jp.MaxNewDevices > 0 {
+		return fmt.Errorf("join_policy with %s adapter: %w", protocol, device.ErrUnsupported)
+	}
+	return nil
+}
+
+// ResetNetwork connects to the adapter on serialPort with the given
+// serial.adapter protocol and clears its network, so a fresh one is formed on
+// the next start. Like openBackend, unset means EZSP and "auto" probes the port.
+func ResetNetwork(serialPort, protocol string) error {
+	protocol = strings.ToLower(protocol)
+	if protocol == "" {
+		protocol = AdapterEZSP
+	}
+	if protocol == AdapterAuto {
+		p := adapter.Port{Path: serialPort}
+		protocol = AdapterEZSP
+		if adapter.Probe(&p) {
+			protocol = p.Protocol
+		}
+	}
+
+	var c interface {
+		ResetNetwork() error
+		Close()
+	}
+	switch protocol {
+	case AdapterEZSP:
+		zc, err := zigbee.NewController(serialPort, zigbee.Options{})
+		if err != nil {
+			return fmt.Errorf("connect to adapter: %w", err)
+		}
+		c = zc
+	case AdapterZNP:
+		zc, err := znp.NewController(serialPort, znp.Options{})
+		if err != nil {
+			return fmt.Errorf("connect to adapter: %w", err)
+		}
+		c = zc
+	case AdapterDeCONZ:
+		dc, err := deconz.NewController(serialPort, deconz.Options{})
+		if err != nil {
+			return fmt.Errorf("connect to adapter: %w", err)
+		}
+		c = dc
+	case AdapterSimulated:
+		return fmt.Errorf("network reset: %s adapter: %w", protocol, device.ErrUnsupported)
+	default:
+		return fmt.Errorf("unknown serial.adapter %q (want %s, %s, %s, %s or %s)", protocol, AdapterEZSP, AdapterZNP, AdapterDeCONZ, AdapterSimulated, AdapterAuto)
+	}
+	defer c.Close()
+	if err := c.ResetNetwork(); err != nil {
+		return fmt.Errorf("reset network: %w", err)
+	}
+	return nil
+}
+
+// simulationOptions converts the simulation config to controller options.
+func simulationOptions(sc config.SimulationConfig) simulated.Options {
+	specs := func(devices []config.SimulatedDevice) []simulated.Spec {
+		out := make([]simulated.Spec, len(devices))
+		for i, d := range devices {
+			out[i] = simulated.Spec{Name: d.Name, Kind: strings.ToLower(d.Type), IEEE: d.IEEE}
+		}
+		return out
+	}
+	return simulated.Options{
+		Devices:     specs(sc.Devices),
+		Joinable:    specs(sc.Joinable),
+		OfflineRate: sc.OfflineRate,
+		Seed:        sc.Seed,
+	}
 }
 
-// Close releases all resources.
+// Close saves the last-known device state and releases all resources.
 func (a *App) Close() {
-	if a.Controller != nil {
-		a.Controller.Close()
+	a.closeOnce.Do(func() {
+		if a.stop != nil {
+			close(a.stop)
+		}
+		a.saveStates()
+		if a.Controller != nil {
+			a.Controller.Close()
+		}
+		if a.store != nil {
+			_ = a.store.Close()
+		}
+	})
+}
+
+// flushStates saves the last-known device state periodically until Close.
+func (a *App) flushStates() {
+	ticker := time.NewTicker(stateFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			a.saveStates()
+		case <-a.stop:
+			return
+		}
+	}
+}
+
+// saveStates merges the cached state of every device of every backend into
+// the state file. Saved state is dropped only for devices no longer in the
+// config, or in a backend that has not recorded them there yet.
+func (a *App) saveStates() {
+	if a.states == nil || len(a.backends) == 0 {
+		return
+	}
+	saved := make(map[string]config.SavedState)
+	keep := a.Config.DeviceAddresses()
+	for _, b := range a.backends {
+		for _, d := range b.ExportDevices() {
+			keep[strings.ToLower(d.IEEEAddress)] = true
+			if len(d.State) > 0 {
+				saved[d.IEEEAddress] = config.SavedState{State: d.State, UpdatedAt: d.StateUpdatedAt}
+			}
+		}
+	}
+	a.states.Merge(saved, keep)
+	if err := a.states.Save(); err != nil {
+		log.Error().Err(err).Msg("Failed to save device state")
+	}
+}
+
+// refreshStale re-reads restored state from available devices with an on/off
+// cluster, the attribute every backend reads. Each device is read once; the
+// rest of its restored state, such as brightness, stays marked stale until the
+// device reports it or a command sets it. Devices not reached by
+// staleRefreshTimeout wait for their own reports too.
+func (a *App) refreshStale() {
+	refreshed := make(map[string]bool)
+	deadline := time.After(staleRefreshTimeout)
+	ticker := time.NewTicker(staleRefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-deadline:
+			return
+		case <-a.stop:
+			return
+		}
+
+		devices, err := a.Controller.ListDevices(context.Background())
+		if err != nil {
+			continue
+		}
+		pending := 0
+		for _, d := range devices {
+			if !d.StateStale || refreshed[d.ID] {
+				continue
+			}
+			pending++
+			if _, ok := d.Capability(device.CapOnOff); !ok || !d.Available {
+				continue
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			if _, err := a.Controller.GetDeviceState(ctx, d.ID); err != nil {
+				log.Debug().Err(err).Str("device", d.ID).Msg("Stale state refresh failed")
+			} else {
+				refreshed[d.ID] = true
+			}
+			cancel()
+		}
+		if pending == 0 {
+			return
+		}
 	}
 }
 
 // configToLoadEntries converts persisted config devices into LoadEntry values
-// for pre-populating the controller's device map on startup.
-func configToLoadEntries(cfg *config.Config) []zigbee.LoadEntry {
-	entries := make([]zigbee.LoadEntry, 0, len(cfg.Devices))
-	for _, d := range cfg.Devices {
+// for pre-populating the controller's device map on startup. Each device's
+// last-known state is taken from states.
+func configToLoadEntries(devices []config.DeviceEntry, states *config.StateFile) []zigbee.LoadEntry {
+	entries := make([]zigbee.LoadEntry, 0, len(devices))
+	for _, d := range devices {
 		addr, err := parseIEEE(d.IEEEAddress)
 		if err != nil {
 			log.Warn().Str("ieee", d.IEEEAddress).Err(err).Msg("Skipping device with invalid IEEE address")
 			continue
 		}
-		entries = append(entries, zigbee.LoadEntry{
-			IEEEAddress:  addr,
-			FriendlyName: d.FriendlyName,
-			DeviceType:   d.Type,
-			Endpoint:     d.Endpoint,
-			Clusters:     d.Clusters,
-		})
+		e := zigbee.LoadEntry{
+			IEEEAddress:   addr,
+			FriendlyName:  d.FriendlyName,
+			DeviceType:    d.Type,
+			Endpoint:      d.Endpoint,
+			Clusters:      d.Clusters,
+			Sleepy:        d.Sleepy,
+			LastSeen:      d.LastSeen,
+			LinkKeyStatus: d.LinkKeyStatus,
+		}
+		if saved, ok := states.Get(d.IEEEAddress); ok {
+			e.State, e.StateUpdatedAt = saved.State, saved.UpdatedAt
+		}
+		entries = append(entries, e)
 	}
 	return entries
 }
 
 // parseIEEE converts a colon-separated IEEE address string (e.g. "ff:ff:b4:0e:06:07:77:37")
-// to an [8]byte in little-endian order (matching formatIEEE in the zigbee package).
+// to an [8]byte in little-endian order (matching FormatIEEE in the zigbee package).
 func parseIEEE(s string) ([8]byte, error) {
 	var addr [8]byte
 	b, err := hex.DecodeString(strings.ReplaceAll(s, ":", ""))
 	if err != nil || len(b) != 8 {
 		return addr, fmt.Errorf("invalid IEEE address: %s", s)
 	}
-	// formatIEEE prints bytes 7..0, so the string is big-endian; reverse to little-endian.
+	// FormatIEEE prints bytes 7..0, so the string is big-endian; reverse to little-endian.
 	for i := range 8 {
 		addr[i] = b[7-i]
 	}
 	return addr, nil
 }
 
-// syncDevicesToConfig exports the controller's in-memory devices to config.
-func syncDevicesToConfig(zb *zigbee.Controller, cfg *config.Config) {
+// networkToFormOptions converts persisted network settings to formation options.
+func networkToFormOptions(n config.NetworkConfig) device.FormOptions {
+	return device.FormOptions{
+		Channel:       n.Channel,
+		PanID:         n.PanID,
+		ExtendedPanID: n.ExtendedPanID,
+		NetworkKey:    n.NetworkKey,
+		TxPower:       n.TxPower,
+	}
+}
+
+// formOptionsToNetwork converts resolved network settings for persistence.
+func formOptionsToNetwork(o device.FormOptions) config.NetworkConfig {
+	return config.NetworkConfig{
+		Channel:       o.Channel,
+		PanID:         o.PanID,
+		ExtendedPanID: o.ExtendedPanID,
+		NetworkKey:    o.NetworkKey,
+		TxPower:       o.TxPower,
+	}
+}
+
+// syncDevicesToConfig exports the controller's in-memory devices to the
+// config of adapter index.
+func syncDevicesToConfig(cfg *config.Config, index int, zb backend) {
 	exported := zb.ExportDevices()
-	cfg.Devices = make([]config.DeviceEntry, 0, len(exported))
+	devices := make([]config.DeviceEntry, 0, len(exported))
 	for _, d := range exported {
-		cfg.Devices = append(cfg.Devices, config.DeviceEntry{
-			IEEEAddress:  d.IEEEAddress,
-			FriendlyName: d.FriendlyName,
-			Type:         d.DeviceType,
-			Endpoint:     d.Endpoint,
-			Clusters:     d.Clusters,
-			LastSeen:     time.Now(),
+		devices = append(devices, config.DeviceEntry{
+			IEEEAddress:   d.IEEEAddress,
+			FriendlyName:  d.FriendlyName,
+			Type:          d.DeviceType,
+			Endpoint:      d.Endpoint,
+			Clusters:      d.Clusters,
+			Sleepy:        d.Sleepy,
+			LastSeen:      d.LastSeen,
+			LinkKeyStatus: d.LinkKeyStatus,
 		})
 	}
+	cfg.UpdateDevices(index, devices)
 }
@@ -0,0 +1,112 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/urmzd/zigbee-skill/pkg/config"
+	"github.com/urmzd/zigbee-skill/pkg/device"
+	"github.com/urmzd/zigbee-skill/pkg/history"
+)
+
+// History defaults, used when the config leaves them unset.
+const (
+	defaultHistoryRetention      = "90d"
+	defaultHistoryFullResolution = "7d"
+	defaultHistoryInterval       = "1h"
+)
+
+// historyCompactInterval is how often the retention policy is applied.
+const historyCompactInterval = time.Hour
+
+// openHistory opens the history store next to the config file.
+func openHistory(cfg *config.Config) (*history.Store, error) {
+	opts := history.Options{Dir: cfg.HistoryPath()}
+	for _, d := range []struct {
+		name, value, def string
+		out              *time.Duration
+	}{
+		{"retention", cfg.History.Retention, defaultHistoryRetention, &opts.Retention},
+		{"full_resolution", cfg.History.FullResolution, defaultHistoryFullResolution, &opts.FullResolution},
+		{"downsample_interval", cfg.History.DownsampleInterval, defaultHistoryInterval, &opts.Interval},
+	} {
+		v := d.value
+		if v == "" {
+			v = d.def
+		}
+		parsed, err := history.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("history.%s: %w", d.name, err)
+		}
+		*d.out = parsed
+	}
+	return history.Open(opts)
+}
+
+// recordHistory records the state changes and device events of b until Close.
+func (a *App) recordHistory(b backend) {
+	b.SetOnStateChange(func(ieee string, state device.DeviceState) {
+		if err := a.store.RecordState(ieee, state, time.Now()); err != nil {
+			log.Warn().Err(err).Msg("Failed to record device history")
+		}
+	})
+	ch := b.Subscribe(device.EventFilter{})
+	go func() {
+		defer b.Unsubscribe(ch)
+		for {
+			select {
+			case evt, ok := <-ch:
+				if !ok {
+					return
+				}
+				// State changes come through the callback, which never
+				// drops them.
+				if evt.DeviceID == "" || evt.Type == device.EventStateChanged {
+					continue
+				}
+				if err := a.store.RecordEvent(evt.DeviceID, evt.Type, evt.Timestamp); err != nil {
+					log.Warn().Err(err).Msg("Failed to record device history")
+				}
+			case <-a.stop:
+				return
+			}
+		}
+	}()
+}
+
+// compactHistory applies the retention policy now and then hourly until Close.
+func (a *App) compactHistory() {
+	ticker := time.NewTicker(historyCompactInterval)
+	defer ticker.Stop()
+	for {
+		if err := a.store.Compact(time.Now()); err != nil {
+			log.Warn().Err(err).Msg("Failed to compact device history")
+		}
+		select {
+		case <-ticker.C:
+		case <-a.stop:
+			return
+		}
+	}
+}
+
+// historyReader resolves device IDs and names for history queries.
+type historyReader struct {
+	store      *history.Store
+	controller device.Controller
+}
+
+// History returns the history of the device with the given ID or name.
+func (r *historyReader) History(ctx context.Context, id string, q history.Query) ([]history.Record, error) {
+	d, err := r.controller.GetDevice(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	// Records are kept by IEEE address; drop the network prefix of a
+	// multi-adapter ID.
+	ieee := d.ID[strings.LastIndex(d.ID, "/")+1:]
+	return r.store.Query(ieee, q)
+}
@@ -0,0 +1,61 @@
+package app
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/urmzd/zigbee-skill/pkg/device"
+	"github.com/urmzd/zigbee-skill/pkg/history"
+	"github.com/urmzd/zigbee-skill/pkg/simulated"
+)
+
+func TestRecordHistoryCommandResult(t *testing.T) {
+	c, err := simulated.NewController(simulated.Options{
+		Devices: []simulated.Spec{{Name: "lamp", Kind: simulated.KindLight}},
+		Seed:    1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	store, err := history.Open(history.Options{Dir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	a := &App{store: store, stop: make(chan struct{})}
+	defer close(a.stop)
+	a.recordHistory(c)
+	reader := &historyReader{store: store, controller: c}
+
+	ctx := context.Background()
+	if _, err := c.SetDeviceState(ctx, "lamp", map[string]any{"state": "ON"}); err != nil {
+		t.Fatal(err)
+	}
+
+	events := func() []string {
+		recs, err := reader.History(ctx, "lamp", history.Query{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out []string
+		for _, r := range recs {
+			if r.Event != "" {
+				out = append(out, r.Event)
+			}
+		}
+		return out
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for !slices.Contains(events(), device.EventCommandResult) {
+		if time.Now().After(deadline) {
+			t.Fatalf("history events = %v, want a %s", events(), device.EventCommandResult)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if slices.Contains(events(), device.EventStateChanged) {
+		t.Errorf("state changes recorded as events: %v", events())
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 
@@ -14,17 +15,109 @@ const configFileName = "zigbee-skill.yaml"
 
 // Config is the top-level configuration persisted to zigbee-skill.yaml.
 type Config struct {
-	Name    string        `yaml:"name,omitempty"`
-	Serial  SerialConfig  `yaml:"serial"`
-	Devices []DeviceEntry `yaml:"devices"`
+	Name     string         `yaml:"name,omitempty"`
+	Serial   SerialConfig   `yaml:"serial"`
+	Network  NetworkConfig  `yaml:"network,omitempty"`
+	Security SecurityConfig `yaml:"security,omitempty"`
+	// JoinPolicy restricts which devices may join while pairing is open.
+	JoinPolicy JoinPolicyConfig `yaml:"join_policy,omitempty"`
+	Devices    []DeviceEntry    `yaml:"devices"`
+	// Simulation declares the virtual devices of the simulated adapter.
+	Simulation SimulationConfig `yaml:"simulation,omitempty"`
+	// Adapters declares several coordinators run by one daemon. When set, the
+	// top-level serial, network, security, join_policy and devices are unused.
+	Adapters []AdapterConfig `yaml:"adapters,omitempty"`
+	// History configures the state and event history of all adapters.
+	History HistoryConfig `yaml:"history,omitempty"`
 
-	mu   sync.Mutex
+	// mu serialises Save and the Update methods. It is a pointer because
+	// marshalling copies the Config value.
+	mu   *sync.Mutex
 	path string // resolved file path for save-back
 }
 
+// AdapterConfig holds the settings of one coordinator and its network. Name
+// prefixes the IDs of its devices ("name/ieee").
+type AdapterConfig struct {
+	Name       string           `yaml:"name"`
+	Serial     SerialConfig     `yaml:"serial"`
+	Network    NetworkConfig    `yaml:"network,omitempty"`
+	Security   SecurityConfig   `yaml:"security,omitempty"`
+	JoinPolicy JoinPolicyConfig `yaml:"join_policy,omitempty"`
+	Devices    []DeviceEntry    `yaml:"devices"`
+	Simulation SimulationConfig `yaml:"simulation,omitempty"`
+}
+
+// SimulationConfig declares virtual devices for serial.adapter "simulated".
+type SimulationConfig struct {
+	// Devices are paired when the daemon starts.
+	Devices []SimulatedDevice `yaml:"devices,omitempty"`
+	// Joinable devices join one at a time while discovery is open.
+	Joinable []SimulatedDevice `yaml:"joinable,omitempty"`
+	// OfflineRate is how often, per device and hour, a device drops off the
+	// network for a while. 0 keeps every device online.
+	OfflineRate float64 `yaml:"offline_rate,omitempty"`
+	// Seed makes sensor drift and outages repeatable when non-zero.
+	Seed uint64 `yaml:"seed,omitempty"`
+}
+
+// SimulatedDevice is one virtual device.
+type SimulatedDevice struct {
+	Name string `yaml:"name"`
+	Type string `yaml:"type"`           // light, plug, sensor, lock or thermostat
+	IEEE string `yaml:"ieee,omitempty"` // derived from the name when unset
+}
+
+// HistoryConfig sets how long device history is kept. Durations are Go
+// durations ("12h") or whole days ("7d").
+type HistoryConfig struct {
+	Disabled bool `yaml:"disabled,omitempty"`
+	// Retention is how long records are kept (default 90d).
+	Retention string `yaml:"retention,omitempty"`
+	// FullResolution is how long every numeric change is kept before it is
+	// averaged per DownsampleInterval (default 7d).
+	FullResolution string `yaml:"full_resolution,omitempty"`
+	// DownsampleInterval is the averaging bucket for older samples (default 1h).
+	DownsampleInterval string `yaml:"downsample_interval,omitempty"`
+}
+
 // SerialConfig holds the Zigbee adapter serial port settings.
 type SerialConfig struct {
+	// Port is the adapter's device path, or "auto" to detect it at startup.
 	Port string `yaml:"port,omitempty"`
+	// Adapter is the serial protocol: "ezsp" (Silicon Labs, default), "znp"
+	// (TI Z-Stack), "deconz" (ConBee/RaspBee) or "auto" to probe the adapter
+	// at startup. With port "auto" the protocol found by detection is used
+	// unless set. "simulated" runs the virtual devices under simulation instead.
+	Adapter string `yaml:"adapter,omitempty"`
+	// FlowControl is "hardware" (RTS/CTS, default) or "software" (XON/XOFF).
+	FlowControl string `yaml:"flow_control,omitempty"`
+	// WindowSize is the number of ASH frames in flight (1-7, default 3).
+	WindowSize int `yaml:"window_size,omitempty"`
+}
+
+// NetworkConfig holds the parameters used to form the Zigbee network.
+// Unset values are chosen automatically when a network is formed.
+type NetworkConfig struct {
+	Channel       int    `yaml:"channel,omitempty"`
+	PanID         string `yaml:"pan_id,omitempty"`          // hex, e.g. "0x1a62"
+	ExtendedPanID string `yaml:"extended_pan_id,omitempty"` // colon-separated
+	NetworkKey    string `yaml:"network_key,omitempty"`     // 32 hex digits
+	TxPower       *int   `yaml:"tx_power,omitempty"`        // dBm
+}
+
+// SecurityConfig holds Trust Center join settings.
+type SecurityConfig struct {
+	// RequireInstallCode disables joins with the well-known link key; only
+	// devices added with an install code can join.
+	RequireInstallCode bool `yaml:"require_install_code,omitempty"`
+}
+
+// JoinPolicyConfig lists the devices allowed or denied to join.
+type JoinPolicyConfig struct {
+	Allow         []string `yaml:"allow,omitempty"`           // IEEE prefixes/OUIs, e.g. "00:15:8d"; empty allows all
+	Deny          []string `yaml:"deny,omitempty"`            // IEEE addresses or prefixes, always rejected
+	MaxNewDevices int      `yaml:"max_new_devices,omitempty"` // per pairing session; 0 = unlimited
 }
 
 // DeviceEntry is a persisted device record.
@@ -36,7 +129,10 @@ type DeviceEntry struct {
 	Model        string    `yaml:"model,omitempty"`
 	Endpoint     uint8     `yaml:"endpoint,omitempty"`
 	Clusters     []uint16  `yaml:"clusters,omitempty"`
+	Sleepy       bool      `yaml:"sleepy,omitempty"`
 	LastSeen     time.Time `yaml:"last_seen,omitempty"`
+	// LinkKeyStatus records whether the device completed its TC link key update.
+	LinkKeyStatus string `yaml:"link_key_status,omitempty"`
 }
 
 // Load reads a config file from path. If path is empty, it searches the
@@ -47,7 +143,7 @@ func Load(path string) (*Config, error) {
 		path = findConfig()
 	}
 
-	cfg := &Config{path: path}
+	cfg := &Config{path: path, mu: new(sync.Mutex)}
 
 	data, err := os.ReadFile(path)
 	if err != nil {
@@ -80,7 +176,8 @@ func (c *Config) Save() error {
 	}
 
 	tmp := c.path + ".tmp"
-	if err := os.WriteFile(tmp, data, 0644); err != nil {
+	// The file may hold the network key, so keep it private.
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
 		return fmt.Errorf("write config: %w", err)
 	}
 	if err := os.Rename(tmp, c.path); err != nil {
@@ -90,6 +187,61 @@ func (c *Config) Save() error {
 	return nil
 }
 
+// UpdateDevices replaces the devices of adapter i, or the top-level devices
+// when i is negative. It holds the lock Save takes, so a running adapter can
+// record its devices while another saves the file.
+func (c *Config) UpdateDevices(i int, entries []DeviceEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if i < 0 {
+		c.Devices = entries
+	} else {
+		c.Adapters[i].Devices = entries
+	}
+}
+
+// UpdateNetwork replaces the network settings of adapter i, or the top-level
+// ones when i is negative, like UpdateDevices.
+func (c *Config) UpdateNetwork(i int, n NetworkConfig) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if i < 0 {
+		c.Network = n
+	} else {
+		c.Adapters[i].Network = n
+	}
+}
+
+// UpdateSerialPort sets the serial port of adapter i, or the top-level one
+// when i is negative, like UpdateDevices.
+func (c *Config) UpdateSerialPort(i int, port string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if i < 0 {
+		c.Serial.Port = port
+	} else {
+		c.Adapters[i].Serial.Port = port
+	}
+}
+
+// DeviceAddresses returns the lower-cased IEEE addresses of the top-level
+// devices and the devices of every adapter.
+func (c *Config) DeviceAddresses() map[string]bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	addrs := make(map[string]bool)
+	add := func(devices []DeviceEntry) {
+		for _, d := range devices {
+			addrs[strings.ToLower(d.IEEEAddress)] = true
+		}
+	}
+	add(c.Devices)
+	for _, a := range c.Adapters {
+		add(a.Devices)
+	}
+	return addrs
+}
+
 // Path returns the resolved config file path.
 func (c *Config) Path() string { return c.path }
 
@@ -0,0 +1,43 @@
+package config
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestUpdateDevicesWhileSaving(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "zigbee-skill.yaml")
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Adapters = []AdapterConfig{{Name: "a"}, {Name: "b"}}
+
+	var wg sync.WaitGroup
+	for i, a := range cfg.Adapters {
+		name := a.Name
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 20 {
+				cfg.UpdateDevices(i, []DeviceEntry{{IEEEAddress: name}})
+				if err := cfg.Save(); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	loaded, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, a := range loaded.Adapters {
+		if len(a.Devices) != 1 || a.Devices[0].IEEEAddress != a.Name {
+			t.Errorf("adapter %d devices = %+v", i, a.Devices)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// StateFile holds the last-known state of every device, keyed by IEEE
+// address. It is kept next to the config file (zigbee-skill.state.json) so
+// frequent state changes do not rewrite the config.
+type StateFile struct {
+	Devices map[string]SavedState `json:"devices"`
+
+	mu    sync.Mutex
+	path  string
+	saved []byte // last bytes written, to skip unchanged saves
+}
+
+// SavedState is one device's last-known state.
+type SavedState struct {
+	State     map[string]any `json:"state"`
+	UpdatedAt time.Time      `json:"updated_at"`
+}
+
+// StatePath returns the state file path that belongs to the config file.
+func (c *Config) StatePath() string {
+	return strings.TrimSuffix(c.path, filepath.Ext(c.path)) + ".state.json"
+}
+
+// HistoryPath returns the history directory that belongs to the config file.
+func (c *Config) HistoryPath() string {
+	return strings.TrimSuffix(c.path, filepath.Ext(c.path)) + ".history"
+}
+
+// LoadState reads the state file at path. A missing file yields an empty
+// state file that is created on the first Save. On a read or parse error the
+// empty state file is returned with the error, so callers may carry on and
+// overwrite it.
+func LoadState(path string) (*StateFile, error) {
+	s := &StateFile{Devices: make(map[string]SavedState), path: path}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s, nil
+		}
+		return s, fmt.Errorf("read state %s: %w", path, err)
+	}
+	if err := json.Unmarshal(data, s); err != nil {
+		s.Devices = make(map[string]SavedState)
+		return s, fmt.Errorf("parse state %s: %w", path, err)
+	}
+	if s.Devices == nil {
+		s.Devices = make(map[string]SavedState)
+	}
+	s.saved = data
+	return s, nil
+}
+
+// Get returns the saved state of the device with the given IEEE address.
+func (s *StateFile) Get(ieee string) (SavedState, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st, ok := s.Devices[ieee]
+	return st, ok
+}
+
+// Merge records states over the saved ones and drops saved devices whose
+// lower-cased IEEE address is not in keep. Devices missing from states keep
+// their saved state, so one with nothing cached yet is not forgotten.
+func (s *StateFile) Merge(states map[string]SavedState, keep map[string]bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for ieee, st := range states {
+		s.Devices[ieee] = st
+	}
+	for ieee := range s.Devices {
+		if !keep[strings.ToLower(ieee)] {
+			delete(s.Devices, ieee)
+		}
+	}
+}
+
+// Save writes the state file atomically (temp file + rename). Nothing is
+// written when the content has not changed since the last load or save.
+func (s *StateFile) Save() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal state: %w", err)
+	}
+	if bytes.Equal(data, s.saved) {
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return fmt.Errorf("create state dir: %w", err)
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("write state: %w", err)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("rename state: %w", err)
+	}
+	s.saved = data
+	return nil
+}
@@ -0,0 +1,67 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStateFileRoundTrip(t *testing.T) {
+	cfg := &Config{path: filepath.Join(t.TempDir(), "zigbee-skill.yaml")}
+	path := cfg.StatePath()
+	if filepath.Base(path) != "zigbee-skill.state.json" {
+		t.Fatalf("state path = %s", path)
+	}
+
+	s, err := LoadState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	s.Merge(map[string]SavedState{
+		"00:15:8d:00:01:a2:b3:c4": {State: map[string]any{"state": "ON", "brightness": 200}, UpdatedAt: at},
+	}, map[string]bool{"00:15:8d:00:01:a2:b3:c4": true})
+	if err := s.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := LoadState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, ok := loaded.Get("00:15:8d:00:01:a2:b3:c4")
+	if !ok || got.State["state"] != "ON" || got.State["brightness"] != 200.0 || !got.UpdatedAt.Equal(at) {
+		t.Fatalf("restored state = %+v", got)
+	}
+
+	// An unchanged state file is not rewritten.
+	if err := os.Chmod(path, 0400); err != nil {
+		t.Fatal(err)
+	}
+	info, _ := os.Stat(path)
+	if err := loaded.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if after, _ := os.Stat(path); !after.ModTime().Equal(info.ModTime()) || after.Mode() != info.Mode() {
+		t.Error("unchanged state was rewritten")
+	}
+}
+
+func TestStateFileMerge(t *testing.T) {
+	s, _ := LoadState(filepath.Join(t.TempDir(), "state.json"))
+	s.Merge(map[string]SavedState{
+		"00:00:00:00:00:00:00:01": {State: map[string]any{"state": "ON"}},
+		"00:00:00:00:00:00:00:02": {State: map[string]any{"state": "OFF"}},
+	}, map[string]bool{"00:00:00:00:00:00:00:01": true, "00:00:00:00:00:00:00:02": true})
+
+	// Device 1 has nothing cached and keeps its saved state; device 2 was
+	// removed from the config.
+	s.Merge(nil, map[string]bool{"00:00:00:00:00:00:00:01": true})
+	if got, ok := s.Get("00:00:00:00:00:00:00:01"); !ok || got.State["state"] != "ON" {
+		t.Errorf("kept device = %+v, %v", got, ok)
+	}
+	if _, ok := s.Get("00:00:00:00:00:00:00:02"); ok {
+		t.Error("removed device still saved")
+	}
+}
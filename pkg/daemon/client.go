@@ -8,12 +8,18 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"net/url"
 	"strings"
+	"sync"
 
 	"github.com/urmzd/zigbee-skill/pkg/device"
+	"github.com/urmzd/zigbee-skill/pkg/history"
 )
 
-const noCacheHeader = "X-No-Cache"
+const (
+	noCacheHeader = "X-No-Cache"
+	networkHeader = "X-Network"
+)
 
 // DaemonClient implements device.Controller by proxying to the daemon over a Unix socket.
 type DaemonClient struct {
@@ -52,6 +58,9 @@ func (c *DaemonClient) post(ctx context.Context, path string, reqBody any) (*htt
 	if device.NoCache(ctx) {
 		req.Header.Set("X-No-Cache", "true")
 	}
+	if name := device.Network(ctx); name != "" {
+		req.Header.Set(networkHeader, name)
+	}
 	return c.http.Do(req)
 }
 
@@ -163,6 +172,195 @@ func (c *DaemonClient) PermitJoin(ctx context.Context, enable bool, duration int
 	return checkErr(resp)
 }
 
+func (c *DaemonClient) PermitJoinVia(ctx context.Context, via string, duration int) error {
+	resp, err := c.post(ctx, "/discovery/permit", permitRequest{Enable: true, Duration: duration, Via: via})
+	if err != nil {
+		return fmt.Errorf("daemon request: %w", err)
+	}
+	defer resp.Body.Close()
+	return checkErr(resp)
+}
+
+func (c *DaemonClient) AddInstallCode(ctx context.Context, ieee, code string) (string, error) {
+	resp, err := c.post(ctx, "/discovery/install-code", installCodeRequest{IEEE: ieee, Code: code})
+	if err != nil {
+		return "", fmt.Errorf("daemon request: %w", err)
+	}
+	defer resp.Body.Close()
+	if err := checkErr(resp); err != nil {
+		return "", err
+	}
+	var result struct {
+		IEEE string `json:"ieee_address"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", err
+	}
+	return result.IEEE, nil
+}
+
+func (c *DaemonClient) NetworkInfo(ctx context.Context) (*device.NetworkInfo, error) {
+	resp, err := c.post(ctx, "/network/info", nil)
+	if err != nil {
+		return nil, fmt.Errorf("daemon request: %w", err)
+	}
+	defer resp.Body.Close()
+	if err := checkErr(resp); err != nil {
+		return nil, err
+	}
+	var result struct {
+		Network device.NetworkInfo `json:"network"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	return &result.Network, nil
+}
+
+func (c *DaemonClient) NetworkMap(ctx context.Context) (*device.NetworkMap, error) {
+	resp, err := c.post(ctx, "/network/map", nil)
+	if err != nil {
+		return nil, fmt.Errorf("daemon request: %w", err)
+	}
+	defer resp.Body.Close()
+	if err := checkErr(resp); err != nil {
+		return nil, err
+	}
+	var result struct {
+		Map device.NetworkMap `json:"map"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	return &result.Map, nil
+}
+
+func (c *DaemonClient) BackupNetwork(ctx context.Context) (*device.NetworkBackup, error) {
+	resp, err := c.post(ctx, "/network/backup", nil)
+	if err != nil {
+		return nil, fmt.Errorf("daemon request: %w", err)
+	}
+	defer resp.Body.Close()
+	if err := checkErr(resp); err != nil {
+		return nil, err
+	}
+	var result struct {
+		Backup device.NetworkBackup `json:"backup"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	return &result.Backup, nil
+}
+
+func (c *DaemonClient) RestoreNetwork(ctx context.Context, b *device.NetworkBackup, overwriteIEEE bool) error {
+	resp, err := c.post(ctx, "/network/restore", restoreRequest{Backup: b, OverwriteIEEE: overwriteIEEE})
+	if err != nil {
+		return fmt.Errorf("daemon request: %w", err)
+	}
+	defer resp.Body.Close()
+	return checkErr(resp)
+}
+
+func (c *DaemonClient) FormNetwork(ctx context.Context, opts device.FormOptions) (*device.NetworkInfo, error) {
+	resp, err := c.post(ctx, "/network/form", opts)
+	if err != nil {
+		return nil, fmt.Errorf("daemon request: %w", err)
+	}
+	defer resp.Body.Close()
+	if err := checkErr(resp); err != nil {
+		return nil, err
+	}
+	var result struct {
+		Network device.NetworkInfo `json:"network"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	return &result.Network, nil
+}
+
+func (c *DaemonClient) ChangeChannel(ctx context.Context, channel int) error {
+	resp, err := c.post(ctx, "/network/channel", channelRequest{Channel: channel})
+	if err != nil {
+		return fmt.Errorf("daemon request: %w", err)
+	}
+	defer resp.Body.Close()
+	return checkErr(resp)
+}
+
+func (c *DaemonClient) EnergyScan(ctx context.Context, channels []int, duration int) ([]device.ChannelEnergy, error) {
+	resp, err := c.post(ctx, "/network/scan", scanRequest{Type: "energy", Channels: channels, Duration: duration})
+	if err != nil {
+		return nil, fmt.Errorf("daemon request: %w", err)
+	}
+	defer resp.Body.Close()
+	if err := checkErr(resp); err != nil {
+		return nil, err
+	}
+	var result struct {
+		Channels []device.ChannelEnergy `json:"channels"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	return result.Channels, nil
+}
+
+func (c *DaemonClient) ActiveScan(ctx context.Context, channels []int, duration int) ([]device.PANInfo, error) {
+	resp, err := c.post(ctx, "/network/scan", scanRequest{Type: "active", Channels: channels, Duration: duration})
+	if err != nil {
+		return nil, fmt.Errorf("daemon request: %w", err)
+	}
+	defer resp.Body.Close()
+	if err := checkErr(resp); err != nil {
+		return nil, err
+	}
+	var result struct {
+		Networks []device.PANInfo `json:"networks"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	return result.Networks, nil
+}
+
+func (c *DaemonClient) KeyTable(ctx context.Context) (*device.KeyTable, error) {
+	resp, err := c.post(ctx, "/network/keys", nil)
+	if err != nil {
+		return nil, fmt.Errorf("daemon request: %w", err)
+	}
+	defer resp.Body.Close()
+	if err := checkErr(resp); err != nil {
+		return nil, err
+	}
+	var result struct {
+		Keys device.KeyTable `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	return &result.Keys, nil
+}
+
+func (c *DaemonClient) RotateNetworkKey(ctx context.Context) (*device.KeyRotation, error) {
+	resp, err := c.post(ctx, "/network/rotate-key", nil)
+	if err != nil {
+		return nil, fmt.Errorf("daemon request: %w", err)
+	}
+	defer resp.Body.Close()
+	if err := checkErr(resp); err != nil {
+		return nil, err
+	}
+	var result struct {
+		Rotation device.KeyRotation `json:"rotation"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	return &result.Rotation, nil
+}
+
 func (c *DaemonClient) IsConnected() bool {
 	resp, err := c.post(context.Background(), "/health", nil)
 	if err != nil {
@@ -176,6 +374,25 @@ func (c *DaemonClient) IsConnected() bool {
 	return result.Connected
 }
 
+// History returns a device's recorded state changes and events.
+func (c *DaemonClient) History(ctx context.Context, id string, q history.Query) ([]history.Record, error) {
+	resp, err := c.post(ctx, "/devices/history", historyRequest{ID: id, Property: q.Property, Since: q.Since, Until: q.Until})
+	if err != nil {
+		return nil, fmt.Errorf("daemon request: %w", err)
+	}
+	defer resp.Body.Close()
+	if err := checkErr(resp); err != nil {
+		return nil, err
+	}
+	var result struct {
+		Records []history.Record `json:"records"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	return result.Records, nil
+}
+
 func (c *DaemonClient) Close() {}
 
 // checkErr reads an error response from the daemon and maps it to sentinel errors.
@@ -201,26 +418,36 @@ func checkErr(resp *http.Response) error {
 		return fmt.Errorf("%w: %s", device.ErrValidation, msg)
 	case resp.StatusCode == http.StatusGatewayTimeout || strings.Contains(msg, "timed out"):
 		return fmt.Errorf("%w: %s", device.ErrTimeout, msg)
+	case resp.StatusCode == http.StatusBadGateway || strings.Contains(msg, "delivery failed"):
+		return fmt.Errorf("%w: %s", device.ErrDeliveryFailed, msg)
+	case resp.StatusCode == http.StatusNotImplemented || strings.Contains(msg, "not supported"):
+		return device.ErrUnsupported
 	default:
 		return fmt.Errorf("daemon error: %s", msg)
 	}
 }
 
-// DaemonEventSubscriber streams discovery events from the daemon over SSE.
+// DaemonEventSubscriber streams events from the daemon over SSE. The daemon
+// applies the filter and reports overflow with events_dropped.
 type DaemonEventSubscriber struct {
 	socketPath string
-	cancel     context.CancelFunc
+
+	mu      sync.Mutex
+	cancels map[chan device.Event]context.CancelFunc
 }
 
 // NewDaemonEventSubscriber creates an event subscriber connected to the daemon.
 func NewDaemonEventSubscriber(socketPath string) *DaemonEventSubscriber {
-	return &DaemonEventSubscriber{socketPath: socketPath}
+	return &DaemonEventSubscriber{socketPath: socketPath, cancels: make(map[chan device.Event]context.CancelFunc)}
 }
 
-func (s *DaemonEventSubscriber) Subscribe() chan device.DiscoveryEvent {
-	ch := make(chan device.DiscoveryEvent, 16)
+func (s *DaemonEventSubscriber) Subscribe(filter device.EventFilter) chan device.Event {
+	ch := make(chan device.Event, 64)
 	ctx, cancel := context.WithCancel(context.Background())
-	s.cancel = cancel
+	s.mu.Lock()
+	s.cancels[ch] = cancel
+	s.mu.Unlock()
+	query := url.Values{"type": filter.Types, "device": filter.Devices}
 
 	go func() {
 		defer close(ch)
@@ -232,7 +459,7 @@ func (s *DaemonEventSubscriber) Subscribe() chan device.DiscoveryEvent {
 				},
 			},
 		}
-		req, err := http.NewRequestWithContext(ctx, "GET", "http://daemon/discovery/events", nil)
+		req, err := http.NewRequestWithContext(ctx, "GET", "http://daemon/events?"+query.Encode(), nil)
 		if err != nil {
 			return
 		}
@@ -241,15 +468,19 @@ func (s *DaemonEventSubscriber) Subscribe() chan device.DiscoveryEvent {
 			return
 		}
 		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return
+		}
 
 		scanner := bufio.NewScanner(resp.Body)
+		scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
 		for scanner.Scan() {
 			line := scanner.Text()
 			if !strings.HasPrefix(line, "data: ") {
 				continue
 			}
 			data := strings.TrimPrefix(line, "data: ")
-			var ev device.DiscoveryEvent
+			var ev device.Event
 			if err := json.Unmarshal([]byte(data), &ev); err != nil {
 				continue
 			}
@@ -264,8 +495,12 @@ func (s *DaemonEventSubscriber) Subscribe() chan device.DiscoveryEvent {
 	return ch
 }
 
-func (s *DaemonEventSubscriber) Unsubscribe(ch chan device.DiscoveryEvent) {
-	if s.cancel != nil {
-		s.cancel()
+func (s *DaemonEventSubscriber) Unsubscribe(ch chan device.Event) {
+	s.mu.Lock()
+	cancel := s.cancels[ch]
+	delete(s.cancels, ch)
+	s.mu.Unlock()
+	if cancel != nil {
+		cancel()
 	}
 }
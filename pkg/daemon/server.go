@@ -9,19 +9,26 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/rs/zerolog/log"
 	"github.com/urmzd/zigbee-skill/pkg/app"
 	"github.com/urmzd/zigbee-skill/pkg/device"
+	"github.com/urmzd/zigbee-skill/pkg/history"
 )
 
-// reqCtx returns the request context, enriched with no-cache if the header is set.
+// reqCtx returns the request context, enriched with no-cache and the target
+// network if the headers are set.
 func reqCtx(r *http.Request) context.Context {
 	ctx := r.Context()
 	if r.Header.Get(noCacheHeader) == "true" {
 		ctx = device.WithNoCache(ctx)
 	}
+	if name := r.Header.Get(networkHeader); name != "" {
+		ctx = device.WithNetwork(ctx, name)
+	}
 	return ctx
 }
 
@@ -104,8 +111,21 @@ func (s *Server) routes() *http.ServeMux {
 	mux.HandleFunc("POST /devices/clear", s.handleDevicesClear)
 	mux.HandleFunc("POST /devices/state", s.handleDevicesState)
 	mux.HandleFunc("POST /devices/set", s.handleDevicesSet)
+	mux.HandleFunc("POST /devices/history", s.handleDevicesHistory)
 	mux.HandleFunc("POST /discovery/permit", s.handleDiscoveryPermit)
+	mux.HandleFunc("GET /events", s.handleEvents)
+	// Older clients stream pairing events from here.
 	mux.HandleFunc("GET /discovery/events", s.handleDiscoveryEvents)
+	mux.HandleFunc("POST /discovery/install-code", s.handleDiscoveryInstallCode)
+	mux.HandleFunc("POST /network/info", s.handleNetworkInfo)
+	mux.HandleFunc("POST /network/map", s.handleNetworkMap)
+	mux.HandleFunc("POST /network/backup", s.handleNetworkBackup)
+	mux.HandleFunc("POST /network/restore", s.handleNetworkRestore)
+	mux.HandleFunc("POST /network/form", s.handleNetworkForm)
+	mux.HandleFunc("POST /network/channel", s.handleNetworkChannel)
+	mux.HandleFunc("POST /network/scan", s.handleNetworkScan)
+	mux.HandleFunc("POST /network/keys", s.handleNetworkKeys)
+	mux.HandleFunc("POST /network/rotate-key", s.handleNetworkRotateKey)
 	return mux
 }
 
@@ -125,22 +145,57 @@ type removeRequest struct {
 	Force bool   `json:"force"`
 }
 
+type restoreRequest struct {
+	Backup        *device.NetworkBackup `json:"backup"`
+	OverwriteIEEE bool                  `json:"overwrite_ieee"`
+}
+
+type channelRequest struct {
+	Channel int `json:"channel"`
+}
+
+type scanRequest struct {
+	Type     string `json:"type"` // energy or active
+	Channels []int  `json:"channels,omitempty"`
+	Duration int    `json:"duration,omitempty"`
+}
+
+type installCodeRequest struct {
+	IEEE string `json:"ieee"`
+	Code string `json:"code"`
+}
+
 type setStateRequest struct {
 	ID    string         `json:"id"`
 	State map[string]any `json:"state"`
 }
 
+type historyRequest struct {
+	ID       string    `json:"id"`
+	Property string    `json:"property,omitempty"`
+	Since    time.Time `json:"since,omitzero"`
+	Until    time.Time `json:"until,omitzero"`
+	Format   string    `json:"format,omitempty"` // json (default) or csv
+}
+
 type permitRequest struct {
-	Enable   bool `json:"enable"`
-	Duration int  `json:"duration"`
+	Enable   bool   `json:"enable"`
+	Duration int    `json:"duration"`
+	Via      string `json:"via,omitempty"` // router id or "all"; empty opens the coordinator
 }
 
 // --- handlers ---
 
 func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
-	writeJSON(w, http.StatusOK, map[string]any{
+	resp := map[string]any{
 		"connected": s.app.Controller.IsConnected(),
-	})
+	}
+	if inspector, ok := s.app.Controller.(device.NetworkInspector); ok {
+		if info, err := inspector.NetworkInfo(reqCtx(r)); err == nil {
+			resp["network"] = info
+		}
+	}
+	writeJSON(w, http.StatusOK, resp)
 }
 
 func (s *Server) handleDevicesList(w http.ResponseWriter, r *http.Request) {
@@ -223,11 +278,47 @@ func (s *Server) handleDevicesSet(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, http.StatusOK, map[string]any{"state": st})
 }
 
+func (s *Server) handleDevicesHistory(w http.ResponseWriter, r *http.Request) {
+	var req historyRequest
+	if !decodeBody(w, r, &req) {
+		return
+	}
+	if s.app.History == nil {
+		writeErr(w, fmt.Errorf("%w: device history is disabled", device.ErrUnsupported))
+		return
+	}
+	recs, err := s.app.History.History(reqCtx(r), req.ID, history.Query{Property: req.Property, Since: req.Since, Until: req.Until})
+	if err != nil {
+		writeErr(w, err)
+		return
+	}
+	if req.Format == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		w.WriteHeader(http.StatusOK)
+		_ = history.WriteCSV(w, recs)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"device": req.ID, "records": recs})
+}
+
 func (s *Server) handleDiscoveryPermit(w http.ResponseWriter, r *http.Request) {
 	var req permitRequest
 	if !decodeBody(w, r, &req) {
 		return
 	}
+	if req.Enable && req.Via != "" {
+		joiner, ok := s.app.Controller.(device.TargetedJoiner)
+		if !ok {
+			writeErr(w, device.ErrUnsupported)
+			return
+		}
+		if err := joiner.PermitJoinVia(reqCtx(r), req.Via, req.Duration); err != nil {
+			writeErr(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"success": true})
+		return
+	}
 	if err := s.app.Controller.PermitJoin(reqCtx(r), req.Enable, req.Duration); err != nil {
 		writeErr(w, err)
 		return
@@ -235,14 +326,216 @@ func (s *Server) handleDiscoveryPermit(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, http.StatusOK, map[string]any{"success": true})
 }
 
-// handleDiscoveryEvents streams discovery events as SSE to the client.
-// The connection stays open until the client disconnects.
+func (s *Server) handleDiscoveryInstallCode(w http.ResponseWriter, r *http.Request) {
+	var req installCodeRequest
+	if !decodeBody(w, r, &req) {
+		return
+	}
+	joiner, ok := s.app.Controller.(device.InstallCodeJoiner)
+	if !ok {
+		writeErr(w, device.ErrUnsupported)
+		return
+	}
+	ieee, err := joiner.AddInstallCode(reqCtx(r), req.IEEE, req.Code)
+	if err != nil {
+		writeErr(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"ieee_address": ieee})
+}
+
+func (s *Server) handleNetworkInfo(w http.ResponseWriter, r *http.Request) {
+	inspector, ok := s.app.Controller.(device.NetworkInspector)
+	if !ok {
+		writeErr(w, device.ErrUnsupported)
+		return
+	}
+	info, err := inspector.NetworkInfo(reqCtx(r))
+	if err != nil {
+		writeErr(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"network": info})
+}
+
+func (s *Server) handleNetworkMap(w http.ResponseWriter, r *http.Request) {
+	mapper, ok := s.app.Controller.(device.TopologyMapper)
+	if !ok {
+		writeErr(w, device.ErrUnsupported)
+		return
+	}
+	m, err := mapper.NetworkMap(reqCtx(r))
+	if err != nil {
+		writeErr(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"map": m})
+}
+
+func (s *Server) handleNetworkBackup(w http.ResponseWriter, r *http.Request) {
+	backuper, ok := s.app.Controller.(device.NetworkBackuper)
+	if !ok {
+		writeErr(w, device.ErrUnsupported)
+		return
+	}
+	b, err := backuper.BackupNetwork(reqCtx(r))
+	if err != nil {
+		writeErr(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"backup": b})
+}
+
+func (s *Server) handleNetworkRestore(w http.ResponseWriter, r *http.Request) {
+	var req restoreRequest
+	if !decodeBody(w, r, &req) {
+		return
+	}
+	backuper, ok := s.app.Controller.(device.NetworkBackuper)
+	if !ok {
+		writeErr(w, device.ErrUnsupported)
+		return
+	}
+	if req.Backup == nil {
+		writeErr(w, fmt.Errorf("%w: backup is required", device.ErrValidation))
+		return
+	}
+	if err := backuper.RestoreNetwork(reqCtx(r), req.Backup, req.OverwriteIEEE); err != nil {
+		writeErr(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"success": true})
+}
+
+func (s *Server) handleNetworkForm(w http.ResponseWriter, r *http.Request) {
+	var req device.FormOptions
+	if !decodeBody(w, r, &req) {
+		return
+	}
+	former, ok := s.app.Controller.(device.NetworkFormer)
+	if !ok {
+		writeErr(w, device.ErrUnsupported)
+		return
+	}
+	info, err := former.FormNetwork(reqCtx(r), req)
+	if err != nil {
+		writeErr(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"network": info})
+}
+
+func (s *Server) handleNetworkChannel(w http.ResponseWriter, r *http.Request) {
+	var req channelRequest
+	if !decodeBody(w, r, &req) {
+		return
+	}
+	former, ok := s.app.Controller.(device.NetworkFormer)
+	if !ok {
+		writeErr(w, device.ErrUnsupported)
+		return
+	}
+	if err := former.ChangeChannel(reqCtx(r), req.Channel); err != nil {
+		writeErr(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"success": true})
+}
+
+func (s *Server) handleNetworkScan(w http.ResponseWriter, r *http.Request) {
+	var req scanRequest
+	if !decodeBody(w, r, &req) {
+		return
+	}
+	scanner, ok := s.app.Controller.(device.ChannelScanner)
+	if !ok {
+		writeErr(w, device.ErrUnsupported)
+		return
+	}
+	switch req.Type {
+	case "energy", "":
+		channels, err := scanner.EnergyScan(reqCtx(r), req.Channels, req.Duration)
+		if err != nil {
+			writeErr(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"channels": channels})
+	case "active":
+		networks, err := scanner.ActiveScan(reqCtx(r), req.Channels, req.Duration)
+		if err != nil {
+			writeErr(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"networks": networks})
+	default:
+		writeErr(w, fmt.Errorf("%w: unknown scan type %q (expected energy or active)", device.ErrValidation, req.Type))
+	}
+}
+
+func (s *Server) handleNetworkKeys(w http.ResponseWriter, r *http.Request) {
+	km, ok := s.app.Controller.(device.KeyManager)
+	if !ok {
+		writeErr(w, device.ErrUnsupported)
+		return
+	}
+	t, err := km.KeyTable(reqCtx(r))
+	if err != nil {
+		writeErr(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"keys": t})
+}
+
+func (s *Server) handleNetworkRotateKey(w http.ResponseWriter, r *http.Request) {
+	km, ok := s.app.Controller.(device.KeyManager)
+	if !ok {
+		writeErr(w, device.ErrUnsupported)
+		return
+	}
+	rot, err := km.RotateNetworkKey(reqCtx(r))
+	if err != nil {
+		writeErr(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"rotation": rot})
+}
+
+// handleEvents streams events as SSE to the client. The type and device
+// query parameters (repeated or comma-separated) filter the stream; devices
+// may be given by ID or friendly name.
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	s.streamEvents(w, r, nil)
+}
+
+// pairingEvents are streamed by /discovery/events when the request names no
+// type, as older clients expect only pairing events there.
+var pairingEvents = []string{device.EventDeviceJoined, device.EventDeviceLeft, device.EventDeviceRejected}
+
 func (s *Server) handleDiscoveryEvents(w http.ResponseWriter, r *http.Request) {
+	s.streamEvents(w, r, pairingEvents)
+}
+
+// streamEvents streams the events selected by the type and device query
+// parameters as server-sent events. Without a type parameter it streams
+// defaultTypes, or every type when that is nil.
+func (s *Server) streamEvents(w http.ResponseWriter, r *http.Request, defaultTypes []string) {
 	flusher, ok := w.(http.Flusher)
 	if !ok {
 		http.Error(w, "streaming not supported", http.StatusInternalServerError)
 		return
 	}
+	filter := device.EventFilter{Types: queryList(r, "type")}
+	if len(filter.Types) == 0 {
+		filter.Types = defaultTypes
+	}
+	for _, id := range queryList(r, "device") {
+		d, err := s.app.Controller.GetDevice(reqCtx(r), id)
+		if err != nil {
+			writeErr(w, fmt.Errorf("device %q: %w", id, err))
+			return
+		}
+		filter.Devices = append(filter.Devices, d.ID)
+	}
 
 	w.Header().Set("Content-Type", "text/event-stream")
 	w.Header().Set("Cache-Control", "no-cache")
@@ -250,12 +543,15 @@ func (s *Server) handleDiscoveryEvents(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	flusher.Flush()
 
-	ch := s.app.Events.Subscribe()
+	ch := s.app.Events.Subscribe(filter)
 	defer s.app.Events.Unsubscribe(ch)
 
 	for {
 		select {
-		case ev := <-ch:
+		case ev, ok := <-ch:
+			if !ok {
+				return
+			}
 			data, err := json.Marshal(ev)
 			if err != nil {
 				continue
@@ -268,6 +564,20 @@ func (s *Server) handleDiscoveryEvents(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// queryList returns the values of a repeated or comma-separated query
+// parameter.
+func queryList(r *http.Request, key string) []string {
+	var out []string
+	for _, v := range r.URL.Query()[key] {
+		for _, part := range strings.Split(v, ",") {
+			if part = strings.TrimSpace(part); part != "" {
+				out = append(out, part)
+			}
+		}
+	}
+	return out
+}
+
 // --- helpers ---
 
 func decodeBody(w http.ResponseWriter, r *http.Request, v any) bool {
@@ -295,6 +605,10 @@ func writeErr(w http.ResponseWriter, err error) {
 		code = http.StatusBadRequest
 	case errors.Is(err, device.ErrTimeout):
 		code = http.StatusGatewayTimeout
+	case errors.Is(err, device.ErrDeliveryFailed):
+		code = http.StatusBadGateway
+	case errors.Is(err, device.ErrUnsupported):
+		code = http.StatusNotImplemented
 	}
 	writeJSON(w, code, map[string]any{"error": err.Error()})
 }
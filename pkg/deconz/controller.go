@@ -0,0 +1,700 @@
+package deconz
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/urmzd/zigbee-skill/pkg/device"
+	"github.com/urmzd/zigbee-skill/pkg/zigbee"
+)
+
+// ZCL and ZDO identifiers used by the deCONZ controller.
+const (
+	zclProfileHA           uint16 = 0x0104
+	zclClusterOnOff        uint16 = 0x0006
+	zclClusterLevelControl uint16 = 0x0008
+
+	zclAttrOnOff        uint16 = 0x0000
+	zclAttrCurrentLevel uint16 = 0x0000
+
+	zclCmdOff    uint8 = 0x00
+	zclCmdOn     uint8 = 0x01
+	zclCmdToggle uint8 = 0x02
+
+	zclGlobalReadAttributesResponse uint8 = 0x01
+	zclGlobalReportAttributes       uint8 = 0x0A
+	zclGlobalDefaultResponse        uint8 = 0x0B
+
+	zdoProfileID             uint16 = 0x0000
+	zdoClusterSimpleDescReq  uint16 = 0x0004
+	zdoClusterActiveEPReq    uint16 = 0x0005
+	zdoClusterDeviceAnnce    uint16 = 0x0013
+	zdoClusterMgmtLeaveReq   uint16 = 0x0034
+	zdoClusterMgmtPermitJoin uint16 = 0x0036
+	zdoClusterResponseFlag   uint16 = 0x8000
+	zdoBroadcastRouters      uint16 = 0xFFFC
+	broadcastAddrMin         uint16 = 0xFFF8
+)
+
+// APS address modes
+const (
+	addrModeGroup   uint8 = 0x01
+	addrModeNWK     uint8 = 0x02
+	addrModeIEEE    uint8 = 0x03
+	addrModeNWKIEEE uint8 = 0x04 // indication source: NWK(2) + IEEE(8)
+)
+
+const (
+	coordinatorEndpoint = 1
+
+	// txOptionsAck requests an APS acknowledgement for unicasts.
+	txOptionsAck = 0x04
+
+	// indicationFlags asks APS_DATA_INDICATION to report the source with
+	// both its NWK and IEEE address.
+	indicationFlags = 0x04
+
+	zdoResponseTimeout = 10 * time.Second
+)
+
+type zclWaitKey struct {
+	nodeID uint16
+	seq    uint8
+}
+
+type zdoWaitKey struct {
+	nodeID  uint16
+	cluster uint16
+	seq     uint8
+}
+
+// Options configures a Controller.
+type Options struct {
+	// Form holds the parameters used when the adapter has no network yet.
+	Form device.FormOptions
+}
+
+// Controller implements device.Controller and device.EventSubscriber for a
+// ConBee or RaspBee adapter.
+type Controller struct {
+	port  zigbee.Transport
+	layer *Layer
+	opts  Options
+
+	*zigbee.KnownDevices
+
+	connected bool
+	connMu    sync.RWMutex
+
+	// poll is signalled when the device state reports a waiting indication
+	// or confirm.
+	poll chan struct{}
+
+	confirmWaiters map[uint8]chan uint32      // APS request ID -> confirm status
+	zclWaiters     map[zclWaitKey]chan uint8  // ZCL transaction -> Default Response status
+	zdoWaiters     map[zdoWaitKey]chan []byte // ZDO transaction -> response
+	nextReqID      uint8
+	sentMu         sync.Mutex
+
+	joinWindow zigbee.JoinWindow
+
+	coordIEEE string
+
+	onNetworkChange func(device.FormOptions)
+	stopChan        chan struct{}
+}
+
+// zdoSeq is the ZDO transaction sequence counter.
+var zdoSeq atomic.Uint32
+
+// NewController opens the adapter on portPath, resumes or forms its network
+// and starts polling for incoming frames.
+func NewController(portPath string, opts Options) (*Controller, error) {
+	log.Info().Str("port", portPath).Msg("Initializing deCONZ controller")
+	s, err := zigbee.OpenSerial(portPath)
+	if err != nil {
+		return nil, fmt.Errorf("open serial: %w", err)
+	}
+	c, err := newController(s, opts)
+	if err != nil {
+		_ = s.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// newController runs the deCONZ startup sequence over an open transport.
+func newController(t zigbee.Transport, opts Options) (*Controller, error) {
+	layer := NewLayer(t)
+	c := &Controller{
+		port:           t,
+		layer:          layer,
+		opts:           opts,
+		poll:           make(chan struct{}, 1),
+		confirmWaiters: make(map[uint8]chan uint32),
+		zclWaiters:     make(map[zclWaitKey]chan uint8),
+		zdoWaiters:     make(map[zdoWaitKey]chan []byte),
+		stopChan:       make(chan struct{}),
+	}
+	c.KnownDevices = zigbee.NewKnownDevices(c)
+	layer.OnDeviceState(c.handleDeviceState)
+	layer.Listen(cmdMACPoll, func(frame) {})
+	layer.Start()
+
+	if err := c.initStack(); err != nil {
+		layer.Close()
+		return nil, fmt.Errorf("init stack: %w", err)
+	}
+
+	c.connMu.Lock()
+	c.connected = true
+	c.connMu.Unlock()
+
+	go c.pollLoop()
+	go c.watchdogLoop()
+	go c.watchLink()
+	c.requestPoll() // drain anything queued while starting
+
+	log.Info().Msg("deCONZ controller initialized")
+	return c, nil
+}
+
+func (c *Controller) initStack() error {
+	if _, err := c.layer.Request(cmdVersion, []byte{0, 0, 0, 0}); err != nil {
+		return fmt.Errorf("read version: %w", err)
+	}
+	if err := c.startNetwork(); err != nil {
+		return err
+	}
+	if mac, err := c.readParam(paramMACAddress); err == nil && len(mac) == 8 {
+		c.coordIEEE = zigbee.FormatIEEE([8]byte(mac))
+	}
+	return nil
+}
+
+// watchLink marks the controller disconnected when the serial link fails.
+func (c *Controller) watchLink() {
+	select {
+	case <-c.layer.Down():
+	case <-c.stopChan:
+		return
+	}
+	reason := "link lost"
+	if err := c.layer.Err(); err != nil {
+		reason = err.Error()
+	}
+	c.connMu.Lock()
+	c.connected = false
+	c.connMu.Unlock()
+	c.joinWindow.Close()
+	log.Warn().Str("reason", reason).Msg("deCONZ coordinator disconnected")
+	c.Publish(device.Event{
+		Type:      device.EventCoordinatorDisconnected,
+		Reason:    reason,
+		Timestamp: time.Now(),
+	})
+}
+
+// SetOnNetworkChange registers a callback invoked after a network is formed.
+func (c *Controller) SetOnNetworkChange(fn func(device.FormOptions)) { c.onNetworkChange = fn }
+
+// LoadDevices pre-populates the device map from persistent storage. Short
+// addresses are learned when devices announce themselves or send traffic.
+func (c *Controller) LoadDevices(entries []zigbee.LoadEntry) {
+	c.Update(func(devices map[string]*zigbee.KnownDevice) {
+		for _, e := range entries {
+			ep := e.Endpoint
+			if ep == 0 {
+				ep = 1
+			}
+			kd := &zigbee.KnownDevice{
+				IEEEAddress:   e.IEEEAddress,
+				FriendlyName:  e.FriendlyName,
+				DeviceType:    e.DeviceType,
+				Endpoint:      ep,
+				Clusters:      e.Clusters,
+				Sleepy:        e.Sleepy,
+				LinkKeyStatus: e.LinkKeyStatus,
+				LastSeen:      e.LastSeen,
+			}
+			kd.RestoreState(e.State, e.StateUpdatedAt)
+			devices[zigbee.FormatIEEE(e.IEEEAddress)] = kd
+		}
+	})
+}
+
+// --- Polling ---
+
+// handleDeviceState runs on the reader goroutine for every reported state.
+func (c *Controller) handleDeviceState(st uint8) {
+	if st&(deviceStateAPSConfirm|deviceStateAPSIndReady) != 0 {
+		c.requestPoll()
+	}
+}
+
+func (c *Controller) requestPoll() {
+	select {
+	case c.poll <- struct{}{}:
+	default:
+	}
+}
+
+// pollLoop fetches queued indications and confirms while the device state
+// says any are waiting.
+func (c *Controller) pollLoop() {
+	for {
+		select {
+		case <-c.poll:
+		case <-c.stopChan:
+			return
+		case <-c.layer.Down():
+			return
+		}
+		st, err := c.readDeviceState()
+		for err == nil && st&(deviceStateAPSConfirm|deviceStateAPSIndReady) != 0 {
+			var resp []byte
+			if st&deviceStateAPSIndReady != 0 {
+				resp, err = c.layer.Request(cmdAPSDataIndication, []byte{0x01, 0x00, indicationFlags})
+				if err == nil {
+					c.handleIndication(resp)
+				}
+			} else {
+				resp, err = c.layer.Request(cmdAPSDataConfirm, []byte{0x00, 0x00})
+				if err == nil {
+					c.handleConfirm(resp)
+				}
+			}
+			switch {
+			case err != nil:
+			case len(resp) > 2:
+				st = resp[2]
+			default:
+				err = fmt.Errorf("APS response too short: %d bytes", len(resp))
+			}
+		}
+		if err != nil {
+			log.Debug().Err(err).Msg("deCONZ poll failed")
+		}
+	}
+}
+
+// readAddress decodes an APS address of the given mode from b, followed by an
+// endpoint if withEndpoint. It returns the short and IEEE addresses and the
+// number of bytes consumed.
+func readAddress(b []byte, mode uint8, withEndpoint bool) (nwk uint16, ieee [8]byte, ep uint8, n int, ok bool) {
+	switch mode {
+	case addrModeGroup, addrModeNWK:
+		n = 2
+	case addrModeIEEE:
+		n = 8
+	case addrModeNWKIEEE:
+		n = 10
+	default:
+		return 0, ieee, 0, 0, false
+	}
+	if len(b) < n {
+		return 0, ieee, 0, 0, false
+	}
+	switch mode {
+	case addrModeIEEE:
+		copy(ieee[:], b[:8])
+	case addrModeNWKIEEE:
+		nwk = binary.LittleEndian.Uint16(b)
+		copy(ieee[:], b[2:10])
+	default:
+		nwk = binary.LittleEndian.Uint16(b)
+	}
+	if withEndpoint {
+		if len(b) < n+1 {
+			return 0, ieee, 0, 0, false
+		}
+		ep = b[n]
+		n++
+	}
+	return nwk, ieee, ep, n, true
+}
+
+// handleIndication processes an APS_DATA_INDICATION response.
+func (c *Controller) handleIndication(p []byte) {
+	// payloadLength(2) + deviceState(1) + dstAddrMode(1) + dstAddr + dstEndpoint(1) +
+	// srcAddrMode(1) + srcAddr + srcEndpoint(1) + profile(2) + cluster(2) +
+	// asduLength(2) + asdu + reserved(2) + lqi(1) + reserved(2) + rssi(1).
+	// Group-addressed frames carry no destination endpoint.
+	if len(p) < 4 {
+		return
+	}
+	off := 3
+	dstMode := p[off]
+	_, _, _, n, ok := readAddress(p[off+1:], dstMode, dstMode != addrModeGroup)
+	if !ok {
+		return
+	}
+	off += 1 + n
+	if len(p) < off+1 {
+		return
+	}
+	srcMode := p[off]
+	sender, srcIEEE, _, n, ok := readAddress(p[off+1:], srcMode, true)
+	if !ok {
+		return
+	}
+	off += 1 + n
+	if srcMode == addrModeNWKIEEE {
+		c.learnNodeID(srcIEEE, sender)
+	}
+	if len(p) < off+6 {
+		return
+	}
+	profile := binary.LittleEndian.Uint16(p[off:])
+	cluster := binary.LittleEndian.Uint16(p[off+2:])
+	asduLen := int(binary.LittleEndian.Uint16(p[off+4:]))
+	off += 6
+	if len(p) < off+asduLen {
+		return
+	}
+	asdu := p[off : off+asduLen]
+	off += asduLen
+	var lqi uint8
+	if len(p) >= off+3 {
+		lqi = p[off+2]
+	}
+
+	log.Debug().
+		Uint16("profile", profile).
+		Uint16("cluster", cluster).
+		Uint16("sender", sender).
+		Uint8("lqi", lqi).
+		Hex("asdu", asdu).
+		Msg("Incoming message")
+
+	c.MarkSeen(sender, lqi)
+	if profile == zdoProfileID {
+		c.handleZDO(sender, cluster, asdu)
+		return
+	}
+	hdr, payload, ok := zigbee.ParseZCLHeader(asdu)
+	if !ok || hdr.FrameControl&0x03 != 0x00 {
+		return
+	}
+	switch hdr.CommandID {
+	case zclGlobalDefaultResponse:
+		if _, status, ok := zigbee.ParseDefaultResponse(payload); ok {
+			c.deliver(c.zclWaiters, zclWaitKey{nodeID: sender, seq: hdr.SeqNumber}, status)
+		}
+	case zclGlobalReadAttributesResponse:
+		c.UpdateState(sender, cluster, zigbee.ParseReadAttributesResponse(payload))
+	case zclGlobalReportAttributes:
+		c.UpdateState(sender, cluster, zigbee.ParseReportAttributes(payload))
+	}
+}
+
+// handleConfirm processes an APS_DATA_CONFIRM response.
+func (c *Controller) handleConfirm(p []byte) {
+	// payloadLength(2) + deviceState(1) + requestId(1) + dstAddrMode(1) +
+	// dstAddr [+ dstEndpoint] + srcEndpoint(1) + status(1) + reserved(4)
+	if len(p) < 5 {
+		return
+	}
+	reqID := p[3]
+	mode := p[4]
+	_, _, _, n, ok := readAddress(p[5:], mode, mode != addrModeGroup)
+	if !ok || len(p) < 5+n+2 {
+		return
+	}
+	status := p[5+n+1]
+	c.sentMu.Lock()
+	ch := c.confirmWaiters[reqID]
+	c.sentMu.Unlock()
+	if ch != nil {
+		select {
+		case ch <- uint32(status):
+		default:
+		}
+	}
+}
+
+// deliver hands a ZCL Default Response status to its waiter.
+func (c *Controller) deliver(waiters map[zclWaitKey]chan uint8, key zclWaitKey, status uint8) {
+	c.sentMu.Lock()
+	ch, ok := waiters[key]
+	c.sentMu.Unlock()
+	if ok {
+		select {
+		case ch <- status:
+		default:
+		}
+	}
+}
+
+// handleZDO processes ZDO responses and Device_annce.
+func (c *Controller) handleZDO(sender, cluster uint16, asdu []byte) {
+	if len(asdu) < 1 {
+		return
+	}
+	if cluster == zdoClusterDeviceAnnce {
+		c.handleDeviceAnnce(asdu)
+		return
+	}
+	if cluster&zdoClusterResponseFlag == 0 {
+		return
+	}
+	c.sentMu.Lock()
+	ch, ok := c.zdoWaiters[zdoWaitKey{nodeID: sender, cluster: cluster, seq: asdu[0]}]
+	c.sentMu.Unlock()
+	if ok {
+		select {
+		case ch <- asdu[1:]:
+		default:
+		}
+	}
+}
+
+// handleDeviceAnnce admits a new device or refreshes a known one. deCONZ has
+// no Trust Center join callback, so Device_annce is the join signal.
+func (c *Controller) handleDeviceAnnce(asdu []byte) {
+	// seq(1) + NWKAddr(2) + IEEEAddr(8) + capability(1)
+	if len(asdu) < 12 {
+		return
+	}
+	nodeID := binary.LittleEndian.Uint16(asdu[1:3])
+	var ieee [8]byte
+	copy(ieee[:], asdu[3:11])
+	sleepy := asdu[11]&0x08 == 0
+	ieeeStr := zigbee.FormatIEEE(ieee)
+
+	var (
+		kd                  *zigbee.KnownDevice
+		found, wasAvailable bool
+		dev                 device.Device
+	)
+	c.Update(func(devices map[string]*zigbee.KnownDevice) {
+		kd, found = devices[ieeeStr]
+		wasAvailable = found && kd.Available
+		if found {
+			kd.NodeID = nodeID
+			kd.Sleepy = sleepy
+		} else {
+			kd = &zigbee.KnownDevice{
+				IEEEAddress:  ieee,
+				FriendlyName: ieeeStr,
+				DeviceType:   device.DeviceTypeLight,
+				Endpoint:     1,
+				NodeID:       nodeID,
+				Sleepy:       sleepy,
+				State:        make(device.DeviceState),
+			}
+			devices[ieeeStr] = kd
+		}
+		kd.Available = true
+		kd.LastSeen = time.Now()
+		dev = zigbee.ToDevice(ieeeStr, kd)
+	})
+
+	log.Info().Str("ieee", ieeeStr).Uint16("nodeID", nodeID).Bool("new", !found).Msg("Device_annce received")
+	if found {
+		if !wasAvailable {
+			c.PublishAvailability(ieeeStr, kd, true)
+		}
+		return
+	}
+	c.Publish(device.Event{Type: device.EventDeviceJoined, Device: &dev, Timestamp: time.Now()})
+	c.NotifyDeviceChange()
+	go c.interview(kd)
+}
+
+// learnNodeID records the short address of a known device, which changes
+// after a rejoin and is unknown for devices loaded from config.
+func (c *Controller) learnNodeID(ieee [8]byte, nodeID uint16) {
+	c.Update(func(devices map[string]*zigbee.KnownDevice) {
+		if kd, ok := devices[zigbee.FormatIEEE(ieee)]; ok {
+			kd.NodeID = nodeID
+		}
+	})
+}
+
+// --- Sending ---
+
+// sendAPS queues an APS_DATA_REQUEST. If confirm is non-nil it receives the
+// APS confirm status; it is registered before the request is written, since
+// the confirm can be polled before Request returns. The returned request ID
+// must be passed to releaseAPS.
+func (c *Controller) sendAPS(nodeID uint16, dstEP uint8, profile, cluster uint16, srcEP uint8, asdu []byte, confirm chan uint32) (uint8, error) {
+	c.sentMu.Lock()
+	for {
+		c.nextReqID++
+		if _, busy := c.confirmWaiters[c.nextReqID]; !busy {
+			break
+		}
+	}
+	reqID := c.nextReqID
+	c.confirmWaiters[reqID] = confirm
+	c.sentMu.Unlock()
+
+	// requestId + flags + dstAddrMode + dstAddr(2) + dstEndpoint + profile(2) +
+	// cluster(2) + srcEndpoint + asduLength(2) + asdu + txOptions + radius
+	body := []byte{reqID, 0x00, addrModeNWK, byte(nodeID), byte(nodeID >> 8), dstEP}
+	body = binary.LittleEndian.AppendUint16(body, profile)
+	body = binary.LittleEndian.AppendUint16(body, cluster)
+	body = append(body, srcEP)
+	body = binary.LittleEndian.AppendUint16(body, uint16(len(asdu)))
+	body = append(body, asdu...)
+	txOptions := uint8(txOptionsAck)
+	if nodeID >= broadcastAddrMin {
+		txOptions = 0
+	}
+	body = append(body, txOptions, 0x00)
+
+	req := binary.LittleEndian.AppendUint16(nil, uint16(len(body)))
+	if _, err := c.layer.Request(cmdAPSDataRequest, append(req, body...)); err != nil {
+		c.releaseAPS(reqID)
+		return 0, err
+	}
+	return reqID, nil
+}
+
+// releaseAPS frees a request ID allocated by sendAPS.
+func (c *Controller) releaseAPS(reqID uint8) {
+	c.sentMu.Lock()
+	delete(c.confirmWaiters, reqID)
+	c.sentMu.Unlock()
+}
+
+// SendZCL sends a ZCL frame and waits for the APS confirm, handling a
+// Default Response as zigbee.AwaitDelivery does.
+func (c *Controller) SendZCL(ctx context.Context, kd *zigbee.KnownDevice, clusterID uint16, frame []byte, expectDefaultResponse bool) error {
+	hdr, _, ok := zigbee.ParseZCLHeader(frame)
+	if !ok {
+		return fmt.Errorf("ZCL frame too short: %d bytes", len(frame))
+	}
+	var nodeID uint16
+	var endpoint uint8
+	c.View(func(map[string]*zigbee.KnownDevice) { nodeID, endpoint = kd.NodeID, kd.Endpoint })
+
+	key := zclWaitKey{nodeID: nodeID, seq: hdr.SeqNumber}
+	var defaultResp chan uint8
+	if expectDefaultResponse {
+		defaultResp = make(chan uint8, 1)
+		c.sentMu.Lock()
+		c.zclWaiters[key] = defaultResp
+		c.sentMu.Unlock()
+	}
+	confirm := make(chan uint32, 1)
+	reqID, err := c.sendAPS(nodeID, endpoint, zclProfileHA, clusterID, coordinatorEndpoint, frame, confirm)
+	release := func() {
+		c.sentMu.Lock()
+		if defaultResp != nil && c.zclWaiters[key] == defaultResp {
+			delete(c.zclWaiters, key)
+		}
+		c.sentMu.Unlock()
+		if err == nil {
+			c.releaseAPS(reqID)
+		}
+	}
+	if err != nil {
+		release()
+		return fmt.Errorf("%w: %v", device.ErrDeliveryFailed, err)
+	}
+	return zigbee.AwaitDelivery(ctx, nodeID, clusterID, confirm, defaultResp, c.layer.Down(), c.stopChan, release)
+}
+
+// zdoRequest sends a ZDO request to nodeID and waits for its response. The
+// returned payload starts with the status byte.
+func (c *Controller) zdoRequest(ctx context.Context, nodeID, cluster uint16, payload []byte) ([]byte, error) {
+	seq := uint8(zdoSeq.Add(1))
+	key := zdoWaitKey{nodeID: nodeID, cluster: cluster | zdoClusterResponseFlag, seq: seq}
+	ch := make(chan []byte, 1)
+	c.sentMu.Lock()
+	c.zdoWaiters[key] = ch
+	c.sentMu.Unlock()
+	defer func() {
+		c.sentMu.Lock()
+		delete(c.zdoWaiters, key)
+		c.sentMu.Unlock()
+	}()
+
+	reqID, err := c.sendAPS(nodeID, 0, zdoProfileID, cluster, 0, append([]byte{seq}, payload...), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer c.releaseAPS(reqID)
+	select {
+	case resp := <-ch:
+		if len(resp) < 1 {
+			return nil, fmt.Errorf("ZDO response 0x%04X too short", cluster|zdoClusterResponseFlag)
+		}
+		return resp, nil
+	case <-time.After(zdoResponseTimeout):
+		return nil, fmt.Errorf("%w: no ZDO response 0x%04X from node 0x%04X", device.ErrTimeout, cluster|zdoClusterResponseFlag, nodeID)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-c.layer.Down():
+		return nil, device.ErrNotConnected
+	}
+}
+
+// interview reads a new device's active endpoints and simple descriptors.
+func (c *Controller) interview(kd *zigbee.KnownDevice) {
+	ctx := context.Background()
+	var nodeID uint16
+	c.View(func(map[string]*zigbee.KnownDevice) { nodeID = kd.NodeID })
+	ieee := zigbee.FormatIEEE(kd.IEEEAddress)
+	c.PublishInterview(ieee, device.InterviewStarted, nil)
+
+	nwk := []byte{byte(nodeID), byte(nodeID >> 8)}
+	// Active_EP_rsp: status + nwkAddr(2) + count + endpoints
+	resp, err := c.zdoRequest(ctx, nodeID, zdoClusterActiveEPReq, nwk)
+	if err != nil || resp[0] != 0x00 || len(resp) < 4 || len(resp) < 4+int(resp[3]) {
+		log.Warn().Err(err).Str("device", ieee).Msg("Active endpoints request failed")
+		if err == nil {
+			err = fmt.Errorf("invalid Active_EP_rsp")
+		}
+		c.PublishInterview(ieee, device.InterviewFailed, err)
+		return
+	}
+	var clusters []uint16
+	var endpoint uint8
+	for _, ep := range resp[4 : 4+int(resp[3])] {
+		if ep == 0 || ep == 242 { // ZDO and Green Power
+			continue
+		}
+		// Simple_Desc_rsp: status + nwkAddr(2) + length + endpoint + profile(2) +
+		// deviceID(2) + version + inCount + in(2n) + ...
+		desc, err := c.zdoRequest(ctx, nodeID, zdoClusterSimpleDescReq, append(nwk, ep))
+		if err != nil || desc[0] != 0x00 || len(desc) < 11 {
+			log.Warn().Err(err).Str("device", ieee).Uint8("endpoint", ep).Msg("Simple descriptor request failed")
+			continue
+		}
+		if endpoint == 0 {
+			endpoint = ep
+		}
+		for i := range int(desc[10]) {
+			off := 11 + 2*i
+			if off+2 > len(desc) {
+				break
+			}
+			if cl := binary.LittleEndian.Uint16(desc[off:]); !slices.Contains(clusters, cl) {
+				clusters = append(clusters, cl)
+			}
+		}
+	}
+	if endpoint == 0 {
+		c.PublishInterview(ieee, device.InterviewFailed, fmt.Errorf("no application endpoint"))
+		return
+	}
+
+	c.Update(func(map[string]*zigbee.KnownDevice) {
+		kd.Endpoint = endpoint
+		kd.Clusters = clusters
+		kd.DeviceType = zigbee.DeviceTypeFromClusters(clusters)
+	})
+	c.NotifyDeviceChange()
+	c.PublishInterview(ieee, device.InterviewEndpoints, nil)
+	log.Info().Str("device", ieee).Int("clusters", len(clusters)).Msg("Device interview complete")
+	c.PublishInterview(ieee, device.InterviewCompleted, nil)
+}
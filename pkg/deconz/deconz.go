@@ -0,0 +1,183 @@
+package deconz
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/urmzd/zigbee-skill/pkg/device"
+	"github.com/urmzd/zigbee-skill/pkg/zigbee"
+)
+
+// requestTimeout bounds the wait for a command response.
+const requestTimeout = 5 * time.Second
+
+// pendingRequest is a command awaiting its response.
+type pendingRequest struct {
+	cmd uint8
+	ch  chan frame
+}
+
+// Layer exchanges deCONZ frames with the adapter. Responses are matched to
+// requests by sequence number; unsolicited frames go to listeners, and every
+// device state the firmware reports is passed to the state hook.
+type Layer struct {
+	t       zigbee.Transport
+	writeMu sync.Mutex
+
+	seq       uint8
+	pending   map[uint8]pendingRequest
+	pendingMu sync.Mutex
+
+	listeners  map[uint8]func(frame)
+	listenerMu sync.RWMutex
+
+	onState func(uint8)
+
+	down     chan struct{}
+	downOnce sync.Once
+	err      error
+	stopChan chan struct{}
+}
+
+// NewLayer creates a deCONZ layer over t. Call Start to begin reading.
+func NewLayer(t zigbee.Transport) *Layer {
+	return &Layer{
+		t:         t,
+		pending:   make(map[uint8]pendingRequest),
+		listeners: make(map[uint8]func(frame)),
+		down:      make(chan struct{}),
+		stopChan:  make(chan struct{}),
+	}
+}
+
+// Start begins reading frames from the transport.
+func (l *Layer) Start() { go l.readLoop() }
+
+// Down is closed when the transport fails.
+func (l *Layer) Down() <-chan struct{} { return l.down }
+
+// Err returns the error that took the link down, once Down is closed.
+func (l *Layer) Err() error {
+	select {
+	case <-l.down:
+		return l.err
+	default:
+		return nil
+	}
+}
+
+// Close stops the layer. The transport is closed by its owner.
+func (l *Layer) Close() {
+	select {
+	case <-l.stopChan:
+	default:
+		close(l.stopChan)
+	}
+}
+
+// OnDeviceState registers fn to receive every reported device state. It runs
+// on the reader goroutine and must not block. Set it before Start.
+func (l *Layer) OnDeviceState(fn func(state uint8)) { l.onState = fn }
+
+// Listen registers fn for unsolicited frames with the given command. Set
+// listeners before Start.
+func (l *Layer) Listen(cmd uint8, fn func(frame)) {
+	l.listenerMu.Lock()
+	l.listeners[cmd] = fn
+	l.listenerMu.Unlock()
+}
+
+func (l *Layer) linkLost(err error) {
+	l.downOnce.Do(func() {
+		l.err = err
+		close(l.down)
+	})
+}
+
+func (l *Layer) readLoop() {
+	for {
+		f, err := readFrame(l.t)
+		if err != nil {
+			select {
+			case <-l.stopChan:
+			default:
+				log.Warn().Err(err).Msg("deCONZ serial read failed")
+			}
+			l.linkLost(err)
+			return
+		}
+		l.processFrame(f)
+	}
+}
+
+func (l *Layer) processFrame(f frame) {
+	if st, ok := deviceState(f); ok && l.onState != nil {
+		l.onState(st)
+	}
+
+	l.pendingMu.Lock()
+	p, ok := l.pending[f.seq]
+	if ok && p.cmd == f.cmd {
+		delete(l.pending, f.seq)
+	}
+	l.pendingMu.Unlock()
+	if ok && p.cmd == f.cmd {
+		p.ch <- f
+		return
+	}
+
+	l.listenerMu.RLock()
+	fn := l.listeners[f.cmd]
+	l.listenerMu.RUnlock()
+	if fn != nil {
+		fn(f)
+		return
+	}
+	log.Debug().Stringer("frame", f).Msg("deCONZ unhandled frame")
+}
+
+// Request sends a command and returns its response payload. A non-success
+// status is returned as an error.
+func (l *Layer) Request(cmd uint8, payload []byte) ([]byte, error) {
+	ch := make(chan frame, 1)
+	l.pendingMu.Lock()
+	for {
+		l.seq++
+		if _, busy := l.pending[l.seq]; !busy {
+			break
+		}
+	}
+	seq := l.seq
+	l.pending[seq] = pendingRequest{cmd: cmd, ch: ch}
+	l.pendingMu.Unlock()
+	defer func() {
+		l.pendingMu.Lock()
+		delete(l.pending, seq)
+		l.pendingMu.Unlock()
+	}()
+
+	b := frame{cmd: cmd, seq: seq, payload: payload}.encode()
+	l.writeMu.Lock()
+	_, err := l.t.Write(b)
+	l.writeMu.Unlock()
+	if err != nil {
+		l.linkLost(err)
+		return nil, fmt.Errorf("%w: write deCONZ frame: %v", device.ErrNotConnected, err)
+	}
+
+	select {
+	case f := <-ch:
+		if f.status != statusSuccess {
+			return f.payload, fmt.Errorf("deCONZ command 0x%02X failed: status %d", cmd, f.status)
+		}
+		return f.payload, nil
+	case <-l.down:
+		return nil, fmt.Errorf("%w: link lost waiting for deCONZ command 0x%02X", device.ErrNotConnected, cmd)
+	case <-time.After(requestTimeout):
+		return nil, fmt.Errorf("%w: no response to deCONZ command 0x%02X", device.ErrTimeout, cmd)
+	case <-l.stopChan:
+		return nil, fmt.Errorf("stopped")
+	}
+}
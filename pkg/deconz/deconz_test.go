@@ -0,0 +1,402 @@
+package deconz
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"math/bits"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/urmzd/zigbee-skill/pkg/device"
+	"github.com/urmzd/zigbee-skill/pkg/zigbee"
+)
+
+// pipeTransport is the host side of an in-memory serial link.
+type pipeTransport struct {
+	r *bufio.Reader
+	w io.WriteCloser
+	c io.Closer
+}
+
+func (p *pipeTransport) Write(b []byte) (int, error) { return p.w.Write(b) }
+func (p *pipeTransport) ReadByte() (byte, error)     { return p.r.ReadByte() }
+func (p *pipeTransport) Close() error {
+	_ = p.w.Close()
+	return p.c.Close()
+}
+
+// emulator is a minimal deCONZ firmware: it keeps network parameters, queues
+// APS confirms and indications behind the device state flags, and answers
+// ZDO and ZCL requests for one on/off light.
+type emulator struct {
+	mu         sync.Mutex
+	params     map[uint8][]byte
+	netState   uint8
+	formations int
+	confirms   [][]byte
+	inds       [][]byte
+
+	lightOn     bool
+	lightNodeID uint16
+	lightIEEE   [8]byte
+
+	w io.Writer
+}
+
+func newEmulator() *emulator {
+	return &emulator{
+		params: map[uint8][]byte{
+			paramMACAddress:             {0x11, 0x22, 0x33, 0x44, 0x55, 0x66, 0x77, 0x88},
+			paramAPSDesignedCoordinator: {0x00},
+			paramNwkPanID:               {0xFF, 0xFF},
+			paramProtocolVersion:        {0x0B, 0x01},
+		},
+		lightNodeID: 0x4A21,
+		lightIEEE:   [8]byte{0x08, 0x07, 0x06, 0x05, 0x04, 0x03, 0x02, 0x01},
+	}
+}
+
+// connect starts the emulator on a fresh link and returns the host side.
+func (e *emulator) connect() *pipeTransport {
+	hostR, fwW := io.Pipe()
+	fwR, hostW := io.Pipe()
+	e.mu.Lock()
+	e.w = fwW
+	e.mu.Unlock()
+	go e.serve(bufio.NewReader(fwR))
+	return &pipeTransport{r: bufio.NewReader(hostR), w: hostW, c: hostR}
+}
+
+func (e *emulator) serve(r io.ByteReader) {
+	for {
+		f, err := readFrame(r)
+		if err != nil {
+			return
+		}
+		e.handle(f)
+	}
+}
+
+func (e *emulator) state() uint8 {
+	st := e.netState | deviceStateAPSFreeSlots
+	if len(e.confirms) > 0 {
+		st |= deviceStateAPSConfirm
+	}
+	if len(e.inds) > 0 {
+		st |= deviceStateAPSIndReady
+	}
+	return st
+}
+
+func (e *emulator) reply(f frame, status uint8, payload ...byte) {
+	_, _ = e.w.Write(frame{cmd: f.cmd, seq: f.seq, status: status, payload: payload}.encode())
+}
+
+// withLength prefixes body with its little-endian length.
+func withLength(body ...byte) []byte {
+	return append(binary.LittleEndian.AppendUint16(nil, uint16(len(body))), body...)
+}
+
+func (e *emulator) handle(f frame) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	p := f.payload
+	switch f.cmd {
+	case cmdVersion:
+		e.reply(f, statusSuccess, 0x00, 0x07, 0x72, 0x26)
+	case cmdDeviceState:
+		e.reply(f, statusSuccess, e.state(), 0, 0)
+	case cmdChangeNetworkState:
+		e.netState = p[0]
+		e.reply(f, statusSuccess, p[0])
+	case cmdReadParameter:
+		v, ok := e.params[p[2]]
+		if !ok {
+			e.reply(f, statusUnsupported, p[:3]...)
+			return
+		}
+		e.reply(f, statusSuccess, withLength(append([]byte{p[2]}, v...)...)...)
+	case cmdWriteParameter:
+		id, v := p[2], append([]byte(nil), p[3:]...)
+		e.params[id] = v
+		switch id {
+		case paramNwkPanID:
+			e.formations++
+		case paramChannelMask:
+			e.params[paramCurrentChannel] = []byte{byte(bits.TrailingZeros32(binary.LittleEndian.Uint32(v)))}
+		case paramAPSExtendedPanID:
+			e.params[paramNwkExtendedPanID] = v
+		}
+		e.reply(f, statusSuccess, withLength(id)...)
+	case cmdAPSDataRequest:
+		e.apsRequest(f)
+	case cmdAPSDataConfirm:
+		c := e.confirms[0]
+		e.confirms = e.confirms[1:]
+		e.reply(f, statusSuccess, withLength(append([]byte{e.state()}, c...)...)...)
+	case cmdAPSDataIndication:
+		ind := e.inds[0]
+		e.inds = e.inds[1:]
+		e.reply(f, statusSuccess, withLength(append([]byte{e.state()}, ind...)...)...)
+	default:
+		e.reply(f, statusSuccess)
+	}
+}
+
+// apsRequest queues the confirm for an APS_DATA_REQUEST and any response.
+func (e *emulator) apsRequest(f frame) {
+	p := f.payload
+	reqID, dst := p[2], binary.LittleEndian.Uint16(p[5:7])
+	profile, cluster := binary.LittleEndian.Uint16(p[8:10]), binary.LittleEndian.Uint16(p[10:12])
+	asdu := p[15 : 15+int(binary.LittleEndian.Uint16(p[13:15]))]
+
+	// deviceState is prepended when the confirm is fetched.
+	e.confirms = append(e.confirms, []byte{reqID, addrModeNWK, byte(dst), byte(dst >> 8), 1, 1, 0x00, 0, 0, 0, 0})
+	if profile == zdoProfileID {
+		e.zdo(cluster, asdu)
+	} else if dst == e.lightNodeID {
+		e.zcl(cluster, asdu)
+	}
+	e.reply(f, statusSuccess, withLength(e.state(), reqID)...)
+	_, _ = e.w.Write(frame{cmd: cmdDeviceStateChanged, payload: []byte{e.state()}}.encode())
+}
+
+// indicate queues an indication from the light to the coordinator.
+func (e *emulator) indicate(profile, cluster uint16, asdu []byte) {
+	e.indicateTo([]byte{addrModeNWK, 0x00, 0x00, 1}, profile, cluster, asdu)
+}
+
+// indicateTo queues an indication from the light to dst: address mode,
+// address and, except for groups, endpoint.
+func (e *emulator) indicateTo(dst []byte, profile, cluster uint16, asdu []byte) {
+	ind := append([]byte(nil), dst...)
+	ind = append(ind, addrModeNWKIEEE, byte(e.lightNodeID), byte(e.lightNodeID>>8))
+	ind = append(ind, e.lightIEEE[:]...)
+	ind = append(ind, 1, byte(profile), byte(profile>>8), byte(cluster), byte(cluster>>8))
+	ind = binary.LittleEndian.AppendUint16(ind, uint16(len(asdu)))
+	ind = append(ind, asdu...)
+	e.inds = append(e.inds, append(ind, 0, 0, 200, 0, 0, 0xC4))
+}
+
+func (e *emulator) zdo(cluster uint16, asdu []byte) {
+	seq, nwk := asdu[0], []byte{byte(e.lightNodeID), byte(e.lightNodeID >> 8)}
+	switch cluster {
+	case zdoClusterMgmtPermitJoin:
+		if asdu[1] > 0 {
+			annce := append([]byte{0x00}, nwk...)
+			annce = append(annce, e.lightIEEE[:]...)
+			e.indicate(zdoProfileID, zdoClusterDeviceAnnce, append(annce, 0x8E))
+		}
+	case zdoClusterActiveEPReq:
+		e.indicate(zdoProfileID, cluster|zdoClusterResponseFlag, []byte{seq, 0x00, nwk[0], nwk[1], 1, 1})
+	case zdoClusterSimpleDescReq:
+		desc := []byte{asdu[3], 0x04, 0x01, 0x00, 0x01, 0x01, 2, 0x06, 0x00, 0x08, 0x00, 0}
+		rsp := append([]byte{seq, 0x00, nwk[0], nwk[1], byte(len(desc))}, desc...)
+		e.indicate(zdoProfileID, cluster|zdoClusterResponseFlag, rsp)
+	}
+}
+
+// zcl answers a ZCL frame sent to the light.
+func (e *emulator) zcl(cluster uint16, frame []byte) {
+	seq, cmd := frame[1], frame[2]
+	switch {
+	case cluster == zclClusterOnOff && frame[0]&0x03 == 0x01:
+		e.lightOn = cmd == zclCmdOn || (cmd == zclCmdToggle && !e.lightOn)
+		e.indicate(zclProfileHA, cluster, []byte{0x18, seq, zclGlobalDefaultResponse, cmd, 0x00})
+	case cluster == zclClusterOnOff && cmd == 0x00: // Read Attributes
+		on := byte(0)
+		if e.lightOn {
+			on = 1
+		}
+		e.indicate(zclProfileHA, cluster, []byte{0x18, seq, zclGlobalReadAttributesResponse, 0x00, 0x00, 0x00, 0x10, on})
+	}
+}
+
+func TestFrameRoundTrip(t *testing.T) {
+	// The payload contains both SLIP special bytes, which must be escaped.
+	want := frame{cmd: cmdReadParameter, seq: 0xC0, status: statusSuccess, payload: []byte{0x02, 0x00, slipEnd, slipEsc}}
+	good := want.encode()
+	bad := append([]byte(nil), good...)
+	bad[len(bad)-2] ^= 0xFF
+
+	// Line noise and a frame with a bad CRC precede the valid frame.
+	var stream []byte
+	stream = append(stream, 0x42, slipEnd)
+	stream = append(stream, bad...)
+	stream = append(stream, good...)
+
+	f, err := readFrame(bytes.NewReader(stream))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.cmd != want.cmd || f.seq != want.seq || !bytes.Equal(f.payload, want.payload) {
+		t.Errorf("decoded %v payload %x", f, f.payload)
+	}
+}
+
+func TestDeCONZFormsNetwork(t *testing.T) {
+	e := newEmulator()
+	c, err := newController(e.connect(), Options{Form: device.FormOptions{Channel: 15, PanID: "0x1a62"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	e.mu.Lock()
+	formations := e.formations
+	coord := e.params[paramAPSDesignedCoordinator]
+	e.mu.Unlock()
+	if formations != 1 || !bytes.Equal(coord, []byte{0x01}) {
+		t.Fatalf("formations = %d, designed coordinator = %x", formations, coord)
+	}
+	info, err := c.NetworkInfo(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Channel != 15 || info.PanID != "0x1a62" || info.CoordinatorIEEE != "88:77:66:55:44:33:22:11" {
+		t.Errorf("network info = %+v", info)
+	}
+	if info.Adapter.Protocol != "deconz" || info.Adapter.StackVersion != "38.114 (ConBee II/RaspBee II)" {
+		t.Errorf("adapter info = %+v", info.Adapter)
+	}
+}
+
+func TestDeCONZResetNetwork(t *testing.T) {
+	e := newEmulator()
+	c, err := newController(e.connect(), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.ResetNetwork(); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	// The next start forms a new network instead of resuming the old one.
+	c, err = newController(e.connect(), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.formations != 2 {
+		t.Errorf("formations = %d, want 2", e.formations)
+	}
+}
+
+func TestDeCONZJoinAndControl(t *testing.T) {
+	e := newEmulator()
+	c, err := newController(e.connect(), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	events := c.Subscribe(device.EventFilter{})
+	ctx := context.Background()
+	if err := c.PermitJoin(ctx, true, 60); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case evt := <-events:
+		if evt.Type != "device_joined" || evt.Device.ID != "01:02:03:04:05:06:07:08" {
+			t.Fatalf("event = %+v", evt)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no device_joined event")
+	}
+
+	// The interview learns On/Off and Level Control from the simple descriptor.
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		dev, err := c.GetDevice(ctx, "01:02:03:04:05:06:07:08")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dev.Type == device.DeviceTypeLight && len(c.ExportDevices()[0].Clusters) == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("interview incomplete: %+v", c.ExportDevices())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if _, err := c.SetDeviceState(ctx, "01:02:03:04:05:06:07:08", map[string]any{"state": "ON"}); err != nil {
+		t.Fatal(err)
+	}
+	e.mu.Lock()
+	on := e.lightOn
+	e.mu.Unlock()
+	if !on {
+		t.Error("light not switched on")
+	}
+	state, err := c.GetDeviceState(device.WithNoCache(ctx), "01:02:03:04:05:06:07:08")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state["state"] != "ON" {
+		t.Errorf("state = %v", state)
+	}
+}
+
+func TestDeCONZGroupIndication(t *testing.T) {
+	e := newEmulator()
+	c, err := newController(e.connect(), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.LoadDevices([]zigbee.LoadEntry{{IEEEAddress: e.lightIEEE, DeviceType: device.DeviceTypeLight, Clusters: []uint16{zclClusterOnOff}}})
+
+	// The light reports its on/off state to group 0x0001; the frame has no
+	// destination endpoint.
+	e.mu.Lock()
+	e.indicateTo([]byte{addrModeGroup, 0x01, 0x00}, zclProfileHA, zclClusterOnOff,
+		[]byte{0x18, 0x01, zclGlobalReadAttributesResponse, 0x00, 0x00, 0x00, 0x10, 0x01})
+	_, _ = e.w.Write(frame{cmd: cmdDeviceStateChanged, payload: []byte{e.state()}}.encode())
+	e.mu.Unlock()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if d := c.ExportDevices(); len(d) == 1 && d[0].State["state"] == "ON" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("group-addressed report not applied: %+v", c.ExportDevices())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDeCONZReportAttributes(t *testing.T) {
+	e := newEmulator()
+	c, err := newController(e.connect(), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.LoadDevices([]zigbee.LoadEntry{{IEEEAddress: e.lightIEEE, DeviceType: device.DeviceTypeLight, Clusters: []uint16{zclClusterOnOff}}})
+	events := c.Subscribe(device.EventFilter{Types: []string{device.EventStateChanged}})
+
+	// Report records carry no status byte: attribute, type, value.
+	e.mu.Lock()
+	e.indicate(zclProfileHA, zclClusterOnOff,
+		[]byte{0x18, 0x02, zclGlobalReportAttributes, 0x00, 0x00, 0x10, 0x01})
+	_, _ = e.w.Write(frame{cmd: cmdDeviceStateChanged, payload: []byte{e.state()}}.encode())
+	e.mu.Unlock()
+
+	select {
+	case evt := <-events:
+		if evt.State["state"] != "ON" {
+			t.Errorf("state_changed = %+v", evt)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("report not applied: %+v", c.ExportDevices())
+	}
+}
@@ -0,0 +1,126 @@
+package deconz
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/rs/zerolog/log"
+	"github.com/urmzd/zigbee-skill/pkg/device"
+	"github.com/urmzd/zigbee-skill/pkg/zigbee"
+)
+
+// --- device.Controller interface ---
+
+// SendLeave asks a device to leave with Mgmt_Leave_req.
+func (c *Controller) SendLeave(kd *zigbee.KnownDevice) error {
+	var nodeID uint16
+	c.View(func(map[string]*zigbee.KnownDevice) { nodeID = kd.NodeID })
+	if nodeID == 0 {
+		return fmt.Errorf("%w: short address unknown", device.ErrNotFound)
+	}
+	// seq + deviceAddr(8) + removeChildren/rejoin flags
+	req := append([]byte{uint8(zdoSeq.Add(1))}, kd.IEEEAddress[:]...)
+	req = append(req, 0x00)
+	reqID, err := c.sendAPS(nodeID, 0, zdoProfileID, zdoClusterMgmtLeaveReq, 0, req, nil)
+	if err != nil {
+		return err
+	}
+	c.releaseAPS(reqID)
+	return nil
+}
+
+// PermitJoin opens joining on the adapter and every router: the adapter's
+// permit-join parameter is written and Mgmt_Permit_Joining_req is broadcast,
+// both re-issued in 254s chunks.
+func (c *Controller) PermitJoin(_ context.Context, enable bool, duration int) error {
+	if !c.IsConnected() {
+		return device.ErrNotConnected
+	}
+	if !enable {
+		c.joinWindow.Close()
+		return c.permitJoin(0)
+	}
+	return c.joinWindow.Open(duration, c.permitJoin, c.stopChan)
+}
+
+func (c *Controller) permitJoin(duration uint8) error {
+	if err := c.writeParam(paramPermitJoin, []byte{duration}); err != nil {
+		return fmt.Errorf("permit join: %w", err)
+	}
+	// seq + duration + tcSignificance
+	req := []byte{uint8(zdoSeq.Add(1)), duration, 0x00}
+	reqID, err := c.sendAPS(zdoBroadcastRouters, 0, zdoProfileID, zdoClusterMgmtPermitJoin, 0, req, nil)
+	if err != nil {
+		return fmt.Errorf("permit join broadcast: %w", err)
+	}
+	c.releaseAPS(reqID)
+	log.Info().Uint8("duration", duration).Msg("Permit joining set")
+	return nil
+}
+
+func (c *Controller) IsConnected() bool {
+	c.connMu.RLock()
+	defer c.connMu.RUnlock()
+	return c.connected
+}
+
+func (c *Controller) Close() {
+	c.connMu.Lock()
+	c.connected = false
+	select {
+	case <-c.stopChan:
+	default:
+		close(c.stopChan)
+	}
+	c.connMu.Unlock()
+
+	c.layer.Close()
+	if err := c.port.Close(); err != nil {
+		log.Warn().Err(err).Msg("Failed to close serial port")
+	}
+	log.Info().Msg("deCONZ controller closed")
+}
+
+// NetworkInfo returns the running network's parameters and firmware version.
+func (c *Controller) NetworkInfo(_ context.Context) (*device.NetworkInfo, error) {
+	if !c.IsConnected() {
+		return nil, device.ErrNotConnected
+	}
+	channel, panID, ext, err := c.networkParams()
+	if err != nil {
+		return nil, err
+	}
+	info := &device.NetworkInfo{
+		NetworkUp:       true,
+		Channel:         int(channel),
+		PanID:           fmt.Sprintf("0x%04x", panID),
+		ExtendedPanID:   zigbee.FormatIEEE(ext),
+		NodeType:        device.NodeTypeCoordinator,
+		CoordinatorIEEE: c.coordIEEE,
+		Adapter:         device.AdapterInfo{Protocol: "deconz"},
+	}
+	// VERSION: version(4), major.minor in the top two bytes, platform in byte 1
+	if v, err := c.layer.Request(cmdVersion, []byte{0, 0, 0, 0}); err == nil && len(v) >= 4 {
+		info.Adapter.FirmwareBuild = int(binary.LittleEndian.Uint32(v))
+		info.Adapter.StackVersion = fmt.Sprintf("%d.%d (%s)", v[3], v[2], platformName(v[1]))
+	}
+	if pv, err := c.readParam(paramProtocolVersion); err == nil && len(pv) >= 2 {
+		info.Adapter.ProtocolVersion = int(binary.LittleEndian.Uint16(pv))
+	}
+	return info, nil
+}
+
+// platformName names the board from the VERSION platform byte.
+func platformName(p uint8) string {
+	switch p {
+	case 0x05:
+		return "ConBee/RaspBee"
+	case 0x07:
+		return "ConBee II/RaspBee II"
+	case 0x09:
+		return "ConBee III"
+	default:
+		return fmt.Sprintf("platform 0x%02X", p)
+	}
+}
@@ -0,0 +1,172 @@
+// Package deconz drives dresden elektronik ConBee and RaspBee adapters over
+// the SLIP-framed deCONZ serial protocol.
+package deconz
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// SLIP (RFC 1055) framing bytes.
+const (
+	slipEnd    = 0xC0
+	slipEsc    = 0xDB
+	slipEscEnd = 0xDC
+	slipEscEsc = 0xDD
+
+	// maxFrameLen bounds a decoded frame; the firmware never sends more.
+	maxFrameLen = 512
+)
+
+// deCONZ commands
+const (
+	cmdAPSDataConfirm     uint8 = 0x04
+	cmdDeviceState        uint8 = 0x07
+	cmdChangeNetworkState uint8 = 0x08
+	cmdReadParameter      uint8 = 0x0A
+	cmdWriteParameter     uint8 = 0x0B
+	cmdVersion            uint8 = 0x0D
+	cmdDeviceStateChanged uint8 = 0x0E
+	cmdAPSDataRequest     uint8 = 0x12
+	cmdAPSDataIndication  uint8 = 0x17
+	cmdMACPoll            uint8 = 0x1C
+)
+
+// Command status codes
+const (
+	statusSuccess      uint8 = 0x00
+	statusFailure      uint8 = 0x01
+	statusBusy         uint8 = 0x02
+	statusTimeout      uint8 = 0x03
+	statusUnsupported  uint8 = 0x04
+	statusError        uint8 = 0x05
+	statusNoNetwork    uint8 = 0x06
+	statusInvalidValue uint8 = 0x07
+)
+
+// Device state bits, reported in DEVICE_STATE and most responses.
+const (
+	deviceStateNetworkMask  uint8 = 0x03 // network state (netOffline...netLeaving)
+	deviceStateAPSConfirm   uint8 = 0x04 // an APSDE-DATA.confirm is waiting
+	deviceStateAPSIndReady  uint8 = 0x08 // an APSDE-DATA.indication is waiting
+	deviceStateConfChanged  uint8 = 0x10
+	deviceStateAPSFreeSlots uint8 = 0x20 // the APS request queue has room
+)
+
+// Network states
+const (
+	netOffline   uint8 = 0x00
+	netJoining   uint8 = 0x01
+	netConnected uint8 = 0x02
+	netLeaving   uint8 = 0x03
+)
+
+// frame is a decoded deCONZ frame: cmd(1) + seq(1) + status(1) + length(2) +
+// payload + CRC(2). length counts the five header bytes and the payload.
+type frame struct {
+	cmd     uint8
+	seq     uint8
+	status  uint8
+	payload []byte
+}
+
+func (f frame) String() string {
+	return fmt.Sprintf("cmd=0x%02X seq=%d status=%d len=%d", f.cmd, f.seq, f.status, len(f.payload))
+}
+
+// frameCRC is the two's complement of the byte sum, sent little-endian.
+func frameCRC(b []byte) uint16 {
+	var sum uint16
+	for _, x := range b {
+		sum += uint16(x)
+	}
+	return ^sum + 1
+}
+
+// encode serializes f with its CRC and SLIP framing.
+func (f frame) encode() []byte {
+	raw := make([]byte, 0, 7+len(f.payload))
+	raw = append(raw, f.cmd, f.seq, f.status, 0, 0)
+	binary.LittleEndian.PutUint16(raw[3:5], uint16(5+len(f.payload)))
+	raw = append(raw, f.payload...)
+	raw = binary.LittleEndian.AppendUint16(raw, frameCRC(raw))
+
+	out := make([]byte, 0, len(raw)+4)
+	out = append(out, slipEnd)
+	for _, b := range raw {
+		switch b {
+		case slipEnd:
+			out = append(out, slipEsc, slipEscEnd)
+		case slipEsc:
+			out = append(out, slipEsc, slipEscEsc)
+		default:
+			out = append(out, b)
+		}
+	}
+	return append(out, slipEnd)
+}
+
+// readFrame reads the next valid frame from r. Empty SLIP packets, frames
+// with a bad CRC or length and oversized packets are skipped.
+func readFrame(r io.ByteReader) (frame, error) {
+	var buf []byte
+	esc := false
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return frame{}, err
+		}
+		switch {
+		case b == slipEnd:
+			if f, ok := decodeFrame(buf); ok {
+				return f, nil
+			}
+			buf = buf[:0]
+			esc = false
+			continue
+		case b == slipEsc:
+			esc = true
+			continue
+		case esc && b == slipEscEnd:
+			b = slipEnd
+		case esc && b == slipEscEsc:
+			b = slipEsc
+		}
+		esc = false
+		if len(buf) < maxFrameLen {
+			buf = append(buf, b)
+		}
+	}
+}
+
+// decodeFrame checks the length and CRC of an unescaped packet.
+func decodeFrame(b []byte) (frame, bool) {
+	if len(b) < 7 {
+		return frame{}, false
+	}
+	n := int(binary.LittleEndian.Uint16(b[3:5]))
+	if n < 5 || n+2 != len(b) {
+		return frame{}, false
+	}
+	if frameCRC(b[:n]) != binary.LittleEndian.Uint16(b[n:]) {
+		return frame{}, false
+	}
+	return frame{cmd: b[0], seq: b[1], status: b[2], payload: append([]byte(nil), b[5:n]...)}, true
+}
+
+// deviceState extracts the device state byte carried by f, if any.
+func deviceState(f frame) (uint8, bool) {
+	switch f.cmd {
+	case cmdDeviceState, cmdDeviceStateChanged:
+		if len(f.payload) >= 1 {
+			return f.payload[0], true
+		}
+	case cmdAPSDataRequest, cmdAPSDataConfirm, cmdAPSDataIndication:
+		// payloadLength(2) + deviceState(1) + ...
+		if len(f.payload) >= 3 {
+			return f.payload[2], true
+		}
+	}
+	return 0, false
+}
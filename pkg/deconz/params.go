@@ -0,0 +1,316 @@
+package deconz
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/urmzd/zigbee-skill/pkg/device"
+	"github.com/urmzd/zigbee-skill/pkg/zigbee"
+)
+
+// Network parameters readable and writable with READ/WRITE_PARAMETER.
+const (
+	paramMACAddress             uint8 = 0x01
+	paramNwkPanID               uint8 = 0x05
+	paramNwkAddress             uint8 = 0x07
+	paramNwkExtendedPanID       uint8 = 0x08
+	paramAPSDesignedCoordinator uint8 = 0x09
+	paramChannelMask            uint8 = 0x0A
+	paramAPSExtendedPanID       uint8 = 0x0B
+	paramTrustCenterAddress     uint8 = 0x0E
+	paramSecurityMode           uint8 = 0x10
+	paramNetworkKey             uint8 = 0x18
+	paramCurrentChannel         uint8 = 0x1C
+	paramPermitJoin             uint8 = 0x21
+	paramProtocolVersion        uint8 = 0x22
+	paramNwkUpdateID            uint8 = 0x24
+	paramWatchdogTTL            uint8 = 0x26
+)
+
+const (
+	// securityModeTCLinkKey is "no master key, trust center link key".
+	securityModeTCLinkKey = 0x03
+
+	// primaryChannelMask is the BDB primary channel set (11, 15, 20, 25).
+	primaryChannelMask uint32 = 0x02108800
+
+	// networkStartTimeout bounds joining or forming the network.
+	networkStartTimeout = 60 * time.Second
+
+	// watchdogTTL is written periodically; ConBee II firmware resets itself if
+	// the host stops refreshing it.
+	watchdogTTL      = 600
+	watchdogInterval = 3 * time.Minute
+)
+
+// readParam reads a network parameter and returns its value.
+func (c *Controller) readParam(id uint8, extra ...byte) ([]byte, error) {
+	req := binary.LittleEndian.AppendUint16(nil, uint16(1+len(extra)))
+	req = append(req, id)
+	req = append(req, extra...)
+	resp, err := c.layer.Request(cmdReadParameter, req)
+	if err != nil {
+		return nil, fmt.Errorf("read parameter 0x%02X: %w", id, err)
+	}
+	// payloadLength(2) + paramId(1) + value
+	if len(resp) < 3 || resp[2] != id {
+		return nil, fmt.Errorf("read parameter 0x%02X: bad response", id)
+	}
+	return resp[3:], nil
+}
+
+// writeParam writes a network parameter.
+func (c *Controller) writeParam(id uint8, value []byte) error {
+	req := binary.LittleEndian.AppendUint16(nil, uint16(1+len(value)))
+	req = append(req, id)
+	req = append(req, value...)
+	if _, err := c.layer.Request(cmdWriteParameter, req); err != nil {
+		return fmt.Errorf("write parameter 0x%02X: %w", id, err)
+	}
+	return nil
+}
+
+// readDeviceState polls DEVICE_STATE.
+func (c *Controller) readDeviceState() (uint8, error) {
+	resp, err := c.layer.Request(cmdDeviceState, []byte{0, 0, 0})
+	if err != nil {
+		return 0, err
+	}
+	if len(resp) < 1 {
+		return 0, fmt.Errorf("device state response too short")
+	}
+	return resp[0], nil
+}
+
+// setNetworkState requests a network state and polls until it is reached.
+func (c *Controller) setNetworkState(want uint8, timeout time.Duration) error {
+	if _, err := c.layer.Request(cmdChangeNetworkState, []byte{want}); err != nil {
+		return fmt.Errorf("change network state: %w", err)
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		st, err := c.readDeviceState()
+		if err != nil {
+			return err
+		}
+		if st&deviceStateNetworkMask == want {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%w: network state %d, want %d", device.ErrTimeout, st&deviceStateNetworkMask, want)
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
+
+// startNetwork brings up the network stored on the adapter, or forms one from
+// c.opts.Form when the adapter is not configured as a coordinator.
+func (c *Controller) startNetwork() error {
+	st, err := c.readDeviceState()
+	if err != nil {
+		return fmt.Errorf("read device state: %w", err)
+	}
+	if st&deviceStateNetworkMask == netConnected {
+		log.Info().Msg("deCONZ network already up")
+		return nil
+	}
+
+	coord, err := c.readParam(paramAPSDesignedCoordinator)
+	if err != nil {
+		return err
+	}
+	pan, err := c.readParam(paramNwkPanID)
+	if err != nil {
+		return err
+	}
+	configured := len(coord) == 1 && coord[0] == 1 && len(pan) == 2 &&
+		binary.LittleEndian.Uint16(pan) != 0 && binary.LittleEndian.Uint16(pan) != 0xFFFF
+	if !configured {
+		log.Info().Msg("Adapter has no coordinator network, forming new one")
+		return c.formNetwork(c.opts.Form)
+	}
+
+	log.Info().Msg("Resuming Zigbee network from adapter")
+	return c.setNetworkState(netConnected, networkStartTimeout)
+}
+
+// formParams is a fully resolved set of formation parameters.
+type formParams struct {
+	channelMask uint32
+	panID       uint16
+	extPanID    [8]byte
+	networkKey  [16]byte
+}
+
+// resolveForm validates opts and fills in random identifiers and key where
+// unset. An unset channel lets the firmware pick from the primary channel set.
+func resolveForm(opts device.FormOptions) (*formParams, error) {
+	p := &formParams{channelMask: primaryChannelMask}
+	switch {
+	case opts.Channel == 0:
+	case opts.Channel >= 11 && opts.Channel <= 26:
+		p.channelMask = 1 << opts.Channel
+	default:
+		return nil, fmt.Errorf("%w: channel must be 11-26, got %d", device.ErrValidation, opts.Channel)
+	}
+
+	if opts.PanID != "" {
+		pan, err := strconv.ParseUint(strings.TrimPrefix(strings.ToLower(opts.PanID), "0x"), 16, 16)
+		if err != nil || pan == 0xFFFF {
+			return nil, fmt.Errorf("%w: invalid PAN ID %q", device.ErrValidation, opts.PanID)
+		}
+		p.panID = uint16(pan)
+	} else {
+		var b [2]byte
+		_, _ = rand.Read(b[:])
+		p.panID = binary.LittleEndian.Uint16(b[:]) % 0xFFFE
+	}
+
+	if opts.ExtendedPanID != "" {
+		ext, err := hex.DecodeString(strings.ReplaceAll(opts.ExtendedPanID, ":", ""))
+		if err != nil || len(ext) != 8 {
+			return nil, fmt.Errorf("%w: invalid extended PAN ID %q", device.ErrValidation, opts.ExtendedPanID)
+		}
+		// Written most significant byte first; the adapter stores it little-endian.
+		for i := range 8 {
+			p.extPanID[i] = ext[7-i]
+		}
+	} else {
+		_, _ = rand.Read(p.extPanID[:])
+	}
+
+	if opts.NetworkKey != "" {
+		key, err := hex.DecodeString(strings.ReplaceAll(opts.NetworkKey, ":", ""))
+		if err != nil || len(key) != 16 {
+			return nil, fmt.Errorf("%w: network key must be 16 hex bytes", device.ErrValidation)
+		}
+		copy(p.networkKey[:], key)
+	} else {
+		_, _ = rand.Read(p.networkKey[:])
+	}
+	return p, nil
+}
+
+// formNetwork takes the adapter offline, writes the coordinator parameters and
+// brings the network up again.
+func (c *Controller) formNetwork(opts device.FormOptions) error {
+	p, err := resolveForm(opts)
+	if err != nil {
+		return err
+	}
+	if err := c.setNetworkState(netOffline, 10*time.Second); err != nil {
+		return err
+	}
+
+	mac, err := c.readParam(paramMACAddress)
+	if err != nil {
+		return err
+	}
+	items := []struct {
+		id    uint8
+		value []byte
+	}{
+		{paramAPSDesignedCoordinator, []byte{0x01}},
+		{paramNwkPanID, binary.LittleEndian.AppendUint16(nil, p.panID)},
+		{paramAPSExtendedPanID, p.extPanID[:]},
+		{paramChannelMask, binary.LittleEndian.AppendUint32(nil, p.channelMask)},
+		{paramTrustCenterAddress, mac},
+		{paramSecurityMode, []byte{securityModeTCLinkKey}},
+		{paramNetworkKey, append([]byte{0x00}, p.networkKey[:]...)},
+		{paramNwkUpdateID, []byte{0x00}},
+	}
+	for _, it := range items {
+		if err := c.writeParam(it.id, it.value); err != nil {
+			return err
+		}
+	}
+
+	if err := c.setNetworkState(netConnected, networkStartTimeout); err != nil {
+		return fmt.Errorf("network formation did not complete: %w", err)
+	}
+	log.Info().Uint16("panID", p.panID).Uint32("channels", p.channelMask).Msg("deCONZ network formed")
+	c.notifyNetworkChange()
+	return nil
+}
+
+// ResetNetwork takes the adapter offline and clears its coordinator role, so
+// a new network is formed on the next start.
+func (c *Controller) ResetNetwork() error {
+	log.Info().Msg("Clearing Zigbee network from adapter")
+	if err := c.setNetworkState(netOffline, 10*time.Second); err != nil {
+		return err
+	}
+	return c.writeParam(paramAPSDesignedCoordinator, []byte{0x00})
+}
+
+// networkParams reads the running network's channel and identifiers.
+func (c *Controller) networkParams() (channel uint8, panID uint16, extPanID [8]byte, err error) {
+	ch, err := c.readParam(paramCurrentChannel)
+	if err != nil {
+		return 0, 0, extPanID, err
+	}
+	pan, err := c.readParam(paramNwkPanID)
+	if err != nil {
+		return 0, 0, extPanID, err
+	}
+	ext, err := c.readParam(paramNwkExtendedPanID)
+	if err != nil {
+		return 0, 0, extPanID, err
+	}
+	if len(ch) < 1 || len(pan) < 2 || len(ext) < 8 {
+		return 0, 0, extPanID, fmt.Errorf("network parameters truncated")
+	}
+	copy(extPanID[:], ext)
+	return ch[0], binary.LittleEndian.Uint16(pan), extPanID, nil
+}
+
+// notifyNetworkChange reads the current settings and passes them to the
+// registered callback.
+func (c *Controller) notifyNetworkChange() {
+	if c.onNetworkChange == nil {
+		return
+	}
+	channel, panID, ext, err := c.networkParams()
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to read network parameters for persistence")
+		return
+	}
+	opts := device.FormOptions{
+		Channel:       int(channel),
+		PanID:         fmt.Sprintf("0x%04x", panID),
+		ExtendedPanID: zigbee.FormatIEEE(ext),
+	}
+	// keyIndex(1) + key(16)
+	if key, err := c.readParam(paramNetworkKey, 0x00); err == nil && len(key) >= 17 {
+		opts.NetworkKey = hex.EncodeToString(key[1:17])
+	}
+	c.onNetworkChange(opts)
+}
+
+// watchdogLoop refreshes the firmware watchdog until the controller stops.
+// Firmware without a watchdog rejects the write, which ends the loop.
+func (c *Controller) watchdogLoop() {
+	ttl := binary.LittleEndian.AppendUint32(nil, watchdogTTL)
+	if err := c.writeParam(paramWatchdogTTL, ttl); err != nil {
+		log.Debug().Err(err).Msg("Adapter has no watchdog")
+		return
+	}
+	ticker := time.NewTicker(watchdogInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := c.writeParam(paramWatchdogTTL, ttl); err != nil {
+				log.Warn().Err(err).Msg("Failed to refresh adapter watchdog")
+			}
+		case <-c.stopChan:
+			return
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package deconz
+
+import (
+	"time"
+
+	"github.com/urmzd/zigbee-skill/pkg/zigbee"
+)
+
+// probeTimeout bounds the wait for the VERSION response while probing.
+const probeTimeout = 1500 * time.Millisecond
+
+// Probe reports whether a deCONZ adapter answers VERSION on portPath. The
+// port is closed before returning.
+func Probe(portPath string) bool {
+	s, err := zigbee.OpenSerial(portPath)
+	if err != nil {
+		return false
+	}
+	defer func() { _ = s.Close() }()
+	return probe(s, probeTimeout)
+}
+
+// probe sends VERSION over t and waits for its response. Reads block, so a
+// transport that stays silent is abandoned to the caller's Close.
+func probe(t zigbee.Transport, timeout time.Duration) bool {
+	req := frame{cmd: cmdVersion, seq: 1, payload: []byte{0, 0, 0, 0}}.encode()
+	if _, err := t.Write(req); err != nil {
+		return false
+	}
+	got := make(chan bool, 1)
+	go func() {
+		for {
+			f, err := readFrame(t)
+			if err != nil {
+				got <- false
+				return
+			}
+			if f.cmd == cmdVersion && f.seq == 1 {
+				got <- true
+				return
+			}
+		}
+	}()
+	select {
+	case ok := <-got:
+		return ok
+	case <-time.After(timeout):
+		return false
+	}
+}
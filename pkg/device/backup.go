@@ -0,0 +1,115 @@
+package device
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+)
+
+// Open Coordinator Backup format identifiers.
+// See https://github.com/zigpy/open-coordinator-backup.
+const (
+	BackupFormat  = "zigpy/open-coordinator-backup"
+	BackupVersion = 1
+)
+
+// NetworkBackuper is implemented by controllers that can snapshot the
+// coordinator's network and restore it onto an adapter.
+type NetworkBackuper interface {
+	// BackupNetwork exports network parameters, keys, frame counters and children
+	BackupNetwork(ctx context.Context) (*NetworkBackup, error)
+	// RestoreNetwork re-forms the network from a backup. If overwriteIEEE is set
+	// and the adapter's IEEE differs from the backup, the adapter IEEE is rewritten.
+	RestoreNetwork(ctx context.Context, b *NetworkBackup, overwriteIEEE bool) error
+}
+
+// NetworkBackup is an Open Coordinator Backup document. Addresses and keys are
+// lowercase hex without separators, most significant byte first.
+type NetworkBackup struct {
+	Metadata        BackupMetadata   `json:"metadata"`
+	CoordinatorIEEE string           `json:"coordinator_ieee"`
+	PanID           string           `json:"pan_id"`
+	ExtendedPanID   string           `json:"extended_pan_id"`
+	NwkUpdateID     int              `json:"nwk_update_id"`
+	SecurityLevel   int              `json:"security_level"`
+	Channel         int              `json:"channel"`
+	ChannelMask     []int            `json:"channel_mask"`
+	NetworkKey      BackupNetworkKey `json:"network_key"`
+	Devices         []BackupDevice   `json:"devices"`
+}
+
+// BackupMetadata identifies the format and the tool that wrote the backup.
+type BackupMetadata struct {
+	Format   string         `json:"format"`
+	Version  int            `json:"version"`
+	Source   string         `json:"source"`
+	Internal map[string]any `json:"internal"`
+}
+
+// BackupNetworkKey is the active network key with its sequence number and
+// outgoing NWK frame counter.
+type BackupNetworkKey struct {
+	Key            string `json:"key"`
+	SequenceNumber int    `json:"sequence_number"`
+	FrameCounter   uint32 `json:"frame_counter"`
+}
+
+// BackupDevice is a child or a device holding a unique TC link key.
+type BackupDevice struct {
+	NwkAddress  *string        `json:"nwk_address"` // e.g. "1a2b", null if unknown
+	IEEEAddress string         `json:"ieee_address"`
+	IsChild     bool           `json:"is_child"`
+	LinkKey     *BackupLinkKey `json:"link_key,omitempty"`
+}
+
+// BackupLinkKey is a device's TC link key with its APS frame counters.
+type BackupLinkKey struct {
+	Key       string `json:"key"`
+	RxCounter uint32 `json:"rx_counter"`
+	TxCounter uint32 `json:"tx_counter"`
+}
+
+// Validate checks that the backup is a supported Open Coordinator Backup with
+// well-formed addresses and keys.
+func (b *NetworkBackup) Validate() error {
+	if b.Metadata.Format != BackupFormat {
+		return fmt.Errorf("%w: unsupported backup format %q", ErrValidation, b.Metadata.Format)
+	}
+	if b.Metadata.Version != BackupVersion {
+		return fmt.Errorf("%w: unsupported backup version %d", ErrValidation, b.Metadata.Version)
+	}
+	if err := checkHex("coordinator_ieee", b.CoordinatorIEEE, 8); err != nil {
+		return err
+	}
+	if err := checkHex("extended_pan_id", b.ExtendedPanID, 8); err != nil {
+		return err
+	}
+	if err := checkHex("network_key.key", b.NetworkKey.Key, 16); err != nil {
+		return err
+	}
+	if pan, err := strconv.ParseUint(b.PanID, 16, 16); err != nil || pan == 0xFFFF {
+		return fmt.Errorf("%w: invalid pan_id %q", ErrValidation, b.PanID)
+	}
+	if b.Channel < 11 || b.Channel > 26 {
+		return fmt.Errorf("%w: invalid channel %d", ErrValidation, b.Channel)
+	}
+	for _, d := range b.Devices {
+		if err := checkHex("ieee_address", d.IEEEAddress, 8); err != nil {
+			return err
+		}
+		if d.LinkKey != nil {
+			if err := checkHex("link_key.key", d.LinkKey.Key, 16); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func checkHex(field, s string, n int) error {
+	if b, err := hex.DecodeString(s); err != nil || len(b) != n {
+		return fmt.Errorf("%w: %s must be %d hex bytes, got %q", ErrValidation, field, n, s)
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package device
+
+import (
+	"errors"
+	"testing"
+)
+
+func validBackup() *NetworkBackup {
+	return &NetworkBackup{
+		Metadata:        BackupMetadata{Format: BackupFormat, Version: BackupVersion, Source: "test"},
+		CoordinatorIEEE: "00124b0001ab89cd",
+		PanID:           "1a62",
+		ExtendedPanID:   "dddddddddddddddd",
+		SecurityLevel:   5,
+		Channel:         15,
+		ChannelMask:     []int{15},
+		NetworkKey:      BackupNetworkKey{Key: "01030507090b0d0f00020406080a0c0d", FrameCounter: 1234},
+		Devices: []BackupDevice{
+			{IEEEAddress: "00158d0001020304", LinkKey: &BackupLinkKey{Key: "5a6967426565416c6c69616e63653039"}},
+		},
+	}
+}
+
+func TestNetworkBackup_Validate(t *testing.T) {
+	if err := validBackup().Validate(); err != nil {
+		t.Fatalf("valid backup rejected: %v", err)
+	}
+
+	cases := map[string]func(b *NetworkBackup){
+		"format":   func(b *NetworkBackup) { b.Metadata.Format = "other" },
+		"version":  func(b *NetworkBackup) { b.Metadata.Version = 2 },
+		"ieee":     func(b *NetworkBackup) { b.CoordinatorIEEE = "00:12:4b:00:01:ab:89:cd" },
+		"pan_id":   func(b *NetworkBackup) { b.PanID = "ffff" },
+		"channel":  func(b *NetworkBackup) { b.Channel = 27 },
+		"key":      func(b *NetworkBackup) { b.NetworkKey.Key = "0103" },
+		"link_key": func(b *NetworkBackup) { b.Devices[0].LinkKey.Key = "zz" },
+	}
+	for name, mutate := range cases {
+		b := validBackup()
+		mutate(b)
+		if err := b.Validate(); !errors.Is(err, ErrValidation) {
+			t.Errorf("%s: expected ErrValidation, got %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package device
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Capability names. Each maps to one key of the device state.
+const (
+	CapOnOff            = "on_off"
+	CapBrightness       = "brightness"
+	CapColorTemp        = "color_temp"
+	CapColorXY          = "color_xy"
+	CapTemperature      = "temperature"
+	CapHumidity         = "humidity"
+	CapOccupancy        = "occupancy"
+	CapIlluminance      = "illuminance"
+	CapPressure         = "pressure"
+	CapPower            = "power"
+	CapBattery          = "battery"
+	CapLock             = "lock"
+	CapCover            = "cover"
+	CapHeatingSetpoint  = "heating_setpoint"
+	CapLocalTemperature = "local_temperature"
+)
+
+// Capability value types.
+const (
+	ValueBinary    = "binary"    // one of two values, e.g. ON/OFF
+	ValueNumeric   = "numeric"   // a number, optionally within Range
+	ValueEnum      = "enum"      // one of Values
+	ValueComposite = "composite" // an object, e.g. {"x": 0.3, "y": 0.3}
+)
+
+// Access describes how a capability's value can be used.
+type Access uint8
+
+const (
+	// AccessRead means the value can be queried with GetDeviceState.
+	AccessRead Access = 1 << iota
+	// AccessWrite means the value can be changed with SetDeviceState.
+	AccessWrite
+	// AccessReport means the device reports changes on its own.
+	AccessReport
+)
+
+var accessNames = []struct {
+	bit  Access
+	name string
+}{
+	{AccessRead, "read"},
+	{AccessWrite, "write"},
+	{AccessReport, "report"},
+}
+
+// Has reports whether all bits of b are set.
+func (a Access) Has(b Access) bool { return a&b == b }
+
+func (a Access) names() []string {
+	names := []string{}
+	for _, n := range accessNames {
+		if a.Has(n.bit) {
+			names = append(names, n.name)
+		}
+	}
+	return names
+}
+
+func (a Access) String() string { return strings.Join(a.names(), ",") }
+
+// MarshalJSON encodes access as a list such as ["read","write","report"].
+func (a Access) MarshalJSON() ([]byte, error) { return json.Marshal(a.names()) }
+
+func (a *Access) UnmarshalJSON(data []byte) error {
+	var names []string
+	if err := json.Unmarshal(data, &names); err != nil {
+		return err
+	}
+	*a = 0
+next:
+	for _, name := range names {
+		for _, n := range accessNames {
+			if n.name == name {
+				*a |= n.bit
+				continue next
+			}
+		}
+		return fmt.Errorf("unknown access %q", name)
+	}
+	return nil
+}
+
+// Range bounds a numeric capability.
+type Range struct {
+	Min float64 `json:"min"`
+	Max float64 `json:"max"`
+}
+
+// Capability describes one thing a device can do or measure.
+type Capability struct {
+	Name     string   `json:"name"`               // e.g. CapBrightness
+	Property string   `json:"property"`           // device state key
+	Type     string   `json:"type"`               // ValueBinary, ValueNumeric, ...
+	Unit     string   `json:"unit,omitempty"`     // e.g. "°C", "mired", "%"
+	Range    *Range   `json:"range,omitempty"`    // numeric bounds
+	Values   []string `json:"values,omitempty"`   // binary and enum values
+	Access   Access   `json:"access"`             // read, write, report
+	Endpoint uint8    `json:"endpoint,omitempty"` // endpoint serving it, 0 when not applicable
+}
+
+// capabilities holds the standard definition of each named capability.
+// Access is left to the controller, which knows what it supports.
+var capabilities = map[string]Capability{
+	CapOnOff:            {Property: "state", Type: ValueBinary, Values: []string{"ON", "OFF", "TOGGLE"}},
+	CapBrightness:       {Property: "brightness", Type: ValueNumeric, Range: &Range{0, 254}},
+	CapColorTemp:        {Property: "color_temp", Type: ValueNumeric, Unit: "mired", Range: &Range{153, 500}},
+	CapColorXY:          {Property: "color", Type: ValueComposite, Range: &Range{0, 1}},
+	CapTemperature:      {Property: "temperature", Type: ValueNumeric, Unit: "°C"},
+	CapHumidity:         {Property: "humidity", Type: ValueNumeric, Unit: "%", Range: &Range{0, 100}},
+	CapOccupancy:        {Property: "occupancy", Type: ValueBinary, Values: []string{"true", "false"}},
+	CapIlluminance:      {Property: "illuminance", Type: ValueNumeric, Unit: "lx"},
+	CapPressure:         {Property: "pressure", Type: ValueNumeric, Unit: "hPa"},
+	CapPower:            {Property: "power", Type: ValueNumeric, Unit: "W"},
+	CapBattery:          {Property: "battery", Type: ValueNumeric, Unit: "%", Range: &Range{0, 100}},
+	CapLock:             {Property: "lock_state", Type: ValueEnum, Values: []string{"LOCK", "UNLOCK"}},
+	CapCover:            {Property: "position", Type: ValueNumeric, Unit: "%", Range: &Range{0, 100}},
+	CapHeatingSetpoint:  {Property: "heating_setpoint", Type: ValueNumeric, Unit: "°C", Range: &Range{5, 30}},
+	CapLocalTemperature: {Property: "local_temperature", Type: ValueNumeric, Unit: "°C"},
+}
+
+// NewCapability returns the standard definition of the named capability
+// served by endpoint with the given access. It returns false for unknown
+// names.
+func NewCapability(name string, endpoint uint8, access Access) (Capability, bool) {
+	c, ok := capabilities[name]
+	if !ok {
+		return Capability{}, false
+	}
+	c.Name = name
+	c.Endpoint = endpoint
+	c.Access = access
+	if c.Range != nil {
+		r := *c.Range
+		c.Range = &r
+	}
+	c.Values = append([]string(nil), c.Values...)
+	return c, true
+}
+
+// Capabilities decodes the device's Exposes.
+func (d *Device) Capabilities() ([]Capability, error) {
+	if len(d.Exposes) == 0 || string(d.Exposes) == "null" {
+		return nil, nil
+	}
+	var caps []Capability
+	if err := json.Unmarshal(d.Exposes, &caps); err != nil {
+		return nil, fmt.Errorf("decode exposes: %w", err)
+	}
+	return caps, nil
+}
+
+// Capability returns the device's capability with the given name.
+func (d *Device) Capability(name string) (Capability, bool) {
+	caps, _ := d.Capabilities()
+	for _, c := range caps {
+		if c.Name == name {
+			return c, true
+		}
+	}
+	return Capability{}, false
+}
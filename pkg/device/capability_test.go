@@ -0,0 +1,39 @@
+package device
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestCapabilityRoundTrip(t *testing.T) {
+	brightness, ok := NewCapability(CapBrightness, 11, AccessRead|AccessWrite|AccessReport)
+	if !ok {
+		t.Fatal("brightness capability missing")
+	}
+	temp, _ := NewCapability(CapTemperature, 2, AccessRead|AccessReport)
+	exposes, err := json.Marshal([]Capability{brightness, temp})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := Device{Exposes: exposes}
+	got, ok := d.Capability(CapBrightness)
+	if !ok || got.Property != "brightness" || got.Endpoint != 11 || got.Range == nil || got.Range.Max != 254 {
+		t.Fatalf("brightness = %+v", got)
+	}
+	if got.Access != AccessRead|AccessWrite|AccessReport {
+		t.Errorf("brightness access = %v", got.Access)
+	}
+	got, _ = d.Capability(CapTemperature)
+	if got.Access.Has(AccessWrite) || !got.Access.Has(AccessReport) || got.Unit != "°C" {
+		t.Errorf("temperature = %+v", got)
+	}
+	if _, ok := d.Capability(CapLock); ok {
+		t.Error("unexpected lock capability")
+	}
+
+	var a Access
+	if err := json.Unmarshal([]byte(`["read","fly"]`), &a); err == nil {
+		t.Error("unknown access accepted")
+	}
+}
@@ -4,7 +4,10 @@ import "context"
 
 type contextKey string
 
-const noCacheKey contextKey = "no-cache"
+const (
+	noCacheKey contextKey = "no-cache"
+	networkKey contextKey = "network"
+)
 
 // WithNoCache returns a context with the no-cache flag set.
 func WithNoCache(ctx context.Context) context.Context {
@@ -17,6 +20,18 @@ func NoCache(ctx context.Context) bool {
 	return v
 }
 
+// WithNetwork returns a context that scopes network-level operations to the
+// named network when several are registered.
+func WithNetwork(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, networkKey, name)
+}
+
+// Network returns the network name set on ctx, or "".
+func Network(ctx context.Context) string {
+	v, _ := ctx.Value(networkKey).(string)
+	return v
+}
+
 // Controller defines the interface for controlling smart home devices.
 // This abstraction allows the API to work with different protocols
 // (Zigbee, Z-Wave, Matter, WiFi) through a unified interface.
@@ -54,9 +69,28 @@ type Controller interface {
 
 // EventSubscriber defines the interface for subscribing to device events
 type EventSubscriber interface {
-	// Subscribe returns a channel that receives discovery events
-	Subscribe() chan DiscoveryEvent
+	// Subscribe returns a channel that receives the events matching filter
+	Subscribe(filter EventFilter) chan Event
 
 	// Unsubscribe removes a subscription
-	Unsubscribe(ch chan DiscoveryEvent)
+	Unsubscribe(ch chan Event)
+}
+
+// InstallCodeJoiner is implemented by controllers that support joining
+// devices with a link key derived from a per-device install code.
+type InstallCodeJoiner interface {
+	// AddInstallCode authorizes the device to join with its install code.
+	// ieee may be empty when the code embeds it. Returns the device's IEEE address.
+	AddInstallCode(ctx context.Context, ieee, code string) (string, error)
+}
+
+// PermitJoinViaAll opens joining on every router as well as the coordinator.
+const PermitJoinViaAll = "all"
+
+// TargetedJoiner is implemented by controllers that can open joining through
+// a chosen router, so devices far from the coordinator pair via a nearby parent.
+type TargetedJoiner interface {
+	// PermitJoinVia opens joining on the router identified by via (IEEE address
+	// or friendly name), or on every router when via is PermitJoinViaAll.
+	PermitJoinVia(ctx context.Context, via string, duration int) error
 }
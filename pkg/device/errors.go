@@ -17,4 +17,7 @@ var (
 
 	// ErrValidation indicates a state payload failed schema validation
 	ErrValidation = errors.New("validation error")
+
+	// ErrDeliveryFailed indicates the network reported that a command was not delivered
+	ErrDeliveryFailed = errors.New("delivery failed")
 )
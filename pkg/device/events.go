@@ -0,0 +1,150 @@
+package device
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+// Event types.
+const (
+	EventDeviceJoined   = "device_joined"
+	EventDeviceLeft     = "device_left"
+	EventDeviceRejected = "device_rejected"
+	EventDeviceOnline   = "device_online"
+	EventDeviceOffline  = "device_offline"
+	// EventStateChanged carries the device's state after a change in State.
+	EventStateChanged = "state_changed"
+	// EventInterview reports the progress of a new device's interview in Stage.
+	EventInterview = "interview"
+	// EventCommandResult reports a SetDeviceState request (State) and, on
+	// failure, its Error.
+	EventCommandResult           = "command_result"
+	EventCoordinatorDisconnected = "coordinator_disconnected"
+	EventCoordinatorReconnected  = "coordinator_reconnected"
+	// EventsDropped tells a subscriber that Dropped events were lost because
+	// it did not keep up.
+	EventsDropped = "events_dropped"
+)
+
+// Interview stages.
+const (
+	InterviewStarted   = "started"
+	InterviewEndpoints = "endpoints" // endpoints and clusters are known
+	InterviewCompleted = "completed"
+	InterviewFailed    = "failed"
+)
+
+// Event is something that happened on the network or to a device.
+type Event struct {
+	Type      string      `json:"type"`                // One of the Event* types
+	DeviceID  string      `json:"device_id,omitempty"` // Device the event is about
+	Device    *Device     `json:"device,omitempty"`    // Device information for join, leave and availability events
+	State     DeviceState `json:"state,omitempty"`     // New state, or the requested change of a command
+	Stage     string      `json:"stage,omitempty"`     // Interview stage
+	Error     string      `json:"error,omitempty"`     // Why a command or interview failed
+	Reason    string      `json:"reason,omitempty"`    // Why a device was rejected or the coordinator disconnected
+	Parent    string      `json:"parent,omitempty"`    // IEEE address of the node a device joined through
+	Dropped   int         `json:"dropped,omitempty"`   // Number of events lost, for events_dropped
+	Timestamp time.Time   `json:"timestamp"`           // When the event occurred
+}
+
+// CommandResultEvent reports the outcome of a SetDeviceState request.
+func CommandResultEvent(deviceID string, req map[string]any, err error) Event {
+	evt := Event{Type: EventCommandResult, DeviceID: deviceID, State: req, Timestamp: time.Now()}
+	if err != nil {
+		evt.Error = err.Error()
+	}
+	return evt
+}
+
+// EventFilter selects the events a subscriber receives. Empty lists match
+// everything; events_dropped notices are always delivered.
+type EventFilter struct {
+	Types   []string
+	Devices []string // device IDs
+}
+
+// Match reports whether evt passes the filter.
+func (f EventFilter) Match(evt Event) bool {
+	if evt.Type == EventsDropped {
+		return true
+	}
+	if len(f.Types) > 0 && !slices.Contains(f.Types, evt.Type) {
+		return false
+	}
+	return len(f.Devices) == 0 || slices.Contains(f.Devices, evt.DeviceID)
+}
+
+// eventBuffer is the channel capacity of each subscription.
+const eventBuffer = 64
+
+// Bus fans events out to filtered subscribers without blocking the
+// publisher. A subscriber whose buffer is full misses events; the next event
+// it can take is an events_dropped notice with the number missed.
+type Bus struct {
+	mu   sync.Mutex
+	subs []*subscription
+}
+
+type subscription struct {
+	ch      chan Event
+	filter  EventFilter
+	dropped int
+}
+
+// NewBus creates an empty event bus.
+func NewBus() *Bus {
+	return &Bus{}
+}
+
+// Subscribe returns a channel receiving the events that match filter.
+func (b *Bus) Subscribe(filter EventFilter) chan Event {
+	ch := make(chan Event, eventBuffer)
+	b.mu.Lock()
+	b.subs = append(b.subs, &subscription{ch: ch, filter: filter})
+	b.mu.Unlock()
+	return ch
+}
+
+// Unsubscribe removes a subscription and closes its channel.
+func (b *Bus) Unsubscribe(ch chan Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i, s := range b.subs {
+		if s.ch == ch {
+			b.subs = append(b.subs[:i], b.subs[i+1:]...)
+			close(ch)
+			return
+		}
+	}
+}
+
+// Publish delivers evt to every matching subscriber. DeviceID is filled in
+// from Device when unset.
+func (b *Bus) Publish(evt Event) {
+	if evt.DeviceID == "" && evt.Device != nil {
+		evt.DeviceID = evt.Device.ID
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, s := range b.subs {
+		if !s.filter.Match(evt) {
+			continue
+		}
+		if s.dropped > 0 {
+			select {
+			case s.ch <- Event{Type: EventsDropped, Dropped: s.dropped, Timestamp: evt.Timestamp}:
+				s.dropped = 0
+			default:
+				s.dropped++
+				continue
+			}
+		}
+		select {
+		case s.ch <- evt:
+		default:
+			s.dropped++
+		}
+	}
+}
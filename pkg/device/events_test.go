@@ -0,0 +1,43 @@
+package device
+
+import "testing"
+
+func TestBusFilterAndOverflow(t *testing.T) {
+	b := NewBus()
+	lamp := b.Subscribe(EventFilter{Devices: []string{"lamp"}, Types: []string{EventStateChanged}})
+	all := b.Subscribe(EventFilter{})
+
+	b.Publish(Event{Type: EventStateChanged, DeviceID: "sensor"})
+	b.Publish(Event{Type: EventDeviceJoined, Device: &Device{ID: "lamp"}})
+	b.Publish(Event{Type: EventStateChanged, DeviceID: "lamp", State: DeviceState{"state": "ON"}})
+	if evt := <-lamp; evt.DeviceID != "lamp" || evt.Type != EventStateChanged {
+		t.Fatalf("filtered event = %+v", evt)
+	}
+	if len(lamp) != 0 || len(all) != 3 {
+		t.Fatalf("lamp has %d queued, all has %d", len(lamp), len(all))
+	}
+	if evt := <-all; evt.Type != EventStateChanged {
+		t.Fatalf("first event = %+v", evt)
+	}
+	if evt := <-all; evt.DeviceID != "lamp" {
+		t.Fatalf("DeviceID not taken from Device: %+v", evt)
+	}
+	<-all
+
+	// Overfill the buffer: the next event after draining says how many were lost.
+	for range eventBuffer + 5 {
+		b.Publish(Event{Type: EventStateChanged, DeviceID: "lamp"})
+	}
+	for range eventBuffer {
+		<-all
+	}
+	b.Publish(Event{Type: EventDeviceLeft, DeviceID: "lamp"})
+	if evt := <-all; evt.Type != EventsDropped || evt.Dropped != 5 {
+		t.Fatalf("overflow notice = %+v", evt)
+	}
+	if evt := <-all; evt.Type != EventDeviceLeft {
+		t.Fatalf("event after notice = %+v", evt)
+	}
+	b.Unsubscribe(all)
+	b.Unsubscribe(lamp)
+}
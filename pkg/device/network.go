@@ -0,0 +1,258 @@
+package device
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// TopologyMapper is implemented by controllers that can crawl the mesh and
+// report how devices are connected. Callers type-assert a Controller to it.
+type TopologyMapper interface {
+	// NetworkMap crawls neighbor and routing tables starting at the coordinator
+	NetworkMap(ctx context.Context) (*NetworkMap, error)
+}
+
+// NetworkInspector is implemented by controllers that can describe the
+// network they coordinate and the adapter they run on.
+type NetworkInspector interface {
+	// NetworkInfo returns the current network parameters and adapter details
+	NetworkInfo(ctx context.Context) (*NetworkInfo, error)
+}
+
+// NetworkInfo describes the coordinator's network and adapter.
+type NetworkInfo struct {
+	NetworkUp       bool        `json:"network_up"`
+	Channel         int         `json:"channel"`
+	PanID           string      `json:"pan_id"`          // e.g. "0x1a62"
+	ExtendedPanID   string      `json:"extended_pan_id"` // colon-separated, most significant byte first
+	TxPower         int         `json:"tx_power"`        // dBm
+	NodeType        string      `json:"node_type"`
+	CoordinatorIEEE string      `json:"coordinator_ieee"`
+	Adapter         AdapterInfo `json:"adapter"`
+}
+
+// AdapterInfo describes the coordinator adapter's protocol and firmware.
+type AdapterInfo struct {
+	Protocol        string `json:"protocol"`                   // serial protocol, e.g. "ezsp"
+	ProtocolVersion int    `json:"protocol_version"`           // e.g. EZSP 13
+	StackVersion    string `json:"stack_version"`              // e.g. "7.4.2.0"
+	FirmwareVersion string `json:"firmware_version,omitempty"` // e.g. "7.4.2.0 GA"
+	FirmwareBuild   int    `json:"firmware_build,omitempty"`
+	Manufacturer    string `json:"manufacturer,omitempty"`
+	Board           string `json:"board,omitempty"`
+}
+
+// Node type constants used in network maps
+const (
+	NodeTypeCoordinator = "coordinator"
+	NodeTypeRouter      = "router"
+	NodeTypeEndDevice   = "end_device"
+	NodeTypeUnknown     = "unknown"
+)
+
+// NetworkMap is a snapshot of the mesh topology.
+type NetworkMap struct {
+	Nodes     []NetworkNode `json:"nodes"`
+	Links     []NetworkLink `json:"links"`
+	Timestamp time.Time     `json:"timestamp"`
+}
+
+// NetworkNode is a device in the network map.
+type NetworkNode struct {
+	IEEEAddress    string `json:"ieee_address"`
+	NetworkAddress uint16 `json:"network_address"`
+	Name           string `json:"friendly_name,omitempty"`
+	Type           string `json:"type"`             // coordinator, router, end_device
+	Depth          int    `json:"depth"`            // tree depth reported by neighbors (coordinator = 0)
+	Failed         bool   `json:"failed,omitempty"` // router did not answer its table requests
+}
+
+// NetworkLink is a neighbor relationship reported by Source about Target.
+type NetworkLink struct {
+	Source       string   `json:"source"`           // IEEE address of the reporting node
+	Target       string   `json:"target"`           // IEEE address of the neighbor
+	LinkQuality  int      `json:"linkquality"`      // LQI of the link as seen by Source
+	Depth        int      `json:"depth"`            // tree depth of Target
+	Relationship string   `json:"relationship"`     // parent, child, sibling, previous_child, none
+	Routes       []uint16 `json:"routes,omitempty"` // destinations Source routes through Target
+}
+
+// DOT renders the map as a Graphviz digraph.
+func (m *NetworkMap) DOT() string {
+	var b strings.Builder
+	b.WriteString("digraph zigbee {\n")
+	b.WriteString("  node [style=filled, fontname=\"Helvetica\"];\n")
+	for _, n := range m.sortedNodes() {
+		color := "#dddddd"
+		switch n.Type {
+		case NodeTypeCoordinator:
+			color = "#e04e39"
+		case NodeTypeRouter:
+			color = "#4ea3e0"
+		case NodeTypeEndDevice:
+			color = "#fff8ce"
+		}
+		style := ""
+		if n.Failed {
+			style = ", style=\"filled,dashed\""
+		}
+		fmt.Fprintf(&b, "  %q [label=%q, fillcolor=%q%s];\n", n.IEEEAddress, nodeLabel(n, "\n"), color, style)
+	}
+	for _, l := range m.Links {
+		style := "solid"
+		if l.Relationship != "parent" && l.Relationship != "child" {
+			style = "dashed"
+		}
+		fmt.Fprintf(&b, "  %q -> %q [label=%q, style=%s];\n", l.Source, l.Target, fmt.Sprint(l.LinkQuality), style)
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// Mermaid renders the map as a Mermaid flowchart.
+func (m *NetworkMap) Mermaid() string {
+	ids := make(map[string]string, len(m.Nodes))
+	var b strings.Builder
+	b.WriteString("graph TD\n")
+	for i, n := range m.sortedNodes() {
+		id := fmt.Sprintf("n%d", i)
+		ids[n.IEEEAddress] = id
+		label := strings.ReplaceAll(nodeLabel(n, "<br/>"), `"`, "'")
+		switch n.Type {
+		case NodeTypeCoordinator:
+			fmt.Fprintf(&b, "  %s{{\"%s\"}}\n", id, label)
+		case NodeTypeRouter:
+			fmt.Fprintf(&b, "  %s[\"%s\"]\n", id, label)
+		default:
+			fmt.Fprintf(&b, "  %s(\"%s\")\n", id, label)
+		}
+	}
+	for _, l := range m.Links {
+		src, ok1 := ids[l.Source]
+		dst, ok2 := ids[l.Target]
+		if !ok1 || !ok2 {
+			continue
+		}
+		arrow := "-->"
+		if l.Relationship != "parent" && l.Relationship != "child" {
+			arrow = "-.->"
+		}
+		fmt.Fprintf(&b, "  %s %s|%d| %s\n", src, arrow, l.LinkQuality, dst)
+	}
+	return b.String()
+}
+
+// sortedNodes returns nodes ordered by depth then IEEE address, so renderings are stable.
+func (m *NetworkMap) sortedNodes() []NetworkNode {
+	nodes := append([]NetworkNode(nil), m.Nodes...)
+	sort.Slice(nodes, func(i, j int) bool {
+		if nodes[i].Depth != nodes[j].Depth {
+			return nodes[i].Depth < nodes[j].Depth
+		}
+		return nodes[i].IEEEAddress < nodes[j].IEEEAddress
+	})
+	return nodes
+}
+
+func nodeLabel(n NetworkNode, sep string) string {
+	name := n.Name
+	if name == "" {
+		name = n.IEEEAddress
+	}
+	return fmt.Sprintf("%s%s0x%04X (%s)", name, sep, n.NetworkAddress, n.Type)
+}
+
+// NetworkFormer is implemented by controllers that can form a network with
+// explicit parameters and migrate it to another channel.
+type NetworkFormer interface {
+	// FormNetwork leaves the current network and forms a new one. Unset
+	// options are chosen automatically (quietest channel, random IDs and key).
+	FormNetwork(ctx context.Context, opts FormOptions) (*NetworkInfo, error)
+	// ChangeChannel asks every device to follow the coordinator to channel
+	ChangeChannel(ctx context.Context, channel int) error
+}
+
+// FormOptions are the parameters of a network to form. Zero values mean
+// "choose automatically".
+type FormOptions struct {
+	Channel       int    `json:"channel,omitempty"`         // 11-26
+	PanID         string `json:"pan_id,omitempty"`          // hex, e.g. "0x1a62"
+	ExtendedPanID string `json:"extended_pan_id,omitempty"` // colon-separated, most significant byte first
+	NetworkKey    string `json:"network_key,omitempty"`     // 32 hex digits
+	TxPower       *int   `json:"tx_power,omitempty"`        // dBm
+}
+
+// ChannelScanner is implemented by controllers that can survey the radio
+// environment for channel planning.
+type ChannelScanner interface {
+	// EnergyScan measures energy per channel. No channels means 11-26; a zero
+	// duration selects the default scan time.
+	EnergyScan(ctx context.Context, channels []int, duration int) ([]ChannelEnergy, error)
+	// ActiveScan lists neighbouring Zigbee networks that answer beacon requests
+	ActiveScan(ctx context.Context, channels []int, duration int) ([]PANInfo, error)
+}
+
+// ChannelEnergy is the energy detected on one channel. Lower is quieter.
+type ChannelEnergy struct {
+	Channel int  `json:"channel"`
+	RSSI    int  `json:"rssi"`              // dBm
+	Current bool `json:"current,omitempty"` // the coordinator's network is on this channel
+}
+
+// PANInfo is a network found by an active scan.
+type PANInfo struct {
+	Channel       int    `json:"channel"`
+	PanID         string `json:"pan_id"`
+	ExtendedPanID string `json:"extended_pan_id"`
+	PermitJoining bool   `json:"permit_joining"`
+	StackProfile  int    `json:"stack_profile"` // 2 = Zigbee PRO
+	NwkUpdateID   int    `json:"nwk_update_id"`
+	LinkQuality   int    `json:"linkquality"`
+	RSSI          int    `json:"rssi"`
+	Own           bool   `json:"own,omitempty"` // beacon from a router of the coordinator's own network
+}
+
+// KeyManager is implemented by controllers that can rotate the network key
+// and report per-device Trust Center link keys.
+type KeyManager interface {
+	// RotateNetworkKey distributes a fresh network key and switches to it
+	RotateNetworkKey(ctx context.Context) (*KeyRotation, error)
+	// KeyTable reports the network key state and each device's TC link key
+	KeyTable(ctx context.Context) (*KeyTable, error)
+}
+
+// KeyRotation is the outcome of a network key rotation.
+type KeyRotation struct {
+	PreviousSequence     int    `json:"previous_sequence"`
+	Sequence             int    `json:"sequence"`
+	PreviousFrameCounter uint32 `json:"previous_frame_counter"`
+	FrameCounter         uint32 `json:"frame_counter"`
+}
+
+// KeyTable describes the coordinator's keys without exposing key material.
+type KeyTable struct {
+	NetworkKeySequence     int           `json:"network_key_sequence"`
+	NetworkKeyFrameCounter uint32        `json:"network_key_frame_counter"`
+	LinkKeys               []LinkKeyInfo `json:"link_keys"`
+}
+
+// Link key status values reported in LinkKeyInfo.
+const (
+	LinkKeyStatusUnknown  = "unknown"  // no key exchange seen since tracking began
+	LinkKeyStatusKeySent  = "key_sent" // TC answered the device's key request
+	LinkKeyStatusVerified = "verified" // device confirmed its unique TC link key
+	LinkKeyStatusFailed   = "failed"   // key request or verification failed
+)
+
+// LinkKeyInfo is a device's Trust Center link key state.
+type LinkKeyInfo struct {
+	IEEEAddress          string `json:"ieee_address"`
+	Name                 string `json:"friendly_name,omitempty"`
+	Status               string `json:"status"`
+	InKeyTable           bool   `json:"in_key_table"` // a unique key is stored on the coordinator
+	OutgoingFrameCounter uint32 `json:"outgoing_frame_counter,omitempty"`
+	IncomingFrameCounter uint32 `json:"incoming_frame_counter,omitempty"`
+}
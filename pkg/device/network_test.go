@@ -0,0 +1,53 @@
+package device
+
+import (
+	"strings"
+	"testing"
+)
+
+func sampleMap() *NetworkMap {
+	return &NetworkMap{
+		Nodes: []NetworkNode{
+			{IEEEAddress: "00:00:00:00:00:00:00:01", NetworkAddress: 0x0000, Name: "Coordinator", Type: NodeTypeCoordinator},
+			{IEEEAddress: "00:00:00:00:00:00:00:02", NetworkAddress: 0x1234, Name: "hall-plug", Type: NodeTypeRouter, Depth: 1},
+			{IEEEAddress: "00:00:00:00:00:00:00:03", NetworkAddress: 0x5678, Name: "porch-sensor", Type: NodeTypeEndDevice, Depth: 2},
+		},
+		Links: []NetworkLink{
+			{Source: "00:00:00:00:00:00:00:01", Target: "00:00:00:00:00:00:00:02", LinkQuality: 200, Depth: 1, Relationship: "child"},
+			{Source: "00:00:00:00:00:00:00:02", Target: "00:00:00:00:00:00:00:03", LinkQuality: 90, Depth: 2, Relationship: "child"},
+			{Source: "00:00:00:00:00:00:00:02", Target: "00:00:00:00:00:00:00:01", LinkQuality: 180, Depth: 0, Relationship: "sibling"},
+		},
+	}
+}
+
+func TestNetworkMap_DOT(t *testing.T) {
+	dot := sampleMap().DOT()
+	if !strings.HasPrefix(dot, "digraph zigbee {") {
+		t.Fatalf("expected digraph header, got: %s", dot)
+	}
+	for _, want := range []string{
+		`"00:00:00:00:00:00:00:02" -> "00:00:00:00:00:00:00:03" [label="90", style=solid];`,
+		`"00:00:00:00:00:00:00:02" -> "00:00:00:00:00:00:00:01" [label="180", style=dashed];`,
+		`porch-sensor\n0x5678 (end_device)`,
+	} {
+		if !strings.Contains(dot, want) {
+			t.Errorf("DOT output missing %q:\n%s", want, dot)
+		}
+	}
+}
+
+func TestNetworkMap_Mermaid(t *testing.T) {
+	mmd := sampleMap().Mermaid()
+	for _, want := range []string{
+		"graph TD",
+		`n0{{"Coordinator<br/>0x0000 (coordinator)"}}`,
+		`n1["hall-plug<br/>0x1234 (router)"]`,
+		`n2("porch-sensor<br/>0x5678 (end_device)")`,
+		"n0 -->|200| n1",
+		"n1 -.->|180| n0",
+	} {
+		if !strings.Contains(mmd, want) {
+			t.Errorf("Mermaid output missing %q:\n%s", want, mmd)
+		}
+	}
+}
@@ -57,12 +57,12 @@ func NewNullEventSubscriber() *NullEventSubscriber {
 	return &NullEventSubscriber{}
 }
 
-func (s *NullEventSubscriber) Subscribe() chan DiscoveryEvent {
-	ch := make(chan DiscoveryEvent)
+func (s *NullEventSubscriber) Subscribe(_ EventFilter) chan Event {
+	ch := make(chan Event)
 	// Channel is never sent to; callers should check IsConnected() on the controller
 	return ch
 }
 
-func (s *NullEventSubscriber) Unsubscribe(ch chan DiscoveryEvent) {
+func (s *NullEventSubscriber) Unsubscribe(ch chan Event) {
 	close(ch)
 }
@@ -0,0 +1,480 @@
+package device
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Registry multiplexes several controllers, each owning one network, behind a
+// single Controller and EventSubscriber. Device IDs are qualified with the
+// network name ("network/ieee") so they stay unique across networks; a bare
+// ID or friendly name is accepted when it matches exactly one device.
+//
+// Network-level operations (info, map, backup, forming, scans, keys) act on
+// the network named by WithNetwork, or on the only one registered.
+type Registry struct {
+	backends   []*registryBackend
+	backendsMu sync.RWMutex
+
+	events *Bus
+}
+
+type registryBackend struct {
+	name   string
+	c      Controller
+	events EventSubscriber
+	ch     chan Event
+}
+
+// NewRegistry creates an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{events: NewBus()}
+}
+
+// Register adds a controller under a network name. events may be nil.
+func (r *Registry) Register(name string, c Controller, events EventSubscriber) error {
+	if name == "" || strings.Contains(name, "/") {
+		return fmt.Errorf("%w: network name %q must be non-empty and contain no '/'", ErrValidation, name)
+	}
+	r.backendsMu.Lock()
+	defer r.backendsMu.Unlock()
+	for _, b := range r.backends {
+		if b.name == name {
+			return fmt.Errorf("%w: network %q registered twice", ErrValidation, name)
+		}
+	}
+	b := &registryBackend{name: name, c: c, events: events}
+	r.backends = append(r.backends, b)
+	if events != nil {
+		b.ch = events.Subscribe(EventFilter{})
+		go r.forward(b)
+	}
+	return nil
+}
+
+// Networks returns the registered network names in registration order.
+func (r *Registry) Networks() []string {
+	r.backendsMu.RLock()
+	defer r.backendsMu.RUnlock()
+	names := make([]string, len(r.backends))
+	for i, b := range r.backends {
+		names[i] = b.name
+	}
+	return names
+}
+
+// Backend returns the controller registered under name.
+func (r *Registry) Backend(name string) (Controller, bool) {
+	r.backendsMu.RLock()
+	defer r.backendsMu.RUnlock()
+	for _, b := range r.backends {
+		if b.name == name {
+			return b.c, true
+		}
+	}
+	return nil, false
+}
+
+// QualifyDeviceID joins a network name and a backend device ID.
+func QualifyDeviceID(network, id string) string { return network + "/" + id }
+
+// SplitDeviceID splits a qualified device ID into network and backend ID.
+func SplitDeviceID(id string) (network, local string, ok bool) {
+	return strings.Cut(id, "/")
+}
+
+func (r *Registry) all() []*registryBackend {
+	r.backendsMu.RLock()
+	defer r.backendsMu.RUnlock()
+	return append([]*registryBackend(nil), r.backends...)
+}
+
+// resolve finds the backend owning a device and the ID it knows it by. An ID
+// is only taken as qualified when its first segment names a network holding
+// the rest, so a friendly name containing '/' still resolves as a bare name.
+func (r *Registry) resolve(ctx context.Context, id string) (*registryBackend, string, error) {
+	backends := r.all()
+	if network, local, ok := SplitDeviceID(id); ok {
+		for _, b := range backends {
+			if b.name != network {
+				continue
+			}
+			if _, err := b.c.GetDevice(ctx, local); err == nil {
+				return b, local, nil
+			}
+		}
+	}
+	if len(backends) == 1 {
+		return backends[0], id, nil
+	}
+	var owner *registryBackend
+	for _, b := range backends {
+		if _, err := b.c.GetDevice(ctx, id); err != nil {
+			continue
+		}
+		if owner != nil {
+			return nil, "", fmt.Errorf("%w: %q exists on networks %q and %q; use network/id", ErrValidation, id, owner.name, b.name)
+		}
+		owner = b
+	}
+	if owner == nil {
+		return nil, "", ErrNotFound
+	}
+	return owner, id, nil
+}
+
+// network returns the backend selected by WithNetwork, or the only one.
+func (r *Registry) network(ctx context.Context) (*registryBackend, error) {
+	backends := r.all()
+	name := Network(ctx)
+	if name == "" {
+		switch len(backends) {
+		case 0:
+			return nil, ErrNotConnected
+		case 1:
+			return backends[0], nil
+		}
+		return nil, fmt.Errorf("%w: %d networks configured, choose one with --network", ErrValidation, len(backends))
+	}
+	for _, b := range backends {
+		if b.name == name {
+			return b, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: unknown network %q", ErrValidation, name)
+}
+
+// scoped returns the backends an operation applies to: the one selected by
+// WithNetwork, or all of them.
+func (r *Registry) scoped(ctx context.Context) ([]*registryBackend, error) {
+	if Network(ctx) == "" {
+		return r.all(), nil
+	}
+	b, err := r.network(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return []*registryBackend{b}, nil
+}
+
+func qualify(network string, d *Device) *Device {
+	q := *d
+	q.ID = QualifyDeviceID(network, d.ID)
+	return &q
+}
+
+// --- Controller ---
+
+// ListDevices merges the devices of every reachable network. It fails only
+// when no network could be listed.
+func (r *Registry) ListDevices(ctx context.Context) ([]Device, error) {
+	var devices []Device
+	var firstErr error
+	listed := false
+	for _, b := range r.all() {
+		ds, err := b.c.ListDevices(ctx)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("network %s: %w", b.name, err)
+			}
+			continue
+		}
+		listed = true
+		for i := range ds {
+			devices = append(devices, *qualify(b.name, &ds[i]))
+		}
+	}
+	if !listed && firstErr != nil {
+		return nil, firstErr
+	}
+	if devices == nil {
+		devices = []Device{}
+	}
+	return devices, nil
+}
+
+func (r *Registry) GetDevice(ctx context.Context, id string) (*Device, error) {
+	b, local, err := r.resolve(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	d, err := b.c.GetDevice(ctx, local)
+	if err != nil {
+		return nil, err
+	}
+	return qualify(b.name, d), nil
+}
+
+func (r *Registry) RenameDevice(ctx context.Context, id, newName string) error {
+	if strings.Contains(newName, "/") {
+		return fmt.Errorf("%w: device name %q must contain no '/'", ErrValidation, newName)
+	}
+	b, local, err := r.resolve(ctx, id)
+	if err != nil {
+		return err
+	}
+	return b.c.RenameDevice(ctx, local, newName)
+}
+
+func (r *Registry) RemoveDevice(ctx context.Context, id string, force bool) error {
+	b, local, err := r.resolve(ctx, id)
+	if err != nil {
+		return err
+	}
+	return b.c.RemoveDevice(ctx, local, force)
+}
+
+// ClearDevices clears the network selected by WithNetwork, or every network.
+func (r *Registry) ClearDevices(ctx context.Context) error {
+	backends, err := r.scoped(ctx)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, b := range backends {
+		if err := b.c.ClearDevices(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("network %s: %w", b.name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (r *Registry) GetDeviceState(ctx context.Context, id string) (DeviceState, error) {
+	b, local, err := r.resolve(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return b.c.GetDeviceState(ctx, local)
+}
+
+func (r *Registry) SetDeviceState(ctx context.Context, id string, state map[string]any) (DeviceState, error) {
+	b, local, err := r.resolve(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return b.c.SetDeviceState(ctx, local, state)
+}
+
+// PermitJoin opens or closes joining on the network selected by WithNetwork,
+// or on every network. It succeeds if any network accepted the request.
+func (r *Registry) PermitJoin(ctx context.Context, enable bool, duration int) error {
+	backends, err := r.scoped(ctx)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, b := range backends {
+		if err := b.c.PermitJoin(ctx, enable, duration); err != nil {
+			errs = append(errs, fmt.Errorf("network %s: %w", b.name, err))
+		}
+	}
+	if len(errs) == len(backends) {
+		return errors.Join(errs...)
+	}
+	return nil
+}
+
+// IsConnected reports whether any network's controller is connected.
+func (r *Registry) IsConnected() bool {
+	for _, b := range r.all() {
+		if b.c.IsConnected() {
+			return true
+		}
+	}
+	return false
+}
+
+// Close stops event forwarding and closes every controller.
+func (r *Registry) Close() {
+	for _, b := range r.all() {
+		if b.events != nil {
+			b.events.Unsubscribe(b.ch)
+		}
+		b.c.Close()
+	}
+}
+
+// --- EventSubscriber ---
+
+// Subscribe filters on qualified device IDs ("network/ieee").
+func (r *Registry) Subscribe(filter EventFilter) chan Event {
+	return r.events.Subscribe(filter)
+}
+
+func (r *Registry) Unsubscribe(ch chan Event) {
+	r.events.Unsubscribe(ch)
+}
+
+// forward relays a backend's events with qualified device IDs until the
+// backend closes its channel.
+func (r *Registry) forward(b *registryBackend) {
+	for evt := range b.ch {
+		if evt.Device != nil {
+			evt.Device = qualify(b.name, evt.Device)
+		}
+		if evt.DeviceID != "" {
+			evt.DeviceID = QualifyDeviceID(b.name, evt.DeviceID)
+		}
+		if evt.Parent != "" {
+			evt.Parent = QualifyDeviceID(b.name, evt.Parent)
+		}
+		r.events.Publish(evt)
+	}
+}
+
+// --- network-level interfaces ---
+
+func (r *Registry) NetworkInfo(ctx context.Context) (*NetworkInfo, error) {
+	b, err := r.network(ctx)
+	if err != nil {
+		return nil, err
+	}
+	inspector, ok := b.c.(NetworkInspector)
+	if !ok {
+		return nil, ErrUnsupported
+	}
+	return inspector.NetworkInfo(ctx)
+}
+
+func (r *Registry) NetworkMap(ctx context.Context) (*NetworkMap, error) {
+	b, err := r.network(ctx)
+	if err != nil {
+		return nil, err
+	}
+	mapper, ok := b.c.(TopologyMapper)
+	if !ok {
+		return nil, ErrUnsupported
+	}
+	return mapper.NetworkMap(ctx)
+}
+
+func (r *Registry) BackupNetwork(ctx context.Context) (*NetworkBackup, error) {
+	b, err := r.network(ctx)
+	if err != nil {
+		return nil, err
+	}
+	backuper, ok := b.c.(NetworkBackuper)
+	if !ok {
+		return nil, ErrUnsupported
+	}
+	return backuper.BackupNetwork(ctx)
+}
+
+func (r *Registry) RestoreNetwork(ctx context.Context, backup *NetworkBackup, overwriteIEEE bool) error {
+	b, err := r.network(ctx)
+	if err != nil {
+		return err
+	}
+	backuper, ok := b.c.(NetworkBackuper)
+	if !ok {
+		return ErrUnsupported
+	}
+	return backuper.RestoreNetwork(ctx, backup, overwriteIEEE)
+}
+
+func (r *Registry) FormNetwork(ctx context.Context, opts FormOptions) (*NetworkInfo, error) {
+	b, err := r.network(ctx)
+	if err != nil {
+		return nil, err
+	}
+	former, ok := b.c.(NetworkFormer)
+	if !ok {
+		return nil, ErrUnsupported
+	}
+	return former.FormNetwork(ctx, opts)
+}
+
+func (r *Registry) ChangeChannel(ctx context.Context, channel int) error {
+	b, err := r.network(ctx)
+	if err != nil {
+		return err
+	}
+	former, ok := b.c.(NetworkFormer)
+	if !ok {
+		return ErrUnsupported
+	}
+	return former.ChangeChannel(ctx, channel)
+}
+
+func (r *Registry) EnergyScan(ctx context.Context, channels []int, duration int) ([]ChannelEnergy, error) {
+	b, err := r.network(ctx)
+	if err != nil {
+		return nil, err
+	}
+	scanner, ok := b.c.(ChannelScanner)
+	if !ok {
+		return nil, ErrUnsupported
+	}
+	return scanner.EnergyScan(ctx, channels, duration)
+}
+
+func (r *Registry) ActiveScan(ctx context.Context, channels []int, duration int) ([]PANInfo, error) {
+	b, err := r.network(ctx)
+	if err != nil {
+		return nil, err
+	}
+	scanner, ok := b.c.(ChannelScanner)
+	if !ok {
+		return nil, ErrUnsupported
+	}
+	return scanner.ActiveScan(ctx, channels, duration)
+}
+
+func (r *Registry) RotateNetworkKey(ctx context.Context) (*KeyRotation, error) {
+	b, err := r.network(ctx)
+	if err != nil {
+		return nil, err
+	}
+	km, ok := b.c.(KeyManager)
+	if !ok {
+		return nil, ErrUnsupported
+	}
+	return km.RotateNetworkKey(ctx)
+}
+
+func (r *Registry) KeyTable(ctx context.Context) (*KeyTable, error) {
+	b, err := r.network(ctx)
+	if err != nil {
+		return nil, err
+	}
+	km, ok := b.c.(KeyManager)
+	if !ok {
+		return nil, ErrUnsupported
+	}
+	return km.KeyTable(ctx)
+}
+
+func (r *Registry) AddInstallCode(ctx context.Context, ieee, code string) (string, error) {
+	b, err := r.network(ctx)
+	if err != nil {
+		return "", err
+	}
+	joiner, ok := b.c.(InstallCodeJoiner)
+	if !ok {
+		return "", ErrUnsupported
+	}
+	return joiner.AddInstallCode(ctx, ieee, code)
+}
+
+// PermitJoinVia opens joining through a router on the router's network, or
+// on every router of the selected network when via is PermitJoinViaAll.
+func (r *Registry) PermitJoinVia(ctx context.Context, via string, duration int) error {
+	var b *registryBackend
+	var err error
+	if via == PermitJoinViaAll {
+		b, err = r.network(ctx)
+	} else {
+		b, via, err = r.resolve(ctx, via)
+	}
+	if err != nil {
+		return err
+	}
+	joiner, ok := b.c.(TargetedJoiner)
+	if !ok {
+		return ErrUnsupported
+	}
+	return joiner.PermitJoinVia(ctx, via, duration)
+}
@@ -0,0 +1,172 @@
+package device
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// fakeController is an in-memory controller for one network.
+type fakeController struct {
+	NullController
+	NullEventSubscriber
+	devices map[string]*Device
+	state   map[string]DeviceState
+	events  chan Event
+	info    *NetworkInfo
+}
+
+func newFake(channel int, devices ...Device) *fakeController {
+	f := &fakeController{
+		devices: make(map[string]*Device),
+		state:   make(map[string]DeviceState),
+		events:  make(chan Event, 4),
+		info:    &NetworkInfo{Channel: channel},
+	}
+	for i := range devices {
+		f.devices[devices[i].ID] = &devices[i]
+	}
+	return f
+}
+
+func (f *fakeController) lookup(id string) *Device {
+	if d, ok := f.devices[id]; ok {
+		return d
+	}
+	for _, d := range f.devices {
+		if d.Name == id {
+			return d
+		}
+	}
+	return nil
+}
+
+func (f *fakeController) ListDevices(context.Context) ([]Device, error) {
+	out := []Device{}
+	for _, d := range f.devices {
+		out = append(out, *d)
+	}
+	return out, nil
+}
+
+func (f *fakeController) GetDevice(_ context.Context, id string) (*Device, error) {
+	if d := f.lookup(id); d != nil {
+		c := *d
+		return &c, nil
+	}
+	return nil, ErrNotFound
+}
+
+func (f *fakeController) SetDeviceState(_ context.Context, id string, state map[string]any) (DeviceState, error) {
+	d := f.lookup(id)
+	if d == nil {
+		return nil, ErrNotFound
+	}
+	f.state[d.ID] = state
+	return state, nil
+}
+
+func (f *fakeController) IsConnected() bool                                 { return true }
+func (f *fakeController) Subscribe(EventFilter) chan Event                  { return f.events }
+func (f *fakeController) Unsubscribe(ch chan Event)                         { close(ch) }
+func (f *fakeController) NetworkInfo(context.Context) (*NetworkInfo, error) { return f.info, nil }
+
+func newTestRegistry(t *testing.T) (*Registry, *fakeController, *fakeController) {
+	t.Helper()
+	home := newFake(15, Device{ID: "00:00:00:00:00:00:00:01", Name: "porch"}, Device{ID: "00:00:00:00:00:00:00:02", Name: "lamp"})
+	barn := newFake(20, Device{ID: "00:00:00:00:00:00:00:03", Name: "lamp"})
+	r := NewRegistry()
+	if err := r.Register("home", home, home); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Register("barn", barn, barn); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Register("home", home, nil); !errors.Is(err, ErrValidation) {
+		t.Errorf("duplicate network: err = %v", err)
+	}
+	return r, home, barn
+}
+
+func TestRegistryRouting(t *testing.T) {
+	r, home, barn := newTestRegistry(t)
+	ctx := context.Background()
+
+	devices, err := r.ListDevices(ctx)
+	if err != nil || len(devices) != 3 {
+		t.Fatalf("ListDevices = %v, %v", devices, err)
+	}
+	d, err := r.GetDevice(ctx, "porch")
+	if err != nil || d.ID != "home/00:00:00:00:00:00:00:01" {
+		t.Fatalf("GetDevice(porch) = %+v, %v", d, err)
+	}
+
+	if _, err := r.SetDeviceState(ctx, "barn/lamp", map[string]any{"state": "ON"}); err != nil {
+		t.Fatal(err)
+	}
+	if barn.state["00:00:00:00:00:00:00:03"] == nil || home.state["00:00:00:00:00:00:00:02"] != nil {
+		t.Error("barn/lamp not routed to the barn network")
+	}
+	if _, err := r.SetDeviceState(ctx, "lamp", map[string]any{"state": "ON"}); !errors.Is(err, ErrValidation) {
+		t.Errorf("ambiguous name: err = %v", err)
+	}
+	if _, err := r.GetDevice(ctx, "cellar/lamp"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("unknown network: err = %v", err)
+	}
+
+	if _, err := r.NetworkInfo(ctx); !errors.Is(err, ErrValidation) {
+		t.Errorf("NetworkInfo without network: err = %v", err)
+	}
+	info, err := r.NetworkInfo(WithNetwork(ctx, "barn"))
+	if err != nil || info.Channel != 20 {
+		t.Errorf("NetworkInfo(barn) = %+v, %v", info, err)
+	}
+}
+
+func TestRegistrySlashInName(t *testing.T) {
+	home := newFake(15, Device{ID: "00:00:00:00:00:00:00:01", Name: "barn/door"})
+	barn := newFake(20, Device{ID: "00:00:00:00:00:00:00:02", Name: "door"})
+	r := NewRegistry()
+	if err := r.Register("home", home, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Register("barn", barn, nil); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	// "barn/door" is both a name on home and a qualified ID on barn; the
+	// qualified ID wins.
+	d, err := r.GetDevice(ctx, "barn/door")
+	if err != nil || d.ID != "barn/00:00:00:00:00:00:00:02" {
+		t.Errorf("GetDevice(barn/door) = %+v, %v", d, err)
+	}
+	// A name whose first segment is a network but the rest is not a device
+	// there resolves as a bare name.
+	home.devices["00:00:00:00:00:00:00:01"].Name = "barn/shed"
+	d, err = r.GetDevice(ctx, "barn/shed")
+	if err != nil || d.ID != "home/00:00:00:00:00:00:00:01" {
+		t.Errorf("GetDevice(barn/shed) = %+v, %v", d, err)
+	}
+
+	if err := r.RenameDevice(ctx, "home/00:00:00:00:00:00:00:01", "barn/door"); !errors.Is(err, ErrValidation) {
+		t.Errorf("rename to barn/door: err = %v, want ErrValidation", err)
+	}
+}
+
+func TestRegistryEvents(t *testing.T) {
+	r, _, barn := newTestRegistry(t)
+	events := r.Subscribe(EventFilter{})
+	defer r.Unsubscribe(events)
+
+	barn.events <- Event{Type: "device_joined", Device: &Device{ID: "00:00:00:00:00:00:00:04"}, Parent: "00:00:00:00:00:00:00:03"}
+	select {
+	case evt := <-events:
+		if evt.Device.ID != "barn/00:00:00:00:00:00:00:04" || evt.DeviceID != evt.Device.ID || evt.Parent != "barn/00:00:00:00:00:00:00:03" {
+			t.Errorf("event = %+v", evt)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("event not forwarded")
+	}
+}
@@ -7,26 +7,29 @@ import (
 
 // Device represents a protocol-agnostic smart home device
 type Device struct {
-	ID           string          `json:"id"`           // Unique identifier (e.g., IEEE address for Zigbee)
-	Name         string          `json:"name"`         // User-friendly name
-	Type         string          `json:"type"`         // Device type (light, switch, sensor, etc.)
-	Protocol     string          `json:"protocol"`     // Protocol (zigbee, zwave, matter, wifi)
-	Manufacturer string          `json:"manufacturer"` // Device manufacturer/vendor
-	Model        string          `json:"model"`        // Device model
-	StateSchema  json.RawMessage `json:"state_schema"` // JSON Schema for settable state
-	Exposes      json.RawMessage `json:"exposes"`      // Raw protocol capability data
+	ID           string          `json:"id"`                    // Unique identifier (e.g., IEEE address for Zigbee)
+	Name         string          `json:"name"`                  // User-friendly name
+	Type         string          `json:"type"`                  // Device type (light, switch, sensor, etc.)
+	Protocol     string          `json:"protocol"`              // Protocol (zigbee, zwave, matter, wifi)
+	Manufacturer string          `json:"manufacturer"`          // Device manufacturer/vendor
+	Model        string          `json:"model"`                 // Device model
+	StateSchema  json.RawMessage `json:"state_schema"`          // JSON Schema for settable state
+	Exposes      json.RawMessage `json:"exposes"`               // Capabilities as JSON; see Device.Capabilities
+	Available    bool            `json:"available"`             // Whether the device is currently reachable
+	LastSeen     time.Time       `json:"last_seen,omitzero"`    // When the device last sent traffic
+	LinkQuality  *int            `json:"linkquality,omitempty"` // Link quality (0-255) of the last received frame; nil until one is received
+
+	// Last-known state, without querying the device. StateStale is set while
+	// any of its keys is a copy restored at startup that the device has not
+	// yet confirmed.
+	State          DeviceState `json:"state,omitempty"`
+	StateUpdatedAt time.Time   `json:"state_updated_at,omitzero"`
+	StateStale     bool        `json:"state_stale,omitempty"`
 }
 
 // DeviceState represents the current state of a device as a dynamic map.
 type DeviceState map[string]any
 
-// DiscoveryEvent represents a device discovery event
-type DiscoveryEvent struct {
-	Type      string    `json:"type"`             // Event type (device_joined, device_left, etc.)
-	Device    *Device   `json:"device,omitempty"` // Device information if available
-	Timestamp time.Time `json:"timestamp"`        // When the event occurred
-}
-
 // Protocol constants
 const (
 	ProtocolZigbee = "zigbee"
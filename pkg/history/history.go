@@ -0,0 +1,328 @@
+// Package history keeps an append-only record of device state changes and
+// events in daily NDJSON segment files, with retention and downsampling of
+// old segments.
+package history
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/urmzd/zigbee-skill/pkg/device"
+)
+
+// Segment files are named by UTC day; downsampled segments get an extra
+// suffix so they are not downsampled twice.
+const (
+	dayLayout         = "2006-01-02"
+	segmentExt        = ".ndjson"
+	downsampledSuffix = ".downsampled"
+)
+
+// Record is one state change or event of a device. State changes set Property
+// and Value; events set Event. Downsampled numeric samples carry the mean as
+// Value along with Min, Max and the number of samples in Count.
+type Record struct {
+	Time     time.Time `json:"time"`
+	Device   string    `json:"device"`
+	Property string    `json:"property,omitempty"`
+	Value    any       `json:"value,omitempty"`
+	Event    string    `json:"event,omitempty"`
+	Min      *float64  `json:"min,omitempty"`
+	Max      *float64  `json:"max,omitempty"`
+	Count    int       `json:"count,omitempty"`
+}
+
+// Query selects records of one device.
+type Query struct {
+	Property string    // only changes of this property; empty includes events
+	Since    time.Time // zero means from the oldest record
+	Until    time.Time // zero means up to now
+}
+
+// Reader answers history queries for a device ID or friendly name.
+type Reader interface {
+	History(ctx context.Context, id string, q Query) ([]Record, error)
+}
+
+// Options configure a Store.
+type Options struct {
+	Dir string
+	// Retention is how long records are kept; 0 keeps them forever.
+	Retention time.Duration
+	// FullResolution is how long every numeric change is kept before it is
+	// averaged into Interval buckets; 0 never downsamples.
+	FullResolution time.Duration
+	// Interval is the downsampling bucket (default one hour).
+	Interval time.Duration
+}
+
+// Store is a file-backed history. It is safe for concurrent use.
+type Store struct {
+	opts Options
+
+	// compact is held for reading by Query and for writing by Compact, so
+	// segments are not rewritten or removed while a query reads them.
+	// Queries read files without mu and so do not hold up recording.
+	compact sync.RWMutex
+
+	mu   sync.Mutex
+	file *os.File // segment of the current day
+	day  string
+	last map[string]map[string]any // device -> property -> last recorded value
+}
+
+// Open creates the history directory if needed and returns a store that
+// appends to it. The newest segment is read so values that have not changed
+// since the last run are not recorded again.
+func Open(opts Options) (*Store, error) {
+	if opts.Interval <= 0 {
+		opts.Interval = time.Hour
+	}
+	if err := os.MkdirAll(opts.Dir, 0755); err != nil {
+		return nil, fmt.Errorf("create history dir: %w", err)
+	}
+	s := &Store{opts: opts, last: make(map[string]map[string]any)}
+	segs, err := s.segments()
+	if err != nil {
+		return nil, err
+	}
+	if len(segs) > 0 {
+		err := readSegment(segs[len(segs)-1].path, func(r Record) {
+			if r.Property == "" {
+				return
+			}
+			if s.last[r.Device] == nil {
+				s.last[r.Device] = make(map[string]any)
+			}
+			s.last[r.Device][r.Property] = r.Value
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// RecordState records the properties of state that changed since the last
+// call for the device.
+func (s *Store) RecordState(dev string, state device.DeviceState, t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	last := s.last[dev]
+	if last == nil {
+		last = make(map[string]any)
+		s.last[dev] = last
+	}
+	var recs []Record
+	for _, k := range slices.Sorted(maps.Keys(state)) {
+		v := state[k]
+		if v == nil {
+			continue
+		}
+		if prev, ok := last[k]; ok && sameValue(prev, v) {
+			continue
+		}
+		last[k] = v
+		recs = append(recs, Record{Time: t, Device: dev, Property: k, Value: v})
+	}
+	return s.append(recs)
+}
+
+// RecordEvent records a device event such as device_joined.
+func (s *Store) RecordEvent(dev, event string, t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.append([]Record{{Time: t, Device: dev, Event: event}})
+}
+
+// append writes recs to the segment of their day. Must be called with mu held.
+func (s *Store) append(recs []Record) error {
+	if len(recs) == 0 {
+		return nil
+	}
+	day := recs[0].Time.UTC().Format(dayLayout)
+	if s.file == nil || s.day != day {
+		if s.file != nil {
+			_ = s.file.Close()
+			s.file = nil
+		}
+		f, err := os.OpenFile(filepath.Join(s.opts.Dir, day+segmentExt), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return fmt.Errorf("open history segment: %w", err)
+		}
+		s.file, s.day = f, day
+	}
+	var buf []byte
+	for _, r := range recs {
+		line, err := json.Marshal(r)
+		if err != nil {
+			return fmt.Errorf("marshal history record: %w", err)
+		}
+		buf = append(append(buf, line...), '\n')
+	}
+	if _, err := s.file.Write(buf); err != nil {
+		return fmt.Errorf("write history: %w", err)
+	}
+	return nil
+}
+
+// Query returns the records of dev matching q, oldest first.
+func (s *Store) Query(dev string, q Query) ([]Record, error) {
+	s.compact.RLock()
+	defer s.compact.RUnlock()
+	until := q.Until
+	if until.IsZero() {
+		until = time.Now()
+	}
+	s.mu.Lock()
+	segs, err := s.segments()
+	s.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	out := []Record{}
+	for _, seg := range segs {
+		if (!q.Since.IsZero() && seg.end().Before(q.Since)) || seg.start.After(until) {
+			continue
+		}
+		err := readSegment(seg.path, func(r Record) {
+			if r.Device != dev || r.Time.Before(q.Since) || r.Time.After(until) {
+				return
+			}
+			if q.Property != "" && r.Property != q.Property {
+				return
+			}
+			out = append(out, r)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Time.Before(out[j].Time) })
+	return out, nil
+}
+
+// Close closes the current segment.
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+// sameValue compares state values, treating numbers read back from a segment
+// as float64 equal to the ints backends report.
+func sameValue(a, b any) bool {
+	fa, aNum := toFloat(a)
+	fb, bNum := toFloat(b)
+	if aNum && bNum {
+		return fa == fb
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func toFloat(v any) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case int:
+		return float64(n), true
+	}
+	return 0, false
+}
+
+// WriteCSV writes records as CSV with a header row.
+func WriteCSV(w io.Writer, recs []Record) error {
+	cw := csv.NewWriter(w)
+	_ = cw.Write([]string{"time", "device", "property", "value", "event", "min", "max", "count"})
+	for _, r := range recs {
+		row := []string{r.Time.UTC().Format(time.RFC3339Nano), r.Device, r.Property, "", r.Event, "", "", ""}
+		if r.Value != nil {
+			row[3] = fmt.Sprint(r.Value)
+		}
+		if r.Count > 0 {
+			row[5] = strconv.FormatFloat(*r.Min, 'f', -1, 64)
+			row[6] = strconv.FormatFloat(*r.Max, 'f', -1, 64)
+			row[7] = strconv.Itoa(r.Count)
+		}
+		_ = cw.Write(row)
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// segment is one day's file.
+type segment struct {
+	path        string
+	day         string
+	start       time.Time
+	downsampled bool
+}
+
+func (g segment) end() time.Time { return g.start.Add(24 * time.Hour) }
+
+// segments lists the segment files in day order. Must be called with mu held.
+func (s *Store) segments() ([]segment, error) {
+	entries, err := os.ReadDir(s.opts.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("read history dir: %w", err)
+	}
+	var segs []segment
+	for _, e := range entries {
+		name, ok := strings.CutSuffix(e.Name(), segmentExt)
+		if !ok || e.IsDir() {
+			continue
+		}
+		day, downsampled := strings.CutSuffix(name, downsampledSuffix)
+		start, err := time.Parse(dayLayout, day)
+		if err != nil {
+			continue
+		}
+		segs = append(segs, segment{path: filepath.Join(s.opts.Dir, e.Name()), day: day, start: start, downsampled: downsampled})
+	}
+	sort.Slice(segs, func(i, j int) bool { return segs[i].start.Before(segs[j].start) })
+	return segs, nil
+}
+
+// readSegment calls fn for every record in the file. Lines that do not
+// parse, such as one torn by a crash mid-write, are skipped.
+func readSegment(path string, fn func(Record)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("open history segment: %w", err)
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for sc.Scan() {
+		var r Record
+		if json.Unmarshal(sc.Bytes(), &r) == nil {
+			fn(r)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return fmt.Errorf("read history segment: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package history
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/urmzd/zigbee-skill/pkg/device"
+)
+
+func TestStoreQueryAndCompact(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(Options{Dir: dir, Retention: 30 * 24 * time.Hour, FullResolution: 48 * time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	const porch, bedroom = "00:15:8d:00:01:a2:b3:c4", "00:15:8d:00:01:a2:b3:c5"
+	now := time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC)
+	old := now.Add(-5 * 24 * time.Hour).Truncate(time.Hour)
+
+	for i, temp := range []float64{20, 21, 22, 22, 25} {
+		if err := s.RecordState(bedroom, device.DeviceState{"temperature": temp}, old.Add(time.Duration(i)*10*time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_ = s.RecordState(porch, device.DeviceState{"state": "ON", "brightness": 200}, now.Add(-2*time.Hour))
+	_ = s.RecordState(porch, device.DeviceState{"state": "ON", "brightness": 100}, now.Add(-time.Hour))
+	_ = s.RecordEvent(porch, "device_offline", now.Add(-30*time.Minute))
+	_ = s.RecordState(bedroom, device.DeviceState{"temperature": 19.5}, now.Add(-40*24*time.Hour))
+
+	recs, err := s.Query(porch, Query{Since: now.Add(-24 * time.Hour), Until: now})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != 4 || recs[2].Property != "brightness" || recs[2].Value != 100.0 || recs[3].Event != "device_offline" {
+		t.Fatalf("porch history = %+v", recs)
+	}
+	recs, _ = s.Query(porch, Query{Property: "state", Since: now.Add(-24 * time.Hour), Until: now})
+	if len(recs) != 1 || recs[0].Value != "ON" {
+		t.Fatalf("unchanged state recorded again: %+v", recs)
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Compact(now); err != nil {
+		t.Fatal(err)
+	}
+	recs, _ = s.Query(bedroom, Query{Property: "temperature", Until: now})
+	if len(recs) != 1 || recs[0].Count != 4 || recs[0].Value != 22.0 || *recs[0].Min != 20 || *recs[0].Max != 25 {
+		t.Fatalf("downsampled temperature = %+v", recs)
+	}
+	if _, err := os.Stat(filepath.Join(dir, old.Format(dayLayout)+segmentExt)); !os.IsNotExist(err) {
+		t.Errorf("raw segment kept after downsampling: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, now.Add(-40*24*time.Hour).Format(dayLayout)+segmentExt)); !os.IsNotExist(err) {
+		t.Errorf("segment past retention kept: %v", err)
+	}
+}
+
+func TestStoreQueryWhileRecording(t *testing.T) {
+	s, err := Open(Options{Dir: t.TempDir(), FullResolution: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	const dev = "00:15:8d:00:01:a2:b3:c4"
+	start := time.Now().Add(-time.Hour)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := range 200 {
+			_ = s.RecordState(dev, device.DeviceState{"brightness": i}, start.Add(time.Duration(i)*time.Second))
+		}
+	}()
+	for range 20 {
+		if _, err := s.Query(dev, Query{}); err != nil {
+			t.Fatal(err)
+		}
+		_ = s.Compact(time.Now())
+	}
+	<-done
+	recs, _ := s.Query(dev, Query{Property: "brightness"})
+	if len(recs) != 200 {
+		t.Errorf("got %d records, want 200", len(recs))
+	}
+}
@@ -0,0 +1,141 @@
+package history
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Compact applies the retention policy: segments older than Retention are
+// deleted, and numeric changes in segments older than FullResolution are
+// averaged into Interval buckets. Other changes and events are kept as
+// recorded. The segment being appended to is left alone.
+func (s *Store) Compact(now time.Time) error {
+	s.compact.Lock()
+	defer s.compact.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	segs, err := s.segments()
+	if err != nil {
+		return err
+	}
+	for _, seg := range segs {
+		switch {
+		case s.opts.Retention > 0 && seg.end().Before(now.Add(-s.opts.Retention)):
+			if err := os.Remove(seg.path); err != nil {
+				return fmt.Errorf("remove history segment: %w", err)
+			}
+		case s.opts.FullResolution > 0 && !seg.downsampled && seg.day != s.day &&
+			seg.end().Before(now.Add(-s.opts.FullResolution)):
+			if err := s.downsample(seg); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// downsample rewrites a raw segment into the day's downsampled segment,
+// merging records already there. Must be called with mu held.
+func (s *Store) downsample(seg segment) error {
+	target := filepath.Join(s.opts.Dir, seg.day+downsampledSuffix+segmentExt)
+	var recs []Record
+	for _, path := range []string{target, seg.path} {
+		if err := readSegment(path, func(r Record) { recs = append(recs, r) }); err != nil {
+			return err
+		}
+	}
+	recs = downsampleRecords(recs, s.opts.Interval)
+
+	var buf []byte
+	for _, r := range recs {
+		line, err := json.Marshal(r)
+		if err != nil {
+			return fmt.Errorf("marshal history record: %w", err)
+		}
+		buf = append(append(buf, line...), '\n')
+	}
+	tmp := target + ".tmp"
+	if err := os.WriteFile(tmp, buf, 0644); err != nil {
+		return fmt.Errorf("write history segment: %w", err)
+	}
+	if err := os.Rename(tmp, target); err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("rename history segment: %w", err)
+	}
+	if err := os.Remove(seg.path); err != nil {
+		return fmt.Errorf("remove history segment: %w", err)
+	}
+	return nil
+}
+
+// bucketKey identifies one device property in one interval.
+type bucketKey struct {
+	device, property string
+	start            time.Time
+}
+
+// downsampleRecords replaces raw numeric changes with one record per device,
+// property and interval holding their mean, minimum and maximum. Records that
+// are already downsampled, non-numeric changes and events pass through.
+func downsampleRecords(recs []Record, interval time.Duration) []Record {
+	type agg struct {
+		sum, min, max float64
+		n             int
+	}
+	buckets := make(map[bucketKey]*agg)
+	var out []Record
+	for _, r := range recs {
+		v, ok := r.Value.(float64)
+		if r.Event != "" || r.Count > 0 || !ok {
+			out = append(out, r)
+			continue
+		}
+		k := bucketKey{r.Device, r.Property, r.Time.Truncate(interval)}
+		a := buckets[k]
+		if a == nil {
+			a = &agg{min: v, max: v}
+			buckets[k] = a
+		}
+		a.sum += v
+		a.min = math.Min(a.min, v)
+		a.max = math.Max(a.max, v)
+		a.n++
+	}
+	for k, a := range buckets {
+		lo, hi := a.min, a.max
+		out = append(out, Record{
+			Time:     k.start,
+			Device:   k.device,
+			Property: k.property,
+			Value:    math.Round(a.sum/float64(a.n)*100) / 100,
+			Min:      &lo,
+			Max:      &hi,
+			Count:    a.n,
+		})
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Time.Before(out[j].Time) })
+	return out
+}
+
+// ParseDuration parses a Go duration ("90m", "24h") or a whole number of
+// days ("7d").
+func ParseDuration(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		if n, err := strconv.Atoi(days); err == nil && n >= 0 {
+			return time.Duration(n) * 24 * time.Hour, nil
+		}
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	return d, nil
+}
@@ -0,0 +1,557 @@
+// Package simulated provides a controller backed by virtual devices, so the
+// CLI and skill can be developed and demonstrated without an adapter.
+package simulated
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"math/rand/v2"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/urmzd/zigbee-skill/pkg/device"
+	"github.com/urmzd/zigbee-skill/pkg/zigbee"
+)
+
+// coordinatorIEEE is the address reported for the virtual coordinator.
+const coordinatorIEEE = "5e:00:00:00:00:00:00:01"
+
+// Options configures a Controller.
+type Options struct {
+	// Devices are paired from the start.
+	Devices []Spec
+	// Joinable devices join one at a time while joining is permitted.
+	Joinable []Spec
+	// OfflineRate is the expected number of outages per device and hour.
+	OfflineRate float64
+	// Seed makes drift and outages repeatable when non-zero.
+	Seed uint64
+}
+
+// timing holds the simulation's clock constants. Tests shorten them.
+type timing struct {
+	tick       time.Duration // sensor drift and outage checks
+	transition time.Duration // brightness and color temperature ramps
+	actuation  time.Duration // lock bolt travel
+	joinDelay  time.Duration // between successive joins
+	latency    time.Duration // per command round trip
+	outage     time.Duration // mean offline period
+}
+
+var defaultTiming = timing{
+	tick:       5 * time.Second,
+	transition: time.Second,
+	actuation:  1500 * time.Millisecond,
+	joinDelay:  3 * time.Second,
+	latency:    40 * time.Millisecond,
+	outage:     2 * time.Minute,
+}
+
+// Controller implements device.Controller and device.EventSubscriber for a
+// network of virtual devices.
+type Controller struct {
+	opts   Options
+	timing timing
+
+	mu       sync.Mutex
+	devices  map[string]*virtualDevice // IEEE string -> paired device
+	joinable []*virtualDevice
+
+	events *device.Bus
+
+	joinMu     sync.Mutex
+	joinWindow chan struct{}
+
+	stopChan  chan struct{}
+	closeOnce sync.Once
+
+	onDeviceChange  func()
+	onNetworkChange func(device.FormOptions)
+	onStateChange   func(string, device.DeviceState)
+}
+
+// NewController builds the virtual network described by opts.
+func NewController(opts Options) (*Controller, error) {
+	return newController(opts, defaultTiming)
+}
+
+func newController(opts Options, t timing) (*Controller, error) {
+	seed := opts.Seed
+	if seed == 0 {
+		seed = rand.Uint64()
+	}
+	c := &Controller{
+		events:   device.NewBus(),
+		opts:     opts,
+		timing:   t,
+		devices:  make(map[string]*virtualDevice),
+		stopChan: make(chan struct{}),
+	}
+	now := time.Now()
+	seen := make(map[[8]byte]string)
+	add := func(s Spec) (*virtualDevice, error) {
+		d, err := newVirtualDevice(s, seed, now)
+		if err != nil {
+			return nil, err
+		}
+		if other, dup := seen[d.ieee]; dup {
+			return nil, fmt.Errorf("%w: devices %q and %q share IEEE address %s", device.ErrValidation, other, s.Name, zigbee.FormatIEEE(d.ieee))
+		}
+		seen[d.ieee] = s.Name
+		return d, nil
+	}
+	for _, s := range opts.Devices {
+		d, err := add(s)
+		if err != nil {
+			return nil, err
+		}
+		c.devices[zigbee.FormatIEEE(d.ieee)] = d
+	}
+	for _, s := range opts.Joinable {
+		d, err := add(s)
+		if err != nil {
+			return nil, err
+		}
+		c.joinable = append(c.joinable, d)
+	}
+
+	go c.simulate()
+	log.Info().Int("devices", len(c.devices)).Int("joinable", len(c.joinable)).Msg("Simulated network started")
+	return c, nil
+}
+
+// SetOnDeviceChange registers a callback invoked after the device list changes.
+func (c *Controller) SetOnDeviceChange(fn func()) { c.onDeviceChange = fn }
+
+// SetOnNetworkChange registers a callback invoked after a network is formed.
+// The simulated network is never re-formed, so it is not called.
+func (c *Controller) SetOnNetworkChange(fn func(device.FormOptions)) { c.onNetworkChange = fn }
+
+// SetOnStateChange registers a callback invoked with a device's IEEE address
+// and its state after a command and on simulation ticks that change it.
+func (c *Controller) SetOnStateChange(fn func(string, device.DeviceState)) { c.onStateChange = fn }
+
+func (c *Controller) notifyDeviceChange() {
+	if c.onDeviceChange != nil {
+		c.onDeviceChange()
+	}
+}
+
+// notifyStateChange calls the state callback if set and publishes a
+// state_changed event for each device; not with mu held.
+func (c *Controller) notifyStateChange(states map[string]device.DeviceState) {
+	now := time.Now()
+	for ieee, st := range states {
+		if c.onStateChange != nil {
+			c.onStateChange(ieee, st)
+		}
+		c.publishEvent(device.Event{Type: device.EventStateChanged, DeviceID: ieee, State: st, Timestamp: now})
+	}
+}
+
+// ExportDevices returns a snapshot of all paired devices for persistence.
+func (c *Controller) ExportDevices() []zigbee.ExportedDevice {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := make([]zigbee.ExportedDevice, 0, len(c.devices))
+	now := time.Now()
+	for ieee, d := range c.devices {
+		out = append(out, zigbee.ExportedDevice{
+			IEEEAddress:    ieee,
+			FriendlyName:   d.name,
+			DeviceType:     zigbee.DeviceTypeFromClusters(kindClusters[d.kind]),
+			Endpoint:       1,
+			Clusters:       kindClusters[d.kind],
+			LastSeen:       d.lastSeen,
+			State:          d.snapshot(now),
+			StateUpdatedAt: now,
+		})
+	}
+	return out
+}
+
+// LoadDevices restores friendly names, pairings and last-known state from
+// persistent storage. Joinable devices that were paired before are paired
+// again; entries that match no declared device are ignored.
+func (c *Controller) LoadDevices(entries []zigbee.LoadEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, e := range entries {
+		ieee := zigbee.FormatIEEE(e.IEEEAddress)
+		d, ok := c.devices[ieee]
+		if !ok {
+			for i, j := range c.joinable {
+				if j.ieee == e.IEEEAddress {
+					d = j
+					c.joinable = append(c.joinable[:i], c.joinable[i+1:]...)
+					c.devices[ieee] = d
+					break
+				}
+			}
+		}
+		if d == nil {
+			log.Debug().Str("device", ieee).Msg("Stored device is not in the simulation; skipping")
+			continue
+		}
+		if e.FriendlyName != "" {
+			d.name = e.FriendlyName
+		}
+		d.restore(e.State)
+	}
+}
+
+// simulate advances sensor drift, thermostats and outages every tick.
+func (c *Controller) simulate() {
+	ticker := time.NewTicker(c.timing.tick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stopChan:
+			return
+		case <-ticker.C:
+			c.step(time.Now())
+		}
+	}
+}
+
+func (c *Controller) step(now time.Time) {
+	var events []device.Event
+	states := make(map[string]device.DeviceState)
+	c.mu.Lock()
+	pOffline := c.opts.OfflineRate * c.timing.tick.Hours()
+	for ieee, d := range c.devices {
+		d.settle(now)
+		switch {
+		case d.available && d.rng.Float64() < pOffline:
+			d.available = false
+			outage := time.Duration(d.rng.ExpFloat64() * float64(c.timing.outage))
+			d.offlineUntil = now.Add(max(outage, c.timing.tick))
+			events = append(events, c.availabilityEvent(ieee, d, now))
+		case !d.available && !now.Before(d.offlineUntil):
+			d.available = true
+			d.lastSeen = now
+			events = append(events, c.availabilityEvent(ieee, d, now))
+		}
+		if d.available {
+			d.step()
+			d.lastSeen = now
+			d.linkQuality = min(255, max(20, d.linkQuality+d.rng.IntN(11)-5))
+			if st := d.snapshot(now); !maps.Equal(st, d.reported) {
+				d.reported = st
+				states[ieee] = d.snapshot(now)
+			}
+		}
+	}
+	c.mu.Unlock()
+	for _, evt := range events {
+		c.publishEvent(evt)
+	}
+	c.notifyStateChange(states)
+}
+
+// availabilityEvent builds a device_online or device_offline event. Must be
+// called with mu held.
+func (c *Controller) availabilityEvent(ieee string, d *virtualDevice, now time.Time) device.Event {
+	evType := device.EventDeviceOffline
+	if d.available {
+		evType = device.EventDeviceOnline
+	}
+	log.Info().Str("device", ieee).Str("event", evType).Msg("Simulated availability change")
+	dev := c.toDevice(ieee, d)
+	return device.Event{Type: evType, Device: &dev, Timestamp: now}
+}
+
+// --- device.Controller interface ---
+
+func (c *Controller) ListDevices(_ context.Context) ([]device.Device, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	devices := make([]device.Device, 0, len(c.devices))
+	for ieee, d := range c.devices {
+		devices = append(devices, c.toDevice(ieee, d))
+	}
+	return devices, nil
+}
+
+func (c *Controller) GetDevice(_ context.Context, id string) (*device.Device, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ieee, d, ok := c.resolveDevice(id)
+	if !ok {
+		return nil, device.ErrNotFound
+	}
+	dev := c.toDevice(ieee, d)
+	return &dev, nil
+}
+
+func (c *Controller) RenameDevice(_ context.Context, id, newName string) error {
+	c.mu.Lock()
+	_, d, ok := c.resolveDevice(id)
+	if !ok {
+		c.mu.Unlock()
+		return device.ErrNotFound
+	}
+	d.name = newName
+	c.mu.Unlock()
+	c.notifyDeviceChange()
+	return nil
+}
+
+// RemoveDevice unpairs a device. It returns to the joinable pool, as a real
+// device would after a factory reset.
+func (c *Controller) RemoveDevice(_ context.Context, id string, _ bool) error {
+	c.mu.Lock()
+	ieee, d, ok := c.resolveDevice(id)
+	if !ok {
+		c.mu.Unlock()
+		return device.ErrNotFound
+	}
+	delete(c.devices, ieee)
+	c.joinable = append(c.joinable, d)
+	dev := c.toDevice(ieee, d)
+	c.mu.Unlock()
+
+	c.publishEvent(device.Event{Type: device.EventDeviceLeft, Device: &dev, Timestamp: time.Now()})
+	c.notifyDeviceChange()
+	return nil
+}
+
+func (c *Controller) ClearDevices(_ context.Context) error {
+	c.mu.Lock()
+	for _, d := range c.devices {
+		c.joinable = append(c.joinable, d)
+	}
+	c.devices = make(map[string]*virtualDevice)
+	c.mu.Unlock()
+	c.notifyDeviceChange()
+	return nil
+}
+
+// reachable resolves id to a paired device and waits out the simulated
+// round trip. Offline devices time out like unreachable real ones.
+func (c *Controller) reachable(ctx context.Context, id string) error {
+	if !c.IsConnected() {
+		return device.ErrNotConnected
+	}
+	c.mu.Lock()
+	_, d, ok := c.resolveDevice(id)
+	available := ok && d.available
+	c.mu.Unlock()
+	if !ok {
+		return device.ErrNotFound
+	}
+	select {
+	case <-time.After(c.timing.latency):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if !available {
+		return fmt.Errorf("%w: device %q did not respond within timeout", device.ErrTimeout, id)
+	}
+	return nil
+}
+
+func (c *Controller) GetDeviceState(ctx context.Context, id string) (device.DeviceState, error) {
+	if err := c.reachable(ctx, id); err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, d, ok := c.resolveDevice(id)
+	if !ok {
+		return nil, device.ErrNotFound
+	}
+	now := time.Now()
+	d.settle(now)
+	return d.snapshot(now), nil
+}
+
+// SetDeviceState applies the change and returns the state the device reports
+// straight away, so brightness may still be part-way through its transition.
+func (c *Controller) SetDeviceState(ctx context.Context, id string, state map[string]any) (_ device.DeviceState, err error) {
+	if !c.IsConnected() {
+		return nil, device.ErrNotConnected
+	}
+	c.mu.Lock()
+	ieee, _, ok := c.resolveDevice(id)
+	c.mu.Unlock()
+	if !ok {
+		return nil, device.ErrNotFound
+	}
+	defer func() { c.publishEvent(device.CommandResultEvent(ieee, state, err)) }()
+
+	if err := c.reachable(ctx, id); err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	_, d, ok := c.resolveDevice(id)
+	if !ok {
+		c.mu.Unlock()
+		return nil, device.ErrNotFound
+	}
+	now := time.Now()
+	if err := d.apply(state, now, c.timing.transition, c.timing.actuation); err != nil {
+		c.mu.Unlock()
+		return nil, err
+	}
+	d.lastSeen = now
+	st, changed := d.snapshot(now), d.snapshot(now)
+	d.reported = d.snapshot(now)
+	c.mu.Unlock()
+	c.notifyStateChange(map[string]device.DeviceState{ieee: changed})
+	return st, nil
+}
+
+// PermitJoin opens joining for duration seconds. Joinable devices join one
+// at a time while it stays open.
+func (c *Controller) PermitJoin(_ context.Context, enable bool, duration int) error {
+	if !c.IsConnected() {
+		return device.ErrNotConnected
+	}
+	c.joinMu.Lock()
+	defer c.joinMu.Unlock()
+	if c.joinWindow != nil {
+		close(c.joinWindow)
+		c.joinWindow = nil
+	}
+	if !enable {
+		log.Info().Msg("Simulated joining closed")
+		return nil
+	}
+	stop := make(chan struct{})
+	c.joinWindow = stop
+	go c.admit(stop, time.Duration(duration)*time.Second)
+	log.Info().Int("duration", duration).Msg("Simulated joining open")
+	return nil
+}
+
+// admit pairs joinable devices until the window closes or the pool is empty.
+func (c *Controller) admit(stop chan struct{}, window time.Duration) {
+	deadline := time.After(window)
+	for {
+		select {
+		case <-time.After(c.timing.joinDelay):
+		case <-deadline:
+			return
+		case <-stop:
+			return
+		case <-c.stopChan:
+			return
+		}
+		c.mu.Lock()
+		if len(c.joinable) == 0 {
+			c.mu.Unlock()
+			return
+		}
+		d := c.joinable[0]
+		c.joinable = c.joinable[1:]
+		now := time.Now()
+		d.available, d.lastSeen = true, now
+		ieee := zigbee.FormatIEEE(d.ieee)
+		c.devices[ieee] = d
+		dev := c.toDevice(ieee, d)
+		c.mu.Unlock()
+
+		log.Info().Str("device", ieee).Str("name", d.name).Msg("Simulated device joined")
+		c.publishEvent(device.Event{Type: device.EventDeviceJoined, Device: &dev, Parent: coordinatorIEEE, Timestamp: now})
+		// Simulated devices describe themselves; the interview is instant.
+		c.publishEvent(device.Event{Type: device.EventInterview, DeviceID: ieee, Stage: device.InterviewStarted, Timestamp: now})
+		c.publishEvent(device.Event{Type: device.EventInterview, DeviceID: ieee, Stage: device.InterviewCompleted, Timestamp: now})
+		c.notifyDeviceChange()
+	}
+}
+
+func (c *Controller) IsConnected() bool {
+	select {
+	case <-c.stopChan:
+		return false
+	default:
+		return true
+	}
+}
+
+func (c *Controller) Close() {
+	c.closeOnce.Do(func() { close(c.stopChan) })
+	log.Info().Msg("Simulated controller closed")
+}
+
+// NetworkInfo describes the virtual network.
+func (c *Controller) NetworkInfo(_ context.Context) (*device.NetworkInfo, error) {
+	if !c.IsConnected() {
+		return nil, device.ErrNotConnected
+	}
+	return &device.NetworkInfo{
+		NetworkUp:       true,
+		Channel:         15,
+		PanID:           "0x5e5e",
+		ExtendedPanID:   "5e:5e:5e:5e:5e:5e:5e:5e",
+		NodeType:        device.NodeTypeCoordinator,
+		CoordinatorIEEE: coordinatorIEEE,
+		Adapter:         device.AdapterInfo{Protocol: "simulated"},
+	}, nil
+}
+
+// --- device.EventSubscriber interface ---
+
+func (c *Controller) Subscribe(filter device.EventFilter) chan device.Event {
+	return c.events.Subscribe(filter)
+}
+
+func (c *Controller) Unsubscribe(ch chan device.Event) {
+	c.events.Unsubscribe(ch)
+}
+
+// --- Helpers ---
+
+// resolveDevice finds a paired device by IEEE address or friendly name. Must
+// be called with mu held.
+func (c *Controller) resolveDevice(id string) (string, *virtualDevice, bool) {
+	if d, ok := c.devices[id]; ok {
+		return id, d, true
+	}
+	for ieee, d := range c.devices {
+		if strings.EqualFold(d.name, id) {
+			return ieee, d, true
+		}
+	}
+	return "", nil, false
+}
+
+// toDevice converts a virtual device to a device.Device. Must be called with
+// mu held.
+func (c *Controller) toDevice(ieee string, d *virtualDevice) device.Device {
+	name := d.name
+	if name == "" {
+		name = ieee
+	}
+	clusters := kindClusters[d.kind]
+	access := d.access()
+	schema, _ := json.Marshal(zigbee.BuildStateSchema(clusters, access))
+	exposes, _ := json.Marshal(zigbee.BuildCapabilities(clusters, 1, access))
+	lqi := d.linkQuality
+	return device.Device{
+		ID:           ieee,
+		Name:         name,
+		Type:         zigbee.DeviceTypeFromClusters(clusters),
+		Protocol:     device.ProtocolZigbee,
+		Manufacturer: "Simulated",
+		Model:        "virtual-" + d.kind,
+		StateSchema:  schema,
+		Exposes:      exposes,
+		Available:    d.available,
+		LastSeen:     d.lastSeen,
+		LinkQuality:  &lqi,
+
+		// The simulation always knows the current state.
+		State:          d.snapshot(time.Now()),
+		StateUpdatedAt: time.Now(),
+	}
+}
+
+func (c *Controller) publishEvent(evt device.Event) {
+	c.events.Publish(evt)
+}
@@ -0,0 +1,372 @@
+package simulated
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/urmzd/zigbee-skill/pkg/device"
+	"github.com/urmzd/zigbee-skill/pkg/zigbee"
+)
+
+// Virtual device kinds accepted in Spec.Kind.
+const (
+	KindLight      = "light"
+	KindPlug       = "plug"
+	KindSensor     = "sensor"
+	KindLock       = "lock"
+	KindThermostat = "thermostat"
+)
+
+// ZCL clusters each kind reports, so state schemas and device types match
+// real adapters.
+var kindClusters = map[string][]uint16{
+	KindLight:      {0x0006, 0x0008, 0x0300}, // On/Off, Level Control, Color Control
+	KindPlug:       {0x0006, 0x0B04},         // On/Off, Electrical Measurement
+	KindSensor:     {0x0001, 0x0402, 0x0405}, // Power Configuration, Temperature, Relative Humidity
+	KindLock:       {0x0101},                 // Door Lock
+	KindThermostat: {0x0201},                 // Thermostat
+}
+
+// Spec declares a virtual device.
+type Spec struct {
+	Name string
+	Kind string
+	// IEEE is the colon-separated address; derived from Name when empty.
+	IEEE string
+}
+
+// ramp is a numeric value moving linearly to a target.
+type ramp struct {
+	from, to float64
+	start    time.Time
+	dur      time.Duration
+}
+
+func (r ramp) at(now time.Time) (float64, bool) {
+	if r.dur <= 0 || now.Sub(r.start) >= r.dur {
+		return r.to, true
+	}
+	f := float64(now.Sub(r.start)) / float64(r.dur)
+	return r.from + (r.to-r.from)*f, false
+}
+
+// virtualDevice is a simulated device and its state.
+type virtualDevice struct {
+	ieee  [8]byte
+	name  string
+	kind  string
+	state device.DeviceState
+	// ramps hold numeric state keys that are in transition.
+	ramps map[string]ramp
+	// pending holds values applied once a mechanical action finishes.
+	pending   device.DeviceState
+	pendingAt time.Time
+
+	available    bool
+	offlineUntil time.Time
+	lastSeen     time.Time
+	linkQuality  int
+
+	// reported is the state last passed to the state callback.
+	reported device.DeviceState
+
+	// rng drives this device's drift and outages. Each device has its own,
+	// seeded from the network seed and its address, so a seeded network
+	// repeats regardless of the order devices are stepped or joined in.
+	rng *rand.Rand
+}
+
+// parseIEEE reads a colon-separated IEEE address, most significant byte
+// first, into little-endian order.
+func parseIEEE(s string) ([8]byte, error) {
+	var addr [8]byte
+	parts := strings.Split(s, ":")
+	if len(parts) != 8 {
+		return addr, fmt.Errorf("invalid IEEE address %q", s)
+	}
+	for i, p := range parts {
+		var b uint8
+		if _, err := fmt.Sscanf(p, "%02x", &b); err != nil || len(p) != 2 {
+			return addr, fmt.Errorf("invalid IEEE address %q", s)
+		}
+		addr[7-i] = b
+	}
+	return addr, nil
+}
+
+// ieeeFromName derives a stable address so a device keeps its ID across
+// restarts. The top byte is fixed to mark simulated devices.
+func ieeeFromName(name string) [8]byte {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(name))
+	sum := h.Sum64()
+	var addr [8]byte
+	for i := range 7 {
+		addr[i] = byte(sum >> (8 * i))
+	}
+	addr[7] = 0x5E
+	return addr
+}
+
+func newVirtualDevice(s Spec, seed uint64, now time.Time) (*virtualDevice, error) {
+	if _, ok := kindClusters[s.Kind]; !ok {
+		return nil, fmt.Errorf("%w: device %q has unknown type %q (want light, plug, sensor, lock or thermostat)", device.ErrValidation, s.Name, s.Kind)
+	}
+	ieee := ieeeFromName(s.Name)
+	if s.IEEE != "" {
+		var err error
+		if ieee, err = parseIEEE(s.IEEE); err != nil {
+			return nil, fmt.Errorf("%w: device %q: %v", device.ErrValidation, s.Name, err)
+		}
+	}
+	rng := rand.New(rand.NewPCG(seed, binary.LittleEndian.Uint64(ieee[:])))
+	d := &virtualDevice{
+		ieee:        ieee,
+		name:        s.Name,
+		kind:        s.Kind,
+		ramps:       make(map[string]ramp),
+		available:   true,
+		lastSeen:    now,
+		linkQuality: 120 + rng.IntN(120),
+		rng:         rng,
+	}
+	switch s.Kind {
+	case KindLight:
+		d.state = device.DeviceState{"state": "OFF", "brightness": 254, "color_temp": 370}
+	case KindPlug:
+		d.state = device.DeviceState{"state": "OFF", "power": 0.0}
+	case KindSensor:
+		d.state = device.DeviceState{
+			"temperature": round1(19 + rng.Float64()*4),
+			"humidity":    round1(40 + rng.Float64()*15),
+			"battery":     80 + rng.IntN(21),
+		}
+	case KindLock:
+		d.state = device.DeviceState{"lock_state": "LOCK"}
+	case KindThermostat:
+		d.state = device.DeviceState{
+			"heating_setpoint":  20.0,
+			"local_temperature": round1(18 + rng.Float64()*3),
+			"running_state":     "idle",
+		}
+	}
+	return d, nil
+}
+
+func round1(v float64) float64 { return math.Round(v*10) / 10 }
+
+// snapshot returns the state as it is at now, with ramps interpolated.
+func (d *virtualDevice) snapshot(now time.Time) device.DeviceState {
+	out := make(device.DeviceState, len(d.state))
+	for k, v := range d.state {
+		out[k] = v
+	}
+	for k, r := range d.ramps {
+		v, _ := r.at(now)
+		out[k] = int(math.Round(v))
+	}
+	return out
+}
+
+// restore takes back persisted values for the properties the device has,
+// keeping each property's Go type.
+func (d *virtualDevice) restore(saved device.DeviceState) {
+	for k, v := range saved {
+		cur, ok := d.state[k]
+		if !ok {
+			continue
+		}
+		switch cur.(type) {
+		case int:
+			if n, ok := number(v); ok {
+				d.state[k] = int(math.Round(n))
+			}
+		case float64:
+			if n, ok := number(v); ok {
+				d.state[k] = n
+			}
+		case string:
+			if s, ok := v.(string); ok {
+				d.state[k] = s
+			}
+		case bool:
+			if b, ok := v.(bool); ok {
+				d.state[k] = b
+			}
+		}
+	}
+}
+
+// settle folds finished ramps and mechanical actions into the state.
+func (d *virtualDevice) settle(now time.Time) {
+	for k, r := range d.ramps {
+		if v, done := r.at(now); done {
+			d.state[k] = int(math.Round(v))
+			delete(d.ramps, k)
+		}
+	}
+	if d.pending != nil && !now.Before(d.pendingAt) {
+		for k, v := range d.pending {
+			d.state[k] = v
+		}
+		d.pending = nil
+	}
+}
+
+// settable lists the request keys each kind accepts.
+var settable = map[string][]string{
+	KindLight: {"state", "brightness", "brightness_percent", "brightness_step", "brightness_move",
+		"color_temp", "color_temp_step", "transition"},
+	KindPlug:       {"state"},
+	KindLock:       {"lock_state"},
+	KindThermostat: {"heating_setpoint"},
+}
+
+// access describes what the simulation supports for d: every state value can
+// be read and is reported as it changes, and settable keys can be written.
+// Must be called with the controller's mu held.
+func (d *virtualDevice) access() zigbee.StateAccess {
+	a := zigbee.StateAccess{}
+	for key := range d.state {
+		a[key] = device.AccessRead | device.AccessReport
+	}
+	for _, key := range settable[d.kind] {
+		a[key] |= device.AccessWrite
+	}
+	return a
+}
+
+// apply validates and applies a state change. Light keys are parsed like a
+// real adapter's; brightness and color temperature then ramp over the
+// requested transition, or defaultTransition, and locks finish after actuation.
+func (d *virtualDevice) apply(req map[string]any, now time.Time, defaultTransition, actuation time.Duration) error {
+	for key := range req {
+		if !slices.Contains(settable[d.kind], key) {
+			return fmt.Errorf("%w: %q is not settable on a %s", device.ErrValidation, key, d.kind)
+		}
+	}
+	r, err := zigbee.ParseStateRequest(req)
+	if err != nil {
+		return err
+	}
+	var lock string
+	if v, ok := req["lock_state"]; ok {
+		lock, _ = v.(string)
+		if lock = strings.ToUpper(lock); lock != "LOCK" && lock != "UNLOCK" {
+			return fmt.Errorf("%w: invalid lock_state value %q", device.ErrValidation, v)
+		}
+	}
+	setpoint, hasSetpoint := number(req["heating_setpoint"])
+	if _, ok := req["heating_setpoint"]; ok && (!hasSetpoint || setpoint < 5 || setpoint > 30) {
+		return fmt.Errorf("%w: heating_setpoint must be a number between 5 and 30", device.ErrValidation)
+	}
+
+	d.settle(now)
+	transition := defaultTransition
+	if _, ok := req["transition"]; ok {
+		transition = time.Duration(r.Transition) * 100 * time.Millisecond
+	}
+	switch r.State {
+	case "ON", "OFF":
+		d.state["state"] = r.State
+	case "TOGGLE":
+		if d.state["state"] == "ON" {
+			d.state["state"] = "OFF"
+		} else {
+			d.state["state"] = "ON"
+		}
+	}
+
+	brightness, _ := number(d.snapshot(now)["brightness"])
+	switch {
+	case r.Level != nil:
+		d.rampTo("brightness", brightness, float64(*r.Level), now, transition)
+	case r.LevelStep != 0:
+		d.rampTo("brightness", brightness, math.Min(254, math.Max(0, brightness+float64(r.LevelStep))), now, transition)
+	case r.LevelMove != nil && *r.LevelMove == 0:
+		delete(d.ramps, "brightness")
+		d.state["brightness"] = int(math.Round(brightness))
+	case r.LevelMove != nil:
+		rate := float64(*r.LevelMove)
+		target := 254.0
+		if rate < 0 {
+			target = 0
+		}
+		d.rampTo("brightness", brightness, target, now, time.Duration(math.Abs(target-brightness)/math.Abs(rate)*float64(time.Second)))
+	}
+	if (r.LevelStep > 0 || r.LevelMove != nil && *r.LevelMove > 0) && d.state["state"] == "OFF" {
+		d.state["state"] = "ON"
+	}
+
+	colorTemp, _ := number(d.snapshot(now)["color_temp"])
+	switch {
+	case r.ColorTemp != nil:
+		d.rampTo("color_temp", colorTemp, float64(*r.ColorTemp), now, transition)
+	case r.ColorTempStep != 0:
+		d.rampTo("color_temp", colorTemp, math.Min(500, math.Max(153, colorTemp+float64(r.ColorTempStep))), now, transition)
+	}
+
+	if lock != "" {
+		d.pending = device.DeviceState{"lock_state": lock}
+		d.pendingAt = now.Add(actuation)
+	}
+	if hasSetpoint {
+		d.state["heating_setpoint"] = setpoint
+	}
+	return nil
+}
+
+func (d *virtualDevice) rampTo(key string, from, to float64, now time.Time, dur time.Duration) {
+	d.ramps[key] = ramp{from: from, to: to, start: now, dur: dur}
+}
+
+// step advances the physical model by one tick.
+func (d *virtualDevice) step() {
+	rng := d.rng
+	switch d.kind {
+	case KindPlug:
+		power := 0.0
+		if d.state["state"] == "ON" {
+			power = round1(60 + rng.NormFloat64()*2)
+		}
+		d.state["power"] = power
+	case KindSensor:
+		t, _ := number(d.state["temperature"])
+		h, _ := number(d.state["humidity"])
+		// Random walk pulled gently back towards a comfortable room.
+		d.state["temperature"] = round1(t + rng.NormFloat64()*0.05 + (21-t)*0.002)
+		d.state["humidity"] = round1(math.Min(100, math.Max(0, h+rng.NormFloat64()*0.1+(50-h)*0.002)))
+	case KindThermostat:
+		sp, _ := number(d.state["heating_setpoint"])
+		t, _ := number(d.state["local_temperature"])
+		if t < sp-0.3 {
+			d.state["running_state"] = "heat"
+		} else if t > sp+0.3 {
+			d.state["running_state"] = "idle"
+		}
+		if d.state["running_state"] == "heat" {
+			t += 0.02
+		} else {
+			t -= 0.005
+		}
+		d.state["local_temperature"] = round1(t + rng.NormFloat64()*0.01)
+	}
+}
+
+// number converts a decoded JSON or Go numeric value.
+func number(v any) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case int:
+		return float64(n), true
+	default:
+		return 0, false
+	}
+}
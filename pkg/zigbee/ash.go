@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"github.com/rs/zerolog/log"
+	"github.com/urmzd/zigbee-skill/pkg/device"
 )
 
 // ASH protocol constants
@@ -20,15 +21,32 @@ const (
 
 	// Frame types (encoded in control byte)
 	ashFrameData   = 0x00 // bit 7 = 0
-	ashFrameACK    = 0x80 // 0b10000xxx
-	ashFrameNAK    = 0xA0 // 0b10100xxx
+	ashFrameACK    = 0x80 // 0b100rNxxx
+	ashFrameNAK    = 0xA0 // 0b101rNxxx
 	ashFrameRST    = 0xC0
 	ashFrameRSTACK = 0xC1
 	ashFrameERROR  = 0xC2
 
-	ashMaxRetries   = 3
-	ashRetryTimeout = 1 * time.Second
-	ashMaxFrameLen  = 256
+	ashReTxBit     = 0x08 // DATA: frame is a retransmission
+	ashNotReadyBit = 0x08 // ACK/NAK: sender's receive buffer is full
+
+	ashMaxFrameLen = 256
+)
+
+// ASH timing and window limits (UG101 §3.1 and §5).
+const (
+	ashDefaultWindow = 3 // TX_K: DATA frames in flight without acknowledgement
+	ashMaxWindow     = 7 // 3-bit frame numbers leave one slot to tell old from new
+
+	ashAckTimeoutInit = 1600 * time.Millisecond // T_RX_ACK_INIT
+	ashAckTimeoutMin  = 400 * time.Millisecond  // T_RX_ACK_MIN
+	ashAckTimeoutMax  = 3200 * time.Millisecond // T_RX_ACK_MAX
+	ashMaxAckTimeouts = 4                       // ACK_TIMEOUTS before the link is declared failed
+
+	ashNotReadyTimeout = 1 * time.Second // T_REMOTE_NOTRDY: how long an nRdy report holds
+	ashXOFFTimeout     = 1 * time.Second // resume if XON never arrives
+	ashRSTACKTimeout   = 5 * time.Second
+	ashTimerTick       = 20 * time.Millisecond // resolution of the retransmit timer
 )
 
 // ASH connection states
@@ -40,22 +58,82 @@ const (
 	ashStateConnected
 )
 
-// ASHLayer handles ASH framing over a serial connection.
-type ASHLayer struct {
-	serial  *SerialPort
-	state   ashState
-	stateMu sync.RWMutex
+// Transport is the byte stream ASH runs over; a *SerialPort in production.
+type Transport interface {
+	Write(data []byte) (int, error)
+	ReadByte() (byte, error)
+	Close() error
+}
 
-	// Sequence numbers
-	sendSeq uint8 // frmNum: next frame to send
-	ackNum  uint8 // ackNum: next frame we expect to receive
-	recvSeq uint8 // next frame we expect from NCP
+// ASHConfig tunes the ASH link. Zero values select the UG101 defaults.
+type ASHConfig struct {
+	// WindowSize is how many DATA frames may await acknowledgement (1-7).
+	WindowSize int
+	// SoftwareFlowControl pauses transmission on XOFF from the NCP until XON,
+	// for adapters wired without RTS/CTS.
+	SoftwareFlowControl bool
+}
+
+// ashTiming holds the retransmission timer bounds; tests shorten them.
+type ashTiming struct {
+	ackInit, ackMin, ackMax time.Duration
+	maxAckTimeouts          int
+}
 
-	seqMu sync.Mutex
+var defaultASHTiming = ashTiming{
+	ackInit:        ashAckTimeoutInit,
+	ackMin:         ashAckTimeoutMin,
+	ackMax:         ashAckTimeoutMax,
+	maxAckTimeouts: ashMaxAckTimeouts,
+}
 
-	// Pending data frames waiting for ACK
-	pending   map[uint8][]byte
-	pendingMu sync.Mutex
+// ashTxFrame is a DATA frame sent but not yet acknowledged.
+type ashTxFrame struct {
+	frmNum        uint8
+	payload       []byte // EZSP bytes before randomization
+	sentAt        time.Time
+	retransmitted bool // excluded from t_rx_ack measurement (Karn's rule)
+}
+
+// ASHLayer handles ASH framing over a serial connection: a sliding window of
+// DATA frames with adaptive retransmission, reject/NAK recovery, nRdy receive
+// backpressure and optional XON/XOFF flow control.
+type ASHLayer struct {
+	transport Transport
+	cfg       ASHConfig
+	timing    ashTiming
+	state     ashState
+	stateMu   sync.RWMutex
+
+	// down is closed when the link is lost (serial error, ERROR frame, an
+	// unexpected RSTACK or too many ACK timeouts). Reopen replaces it along
+	// with the transport.
+	down    chan struct{}
+	downErr error
+	linkMu  sync.Mutex
+
+	// Transmit window
+	frmTx          uint8 // frame number of the next new DATA frame
+	ackRx          uint8 // oldest unacknowledged frame number
+	unacked        []*ashTxFrame
+	tRxAck         time.Duration
+	ackTimeouts    int       // consecutive retransmit timer expiries
+	remoteNotReady time.Time // the NCP reported nRdy until this time
+	txMu           sync.Mutex
+	txSpace        chan struct{} // signalled when the window opens
+	sendMu         sync.Mutex    // keeps DATA frames on the wire in frame-number order
+	nakCh          chan struct{} // asks the retransmit loop to resend after a NAK
+
+	// Receive state
+	frmRx  uint8 // next frame number expected from the NCP
+	reject bool  // Reject Condition: a NAK was sent and no in-order frame arrived since
+	rxMu   sync.Mutex
+
+	// XON/XOFF from the NCP
+	xoff   bool
+	xoffAt time.Time
+	flowMu sync.Mutex
+	xonCh  chan struct{}
 
 	// Channel for received EZSP data frames
 	recvChan chan []byte
@@ -68,15 +146,89 @@ type ASHLayer struct {
 }
 
 // NewASHLayer creates a new ASH framing layer.
-func NewASHLayer(s *SerialPort) *ASHLayer {
+func NewASHLayer(t Transport, cfg ASHConfig) *ASHLayer {
+	if cfg.WindowSize <= 0 {
+		cfg.WindowSize = ashDefaultWindow
+	}
+	cfg.WindowSize = min(cfg.WindowSize, ashMaxWindow)
 	return &ASHLayer{
-		serial:   s,
-		state:    ashStateDisconnected,
-		pending:  make(map[uint8][]byte),
-		recvChan: make(chan []byte, 16),
-		connChan: make(chan struct{}, 1),
-		stopChan: make(chan struct{}),
+		transport: t,
+		cfg:       cfg,
+		timing:    defaultASHTiming,
+		state:     ashStateDisconnected,
+		tRxAck:    defaultASHTiming.ackInit,
+		txSpace:   make(chan struct{}, 1),
+		nakCh:     make(chan struct{}, 1),
+		xonCh:     make(chan struct{}, 1),
+		recvChan:  make(chan []byte, 16),
+		connChan:  make(chan struct{}, 1),
+		down:      make(chan struct{}),
+		stopChan:  make(chan struct{}),
+	}
+}
+
+// port returns the transport of the current link.
+func (a *ASHLayer) port() Transport {
+	a.linkMu.Lock()
+	defer a.linkMu.Unlock()
+	return a.transport
+}
+
+// Down returns a channel that is closed when the current link is lost.
+func (a *ASHLayer) Down() <-chan struct{} {
+	a.linkMu.Lock()
+	defer a.linkMu.Unlock()
+	return a.down
+}
+
+// Err returns why the current link was lost, or nil while it is up.
+func (a *ASHLayer) Err() error {
+	a.linkMu.Lock()
+	defer a.linkMu.Unlock()
+	return a.downErr
+}
+
+// linkLost marks the link on t as lost. Reports from a transport that has
+// already been replaced by Reopen are ignored.
+func (a *ASHLayer) linkLost(t Transport, err error) {
+	a.linkMu.Lock()
+	if t != a.transport || a.downErr != nil {
+		a.linkMu.Unlock()
+		return
 	}
+	a.downErr = err
+	close(a.down)
+	a.linkMu.Unlock()
+
+	a.stateMu.Lock()
+	a.state = ashStateDisconnected
+	a.stateMu.Unlock()
+	log.Error().Err(err).Msg("ASH link lost")
+}
+
+// Reopen attaches a freshly opened transport and repeats the RST/RSTACK
+// handshake. The caller closes the previous transport.
+func (a *ASHLayer) Reopen(t Transport) error {
+	a.linkMu.Lock()
+	if a.downErr == nil {
+		// Stop the old link's timer even if its loss was never reported.
+		close(a.down)
+	}
+	a.transport = t
+	a.down = make(chan struct{})
+	a.downErr = nil
+	a.linkMu.Unlock()
+
+	// Drain frames from the old link
+	for {
+		select {
+		case <-a.recvChan:
+			continue
+		default:
+		}
+		break
+	}
+	return a.Connect()
 }
 
 // Connect sends RST and waits for RSTACK to establish the ASH connection.
@@ -85,63 +237,107 @@ func (a *ASHLayer) Connect() error {
 	a.state = ashStateResetPending
 	a.stateMu.Unlock()
 
+	// Drain any stale connChan signal
+	select {
+	case <-a.connChan:
+	default:
+	}
+
+	a.startLink()
+
 	// Send RST frame
 	if err := a.sendRST(); err != nil {
 		return fmt.Errorf("send RST: %w", err)
 	}
 
-	// Start reader goroutine
-	go a.readLoop()
-
 	// Wait for RSTACK
 	select {
 	case <-a.connChan:
 		log.Info().Msg("ASH connection established")
 		return nil
-	case <-time.After(5 * time.Second):
+	case <-time.After(ashRSTACKTimeout):
 		return fmt.Errorf("timeout waiting for RSTACK")
 	case <-a.stopChan:
 		return fmt.Errorf("stopped")
 	}
 }
 
-// SendData sends an EZSP payload wrapped in an ASH DATA frame.
+// startLink starts the reader and retransmit timer for the current transport.
+// Both exit when that link is lost or the layer is closed.
+func (a *ASHLayer) startLink() {
+	t, down := a.port(), a.Down()
+	go a.readLoop(t)
+	go a.retransmitLoop(down)
+}
+
+// SendData queues an EZSP payload as an ASH DATA frame. It blocks while the
+// transmit window is full, the NCP reports nRdy or, with software flow
+// control, after XOFF. It returns once the frame is written; acknowledgement
+// and retransmission are handled in the background.
 func (a *ASHLayer) SendData(payload []byte) error {
-	a.stateMu.RLock()
-	if a.state != ashStateConnected {
-		a.stateMu.RUnlock()
-		return fmt.Errorf("ASH not connected")
+	down := a.Down()
+	for {
+		if !a.IsConnected() {
+			return fmt.Errorf("%w: ASH link down", device.ErrNotConnected)
+		}
+		if a.canSend() {
+			a.waitXON()
+			a.sendMu.Lock()
+			frame, ok := a.queueFrame(payload)
+			if ok {
+				_, err := a.port().Write(frame)
+				a.sendMu.Unlock()
+				if err != nil {
+					return fmt.Errorf("write DATA frame: %w", err)
+				}
+				return nil
+			}
+			a.sendMu.Unlock()
+		}
+		select {
+		case <-a.txSpace:
+		case <-time.After(ashTimerTick):
+		case <-down:
+			return fmt.Errorf("%w: ASH link down", device.ErrNotConnected)
+		case <-a.stopChan:
+			return fmt.Errorf("stopped")
+		}
 	}
-	a.stateMu.RUnlock()
-
-	a.seqMu.Lock()
-	seq := a.sendSeq
-	a.sendSeq = (a.sendSeq + 1) & 0x07
-	ack := a.recvSeq
-	a.seqMu.Unlock()
-
-	// Build DATA control byte: bit7=0, frmNum[2:0] in bits 6-4, reTx=0, ackNum[2:0] in bits 2-0
-	control := (seq << 4) | (ack & 0x07)
+}
 
-	frame := a.buildDataFrame(control, payload)
+// canSend reports whether the window has room and the NCP is ready.
+func (a *ASHLayer) canSend() bool {
+	a.txMu.Lock()
+	defer a.txMu.Unlock()
+	return len(a.unacked) < a.cfg.WindowSize && time.Now().After(a.remoteNotReady)
+}
 
-	// Store for potential retransmission
-	a.pendingMu.Lock()
-	a.pending[seq] = frame
-	a.pendingMu.Unlock()
+// queueFrame assigns the next frame number to payload and returns the encoded
+// frame, or false if the window filled up in the meantime.
+func (a *ASHLayer) queueFrame(payload []byte) ([]byte, bool) {
+	a.txMu.Lock()
+	defer a.txMu.Unlock()
+	if len(a.unacked) >= a.cfg.WindowSize || time.Now().Before(a.remoteNotReady) {
+		return nil, false
+	}
+	f := &ashTxFrame{frmNum: a.frmTx, payload: payload, sentAt: time.Now()}
+	a.frmTx = (a.frmTx + 1) & 0x07
+	a.unacked = append(a.unacked, f)
 
+	ack := a.rxAckNum()
 	log.Debug().
-		Uint8("seq", seq).
+		Uint8("seq", f.frmNum).
 		Uint8("ack", ack).
 		Int("payload_len", len(payload)).
 		Msg("ASH TX DATA")
+	return a.buildDataFrame(f.frmNum<<4|ack, payload), true
+}
 
-	_, err := a.serial.Write(frame)
-	if err != nil {
-		return fmt.Errorf("write DATA frame: %w", err)
-	}
-
-	return nil
+// rxAckNum returns the ackNum to piggyback: the next frame expected from the NCP.
+func (a *ASHLayer) rxAckNum() uint8 {
+	a.rxMu.Lock()
+	defer a.rxMu.Unlock()
+	return a.frmRx
 }
 
 // RecvData returns the channel for receiving EZSP payloads.
@@ -190,7 +386,7 @@ func (a *ASHLayer) Reset() error {
 	case <-a.connChan:
 		log.Info().Msg("ASH connection re-established after reset")
 		return nil
-	case <-time.After(5 * time.Second):
+	case <-time.After(ashRSTACKTimeout):
 		return fmt.Errorf("timeout waiting for RSTACK after reset")
 	case <-a.stopChan:
 		return fmt.Errorf("stopped")
@@ -199,48 +395,47 @@ func (a *ASHLayer) Reset() error {
 
 // sendRST sends an ASH RST frame (0xC0 + CRC + flag).
 func (a *ASHLayer) sendRST() error {
-	// RST frame: just the cancel byte to flush, then 0xC0 with CRC and flag
 	// First send cancel byte to reset NCP receiver state
-	if _, err := a.serial.Write([]byte{ashCancelByte}); err != nil {
+	if _, err := a.port().Write([]byte{ashCancelByte}); err != nil {
 		return err
 	}
-
-	raw := []byte{ashFrameRST}
-	crc := crcCCITT(raw)
-	raw = append(raw, byte(crc>>8), byte(crc&0xFF))
-
-	frame := ashStuff(raw)
-	frame = append(frame, ashFlagByte)
-
 	log.Debug().Msg("ASH TX RST")
-
-	_, err := a.serial.Write(frame)
+	_, err := a.port().Write(buildControlFrame(ashFrameRST))
 	return err
 }
 
-// sendACK sends an ASH ACK frame.
-func (a *ASHLayer) sendACK() error {
-	a.seqMu.Lock()
-	ack := a.recvSeq
-	a.seqMu.Unlock()
-
-	control := byte(ashFrameACK) | (ack & 0x07)
-	raw := []byte{control}
-	crc := crcCCITT(raw)
-	raw = append(raw, byte(crc>>8), byte(crc&0xFF))
-
-	frame := ashStuff(raw)
-	frame = append(frame, ashFlagByte)
-
+// sendACK sends an ASH ACK frame, with nRdy set while our receive buffer is full.
+func (a *ASHLayer) sendACK() {
+	ack := a.rxAckNum()
+	control := byte(ashFrameACK) | a.notReadyBit() | ack
 	log.Debug().Uint8("ack", ack).Msg("ASH TX ACK")
+	if _, err := a.port().Write(buildControlFrame(control)); err != nil {
+		log.Error().Err(err).Msg("Failed to send ACK")
+	}
+}
 
-	_, err := a.serial.Write(frame)
-	return err
+// sendNAK sends an ASH NAK frame asking the NCP to resend from our ackNum.
+func (a *ASHLayer) sendNAK() {
+	ack := a.rxAckNum()
+	control := byte(ashFrameNAK) | a.notReadyBit() | ack
+	log.Debug().Uint8("ack", ack).Msg("ASH TX NAK")
+	if _, err := a.port().Write(buildControlFrame(control)); err != nil {
+		log.Error().Err(err).Msg("ASH NAK send failed")
+	}
 }
 
-// readLoop continuously reads frames from the serial port.
-func (a *ASHLayer) readLoop() {
+// notReadyBit returns the nRdy flag for outgoing ACK/NAK frames.
+func (a *ASHLayer) notReadyBit() byte {
+	if len(a.recvChan) >= cap(a.recvChan) {
+		return ashNotReadyBit
+	}
+	return 0
+}
+
+// readLoop continuously reads frames from the transport until it fails.
+func (a *ASHLayer) readLoop(t Transport) {
 	buf := make([]byte, 0, ashMaxFrameLen)
+	discard := false // a Substitute byte poisoned the frame in progress
 
 	for {
 		select {
@@ -249,44 +444,42 @@ func (a *ASHLayer) readLoop() {
 		default:
 		}
 
-		b, err := a.serial.ReadByte()
+		b, err := t.ReadByte()
 		if err != nil {
 			a.stopMu.Lock()
 			stopped := a.stopped
 			a.stopMu.Unlock()
-			if stopped {
-				return
+			if !stopped {
+				// Unplugged or the port was closed under us; the supervisor reopens it.
+				a.linkLost(t, fmt.Errorf("serial read: %w", err))
 			}
-			log.Error().Err(err).Msg("ASH read error")
-			time.Sleep(time.Second)
-			continue
-		}
-
-		if b == ashCancelByte {
-			buf = buf[:0]
-			continue
-		}
-
-		if b == ashSubstitute {
-			buf = buf[:0]
-			continue
-		}
-
-		if b == ashXON || b == ashXOFF {
-			continue
+			return
 		}
 
-		if b == ashFlagByte {
-			if len(buf) > 0 {
+		switch b {
+		case ashCancelByte:
+			buf, discard = buf[:0], false
+		case ashSubstitute:
+			buf, discard = buf[:0], true
+		case ashXON, ashXOFF:
+			if a.cfg.SoftwareFlowControl {
+				a.setXOFF(b == ashXOFF)
+			}
+		case ashFlagByte:
+			if discard {
+				a.frameError("substitute byte")
+			} else if len(buf) > 0 {
 				a.processFrame(buf)
-				buf = buf[:0]
 			}
-			continue
-		}
-
-		buf = append(buf, b)
-		if len(buf) > ashMaxFrameLen {
-			buf = buf[:0]
+			buf, discard = buf[:0], false
+		default:
+			if discard {
+				continue
+			}
+			buf = append(buf, b)
+			if len(buf) > ashMaxFrameLen {
+				buf, discard = buf[:0], true
+			}
 		}
 	}
 }
@@ -296,20 +489,15 @@ func (a *ASHLayer) processFrame(stuffed []byte) {
 	raw := ashUnstuff(stuffed)
 
 	if len(raw) < 3 {
-		log.Debug().Int("len", len(raw)).Msg("ASH frame too short, discarding")
+		a.frameError(fmt.Sprintf("frame too short: %d bytes", len(raw)))
 		return
 	}
 
 	// Verify CRC
 	payload := raw[:len(raw)-2]
 	receivedCRC := uint16(raw[len(raw)-2])<<8 | uint16(raw[len(raw)-1])
-	computedCRC := crcCCITT(payload)
-
-	if receivedCRC != computedCRC {
-		log.Warn().
-			Uint16("received", receivedCRC).
-			Uint16("computed", computedCRC).
-			Msg("ASH CRC mismatch")
+	if receivedCRC != crcCCITT(payload) {
+		a.frameError("CRC mismatch")
 		return
 	}
 
@@ -317,38 +505,80 @@ func (a *ASHLayer) processFrame(stuffed []byte) {
 
 	switch {
 	case control == ashFrameRSTACK:
-		// RSTACK
 		a.handleRSTACK(payload)
 	case control == ashFrameERROR:
-		// ERROR
+		// ERROR: the NCP entered the FAILED state and needs a reset
 		log.Error().Hex("frame", payload).Msg("ASH ERROR frame received")
+		code := byte(0)
+		if len(payload) >= 3 {
+			code = payload[2]
+		}
+		a.linkLost(a.port(), fmt.Errorf("NCP ERROR frame, reset code 0x%02X", code))
+	case !a.IsConnected():
+		// DATA/ACK/NAK before RSTACK belong to the previous session.
+		log.Debug().Uint8("control", control).Msg("ASH frame before RSTACK, discarding")
 	case control&0x80 == ashFrameData:
-		// DATA frame
 		a.handleData(payload)
 	case control&0xE0 == ashFrameACK:
-		// ACK
-		a.handleACK(control)
+		log.Debug().Uint8("ack", control&0x07).Msg("ASH RX ACK")
+		a.setRemoteNotReady(control&ashNotReadyBit != 0)
+		a.handleAckNum(control & 0x07)
 	case control&0xE0 == ashFrameNAK:
-		// NAK
-		a.handleNAK(control)
+		log.Warn().Uint8("nak", control&0x07).Msg("ASH RX NAK, retransmitting")
+		a.setRemoteNotReady(control&ashNotReadyBit != 0)
+		a.handleAckNum(control & 0x07)
+		select {
+		case a.nakCh <- struct{}{}:
+		default:
+		}
 	default:
 		log.Debug().Uint8("control", control).Msg("ASH unknown frame type")
 	}
 }
 
+// frameError enters the Reject Condition for a damaged frame, sending one NAK
+// until an in-order DATA frame arrives (UG101 §3.3).
+func (a *ASHLayer) frameError(reason string) {
+	log.Warn().Str("reason", reason).Msg("ASH bad frame")
+	if !a.IsConnected() {
+		return
+	}
+	a.rxMu.Lock()
+	nak := !a.reject
+	a.reject = true
+	a.rxMu.Unlock()
+	if nak {
+		a.sendNAK()
+	}
+}
+
 // handleRSTACK processes RSTACK frame.
 func (a *ASHLayer) handleRSTACK(payload []byte) {
 	log.Info().Hex("payload", payload).Msg("ASH RSTACK received")
 
-	a.seqMu.Lock()
-	a.sendSeq = 0
-	a.ackNum = 0
-	a.recvSeq = 0
-	a.seqMu.Unlock()
+	a.stateMu.RLock()
+	unexpected := a.state == ashStateConnected
+	a.stateMu.RUnlock()
+	if unexpected {
+		// The NCP reset on its own and lost all stack configuration.
+		a.linkLost(a.port(), fmt.Errorf("unexpected RSTACK, NCP reset"))
+		return
+	}
+
+	a.txMu.Lock()
+	a.frmTx, a.ackRx = 0, 0
+	a.unacked = nil
+	a.tRxAck = a.timing.ackInit
+	a.ackTimeouts = 0
+	a.remoteNotReady = time.Time{}
+	a.txMu.Unlock()
 
-	a.pendingMu.Lock()
-	a.pending = make(map[uint8][]byte)
-	a.pendingMu.Unlock()
+	a.rxMu.Lock()
+	a.frmRx = 0
+	a.reject = false
+	a.rxMu.Unlock()
+
+	a.setXOFF(false)
 
 	a.stateMu.Lock()
 	a.state = ashStateConnected
@@ -364,100 +594,205 @@ func (a *ASHLayer) handleRSTACK(payload []byte) {
 func (a *ASHLayer) handleData(payload []byte) {
 	control := payload[0]
 	frmNum := (control >> 4) & 0x07
-	// ackNum from NCP is in bits 2:0
-	npcAck := control & 0x07
+	reTx := control&ashReTxBit != 0
 
 	log.Debug().
 		Uint8("frmNum", frmNum).
-		Uint8("npcAck", npcAck).
+		Uint8("ncpAck", control&0x07).
+		Bool("reTx", reTx).
 		Int("payload_len", len(payload)-1).
 		Msg("ASH RX DATA")
 
-	// Remove acknowledged frames
-	a.pendingMu.Lock()
-	for seq := range a.pending {
-		if ashSeqLessThan(seq, npcAck) {
-			delete(a.pending, seq)
+	// The piggybacked ackNum is valid even on out-of-order frames.
+	a.handleAckNum(control & 0x07)
+
+	a.rxMu.Lock()
+	expected := a.frmRx
+	switch {
+	case frmNum == expected:
+		// Extract EZSP data (skip control byte) and de-randomize.
+		select {
+		case a.recvChan <- ashRandomize(payload[1:]):
+			a.frmRx = (expected + 1) & 0x07
+			a.reject = false
+			a.rxMu.Unlock()
+		default:
+			// No room: leave it unacknowledged and signal nRdy; the NCP resends.
+			a.rxMu.Unlock()
+			log.Warn().Msg("ASH receive buffer full, signalling not ready")
+		}
+		a.sendACK()
+	case reTx && ashSeqLessThan(frmNum, expected):
+		// Duplicate of a frame already accepted; our ACK was probably lost.
+		a.rxMu.Unlock()
+		a.sendACK()
+	default:
+		nak := !a.reject
+		a.reject = true
+		a.rxMu.Unlock()
+		if nak {
+			log.Warn().
+				Uint8("expected", expected).
+				Uint8("got", frmNum).
+				Msg("ASH out-of-sequence DATA, sending NAK")
+			a.sendNAK()
 		}
 	}
-	a.pendingMu.Unlock()
-
-	a.seqMu.Lock()
-	expected := a.recvSeq
-	if frmNum == expected {
-		a.recvSeq = (expected + 1) & 0x07
-		a.seqMu.Unlock()
+}
 
-		// Send ACK
-		if err := a.sendACK(); err != nil {
-			log.Error().Err(err).Msg("Failed to send ACK")
+// handleAckNum releases every frame before ackNum from the transmit window
+// and updates t_rx_ack from the round trip of first-time transmissions.
+func (a *ASHLayer) handleAckNum(ackNum uint8) {
+	a.txMu.Lock()
+	n := int((ackNum - a.ackRx) & 0x07)
+	if n == 0 || n > len(a.unacked) {
+		// Nothing new, or an ackNum outside the window.
+		a.txMu.Unlock()
+		return
+	}
+	now := time.Now()
+	for _, f := range a.unacked[:n] {
+		if !f.retransmitted {
+			// t_rx_ack = 7/8 t_rx_ack + 1/2 measured (UG101 §3.4)
+			a.tRxAck = a.tRxAck*7/8 + now.Sub(f.sentAt)/2
+			a.tRxAck = min(max(a.tRxAck, a.timing.ackMin), a.timing.ackMax)
 		}
+	}
+	a.unacked = a.unacked[n:]
+	a.ackRx = ackNum
+	a.ackTimeouts = 0
+	a.txMu.Unlock()
 
-		// Extract EZSP data (skip control byte) and de-randomize.
-		ezspData := ashRandomize(payload[1:])
+	select {
+	case a.txSpace <- struct{}{}:
+	default:
+	}
+}
 
+// setRemoteNotReady records the nRdy flag from an NCP ACK or NAK.
+func (a *ASHLayer) setRemoteNotReady(notReady bool) {
+	a.txMu.Lock()
+	if notReady {
+		a.remoteNotReady = time.Now().Add(ashNotReadyTimeout)
+	} else {
+		a.remoteNotReady = time.Time{}
+	}
+	a.txMu.Unlock()
+	if !notReady {
 		select {
-		case a.recvChan <- ezspData:
+		case a.txSpace <- struct{}{}:
 		default:
-			log.Warn().Msg("ASH recv channel full, dropping frame")
 		}
-	} else {
-		a.seqMu.Unlock()
-		log.Warn().
-			Uint8("expected", expected).
-			Uint8("got", frmNum).
-			Msg("ASH out-of-sequence DATA, sending NAK")
-		a.sendNAK()
 	}
 }
 
-// handleACK processes an ACK frame.
-func (a *ASHLayer) handleACK(control byte) {
-	ackNum := control & 0x07
-	log.Debug().Uint8("ack", ackNum).Msg("ASH RX ACK")
+// setXOFF records XON/XOFF received from the NCP.
+func (a *ASHLayer) setXOFF(off bool) {
+	a.flowMu.Lock()
+	a.xoff = off
+	if off {
+		a.xoffAt = time.Now()
+	}
+	a.flowMu.Unlock()
+	if !off {
+		select {
+		case a.xonCh <- struct{}{}:
+		default:
+		}
+	}
+}
 
-	a.pendingMu.Lock()
-	for seq := range a.pending {
-		if ashSeqLessThan(seq, ackNum) {
-			delete(a.pending, seq)
+// waitXON blocks while the NCP has paused us with XOFF, up to ashXOFFTimeout.
+func (a *ASHLayer) waitXON() {
+	for {
+		a.flowMu.Lock()
+		paused := a.xoff && time.Since(a.xoffAt) < ashXOFFTimeout
+		a.flowMu.Unlock()
+		if !paused {
+			return
+		}
+		select {
+		case <-a.xonCh:
+		case <-time.After(ashTimerTick):
+		case <-a.stopChan:
+			return
 		}
 	}
-	a.pendingMu.Unlock()
 }
 
-// handleNAK processes a NAK frame and retransmits.
-func (a *ASHLayer) handleNAK(control byte) {
-	nakNum := control & 0x07
-	log.Warn().Uint8("nak", nakNum).Msg("ASH RX NAK, retransmitting")
+// retransmitLoop runs the t_rx_ack timer for one link and resends after NAKs.
+func (a *ASHLayer) retransmitLoop(down <-chan struct{}) {
+	ticker := time.NewTicker(ashTimerTick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-down:
+			return
+		case <-a.stopChan:
+			return
+		case <-a.nakCh:
+			a.retransmit()
+		case <-ticker.C:
+			a.checkAckTimer()
+		}
+	}
+}
+
+// checkAckTimer retransmits when the oldest frame has waited longer than
+// t_rx_ack, doubling the timeout each time. Too many consecutive expiries
+// mean the NCP is gone.
+func (a *ASHLayer) checkAckTimer() {
+	a.txMu.Lock()
+	if len(a.unacked) == 0 || time.Since(a.unacked[0].sentAt) < a.tRxAck {
+		a.txMu.Unlock()
+		return
+	}
+	a.ackTimeouts++
+	timeouts := a.ackTimeouts
+	a.tRxAck = min(a.tRxAck*2, a.timing.ackMax)
+	a.txMu.Unlock()
+
+	if timeouts > a.timing.maxAckTimeouts {
+		a.linkLost(a.port(), fmt.Errorf("no ACK after %d retransmissions", timeouts-1))
+		return
+	}
+	log.Warn().Int("timeouts", timeouts).Msg("ASH ACK timeout, retransmitting")
+	a.retransmit()
+}
 
-	a.pendingMu.Lock()
-	frame, ok := a.pending[nakNum]
-	a.pendingMu.Unlock()
+// retransmit resends every unacknowledged frame in order with reTx set. The
+// NCP discards frames after a missing one, so the whole window goes again.
+func (a *ASHLayer) retransmit() {
+	a.waitXON()
+	a.sendMu.Lock()
+	defer a.sendMu.Unlock()
+
+	a.txMu.Lock()
+	ack := a.rxAckNum()
+	now := time.Now()
+	frames := make([][]byte, 0, len(a.unacked))
+	for _, f := range a.unacked {
+		f.sentAt = now
+		f.retransmitted = true
+		frames = append(frames, a.buildDataFrame(f.frmNum<<4|ashReTxBit|ack, f.payload))
+	}
+	a.txMu.Unlock()
 
-	if ok {
-		if _, err := a.serial.Write(frame); err != nil {
+	for _, frame := range frames {
+		if _, err := a.port().Write(frame); err != nil {
 			log.Error().Err(err).Msg("ASH retransmit failed")
+			return
 		}
 	}
 }
 
-// sendNAK sends an ASH NAK frame.
-func (a *ASHLayer) sendNAK() {
-	a.seqMu.Lock()
-	ack := a.recvSeq
-	a.seqMu.Unlock()
-
-	control := byte(ashFrameNAK) | (ack & 0x07)
+// buildControlFrame encodes a frame that is only a control byte (RST, ACK, NAK).
+func buildControlFrame(control byte) []byte {
 	raw := []byte{control}
 	crc := crcCCITT(raw)
 	raw = append(raw, byte(crc>>8), byte(crc&0xFF))
-
 	frame := ashStuff(raw)
-	frame = append(frame, ashFlagByte)
-
-	if _, err := a.serial.Write(frame); err != nil {
-		log.Error().Err(err).Msg("ASH NAK send failed")
-	}
+	return append(frame, ashFlagByte)
 }
 
 // ashRandomize XORs data with a pseudo-random sequence (LFSR, seed 0x42)
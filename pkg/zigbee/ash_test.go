@@ -0,0 +1,276 @@
+package zigbee
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lossyLink is one direction of an in-memory serial line that drops,
+// corrupts and reorders bytes.
+type lossyLink struct {
+	mu      sync.Mutex
+	rng     *rand.Rand
+	loss    float64 // probability per byte of each fault
+	held    []byte  // byte delayed to swap with the next one
+	bytes   chan byte
+	closed  chan struct{}
+	closeMu sync.Once
+}
+
+func newLossyLink(seed int64, loss float64) *lossyLink {
+	return &lossyLink{
+		rng:    rand.New(rand.NewSource(seed)),
+		loss:   loss,
+		bytes:  make(chan byte, 1<<16),
+		closed: make(chan struct{}),
+	}
+}
+
+func (l *lossyLink) send(p []byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, b := range p {
+		switch r := l.rng.Float64(); {
+		case r < l.loss: // drop
+			continue
+		case r < 2*l.loss: // corrupt one bit
+			b ^= 1 << l.rng.Intn(8)
+		case r < 3*l.loss && l.held == nil && b != ashFlagByte:
+			// Reorder with the next byte. Flags stay put: swapping a flag with
+			// a following 0x00 control byte yields a frame whose CRC still
+			// checks out, which no UART can produce.
+			l.held = []byte{b}
+			continue
+		}
+		l.bytes <- b
+		if l.held != nil {
+			l.bytes <- l.held[0]
+			l.held = nil
+		}
+	}
+}
+
+func (l *lossyLink) close() { l.closeMu.Do(func() { close(l.closed) }) }
+
+// lossyEnd is one side of a lossy link pair, implementing Transport.
+type lossyEnd struct {
+	tx, rx *lossyLink
+}
+
+func (e *lossyEnd) Write(p []byte) (int, error) {
+	e.tx.send(p)
+	return len(p), nil
+}
+
+func (e *lossyEnd) ReadByte() (byte, error) {
+	select {
+	case b := <-e.rx.bytes:
+		return b, nil
+	case <-e.rx.closed:
+		return 0, io.EOF
+	}
+}
+
+func (e *lossyEnd) Close() error {
+	e.tx.close()
+	e.rx.close()
+	return nil
+}
+
+var testASHTiming = ashTiming{
+	ackInit:        30 * time.Millisecond,
+	ackMin:         10 * time.Millisecond,
+	ackMax:         100 * time.Millisecond,
+	maxAckTimeouts: 50,
+}
+
+// connectASH marks a layer connected as if RSTACK had arrived and starts its
+// reader and retransmit timer.
+func connectASH(a *ASHLayer) {
+	a.timing = testASHTiming
+	a.state = ashStateResetPending
+	a.startLink()
+	a.handleRSTACK([]byte{ashFrameRSTACK, 0x02, 0x0B})
+}
+
+func TestASHLossyLink(t *testing.T) {
+	const frames = 40
+	ab, ba := newLossyLink(1, 0.005), newLossyLink(2, 0.005)
+	host := NewASHLayer(&lossyEnd{tx: ab, rx: ba}, ASHConfig{WindowSize: 3})
+	peer := NewASHLayer(&lossyEnd{tx: ba, rx: ab}, ASHConfig{WindowSize: 3})
+	defer host.Close()
+	defer peer.Close()
+	connectASH(host)
+	connectASH(peer)
+
+	sendErrs := make(chan error, 2)
+	send := func(a *ASHLayer, prefix string) {
+		for i := range frames {
+			if err := a.SendData([]byte(fmt.Sprintf("%s-%02d", prefix, i))); err != nil {
+				sendErrs <- fmt.Errorf("%s SendData %d: %w", prefix, i, err)
+				return
+			}
+		}
+	}
+	go send(host, "host")
+	go send(peer, "ncp")
+
+	expect := func(a *ASHLayer, prefix string, done chan<- struct{}) {
+		defer close(done)
+		for i := range frames {
+			select {
+			case got := <-a.RecvData():
+				if want := fmt.Sprintf("%s-%02d", prefix, i); string(got) != want {
+					t.Errorf("received %q, want %q", got, want)
+					return
+				}
+			case <-time.After(20 * time.Second):
+				t.Errorf("timed out waiting for %s frame %d", prefix, i)
+				return
+			}
+		}
+	}
+	hostDone, peerDone := make(chan struct{}), make(chan struct{})
+	go expect(peer, "host", peerDone)
+	go expect(host, "ncp", hostDone)
+	<-hostDone
+	<-peerDone
+
+	select {
+	case err := <-sendErrs:
+		t.Fatal(err)
+	case <-host.Down():
+		t.Fatalf("host link lost: %v", host.Err())
+	default:
+	}
+}
+
+// recordingTransport captures written frames and never yields input.
+type recordingTransport struct {
+	mu     sync.Mutex
+	writes [][]byte
+}
+
+func (r *recordingTransport) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	r.writes = append(r.writes, append([]byte(nil), p...))
+	r.mu.Unlock()
+	return len(p), nil
+}
+
+func (r *recordingTransport) ReadByte() (byte, error) { select {} }
+func (r *recordingTransport) Close() error            { return nil }
+
+// controls returns the control byte of each frame written so far.
+func (r *recordingTransport) controls() []byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var out []byte
+	for _, w := range r.writes {
+		if raw := ashUnstuff(w[:len(w)-1]); len(raw) >= 3 {
+			out = append(out, raw[0])
+		}
+	}
+	return out
+}
+
+func dataFrame(a *ASHLayer, frmNum, ackNum uint8, payload string) []byte {
+	f := a.buildDataFrame(frmNum<<4|ackNum, []byte(payload))
+	return f[:len(f)-1] // processFrame takes the frame without its flag
+}
+
+func TestASHRejectCondition(t *testing.T) {
+	rec := &recordingTransport{}
+	a := NewASHLayer(rec, ASHConfig{})
+	a.state = ashStateResetPending
+	a.handleRSTACK([]byte{ashFrameRSTACK, 0x02, 0x0B})
+
+	// Frame 0 was lost: frames 1 and 2 arrive out of sequence. Only the
+	// first triggers a NAK; the second is discarded in the Reject Condition.
+	a.processFrame(dataFrame(a, 1, 0, "one"))
+	a.processFrame(dataFrame(a, 2, 0, "two"))
+	if got := rec.controls(); len(got) != 1 || got[0] != ashFrameNAK|0 {
+		t.Fatalf("controls after out-of-sequence frames = %x, want one NAK(0)", got)
+	}
+
+	// The retransmitted frame 0 clears the condition and is acknowledged.
+	a.processFrame(dataFrame(a, 0, 0, "zero"))
+	got := rec.controls()
+	if len(got) != 2 || got[1] != ashFrameACK|1 {
+		t.Fatalf("controls after in-sequence frame = %x, want ACK(1)", got)
+	}
+	if payload := <-a.RecvData(); string(payload) != "zero" {
+		t.Fatalf("delivered %q, want %q", payload, "zero")
+	}
+
+	// A damaged frame starts a new Reject Condition.
+	a.processFrame([]byte{0x01, 0x02, 0x03})
+	if got := rec.controls(); len(got) != 3 || got[2] != ashFrameNAK|1 {
+		t.Fatalf("controls after bad CRC = %x, want NAK(1)", got)
+	}
+}
+
+func TestASHAdaptiveAckTimeout(t *testing.T) {
+	rec := &recordingTransport{}
+	a := NewASHLayer(rec, ASHConfig{WindowSize: 2})
+	a.state = ashStateResetPending
+	a.handleRSTACK([]byte{ashFrameRSTACK, 0x02, 0x0B})
+
+	for i := range 2 {
+		if err := a.SendData([]byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if a.canSend() {
+		t.Fatal("window of 2 should be full after two frames")
+	}
+
+	// A fast ACK for both frames shrinks t_rx_ack towards the minimum.
+	a.handleAckNum(2)
+	if !a.canSend() {
+		t.Fatal("window should reopen after ACK")
+	}
+	if a.tRxAck >= ashAckTimeoutInit {
+		t.Fatalf("t_rx_ack = %v, want below %v after a fast ACK", a.tRxAck, ashAckTimeoutInit)
+	}
+
+	// An nRdy ACK holds transmission even with room in the window.
+	a.setRemoteNotReady(true)
+	if a.canSend() {
+		t.Fatal("nRdy should pause transmission")
+	}
+	a.setRemoteNotReady(false)
+	if !a.canSend() {
+		t.Fatal("transmission should resume once nRdy clears")
+	}
+}
+
+func TestASHSoftwareFlowControl(t *testing.T) {
+	rec := &recordingTransport{}
+	a := NewASHLayer(rec, ASHConfig{SoftwareFlowControl: true})
+	a.state = ashStateResetPending
+	a.handleRSTACK([]byte{ashFrameRSTACK, 0x02, 0x0B})
+
+	a.setXOFF(true)
+	sent := make(chan error, 1)
+	go func() { sent <- a.SendData([]byte("paused")) }()
+
+	select {
+	case <-sent:
+		t.Fatal("SendData wrote while XOFF was in effect")
+	case <-time.After(100 * time.Millisecond):
+	}
+	a.setXOFF(false)
+	select {
+	case err := <-sent:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("SendData did not resume after XON")
+	}
+}
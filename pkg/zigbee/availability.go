@@ -0,0 +1,136 @@
+package zigbee
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// availabilityCheckInterval is how often the checker evaluates devices.
+	availabilityCheckInterval = 1 * time.Minute
+
+	// routerAvailabilityTimeout is how long a mains-powered device may stay
+	// silent before it is pinged. A failed ping marks it offline.
+	routerAvailabilityTimeout = 10 * time.Minute
+
+	// sleepyAvailabilityTimeout is how long a sleepy end device may stay silent
+	// before it is marked offline. Sleepy devices cannot be pinged reliably,
+	// so they are judged only on the traffic they send (check-ins, reports).
+	sleepyAvailabilityTimeout = 25 * time.Hour
+
+	// pingTimeout bounds a single availability ping.
+	pingTimeout = 15 * time.Second
+
+	// maxConcurrentPings bounds the pings in flight during one sweep, so a few
+	// dead routers cannot hold up the rest.
+	maxConcurrentPings = 4
+
+	// maxPingBackoff caps the delay between pings of a router that keeps
+	// failing them. The delay starts at availabilityCheckInterval and doubles.
+	maxPingBackoff = time.Hour
+)
+
+// setAvailable updates a device's availability and publishes a transition event.
+func (c *Controller) setAvailable(ieee string, kd *KnownDevice, available bool) {
+	c.mu.Lock()
+	changed := kd.Available != available
+	kd.Available = available
+	c.mu.Unlock()
+
+	if changed {
+		c.PublishAvailability(ieee, kd, available)
+	}
+}
+
+// availabilityLoop periodically checks every device until the controller stops.
+func (c *Controller) availabilityLoop() {
+	ticker := time.NewTicker(availabilityCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.checkAvailability()
+		case <-c.stopChan:
+			return
+		}
+	}
+}
+
+// availabilityCandidate is a device the availability checker acts on.
+type availabilityCandidate struct {
+	ieee string
+	kd   *KnownDevice
+}
+
+// checkAvailability marks silent sleepy devices offline and pings silent routers.
+func (c *Controller) checkAvailability() {
+	expired, ping := c.availabilityPlan(time.Now())
+	for _, d := range expired {
+		c.setAvailable(d.ieee, d.kd, false)
+	}
+	c.pingAll(ping, c.ping)
+}
+
+// availabilityPlan returns the devices to mark offline without a ping and
+// the silent routers due for one.
+func (c *Controller) availabilityPlan(now time.Time) (expired, ping []availabilityCandidate) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for ieee, kd := range c.devices {
+		silent := now.Sub(kd.LastSeen)
+		switch {
+		case kd.NodeID == 0:
+			// Not resolved since startup; it is offline until it rejoins.
+			if kd.Available {
+				expired = append(expired, availabilityCandidate{ieee, kd})
+			}
+		case kd.Sleepy:
+			if silent > sleepyAvailabilityTimeout && kd.Available {
+				expired = append(expired, availabilityCandidate{ieee, kd})
+			}
+		case silent > routerAvailabilityTimeout && !now.Before(kd.nextPing):
+			ping = append(ping, availabilityCandidate{ieee, kd})
+		}
+	}
+	return expired, ping
+}
+
+// pingAll pings routers at most maxConcurrentPings at a time. A router that
+// fails is marked offline and not pinged again until its backoff expires.
+func (c *Controller) pingAll(cands []availabilityCandidate, ping func(*KnownDevice) error) {
+	sem := make(chan struct{}, maxConcurrentPings)
+	var wg sync.WaitGroup
+	for _, d := range cands {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer func() { <-sem; wg.Done() }()
+			if err := ping(d.kd); err != nil {
+				log.Debug().Err(err).Str("device", d.ieee).Msg("Availability ping failed")
+				c.mu.Lock()
+				d.kd.pingBackoff = min(max(2*d.kd.pingBackoff, availabilityCheckInterval), maxPingBackoff)
+				d.kd.nextPing = time.Now().Add(d.kd.pingBackoff)
+				c.mu.Unlock()
+				c.setAvailable(d.ieee, d.kd, false)
+				return
+			}
+			c.mu.Lock()
+			d.kd.LastSeen = time.Now()
+			d.kd.pingBackoff, d.kd.nextPing = 0, time.Time{}
+			c.mu.Unlock()
+			c.setAvailable(d.ieee, d.kd, true)
+		}()
+	}
+	wg.Wait()
+}
+
+// ping checks that a router is reachable by reading the Basic cluster's
+// ZCL version attribute and waiting for the APS acknowledgement.
+func (c *Controller) ping(kd *KnownDevice) error {
+	ctx, cancel := context.WithTimeout(context.Background(), pingTimeout)
+	defer cancel()
+	return c.sendTracked(ctx, kd, zclClusterBasic, BuildReadAttributesCommand(zclAttrZCLVersion), false)
+}
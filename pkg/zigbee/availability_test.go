@@ -0,0 +1,85 @@
+package zigbee
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAvailabilityPlan(t *testing.T) {
+	now := time.Now()
+	c := &Controller{KnownDevices: &KnownDevices{devices: map[string]*KnownDevice{
+		"unresolved":   {NodeID: 0, Available: true},
+		"quiet-router": {NodeID: 1, LastSeen: now.Add(-time.Hour), Available: true},
+		"busy-router":  {NodeID: 2, LastSeen: now.Add(-time.Minute), Available: true},
+		"backing-off":  {NodeID: 3, LastSeen: now.Add(-time.Hour), nextPing: now.Add(time.Minute)},
+		"sleepy-gone":  {NodeID: 4, Sleepy: true, LastSeen: now.Add(-26 * time.Hour), Available: true},
+		"sleepy-quiet": {NodeID: 5, Sleepy: true, LastSeen: now.Add(-time.Hour), Available: true},
+	}}}
+	expired, ping := c.availabilityPlan(now)
+	names := func(cands []availabilityCandidate) map[string]bool {
+		out := map[string]bool{}
+		for _, d := range cands {
+			out[d.ieee] = true
+		}
+		return out
+	}
+	if got := names(expired); len(got) != 2 || !got["unresolved"] || !got["sleepy-gone"] {
+		t.Errorf("expired = %v", got)
+	}
+	if got := names(ping); len(got) != 1 || !got["quiet-router"] {
+		t.Errorf("ping = %v", got)
+	}
+}
+
+func TestPingAllBoundsAndBacksOff(t *testing.T) {
+	c := &Controller{KnownDevices: NewKnownDevices(nil)}
+	var cands []availabilityCandidate
+	for i := range 10 {
+		kd := &KnownDevice{NodeID: uint16(i + 1), Available: true}
+		cands = append(cands, availabilityCandidate{FormatIEEE([8]byte{byte(i)}), kd})
+	}
+
+	var mu sync.Mutex
+	inFlight, peak := 0, 0
+	start := time.Now()
+	c.pingAll(cands, func(kd *KnownDevice) error {
+		mu.Lock()
+		inFlight++
+		peak = max(peak, inFlight)
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+		if kd.NodeID%2 == 0 {
+			return errors.New("no ack")
+		}
+		return nil
+	})
+	if peak > maxConcurrentPings {
+		t.Errorf("%d pings in flight, want at most %d", peak, maxConcurrentPings)
+	}
+	if d := time.Since(start); d > 150*time.Millisecond {
+		t.Errorf("sweep took %v; pings were not concurrent", d)
+	}
+	for _, d := range cands {
+		failed := d.kd.NodeID%2 == 0
+		if d.kd.Available == failed {
+			t.Errorf("node %d available = %v", d.kd.NodeID, d.kd.Available)
+		}
+		if failed && (d.kd.pingBackoff != availabilityCheckInterval || d.kd.nextPing.Before(start.Add(availabilityCheckInterval))) {
+			t.Errorf("node %d backoff = %v next = %v", d.kd.NodeID, d.kd.pingBackoff, d.kd.nextPing)
+		}
+	}
+
+	// Repeated failures double the backoff up to the cap.
+	kd := cands[1].kd
+	for range 10 {
+		c.pingAll(cands[1:2], func(*KnownDevice) error { return errors.New("no ack") })
+	}
+	if kd.pingBackoff != maxPingBackoff {
+		t.Errorf("backoff after repeated failures = %v, want %v", kd.pingBackoff, maxPingBackoff)
+	}
+}
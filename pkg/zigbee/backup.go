@@ -0,0 +1,304 @@
+package zigbee
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/urmzd/zigbee-skill/pkg/device"
+)
+
+const (
+	// backupSource identifies this tool in backup metadata.
+	backupSource = "zigbee-skill"
+
+	// frameCounterMargin is added to the restored NWK and APS frame counters.
+	// Frames the old adapter sent after the backup was taken would otherwise
+	// make devices drop our traffic as replays until the counters caught up.
+	frameCounterMargin = 10000
+
+	// zigbeeSecurityLevel is the only NWK security level Zigbee 3.0 uses (ENC-MIC-32).
+	zigbeeSecurityLevel = 5
+)
+
+// BackupNetwork exports the coordinator's network in Open Coordinator Backup
+// format: network parameters, the network key and its frame counter, the TC
+// link key table and the child table.
+func (c *Controller) BackupNetwork(_ context.Context) (*device.NetworkBackup, error) {
+	if !c.IsConnected() {
+		return nil, device.ErrNotConnected
+	}
+
+	status, params, err := c.ezsp.GetNetworkParameters()
+	if err != nil {
+		return nil, fmt.Errorf("get network parameters: %w", err)
+	}
+	if status != emberSuccess {
+		return nil, fmt.Errorf("network is not up (status 0x%02X)", status)
+	}
+	eui, err := c.ezsp.GetEUI64()
+	if err != nil {
+		return nil, fmt.Errorf("get EUI64: %w", err)
+	}
+	nwkKey, err := c.ezsp.GetNetworkKey()
+	if err != nil {
+		return nil, fmt.Errorf("export network key: %w", err)
+	}
+	linkKeys, err := c.ezsp.GetLinkKeys()
+	if err != nil {
+		return nil, fmt.Errorf("export link keys: %w", err)
+	}
+	children, err := c.ezsp.GetChildren()
+	if err != nil {
+		return nil, fmt.Errorf("read child table: %w", err)
+	}
+	apsCounter, err := c.ezsp.GetValue(ezspValueAPSFrameCounter)
+	if err != nil {
+		return nil, fmt.Errorf("read APS frame counter: %w", err)
+	}
+	if len(apsCounter) < 4 {
+		return nil, fmt.Errorf("read APS frame counter: value too short: %d bytes", len(apsCounter))
+	}
+
+	proto, _, stackVer := c.ezsp.Version()
+	b := &device.NetworkBackup{
+		Metadata: device.BackupMetadata{
+			Format:  device.BackupFormat,
+			Version: device.BackupVersion,
+			Source:  backupSource,
+			Internal: map[string]any{
+				"creation_time": time.Now().UTC().Format(time.RFC3339),
+				"ezsp_version":  int(proto),
+				"stack_version": formatStackVersion(stackVer),
+				// Not part of the format; restored by this tool when present.
+				"aps_frame_counter": binary.LittleEndian.Uint32(apsCounter),
+				"tx_power":          int(params.RadioTxPower),
+			},
+		},
+		CoordinatorIEEE: backupHex(eui[:]),
+		PanID:           fmt.Sprintf("%04x", params.PanID),
+		ExtendedPanID:   backupHex(params.ExtendedPanID[:]),
+		NwkUpdateID:     int(params.NwkUpdateID),
+		SecurityLevel:   zigbeeSecurityLevel,
+		Channel:         int(params.RadioChannel),
+		ChannelMask:     channelList(params.Channels),
+		NetworkKey: device.BackupNetworkKey{
+			Key:            hex.EncodeToString(nwkKey.Key[:]),
+			SequenceNumber: int(nwkKey.SequenceNumber),
+			FrameCounter:   nwkKey.OutgoingFrameCounter,
+		},
+	}
+	if len(b.ChannelMask) == 0 {
+		b.ChannelMask = []int{b.Channel}
+	}
+
+	// Merge children and key table entries by IEEE address, keeping table order.
+	index := map[[8]byte]int{}
+	entry := func(ieee [8]byte) *device.BackupDevice {
+		if i, ok := index[ieee]; ok {
+			return &b.Devices[i]
+		}
+		index[ieee] = len(b.Devices)
+		b.Devices = append(b.Devices, device.BackupDevice{IEEEAddress: backupHex(ieee[:])})
+		return &b.Devices[len(b.Devices)-1]
+	}
+	for _, ch := range children {
+		d := entry(ch.EUI64)
+		d.IsChild = true
+		nwk := fmt.Sprintf("%04x", ch.NodeID)
+		d.NwkAddress = &nwk
+	}
+	for _, k := range linkKeys {
+		d := entry(k.PartnerEUI64)
+		d.LinkKey = &device.BackupLinkKey{
+			Key:       hex.EncodeToString(k.Key[:]),
+			RxCounter: k.IncomingFrameCounter,
+			TxCounter: k.OutgoingFrameCounter,
+		}
+	}
+	c.mu.RLock()
+	for _, kd := range c.devices {
+		if kd.NodeID == 0 {
+			continue
+		}
+		d := entry(kd.IEEEAddress)
+		if d.NwkAddress == nil {
+			nwk := fmt.Sprintf("%04x", kd.NodeID)
+			d.NwkAddress = &nwk
+		}
+	}
+	c.mu.RUnlock()
+
+	log.Info().
+		Int("devices", len(b.Devices)).
+		Int("link_keys", len(linkKeys)).
+		Int("children", len(children)).
+		Msg("Network backup created")
+	return b, nil
+}
+
+// RestoreNetwork leaves the current network and re-forms the one described by
+// the backup with the same PAN, channel, network key and a frame counter ahead
+// of the backed-up one, then re-imports TC link keys. Children are not written
+// back: they rejoin their new parent through a Trust Center rejoin.
+func (c *Controller) RestoreNetwork(_ context.Context, b *device.NetworkBackup, overwriteIEEE bool) error {
+	if !c.IsConnected() {
+		return device.ErrNotConnected
+	}
+	if err := b.Validate(); err != nil {
+		return err
+	}
+
+	coordIEEE, _ := parseBackupEUI64(b.CoordinatorIEEE)
+	extPanID, _ := parseBackupEUI64(b.ExtendedPanID)
+	panID, _ := strconv.ParseUint(b.PanID, 16, 16)
+	var nwkKey [16]byte
+	keyBytes, _ := hex.DecodeString(b.NetworkKey.Key)
+	copy(nwkKey[:], keyBytes)
+
+	eui, err := c.ezsp.GetEUI64()
+	if err != nil {
+		return fmt.Errorf("get EUI64: %w", err)
+	}
+	if eui != coordIEEE {
+		if !overwriteIEEE {
+			return fmt.Errorf("%w: adapter IEEE %s does not match backup %s (use overwrite to rewrite it)",
+				device.ErrValidation, FormatIEEE(eui), FormatIEEE(coordIEEE))
+		}
+		// The custom EUI64 token is write-once on most adapters and takes
+		// effect after the NCP resets below.
+		log.Warn().Str("from", FormatIEEE(eui)).Str("to", FormatIEEE(coordIEEE)).Msg("Overwriting adapter IEEE address")
+		if err := c.ezsp.SetMfgToken(ezspMfgCustomEUI64, coordIEEE[:]); err != nil {
+			return fmt.Errorf("write adapter IEEE: %w", err)
+		}
+	}
+
+	if err := c.resetNCP(); err != nil {
+		return err
+	}
+
+	st := DefaultSecurityState()
+	st.Bitmask |= emberNoFrameCounterReset
+	st.NetworkKey = nwkKey
+	st.KeySequence = uint8(b.NetworkKey.SequenceNumber)
+	if err := c.ezsp.SetInitialSecurityState(st); err != nil {
+		return fmt.Errorf("set initial security state: %w", err)
+	}
+	fc := make([]byte, 4)
+	binary.LittleEndian.PutUint32(fc, b.NetworkKey.FrameCounter+frameCounterMargin)
+	if err := c.ezsp.SetValue(ezspValueNwkFrameCounter, fc); err != nil {
+		return fmt.Errorf("set NWK frame counter: %w", err)
+	}
+	// EmberZNet keeps one outgoing APS counter for all link keys, so it must
+	// be ahead of the highest counter any device has seen from us.
+	binary.LittleEndian.PutUint32(fc, backupAPSFrameCounter(b)+frameCounterMargin)
+	if err := c.ezsp.SetValue(ezspValueAPSFrameCounter, fc); err != nil {
+		return fmt.Errorf("set APS frame counter: %w", err)
+	}
+
+	txPower := int8(defaultTxPower)
+	if p, ok := internalNumber(b, "tx_power"); ok && p >= -30 && p <= 20 {
+		txPower = int8(p)
+	}
+	if err := c.ezsp.FormNetwork(NetworkParams{
+		ExtendedPanID: extPanID,
+		PanID:         uint16(panID),
+		RadioTxPower:  txPower,
+		RadioChannel:  uint8(b.Channel),
+		NwkUpdateID:   uint8(b.NwkUpdateID),
+	}); err != nil {
+		return fmt.Errorf("form network: %w", err)
+	}
+	time.Sleep(500 * time.Millisecond)
+
+	var slot uint8
+	for _, d := range b.Devices {
+		if d.LinkKey == nil {
+			continue
+		}
+		ieee, _ := parseBackupEUI64(d.IEEEAddress)
+		var key [16]byte
+		kb, _ := hex.DecodeString(d.LinkKey.Key)
+		copy(key[:], kb)
+		if err := c.ezsp.ImportLinkKey(slot, ieee, key); err != nil {
+			log.Warn().Err(err).Str("ieee", FormatIEEE(ieee)).Msg("Failed to import link key")
+			continue
+		}
+		slot++
+	}
+
+	if err := c.broadcastDeviceAnnce(); err != nil {
+		log.Warn().Err(err).Msg("Failed to broadcast Device_annce after restore (non-fatal)")
+	}
+	log.Info().Int("channel", b.Channel).Str("panID", b.PanID).Int("link_keys", int(slot)).Msg("Network restored from backup")
+	c.notifyNetworkChange()
+	return nil
+}
+
+// backupAPSFrameCounter returns the highest outgoing APS frame counter in
+// the backup: the link keys' TX counters or the global counter this tool
+// records in the metadata.
+func backupAPSFrameCounter(b *device.NetworkBackup) uint32 {
+	var fc uint32
+	if v, ok := internalNumber(b, "aps_frame_counter"); ok && v >= 0 && v <= math.MaxUint32 {
+		fc = uint32(v)
+	}
+	for _, d := range b.Devices {
+		if d.LinkKey != nil {
+			fc = max(fc, d.LinkKey.TxCounter)
+		}
+	}
+	return fc
+}
+
+// internalNumber reads a number from the backup's tool-specific metadata,
+// which holds float64 once the backup has been read from JSON.
+func internalNumber(b *device.NetworkBackup, key string) (float64, bool) {
+	switch v := b.Metadata.Internal[key].(type) {
+	case float64:
+		return v, true
+	case int:
+		return float64(v), true
+	case uint32:
+		return float64(v), true
+	}
+	return 0, false
+}
+
+// backupHex formats a little-endian address as big-endian hex without separators.
+func backupHex(le []byte) string {
+	be := make([]byte, len(le))
+	for i := range le {
+		be[i] = le[len(le)-1-i]
+	}
+	return hex.EncodeToString(be)
+}
+
+// parseBackupEUI64 parses big-endian hex into little-endian bytes.
+func parseBackupEUI64(s string) ([8]byte, error) {
+	var out [8]byte
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != 8 {
+		return out, fmt.Errorf("invalid EUI64 %q", s)
+	}
+	for i := range 8 {
+		out[i] = b[7-i]
+	}
+	return out, nil
+}
+
+// channelList expands a channel bitmask into channel numbers.
+func channelList(mask uint32) []int {
+	var out []int
+	for ch := 11; ch <= 26; ch++ {
+		if mask&(1<<ch) != 0 {
+			out = append(out, ch)
+		}
+	}
+	return out
+}
@@ -5,8 +5,6 @@ import (
 	"encoding/binary"
 	"encoding/json"
 	"fmt"
-	"math/rand"
-	"strings"
 	"sync"
 	"time"
 
@@ -22,31 +20,49 @@ type KnownDevice struct {
 	DeviceType   string
 	Endpoint     uint8
 	Clusters     []uint16 // input clusters from Simple Descriptor
-	State        device.DeviceState
-	stateUpdate  chan struct{} // signalled when State is updated
+	Sleepy       bool     // receiver off when idle (from Device_annce capability)
+	// LinkKeyStatus tracks the Zigbee 3.0 TC link key update (device.LinkKeyStatus*).
+	LinkKeyStatus string
+	State         device.DeviceState
+	stateUpdate   chan struct{} // signalled when State is updated
+	// StateUpdatedAt is when State last changed.
+	StateUpdatedAt time.Time
+	staleKeys      map[string]bool // keys of a restored State not yet confirmed
+
+	// Availability, refreshed from real traffic and pings.
+	Available   bool
+	LastSeen    time.Time
+	LinkQuality uint8 // last-hop LQI of the most recent message
+	RSSI        int8  // last-hop RSSI of the most recent message
+	heard       bool  // LinkQuality and RSSI come from a received message
+	// pingBackoff and nextPing space out pings of a router that fails them.
+	pingBackoff time.Duration
+	nextPing    time.Time
 }
 
 // LoadEntry is used to pre-populate the device map from persistent config on startup.
 type LoadEntry struct {
-	IEEEAddress  [8]byte
-	FriendlyName string
-	DeviceType   string
-	Endpoint     uint8
-	Clusters     []uint16
+	IEEEAddress   [8]byte
+	FriendlyName  string
+	DeviceType    string
+	Endpoint      uint8
+	Clusters      []uint16
+	Sleepy        bool
+	LastSeen      time.Time
+	LinkKeyStatus string
+	// State is the last-known state; it is restored marked stale.
+	State          device.DeviceState
+	StateUpdatedAt time.Time
 }
 
 // Controller implements device.Controller and device.EventSubscriber
 // for direct EZSP communication with a Sonoff Zigbee dongle.
 type Controller struct {
-	serial *SerialPort
-	ash    *ASHLayer
-	ezsp   *EZSPLayer
-
-	devices   map[string]*KnownDevice // IEEE hex string -> device
-	devicesMu sync.RWMutex
+	portPath string
+	ash      *ASHLayer
+	ezsp     *EZSPLayer
 
-	subscribers   []chan device.DiscoveryEvent
-	subscribersMu sync.Mutex
+	*KnownDevices
 
 	connected bool
 	connMu    sync.RWMutex
@@ -54,44 +70,63 @@ type Controller struct {
 	nwkAddrWaiters map[string]chan uint16 // IEEE string -> response channel
 	nwkAddrMu      sync.Mutex
 
-	onDeviceChange func() // called after device join/leave/rename
-	stopChan       chan struct{}
-}
+	sentWaiters map[uint8]chan uint32     // message tag -> messageSentHandler status
+	zclWaiters  map[zclWaitKey]chan uint8 // ZCL transaction -> Default Response status
+	nextTag     uint8
+	sentMu      sync.Mutex
 
-// SetOnDeviceChange registers a callback invoked after the device list changes.
-func (c *Controller) SetOnDeviceChange(fn func()) { c.onDeviceChange = fn }
+	zdoWaiters map[zdoWaitKey]chan []byte // outstanding ZDO requests
+	zdoMu      sync.Mutex
 
-// ExportDevices returns a snapshot of all known devices for persistence.
-func (c *Controller) ExportDevices() []ExportedDevice {
-	c.devicesMu.RLock()
-	defer c.devicesMu.RUnlock()
-	out := make([]ExportedDevice, 0, len(c.devices))
-	for ieee, kd := range c.devices {
-		out = append(out, ExportedDevice{
-			IEEEAddress:  ieee,
-			FriendlyName: kd.FriendlyName,
-			DeviceType:   kd.DeviceType,
-			Endpoint:     kd.Endpoint,
-			Clusters:     kd.Clusters,
-		})
+	sessionJoins int        // new devices admitted in the current permit-join session
+	joinMu       sync.Mutex // guards sessionJoins
+	joinWindow   JoinWindow
+
+	coordIEEE string // coordinator EUI64, cached for use inside callbacks
+
+	opts            Options
+	onNetworkChange func(device.FormOptions) // called after network formation or channel change
+	stopChan        chan struct{}
+}
+
+// exportDevice snapshots kd for persistence. Must be called with the device
+// map locked.
+func exportDevice(ieee string, kd *KnownDevice) ExportedDevice {
+	return ExportedDevice{
+		IEEEAddress:    ieee,
+		FriendlyName:   kd.FriendlyName,
+		DeviceType:     kd.DeviceType,
+		Endpoint:       kd.Endpoint,
+		Clusters:       kd.Clusters,
+		Sleepy:         kd.Sleepy,
+		LastSeen:       kd.LastSeen,
+		LinkKeyStatus:  kd.LinkKeyStatus,
+		State:          CopyState(kd.State),
+		StateUpdatedAt: kd.StateUpdatedAt,
 	}
-	return out
 }
 
 // ExportedDevice is a snapshot of device data for persistence.
 type ExportedDevice struct {
-	IEEEAddress  string
-	FriendlyName string
-	DeviceType   string
-	Endpoint     uint8
-	Clusters     []uint16
+	IEEEAddress    string
+	FriendlyName   string
+	DeviceType     string
+	Endpoint       uint8
+	Clusters       []uint16
+	Sleepy         bool
+	LastSeen       time.Time
+	LinkKeyStatus  string
+	State          device.DeviceState
+	StateUpdatedAt time.Time
 }
 
-// notifyDeviceChange calls the registered callback if set.
-func (c *Controller) notifyDeviceChange() {
-	if c.onDeviceChange != nil {
-		c.onDeviceChange()
+// CopyState returns a shallow copy of s that is safe to modify.
+func CopyState(s device.DeviceState) device.DeviceState {
+	out := make(device.DeviceState, len(s))
+	for k, v := range s {
+		out[k] = v
 	}
+	return out
 }
 
 // LoadDevices pre-populates the in-memory device map from persistent storage.
@@ -99,43 +134,57 @@ func (c *Controller) notifyDeviceChange() {
 // broadcasting ZDO NWK_addr_req to resolve devices still on the network.
 func (c *Controller) LoadDevices(entries []LoadEntry) {
 	for _, e := range entries {
-		ieee := formatIEEE(e.IEEEAddress)
+		ieee := FormatIEEE(e.IEEEAddress)
 		ep := e.Endpoint
 		if ep == 0 {
 			ep = 1
 		}
 
-		// Try NCP address table first (fast, local).
-		var nodeID uint16
-		if nid, err := c.ezsp.LookupNodeIDByEUI64(e.IEEEAddress); err == nil && nid != 0xFFFE && nid != 0xFFFF {
-			nodeID = nid
-			log.Info().Str("ieee", ieee).Uint16("nodeID", nid).Msg("Resolved NodeID from NCP address table")
+		nodeID, answered := c.lookupNodeID(e.IEEEAddress)
+		lastSeen := e.LastSeen
+		if answered {
+			lastSeen = time.Now()
 		}
 
-		// Fall back to ZDO NWK_addr_req broadcast (asks the device directly).
-		if nodeID == 0 {
-			if nid, err := c.resolveNodeIDByIEEE(e.IEEEAddress); err == nil && nid != 0 {
-				nodeID = nid
-				log.Info().Str("ieee", ieee).Uint16("nodeID", nid).Msg("Resolved NodeID via NWK_addr_req")
-			} else {
-				log.Warn().Str("ieee", ieee).Msg("Could not resolve NodeID — device will need to rejoin")
-			}
+		kd := &KnownDevice{
+			IEEEAddress:   e.IEEEAddress,
+			NodeID:        nodeID,
+			FriendlyName:  e.FriendlyName,
+			DeviceType:    e.DeviceType,
+			Endpoint:      ep,
+			Clusters:      e.Clusters,
+			Sleepy:        e.Sleepy,
+			LinkKeyStatus: e.LinkKeyStatus,
+			// Only a device that answered just now is known to be up; the
+			// rest stay offline until they are heard from or pinged.
+			Available: answered,
+			LastSeen:  lastSeen,
 		}
+		kd.RestoreState(e.State, e.StateUpdatedAt)
 
-		c.devicesMu.Lock()
-		c.devices[ieee] = &KnownDevice{
-			IEEEAddress:  e.IEEEAddress,
-			NodeID:       nodeID,
-			FriendlyName: e.FriendlyName,
-			DeviceType:   e.DeviceType,
-			Endpoint:     ep,
-			Clusters:     e.Clusters,
-			State:        make(device.DeviceState),
-		}
-		c.devicesMu.Unlock()
+		c.mu.Lock()
+		c.devices[ieee] = kd
+		c.mu.Unlock()
 	}
 }
 
+// lookupNodeID finds a device's NodeID in the NCP address table (fast, local),
+// falling back to a ZDO NWK_addr_req broadcast that asks the device directly.
+// answered reports whether the device itself replied. Returns 0 if unresolved.
+func (c *Controller) lookupNodeID(eui [8]byte) (nodeID uint16, answered bool) {
+	ieee := FormatIEEE(eui)
+	if nid, err := c.ezsp.LookupNodeIDByEUI64(eui); err == nil && nid != 0xFFFE && nid != 0xFFFF && nid != 0 {
+		log.Info().Str("ieee", ieee).Uint16("nodeID", nid).Msg("Resolved NodeID from NCP address table")
+		return nid, false
+	}
+	if nid, err := c.resolveNodeIDByIEEE(eui); err == nil && nid != 0 {
+		log.Info().Str("ieee", ieee).Uint16("nodeID", nid).Msg("Resolved NodeID via NWK_addr_req")
+		return nid, true
+	}
+	log.Warn().Str("ieee", ieee).Msg("Could not resolve NodeID — device will need to rejoin")
+	return 0, false
+}
+
 // resolveNodeIDByIEEE broadcasts a ZDO NWK_addr_req for the given IEEE address
 // and waits up to 5 seconds for the device to respond with its NodeID.
 func (c *Controller) resolveNodeIDByIEEE(ieee [8]byte) (uint16, error) {
@@ -146,7 +195,7 @@ func (c *Controller) resolveNodeIDByIEEE(ieee [8]byte) (uint16, error) {
 	payload[9] = 0x00 // start index
 
 	ch := make(chan uint16, 1)
-	ieeeStr := formatIEEE(ieee)
+	ieeeStr := FormatIEEE(ieee)
 
 	// Temporarily register a one-shot handler for the response.
 	c.nwkAddrMu.Lock()
@@ -158,6 +207,7 @@ func (c *Controller) resolveNodeIDByIEEE(ieee [8]byte) (uint16, error) {
 		c.nwkAddrMu.Unlock()
 	}()
 
+	down := c.ash.Down()
 	if err := c.ezsp.SendBroadcast(0xFFFD, zdoProfileID, zdoClusterNWKAddrReq, 0, 0, payload, 0); err != nil {
 		return 0, fmt.Errorf("send NWK_addr_req: %w", err)
 	}
@@ -165,33 +215,59 @@ func (c *Controller) resolveNodeIDByIEEE(ieee [8]byte) (uint16, error) {
 	select {
 	case nid := <-ch:
 		return nid, nil
+	case <-down:
+		return 0, device.ErrNotConnected
 	case <-time.After(5 * time.Second):
 		return 0, fmt.Errorf("NWK_addr_req timeout for %s", ieeeStr)
 	}
 }
 
+// Options configures a Controller.
+type Options struct {
+	// Form holds the parameters used when no network exists and one is formed at startup.
+	Form device.FormOptions
+
+	// RequireInstallCode rejects joins that use the well-known link key; only
+	// devices whose install code was added with AddInstallCode can join.
+	RequireInstallCode bool
+
+	// JoinPolicy restricts which devices may join.
+	JoinPolicy JoinPolicy
+
+	// ASH tunes the serial link to the NCP.
+	ASH ASHConfig
+}
+
 // NewController creates and initializes a Zigbee EZSP controller.
-func NewController(portPath string) (*Controller, error) {
+func NewController(portPath string, opts Options) (*Controller, error) {
 	log.Info().Str("port", portPath).Msg("Initializing Zigbee controller")
 	s, err := OpenSerial(portPath)
 	if err != nil {
 		return nil, fmt.Errorf("open serial: %w", err)
 	}
 
-	ash := NewASHLayer(s)
+	ash := NewASHLayer(s, opts.ASH)
 	ezsp := NewEZSPLayer(ash)
 
 	c := &Controller{
-		serial:         s,
+		portPath:       portPath,
 		ash:            ash,
 		ezsp:           ezsp,
-		devices:        make(map[string]*KnownDevice),
+		opts:           opts,
 		nwkAddrWaiters: make(map[string]chan uint16),
+		sentWaiters:    make(map[uint8]chan uint32),
+		zclWaiters:     make(map[zclWaitKey]chan uint8),
+		zdoWaiters:     make(map[zdoWaitKey]chan []byte),
 		stopChan:       make(chan struct{}),
 	}
+	c.KnownDevices = NewKnownDevices(c)
 
-	// Set up callback handler
-	ezsp.SetCallbackHandler(c.handleCallback)
+	// Register callback listeners
+	ezsp.Listen(ezspTrustCenterJoinHandler, c.handleTrustCenterJoin)
+	ezsp.Listen(ezspIncomingMessageHandler, c.handleIncomingMessage)
+	ezsp.Listen(ezspStackStatusHandler, c.handleStackStatus)
+	ezsp.Listen(ezspMessageSentHandler, c.handleMessageSent)
+	ezsp.Listen(ezspKeyEstablishmentHandler, c.handleKeyEstablishment)
 
 	// Connect ASH layer
 	log.Info().Msg("Connecting ASH layer")
@@ -215,6 +291,9 @@ func NewController(portPath string) (*Controller, error) {
 	c.connected = true
 	c.connMu.Unlock()
 
+	go c.availabilityLoop()
+	go c.superviseLink()
+
 	log.Info().Msg("Zigbee EZSP controller initialized")
 
 	return c, nil
@@ -236,32 +315,21 @@ func (c *Controller) initStack() error {
 			Msg("Stack version < 7.0 (R23); some BDB 3.1 features may not be available")
 	}
 
-	// Configure stack
-	log.Info().Msg("Configuring EZSP stack")
-	if err := c.ezsp.ConfigureStack(); err != nil {
+	if err := c.configureNCP(); err != nil {
 		return err
 	}
 
-	// Issue 7: Set Trust Center policies (BDB 5.6.1, 5.6.2 backwards compat mode)
-	// Allow joins with well-known TC link key so devices can receive the network key.
-	if err := c.ezsp.SetPolicy(ezspPolicyTrustCenterPolicy, ezspDecisionAllowJoins); err != nil {
-		log.Warn().Err(err).Msg("Failed to set TC policy (non-fatal)")
-	}
-	if err := c.ezsp.SetPolicy(ezspPolicyTCKeyRequestPolicy, 0x01); err != nil {
-		log.Warn().Err(err).Msg("Failed to set TC key request policy (non-fatal)")
-	}
-
-	// Register HA endpoint on the coordinator so the NCP can route
-	// incoming ZCL messages (responses, reports) to the host.
-	haClusters := []uint16{zclClusterOnOff, zclClusterLevelControl}
-	if err := c.ezsp.AddEndpoint(1, zclProfileHA, 0x0005, haClusters, haClusters); err != nil {
-		return fmt.Errorf("register HA endpoint: %w", err)
+	// Resolve formation parameters first so the security state set before
+	// NetworkInit carries the configured network key.
+	form, err := resolveFormParams(c.opts.Form)
+	if err != nil {
+		return fmt.Errorf("network settings: %w", err)
 	}
 
 	// Set initial security state BEFORE NetworkInit so the Trust Center
 	// can distribute the network key to joining devices on both fresh
 	// and resumed networks.
-	if err := c.ezsp.SetInitialSecurityState(); err != nil {
+	if err := c.ezsp.SetInitialSecurityState(form.security); err != nil {
 		return fmt.Errorf("set initial security state: %w", err)
 	}
 
@@ -280,37 +348,49 @@ func (c *Controller) initStack() error {
 		return nil
 	}
 
-	log.Info().Uint8("status", status).Msg("No existing network, forming new one")
+	log.Info().Uint32("status", status).Msg("No existing network, forming new one")
+	return c.formWith(form)
+}
 
-	// Issue 1: Energy scan across BDB primary channel set before forming (BDB 8.1)
-	channel, err := c.ezsp.EnergyScan(bdbcTLPrimaryChannelSet, 4)
-	if err != nil {
-		log.Warn().Err(err).Msg("Primary channel scan failed, trying secondary")
-		channel, err = c.ezsp.EnergyScan(bdbcTLSecondaryChannelSet, 4)
-		if err != nil {
-			log.Warn().Err(err).Msg("Secondary scan failed, defaulting to channel 15")
-			channel = 15
-		}
+// configureNCP applies stack configuration, Trust Center policies and the
+// coordinator endpoint. The NCP forgets all of these on reset, so this runs
+// after every version negotiation.
+func (c *Controller) configureNCP() error {
+	log.Info().Msg("Configuring EZSP stack")
+	if err := c.ezsp.ConfigureStack(); err != nil {
+		return err
 	}
-
-	panID := uint16(rand.Intn(0xFFFE) + 1)
-	var extPanID [8]byte
-	for i := range extPanID {
-		extPanID[i] = byte(rand.Intn(256))
+	if eui, err := c.ezsp.GetEUI64(); err == nil {
+		c.coordIEEE = FormatIEEE(eui)
 	}
 
-	if err := c.ezsp.FormNetwork(channel, panID, extPanID); err != nil {
-		return fmt.Errorf("form network: %w", err)
+	// Issue 7: Set Trust Center policies (BDB 5.6.1, 5.6.2 backwards compat mode)
+	// Allow joins with well-known TC link key so devices can receive the network key,
+	// unless joins are restricted to install-code keys.
+	tcPolicy := ezspDecisionAllowJoins
+	if c.opts.RequireInstallCode {
+		tcPolicy |= ezspDecisionJoinsUseInstallCodeKey
+	}
+	// With a join policy the NCP holds the network key back until the join
+	// is admitted, so rejected devices never get on the network.
+	if c.opts.JoinPolicy.restricts() {
+		tcPolicy |= ezspDecisionDeferJoins
+	}
+	if err := c.ezsp.SetPolicy(ezspPolicyTrustCenterPolicy, tcPolicy); err != nil {
+		log.Warn().Err(err).Msg("Failed to set TC policy (non-fatal)")
 	}
-
-	// Wait briefly for network to come up
-	time.Sleep(500 * time.Millisecond)
-
-	// Broadcast Device_annce for newly formed network
-	if err := c.broadcastDeviceAnnce(); err != nil {
-		log.Warn().Err(err).Msg("Failed to broadcast Device_annce after formation (non-fatal)")
+	// Answer Zigbee 3.0 TC link key requests with a unique key per device.
+	// 0x01 used to be sent here, which is not one of this policy's decisions.
+	if err := c.ezsp.SetPolicy(ezspPolicyTCKeyRequestPolicy, ezspAllowTCKeyRequestAndGenerateNewKey); err != nil {
+		log.Warn().Err(err).Msg("Failed to set TC key request policy (non-fatal)")
 	}
 
+	// Register HA endpoint on the coordinator so the NCP can route
+	// incoming ZCL messages (responses, reports) to the host.
+	haClusters := []uint16{zclClusterOnOff, zclClusterLevelControl}
+	if err := c.ezsp.AddEndpoint(1, zclProfileHA, 0x0005, haClusters, haClusters); err != nil {
+		return fmt.Errorf("register HA endpoint: %w", err)
+	}
 	return nil
 }
 
@@ -333,54 +413,38 @@ func (c *Controller) broadcastDeviceAnnce() error {
 	// Capability: allocate address | RX on when idle | main powered = 0x8C
 	payload[10] = 0x8C
 
-	log.Info().Str("eui64", formatIEEE(eui64)).Uint16("nodeID", nodeID).Msg("Broadcasting Device_annce")
+	log.Info().Str("eui64", FormatIEEE(eui64)).Uint16("nodeID", nodeID).Msg("Broadcasting Device_annce")
 	return c.ezsp.SendBroadcast(0xFFFD, zdoProfileID, zdoClusterDeviceAnnce, 0, 0, payload, 0)
 }
 
-// handleCallback processes async EZSP callbacks from the NCP.
-func (c *Controller) handleCallback(frameID uint16, data []byte) {
-	switch frameID {
-	case ezspTrustCenterJoinHandler:
-		c.handleTrustCenterJoin(data)
-	case ezspIncomingMessageHandler:
-		c.handleIncomingMessage(data)
-	case ezspStackStatusHandler:
-		c.handleStackStatus(data)
-	case ezspMessageSentHandler:
-		c.handleMessageSent(data)
-	default:
-		log.Debug().Uint16("frameID", frameID).Hex("data", data).Msg("Unhandled EZSP callback")
-	}
-}
-
 // handleMessageSent processes the messageSentHandler callback (0x003F).
-// This tells us whether the NCP successfully delivered the message to the device.
+// This tells us whether the NCP successfully delivered the message to the device,
+// and wakes any sender waiting on the message tag.
 func (c *Controller) handleMessageSent(data []byte) {
-	// Format: type(1) + destination(2) + apsFrame(12) + messageTag(1) + status(1) + messageLen(1) + message(N)
-	if len(data) < 17 {
-		log.Warn().Int("len", len(data)).Msg("messageSentHandler too short")
+	ms, err := c.ezsp.codec().messageSent(data)
+	if err != nil {
+		log.Warn().Err(err).Msg("Bad messageSentHandler")
 		return
 	}
-	msgType := data[0]
-	destination := binary.LittleEndian.Uint16(data[1:3])
-	// APS frame at data[3:15]
-	clusterID := binary.LittleEndian.Uint16(data[5:7])
-	status := data[16]
 
-	if status == emberSuccess {
+	if ms.status == emberSuccess {
 		log.Debug().
-			Uint8("type", msgType).
-			Uint16("destination", destination).
-			Uint16("cluster", clusterID).
+			Uint8("type", ms.msgType).
+			Uint16("destination", ms.destination).
+			Uint16("cluster", ms.aps.clusterID).
+			Uint8("tag", ms.tag).
 			Msg("Message delivered successfully")
 	} else {
 		log.Error().
-			Uint8("type", msgType).
-			Uint16("destination", destination).
-			Uint16("cluster", clusterID).
-			Uint8("status", status).
+			Uint8("type", ms.msgType).
+			Uint16("destination", ms.destination).
+			Uint16("cluster", ms.aps.clusterID).
+			Uint8("tag", ms.tag).
+			Uint32("status", ms.status).
 			Msg("Message delivery FAILED")
 	}
+
+	c.deliverMessageSent(ms.tag, ms.status)
 }
 
 // handleTrustCenterJoin processes device join/leave events.
@@ -393,37 +457,61 @@ func (c *Controller) handleTrustCenterJoin(data []byte) {
 	var ieee [8]byte
 	copy(ieee[:], data[2:10])
 	status := data[10]
+	// policyDecision(1) follows, then the parent the device joined through.
+	var parentID uint16
+	parent := ""
+	if len(data) >= 14 {
+		parentID = binary.LittleEndian.Uint16(data[12:14])
+		parent = c.ieeeForNodeID(parentID)
+	}
 
-	ieeeStr := formatIEEE(ieee)
+	ieeeStr := FormatIEEE(ieee)
 
 	log.Info().
 		Str("ieee", ieeeStr).
 		Uint16("nodeID", nodeID).
 		Uint8("status", status).
+		Str("parent", parent).
 		Msg("Trust center join event")
 
-	// Status 1 = STANDARD_SECURITY_SECURED_REJOIN or new join
-	// Status 3 = DEVICE_LEFT
-	if status == 3 {
-		c.devicesMu.Lock()
+	if status == emberDeviceLeft {
+		c.mu.Lock()
 		delete(c.devices, ieeeStr)
-		c.devicesMu.Unlock()
+		c.mu.Unlock()
 
-		c.publishEvent(device.DiscoveryEvent{
-			Type:      "device_left",
+		c.Publish(device.Event{
+			Type:      device.EventDeviceLeft,
 			Timestamp: time.Now(),
 			Device:    &device.Device{ID: ieeeStr},
 		})
-		c.notifyDeviceChange()
+		c.NotifyDeviceChange()
 		return
 	}
 
-	c.devicesMu.Lock()
+	c.mu.RLock()
+	_, known := c.devices[ieeeStr]
+	c.mu.RUnlock()
+	deferred := status == emberUnsecuredJoin && c.opts.JoinPolicy.restricts()
+	if reason := c.admitJoin(ieeeStr, known); reason != "" {
+		c.rejectJoin(nodeID, ieee, deferred, reason)
+		return
+	}
+	if deferred {
+		c.sendNetworkKey(nodeID, ieee, parentID)
+	}
+
+	c.mu.Lock()
 	existing, found := c.devices[ieeeStr]
 	if found {
 		// Device rejoining — update NodeID but preserve friendly name and type.
 		existing.NodeID = nodeID
-		c.devicesMu.Unlock()
+		existing.LastSeen = time.Now()
+		wasAvailable := existing.Available
+		existing.Available = true
+		c.mu.Unlock()
+		if !wasAvailable {
+			c.PublishAvailability(ieeeStr, existing, true)
+		}
 		log.Info().Str("ieee", ieeeStr).Uint16("nodeID", nodeID).Msg("Known device rejoined, updated NodeID")
 	} else {
 		// New device
@@ -434,66 +522,75 @@ func (c *Controller) handleTrustCenterJoin(data []byte) {
 			DeviceType:   device.DeviceTypeLight,
 			Endpoint:     1,
 			State:        make(device.DeviceState),
+			Available:    true,
+			LastSeen:     time.Now(),
 		}
 		c.devices[ieeeStr] = kd
-		c.devicesMu.Unlock()
-		c.notifyDeviceChange()
+		c.mu.Unlock()
+		c.NotifyDeviceChange()
 	}
 
-	c.devicesMu.RLock()
+	// Build the event under the lock; markSeen writes the availability fields
+	// concurrently and the device may have been removed meanwhile.
+	c.mu.RLock()
 	kd := c.devices[ieeeStr]
-	c.devicesMu.RUnlock()
+	var dev device.Device
+	if kd != nil {
+		dev = ToDevice(ieeeStr, kd)
+	}
+	c.mu.RUnlock()
+	if kd == nil {
+		return
+	}
 
-	dev := c.knownToDevice(ieeeStr, kd)
-	c.publishEvent(device.DiscoveryEvent{
-		Type:      "device_joined",
+	c.Publish(device.Event{
+		Type:      device.EventDeviceJoined,
 		Device:    &dev,
+		Parent:    parent,
 		Timestamp: time.Now(),
 	})
 
 	// Discover device clusters and configure reporting after a brief stabilization delay.
 	go func() {
+		c.PublishInterview(ieeeStr, device.InterviewStarted, nil)
 		time.Sleep(2 * time.Second)
 		c.discoverDeviceClusters(kd)
+		c.PublishInterview(ieeeStr, device.InterviewEndpoints, nil)
 		c.configureDeviceReporting(kd)
+		c.PublishInterview(ieeeStr, device.InterviewCompleted, nil)
 	}()
 }
 
 // handleIncomingMessage processes incoming ZCL messages from devices.
 func (c *Controller) handleIncomingMessage(data []byte) {
-	// Parse the incoming message callback structure
-	// type(1) + apsFrame(12) + lastHopLqi(1) + lastHopRssi(1) + sender(2) + bindingIndex(1) + addressIndex(1) + messageLength(1) + message(N)
-	if len(data) < 19 {
-		return
-	}
-
-	// Extract APS frame fields
-	// profileID := binary.LittleEndian.Uint16(data[1:3])
-	clusterID := binary.LittleEndian.Uint16(data[3:5])
-	// srcEndpoint := data[5]
-	// dstEndpoint := data[6]
-
-	sender := binary.LittleEndian.Uint16(data[14:16])
-	msgLen := data[18]
-
-	if len(data) < 19+int(msgLen) {
+	// The callback layout depends on the EZSP version; the codec decodes it.
+	im, err := c.ezsp.codec().incomingMessage(data)
+	if err != nil {
+		log.Debug().Err(err).Msg("Bad incomingMessageHandler")
 		return
 	}
-
-	message := data[19 : 19+int(msgLen)]
-
-	profileID := binary.LittleEndian.Uint16(data[1:3])
+	clusterID := im.aps.clusterID
+	profileID := im.aps.profileID
+	sender := im.sender
+	message := im.message
 
 	log.Debug().
 		Uint16("cluster", clusterID).
 		Uint16("sender", sender).
 		Uint16("profile", profileID).
-		Int("msgLen", int(msgLen)).
+		Int("msgLen", len(message)).
+		Uint8("lqi", im.lqi).
+		Int8("rssi", im.rssi).
 		Hex("message", message).
 		Msg("Incoming message")
 
+	c.markSeen(sender, im.lqi, im.rssi)
+
 	// Handle ZDO responses (profile 0x0000)
 	if profileID == zdoProfileID {
+		if c.deliverZDOResponse(sender, clusterID, message) {
+			return
+		}
 		c.handleZDOResponse(clusterID, sender, message)
 		return
 	}
@@ -509,90 +606,108 @@ func (c *Controller) handleIncomingMessage(data []byte) {
 		}
 	}
 
-	// Try to find device by nodeID and update state
-	c.devicesMu.Lock()
-	for _, kd := range c.devices {
-		if kd.NodeID == sender {
-			c.updateDeviceStateFromZCL(kd, clusterID, message)
-			break
+	// ZCL Default Response: hand it to the sender waiting on this transaction.
+	if hdr, payload, ok := ParseZCLHeader(message); ok && hdr.IsDefaultResponse() {
+		if _, status, ok := ParseDefaultResponse(payload); ok && c.deliverDefaultResponse(sender, hdr.SeqNumber, status) {
+			return
 		}
 	}
-	c.devicesMu.Unlock()
-}
 
-// updateDeviceStateFromZCL updates device state based on ZCL message content.
-func (c *Controller) updateDeviceStateFromZCL(kd *KnownDevice, clusterID uint16, message []byte) {
-	if len(message) < 3 {
+	hdr, payload, ok := ParseZCLHeader(message)
+	if !ok || hdr.FrameControl&0x03 != zclFrameTypeGlobal {
 		return
 	}
+	switch hdr.CommandID {
+	case zclGlobalReadAttributesResponse:
+		c.UpdateState(sender, clusterID, ParseReadAttributesResponse(payload))
+	case zclGlobalReportAttributes:
+		c.UpdateState(sender, clusterID, ParseReportAttributes(payload))
+	}
+}
 
-	frameControl := message[0]
-	// seq := message[1]
-	cmdID := message[2]
-	payload := message[3:]
-
-	isGlobal := frameControl&0x01 == 0
-
-	if isGlobal && cmdID == zclGlobalReadAttributesResponse {
-		attrs := ParseReadAttributesResponse(payload)
-		updated := false
-		switch clusterID {
-		case zclClusterOnOff:
-			if val, ok := attrs[zclAttrOnOff]; ok && len(val) > 0 {
-				kd.State["state"] = boolToOnOff(val[0] != 0)
-				updated = true
-			}
-		case zclClusterLevelControl:
-			if val, ok := attrs[zclAttrCurrentLevel]; ok && len(val) > 0 {
-				kd.State["brightness"] = int(val[0])
-				updated = true
-			}
+// applyAttributes updates State from On/Off and Level Control attribute
+// values, wakes a pending state read and reports whether State changed. Must
+// be called with the device map locked.
+func (kd *KnownDevice) applyAttributes(clusterID uint16, attrs map[uint16][]byte) bool {
+	var key string
+	switch clusterID {
+	case zclClusterOnOff:
+		if val, ok := attrs[zclAttrOnOff]; ok && len(val) > 0 {
+			key = "state"
+			kd.State[key] = boolToOnOff(val[0] != 0)
 		}
-		if updated && kd.stateUpdate != nil {
-			select {
-			case kd.stateUpdate <- struct{}{}:
-			default:
-			}
+	case zclClusterLevelControl:
+		if val, ok := attrs[zclAttrCurrentLevel]; ok && len(val) > 0 {
+			key = "brightness"
+			kd.State[key] = int(val[0])
+		}
+	}
+	if key == "" {
+		return false
+	}
+	kd.touchState(key)
+	if kd.stateUpdate != nil {
+		select {
+		case kd.stateUpdate <- struct{}{}:
+		default:
 		}
 	}
+	return true
+}
+
+// touchState records a change of State; keys were confirmed by the device or
+// a delivered command and are no longer stale. Must be called with the device
+// map locked.
+func (kd *KnownDevice) touchState(keys ...string) {
+	kd.StateUpdatedAt = time.Now()
+	for _, k := range keys {
+		delete(kd.staleKeys, k)
+	}
+	// A key the command dropped is no longer a restored value either.
+	for k := range kd.staleKeys {
+		if _, ok := kd.State[k]; !ok {
+			delete(kd.staleKeys, k)
+		}
+	}
+}
+
+// RestoreState sets State to a persisted copy. Each of its keys is reported
+// stale until the device or a delivered command confirms it. Must be called
+// before kd is shared or with the device map locked.
+func (kd *KnownDevice) RestoreState(state device.DeviceState, updatedAt time.Time) {
+	kd.State = CopyState(state)
+	kd.StateUpdatedAt = updatedAt
+	kd.staleKeys = make(map[string]bool, len(state))
+	for k := range state {
+		kd.staleKeys[k] = true
+	}
 }
 
 // handleStackStatus processes stack status changes.
 func (c *Controller) handleStackStatus(data []byte) {
-	if len(data) < 1 {
+	status, _, err := c.ezsp.codec().status(data)
+	if err != nil {
 		return
 	}
-	status := data[0]
 	switch status {
 	case emberNetworkUp:
 		log.Info().Msg("Stack status: network up")
 	case emberNetworkDown:
 		log.Warn().Msg("Stack status: network down")
 	default:
-		log.Debug().Uint8("status", status).Msg("Stack status changed")
+		log.Debug().Uint32("status", status).Msg("Stack status changed")
 	}
 }
 
-// publishEvent sends a discovery event to all subscribers.
-func (c *Controller) publishEvent(evt device.DiscoveryEvent) {
-	c.subscribersMu.Lock()
-	defer c.subscribersMu.Unlock()
-
-	for _, ch := range c.subscribers {
-		select {
-		case ch <- evt:
-		default:
-		}
-	}
-}
-
-// knownToDevice converts a KnownDevice to a device.Device.
-func (c *Controller) knownToDevice(ieeeStr string, kd *KnownDevice) device.Device {
+// ToDevice converts a KnownDevice to a device.Device. Must be called with the
+// device map locked.
+func ToDevice(ieeeStr string, kd *KnownDevice) device.Device {
 	name := kd.FriendlyName
 	if name == "" {
 		name = ieeeStr
 	}
-	stateSchema, _ := json.Marshal(buildStateSchema(kd.Clusters))
+	stateSchema, _ := json.Marshal(BuildStateSchema(kd.Clusters, AdapterAccess))
+	exposes, _ := json.Marshal(BuildCapabilities(kd.Clusters, kd.Endpoint, AdapterAccess))
 	return device.Device{
 		ID:           ieeeStr,
 		Name:         name,
@@ -601,81 +716,29 @@ func (c *Controller) knownToDevice(ieeeStr string, kd *KnownDevice) device.Devic
 		Manufacturer: "Unknown",
 		Model:        "Unknown",
 		StateSchema:  stateSchema,
-	}
-}
+		Exposes:      exposes,
+		Available:    kd.Available,
+		LastSeen:     kd.LastSeen,
+		LinkQuality:  linkQuality(kd),
 
-// buildStateSchema generates a JSON schema based on the device's actual clusters.
-func buildStateSchema(clusters []uint16) map[string]any {
-	props := map[string]any{}
-	has := func(id uint16) bool {
-		for _, c := range clusters {
-			if c == id {
-				return true
-			}
-		}
-		return false
-	}
-
-	if has(zclClusterOnOff) {
-		props["state"] = map[string]any{
-			"type": "string",
-			"enum": []string{"ON", "OFF", "TOGGLE"},
-		}
-	}
-	if has(zclClusterLevelControl) {
-		props["brightness"] = map[string]any{
-			"type": "integer", "minimum": 0, "maximum": 254,
-		}
-	}
-	if has(zclClusterColorControl) {
-		props["color_temp"] = map[string]any{
-			"type": "integer", "minimum": 153, "maximum": 500,
-			"description": "color temperature in mireds",
-		}
-	}
-	if has(zclClusterTemperature) {
-		props["temperature"] = map[string]any{
-			"type": "number", "readOnly": true,
-			"description": "temperature in °C",
-		}
-	}
-	if has(zclClusterRelativeHumidity) {
-		props["humidity"] = map[string]any{
-			"type": "number", "readOnly": true,
-			"description": "relative humidity %",
-		}
-	}
-	if has(zclClusterOccupancy) {
-		props["occupancy"] = map[string]any{
-			"type": "boolean", "readOnly": true,
-		}
-	}
-	if has(zclClusterDoorLock) {
-		props["lock_state"] = map[string]any{
-			"type": "string",
-			"enum": []string{"LOCK", "UNLOCK"},
-		}
-	}
-	if has(zclClusterThermostat) {
-		props["heating_setpoint"] = map[string]any{
-			"type":        "number",
-			"description": "heating setpoint in °C",
-		}
+		State:          CopyState(kd.State),
+		StateUpdatedAt: kd.StateUpdatedAt,
+		StateStale:     len(kd.staleKeys) > 0,
 	}
+}
 
-	// Fallback: if no clusters known, assume on/off
-	if len(props) == 0 {
-		props["state"] = map[string]any{
-			"type": "string",
-			"enum": []string{"ON", "OFF", "TOGGLE"},
-		}
+// linkQuality returns kd's LQI, or nil if no message has been received from
+// it since startup. An LQI of 0 is a real reading for the weakest link.
+func linkQuality(kd *KnownDevice) *int {
+	if !kd.heard {
+		return nil
 	}
-
-	return map[string]any{"type": "object", "properties": props}
+	lqi := int(kd.LinkQuality)
+	return &lqi
 }
 
-// deviceTypeFromClusters infers the device type from its cluster list.
-func deviceTypeFromClusters(clusters []uint16) string {
+// DeviceTypeFromClusters infers the device type from its cluster list.
+func DeviceTypeFromClusters(clusters []uint16) string {
 	has := func(id uint16) bool {
 		for _, c := range clusters {
 			if c == id {
@@ -702,11 +765,22 @@ func deviceTypeFromClusters(clusters []uint16) string {
 	}
 }
 
-// waitForDevice ensures a device has a valid NodeID (i.e., has rejoined the network).
+// awaitRejoin ensures a device has a valid NodeID (i.e., has rejoined the network).
 // If NodeID is 0 (loaded from config but not yet rejoined), it enables permit-join
-// and waits up to 30 seconds for the device to rejoin.
-func (c *Controller) waitForDevice(kd *KnownDevice, id string) error {
-	if kd.NodeID != 0 {
+// and waits up to 30 seconds for the device to rejoin. Unknown devices are
+// left for the caller to report.
+func (c *Controller) awaitRejoin(id string) error {
+	if !c.IsConnected() {
+		return device.ErrNotConnected
+	}
+	c.mu.RLock()
+	_, kd, ok := c.resolve(id)
+	var nodeID uint16
+	if ok {
+		nodeID = kd.NodeID
+	}
+	c.mu.RUnlock()
+	if !ok || nodeID != 0 {
 		return nil
 	}
 
@@ -716,9 +790,9 @@ func (c *Controller) waitForDevice(kd *KnownDevice, id string) error {
 
 	for range 60 {
 		time.Sleep(500 * time.Millisecond)
-		c.devicesMu.RLock()
+		c.mu.RLock()
 		nodeID := kd.NodeID
-		c.devicesMu.RUnlock()
+		c.mu.RUnlock()
 		if nodeID != 0 {
 			log.Info().Str("device", id).Uint16("nodeID", nodeID).Msg("Device rejoined")
 			return nil
@@ -727,349 +801,53 @@ func (c *Controller) waitForDevice(kd *KnownDevice, id string) error {
 	return fmt.Errorf("%w: device %s has not rejoined the network (try power-cycling it)", device.ErrTimeout, id)
 }
 
-// resolveDevice finds a KnownDevice by IEEE address or friendly name.
-// Must be called with devicesMu held (at least RLock).
-func (c *Controller) resolveDevice(id string) (*KnownDevice, bool) {
-	if kd, ok := c.devices[id]; ok {
-		return kd, true
-	}
-	for _, kd := range c.devices {
-		if strings.EqualFold(kd.FriendlyName, id) {
-			return kd, true
-		}
-	}
-	return nil, false
-}
-
 // --- device.Controller interface ---
 
-func (c *Controller) ListDevices(_ context.Context) ([]device.Device, error) {
-	c.devicesMu.RLock()
-	defer c.devicesMu.RUnlock()
-
-	devices := make([]device.Device, 0, len(c.devices))
-	for ieee, kd := range c.devices {
-		devices = append(devices, c.knownToDevice(ieee, kd))
+// GetDeviceState reads a device's state, first waiting for a device restored
+// from config to rejoin.
+func (c *Controller) GetDeviceState(ctx context.Context, id string) (device.DeviceState, error) {
+	if err := c.awaitRejoin(id); err != nil {
+		return nil, err
 	}
-	return devices, nil
+	return c.KnownDevices.GetDeviceState(ctx, id)
 }
 
-func (c *Controller) GetDevice(_ context.Context, id string) (*device.Device, error) {
-	c.devicesMu.RLock()
-	defer c.devicesMu.RUnlock()
-
-	kd, ok := c.devices[id]
-	if !ok {
-		// Search by friendly name
-		for ieee, d := range c.devices {
-			if strings.EqualFold(d.FriendlyName, id) {
-				kd = d
-				ok = true
-				id = ieee
-				break
-			}
-		}
-		if !ok {
-			return nil, device.ErrNotFound
-		}
+// SetDeviceState sends the requested changes, first waiting for a device
+// restored from config to rejoin.
+func (c *Controller) SetDeviceState(ctx context.Context, id string, state map[string]any) (device.DeviceState, error) {
+	if err := c.awaitRejoin(id); err != nil {
+		return nil, err
 	}
-
-	dev := c.knownToDevice(id, kd)
-	return &dev, nil
+	return c.KnownDevices.SetDeviceState(ctx, id, state)
 }
 
-func (c *Controller) RenameDevice(_ context.Context, id, newName string) error {
-	c.devicesMu.Lock()
-	kd, ok := c.devices[id]
-	if !ok {
-		// Search by friendly name
-		for ieee, d := range c.devices {
-			if strings.EqualFold(d.FriendlyName, id) {
-				kd = d
-				ok = true
-				_ = ieee
-				break
-			}
-		}
-	}
-	if !ok {
-		c.devicesMu.Unlock()
-		return device.ErrNotFound
-	}
-	kd.FriendlyName = newName
-	c.devicesMu.Unlock()
-	c.notifyDeviceChange()
-	return nil
+// SendZCL sends a ZCL frame to kd and waits for APS delivery; see sendTracked.
+func (c *Controller) SendZCL(ctx context.Context, kd *KnownDevice, clusterID uint16, frame []byte, expectDefaultResponse bool) error {
+	return c.sendTracked(ctx, kd, clusterID, frame, expectDefaultResponse)
 }
 
-func (c *Controller) RemoveDevice(_ context.Context, id string, force bool) error {
-	c.devicesMu.Lock()
-	kd, ok := c.resolveDevice(id)
-	if !ok {
-		c.devicesMu.Unlock()
-		return device.ErrNotFound
-	}
-	// Find the actual map key (IEEE address) for deletion
-	for ieee, d := range c.devices {
-		if d == kd {
-			id = ieee
-			break
-		}
-	}
-
-	// Issue 10: Send ZDO Mgmt_Leave_req before local removal (BDB 13.4)
-	ieee := kd.IEEEAddress
-	nodeID := kd.NodeID
-	delete(c.devices, id)
-	c.devicesMu.Unlock()
-
+// SendLeave asks a device to leave with ZDO Mgmt_Leave_req (BDB 13.4).
+func (c *Controller) SendLeave(kd *KnownDevice) error {
+	var nodeID uint16
+	c.View(func(map[string]*KnownDevice) { nodeID = kd.NodeID })
 	// ZDO Mgmt_Leave_req payload: IEEE address (8) + options (1)
 	payload := make([]byte, 9)
-	copy(payload[0:8], ieee[:])
+	copy(payload[0:8], kd.IEEEAddress[:])
 	payload[8] = 0x00 // options: no rejoin, no remove children
-	if err := c.ezsp.SendUnicast(nodeID, zdoProfileID, zdoClusterMgmtLeaveReq, 0, 0, payload); err != nil {
-		log.Warn().Err(err).Str("device", id).Msg("Failed to send ZDO Leave request (device removed locally)")
-	}
-
-	c.notifyDeviceChange()
-	return nil
-}
-
-func (c *Controller) ClearDevices(_ context.Context) error {
-	c.devicesMu.Lock()
-	devices := make(map[string]*KnownDevice, len(c.devices))
-	for k, v := range c.devices {
-		devices[k] = v
-	}
-	c.devices = make(map[string]*KnownDevice)
-	c.devicesMu.Unlock()
-
-	// Send ZDO Leave to each device
-	for ieee, kd := range devices {
-		payload := make([]byte, 9)
-		copy(payload[0:8], kd.IEEEAddress[:])
-		payload[8] = 0x00
-		if err := c.ezsp.SendUnicast(kd.NodeID, zdoProfileID, zdoClusterMgmtLeaveReq, 0, 0, payload); err != nil {
-			log.Warn().Err(err).Str("device", ieee).Msg("Failed to send ZDO Leave request")
-		}
-	}
-
-	c.notifyDeviceChange()
-	return nil
-}
-
-func (c *Controller) GetDeviceState(ctx context.Context, id string) (device.DeviceState, error) {
-	noCache := device.NoCache(ctx)
-
-	c.devicesMu.RLock()
-	kd, ok := c.resolveDevice(id)
-	c.devicesMu.RUnlock()
-
-	if !ok {
-		return nil, device.ErrNotFound
-	}
-
-	if err := c.waitForDevice(kd, id); err != nil {
-		return nil, err
-	}
-
-	// When --no-cache is set, clear cached state so a timeout returns empty/error
-	// instead of stale data.
-	if noCache {
-		c.devicesMu.Lock()
-		kd.State = make(device.DeviceState)
-		c.devicesMu.Unlock()
-	}
-
-	// Set up channel to wait for the state response.
-	ch := make(chan struct{}, 1)
-	c.devicesMu.Lock()
-	kd.stateUpdate = ch
-	c.devicesMu.Unlock()
-	defer func() {
-		c.devicesMu.Lock()
-		kd.stateUpdate = nil
-		c.devicesMu.Unlock()
-	}()
-
-	// Send Read Attributes to refresh state (retry on transient NCP buffer-full errors)
-	readOnOff := BuildReadAttributesCommand(zclAttrOnOff)
-	log.Info().
-		Uint16("nodeID", kd.NodeID).
-		Uint8("endpoint", kd.Endpoint).
-		Str("device", id).
-		Msg("Sending ReadAttributes for On/Off cluster")
-	var sendErr error
-	for attempt := range 3 {
-		sendErr = c.ezsp.SendUnicast(kd.NodeID, zclProfileHA, zclClusterOnOff, 1, kd.Endpoint, readOnOff)
-		if sendErr == nil {
-			log.Info().Str("device", id).Msg("ReadAttributes sent successfully")
-			break
-		}
-		log.Warn().Err(sendErr).Int("attempt", attempt+1).Str("device", id).Msg("Failed to send ReadAttributes, retrying")
-		time.Sleep(500 * time.Millisecond)
-	}
-	if sendErr != nil {
-		log.Error().Err(sendErr).Str("device", id).Msg("All ReadAttributes attempts failed")
-	}
-
-	// Wait for the response or timeout
-	timedOut := false
-	select {
-	case <-ch:
-		log.Debug().Str("device", id).Msg("Received state update from device")
-	case <-time.After(5 * time.Second):
-		log.Warn().Str("device", id).Msg("Timed out waiting for state response")
-		timedOut = true
-	}
-
-	if timedOut && noCache {
-		return nil, fmt.Errorf("%w: device %q did not respond within timeout", device.ErrTimeout, id)
-	}
-
-	c.devicesMu.RLock()
-	state := make(device.DeviceState)
-	for k, v := range kd.State {
-		state[k] = v
-	}
-	c.devicesMu.RUnlock()
-
-	return state, nil
-}
-
-func (c *Controller) SetDeviceState(_ context.Context, id string, state map[string]any) (device.DeviceState, error) {
-	c.devicesMu.RLock()
-	kd, ok := c.resolveDevice(id)
-	c.devicesMu.RUnlock()
-
-	if !ok {
-		return nil, device.ErrNotFound
-	}
-
-	if err := c.waitForDevice(kd, id); err != nil {
-		return nil, err
-	}
-
-	// Handle "state" field (On/Off)
-	if stateVal, ok := state["state"]; ok {
-		if strVal, ok := stateVal.(string); ok {
-			var cmd uint8
-			switch strings.ToUpper(strVal) {
-			case "ON":
-				cmd = zclCmdOn
-			case "OFF":
-				cmd = zclCmdOff
-			case "TOGGLE":
-				cmd = zclCmdToggle
-			default:
-				return nil, fmt.Errorf("%w: invalid state value %q", device.ErrValidation, strVal)
-			}
-
-			payload := BuildOnOffCommand(cmd)
-			log.Info().
-				Uint16("nodeID", kd.NodeID).
-				Uint8("endpoint", kd.Endpoint).
-				Uint8("cmd", cmd).
-				Str("device", id).
-				Msg("Sending On/Off command")
-			if err := c.ezsp.SendUnicast(kd.NodeID, zclProfileHA, zclClusterOnOff, 1, kd.Endpoint, payload); err != nil {
-				return nil, fmt.Errorf("send on/off command: %w", err)
-			}
-			log.Info().Str("device", id).Msg("On/Off command sent successfully")
-
-			c.devicesMu.Lock()
-			kd.State["state"] = strings.ToUpper(strVal)
-			c.devicesMu.Unlock()
-		}
-	}
-
-	// Handle "brightness" field (Level Control)
-	if brightnessVal, ok := state["brightness"]; ok {
-		var level uint8
-		switch v := brightnessVal.(type) {
-		case float64:
-			level = uint8(v)
-		case int:
-			level = uint8(v)
-		case json.Number:
-			n, _ := v.Int64()
-			level = uint8(n)
-		default:
-			return nil, fmt.Errorf("%w: invalid brightness type", device.ErrValidation)
-		}
-
-		payload := BuildMoveToLevelCommand(level, 10) // 1 second transition
-		if err := c.ezsp.SendUnicast(kd.NodeID, zclProfileHA, zclClusterLevelControl, 1, kd.Endpoint, payload); err != nil {
-			return nil, fmt.Errorf("send level command: %w", err)
-		}
-
-		c.devicesMu.Lock()
-		kd.State["brightness"] = int(level)
-		c.devicesMu.Unlock()
-	}
-
-	// Return updated state
-	c.devicesMu.RLock()
-	result := make(device.DeviceState)
-	for k, v := range kd.State {
-		result[k] = v
-	}
-	c.devicesMu.RUnlock()
-
-	return result, nil
+	return c.ezsp.SendUnicast(nodeID, zdoProfileID, zdoClusterMgmtLeaveReq, 0, 0, payload)
 }
 
 func (c *Controller) PermitJoin(_ context.Context, enable bool, duration int) error {
 	if !enable {
-		return c.ezsp.PermitJoining(0)
-	}
-
-	// Load the well-known TC link key ("ZigBeeAlliance09") as a transient key
-	// so the NCP can encrypt the APS Transport Key for joining devices.
-	var wildcardEui [8]byte
-	wellKnownKey := [16]byte{
-		0x5A, 0x69, 0x67, 0x42, 0x65, 0x65, 0x41, 0x6C,
-		0x6C, 0x69, 0x61, 0x6E, 0x63, 0x65, 0x30, 0x39,
-	}
-	if err := c.ezsp.ImportTransientKey(wildcardEui, wellKnownKey); err != nil {
-		log.Warn().Err(err).Msg("Failed to import transient link key (join may fail)")
-	}
-
-	// Issue 3: BDB 9.7 requires permit join >= bdbcMinCommissioningTime (180s)
-	if duration < bdbcMinCommissioningTime {
-		duration = bdbcMinCommissioningTime
-	}
-
-	// EZSP permitJoining accepts uint8 max 254. For durations > 254s,
-	// issue the first chunk and schedule re-issue in the background.
-	chunk := min(duration, 254)
-	if err := c.ezsp.PermitJoining(uint8(chunk)); err != nil {
-		return err
-	}
-
-	remaining := duration - chunk
-	if remaining > 0 {
-		go c.reissuePermitJoin(remaining)
-	}
-	return nil
-}
-
-// reissuePermitJoin extends permit joining in 254s chunks until the total duration is met.
-func (c *Controller) reissuePermitJoin(remaining int) {
-	for remaining > 0 {
-		chunk := min(remaining, 254)
-		// Wait until just before the current permit window expires, then re-issue
-		select {
-		case <-time.After(time.Duration(chunk-4) * time.Second):
-		case <-c.stopChan:
-			return
-		}
-		if err := c.ezsp.PermitJoining(uint8(chunk)); err != nil {
-			log.Warn().Err(err).Msg("Failed to re-issue permitJoining")
-			return
+		c.joinWindow.Close()
+		// Routers opened by PermitJoinVia close too.
+		if err := c.broadcastPermitJoin(0); err != nil {
+			log.Warn().Err(err).Msg("Failed to broadcast permit-join close")
 		}
-		remaining -= chunk
+		return c.ezsp.PermitJoining(0)
 	}
+	c.prepareJoinSession()
+	return c.joinWindow.Open(duration, c.ezsp.PermitJoining, c.stopChan)
 }
 
 func (c *Controller) IsConnected() bool {
@@ -1088,44 +866,26 @@ func (c *Controller) ResetNetwork() error {
 func (c *Controller) Close() {
 	c.connMu.Lock()
 	c.connected = false
+	select {
+	case <-c.stopChan:
+	default:
+		close(c.stopChan)
+	}
 	c.connMu.Unlock()
 
 	c.ezsp.Close()
 	c.ash.Close()
-	if err := c.serial.Close(); err != nil {
+	if err := c.ash.port().Close(); err != nil {
 		log.Warn().Err(err).Msg("Failed to close serial port")
 	}
 
 	log.Info().Msg("Zigbee controller closed")
 }
 
-// --- device.EventSubscriber interface ---
-
-func (c *Controller) Subscribe() chan device.DiscoveryEvent {
-	ch := make(chan device.DiscoveryEvent, 16)
-	c.subscribersMu.Lock()
-	c.subscribers = append(c.subscribers, ch)
-	c.subscribersMu.Unlock()
-	return ch
-}
-
-func (c *Controller) Unsubscribe(ch chan device.DiscoveryEvent) {
-	c.subscribersMu.Lock()
-	defer c.subscribersMu.Unlock()
-
-	for i, sub := range c.subscribers {
-		if sub == ch {
-			c.subscribers = append(c.subscribers[:i], c.subscribers[i+1:]...)
-			close(ch)
-			return
-		}
-	}
-}
-
 // --- Helpers ---
 
-// formatIEEE formats an 8-byte IEEE address as a colon-separated hex string.
-func formatIEEE(addr [8]byte) string {
+// FormatIEEE formats an 8-byte IEEE address as a colon-separated hex string.
+func FormatIEEE(addr [8]byte) string {
 	return fmt.Sprintf("%02x:%02x:%02x:%02x:%02x:%02x:%02x:%02x",
 		addr[7], addr[6], addr[5], addr[4], addr[3], addr[2], addr[1], addr[0])
 }
@@ -1159,7 +919,7 @@ func (c *Controller) handleKeepAliveRequest(sender uint16, seqNum uint8) {
 // discoverDeviceClusters probes a device for known ZCL clusters by sending
 // Read Attributes requests and checking which ones get responses.
 func (c *Controller) discoverDeviceClusters(kd *KnownDevice) {
-	ieeeStr := formatIEEE(kd.IEEEAddress)
+	ieeeStr := FormatIEEE(kd.IEEEAddress)
 
 	// Probe these clusters — send a Read Attributes for attribute 0x0000 on each.
 	// If the device supports the cluster, it responds; otherwise silence/error.
@@ -1184,7 +944,7 @@ func (c *Controller) discoverDeviceClusters(kd *KnownDevice) {
 	time.Sleep(3 * time.Second)
 
 	var discovered []uint16
-	c.devicesMu.Lock()
+	c.mu.Lock()
 	if _, ok := kd.State["state"]; ok {
 		discovered = append(discovered, zclClusterOnOff)
 	}
@@ -1198,19 +958,22 @@ func (c *Controller) discoverDeviceClusters(kd *KnownDevice) {
 		discovered = append(discovered, zclClusterOnOff)
 	}
 	kd.Clusters = discovered
-	kd.DeviceType = deviceTypeFromClusters(discovered)
-	c.devicesMu.Unlock()
+	kd.DeviceType = DeviceTypeFromClusters(discovered)
+	c.mu.Unlock()
 
-	c.notifyDeviceChange()
+	c.NotifyDeviceChange()
 	log.Info().Str("device", ieeeStr).
 		Int("clusters", len(discovered)).
 		Str("type", kd.DeviceType).
 		Msg("Device clusters discovered")
 }
 
-// handleZDOResponse processes ZDO response messages (Active Endpoints, Simple Descriptor, NWK_addr).
+// handleZDOResponse processes ZDO response messages (Active Endpoints, Simple Descriptor, NWK_addr)
+// and Device_annce broadcasts.
 func (c *Controller) handleZDOResponse(clusterID uint16, sender uint16, message []byte) bool {
 	switch clusterID {
+	case zdoClusterDeviceAnnce:
+		return c.handleDeviceAnnce(message)
 	case zdoClusterNWKAddrResp:
 		return c.handleNWKAddrResponse(message)
 	case zdoClusterActiveEndpointsResp:
@@ -1221,6 +984,38 @@ func (c *Controller) handleZDOResponse(clusterID uint16, sender uint16, message
 	return false
 }
 
+// handleDeviceAnnce records a device's new NodeID and power mode from its Device_annce.
+func (c *Controller) handleDeviceAnnce(data []byte) bool {
+	// Device_annce: seq(1) + NWKAddr(2) + IEEEAddr(8) + capability(1)
+	if len(data) < 12 {
+		return false
+	}
+	nodeID := binary.LittleEndian.Uint16(data[1:3])
+	var ieee [8]byte
+	copy(ieee[:], data[3:11])
+	capability := data[11]
+	ieeeStr := FormatIEEE(ieee)
+
+	c.mu.Lock()
+	kd, ok := c.devices[ieeeStr]
+	cameOnline := false
+	if ok {
+		kd.NodeID = nodeID
+		// Capability bit 3: receiver on when idle. Without it the device sleeps.
+		kd.Sleepy = capability&0x08 == 0
+		kd.LastSeen = time.Now()
+		cameOnline = !kd.Available
+		kd.Available = true
+	}
+	c.mu.Unlock()
+
+	log.Info().Str("ieee", ieeeStr).Uint16("nodeID", nodeID).Uint8("capability", capability).Msg("Device_annce received")
+	if cameOnline {
+		c.PublishAvailability(ieeeStr, kd, true)
+	}
+	return true
+}
+
 // handleNWKAddrResponse processes a ZDO NWK_addr_rsp and unblocks any waiter.
 func (c *Controller) handleNWKAddrResponse(data []byte) bool {
 	// NWK_addr_rsp: seq(1) + status(1) + IEEEAddr(8) + NWKAddr(2)
@@ -1234,7 +1029,7 @@ func (c *Controller) handleNWKAddrResponse(data []byte) bool {
 	var ieee [8]byte
 	copy(ieee[:], data[2:10])
 	nodeID := binary.LittleEndian.Uint16(data[10:12])
-	ieeeStr := formatIEEE(ieee)
+	ieeeStr := FormatIEEE(ieee)
 
 	log.Info().Str("ieee", ieeeStr).Uint16("nodeID", nodeID).Msg("NWK_addr_rsp received")
 
@@ -1330,7 +1125,7 @@ func (c *Controller) handleSimpleDescriptorResponse(sender uint16, data []byte)
 		Msg("Simple Descriptor response")
 
 	// Update the device with discovered clusters
-	c.devicesMu.Lock()
+	c.mu.Lock()
 	for _, kd := range c.devices {
 		if kd.NodeID == sender {
 			kd.Endpoint = endpoint
@@ -1344,12 +1139,12 @@ func (c *Controller) handleSimpleDescriptorResponse(sender uint16, data []byte)
 					kd.Clusters = append(kd.Clusters, cl)
 				}
 			}
-			kd.DeviceType = deviceTypeFromClusters(kd.Clusters)
+			kd.DeviceType = DeviceTypeFromClusters(kd.Clusters)
 			break
 		}
 	}
-	c.devicesMu.Unlock()
-	c.notifyDeviceChange()
+	c.mu.Unlock()
+	c.NotifyDeviceChange()
 	return true
 }
 
@@ -0,0 +1,198 @@
+package zigbee
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/urmzd/zigbee-skill/pkg/device"
+)
+
+const (
+	// deliveryTimeout bounds the wait for messageSentHandler. With APS retries
+	// enabled the NCP may take several seconds before giving up on a device.
+	deliveryTimeout = 10 * time.Second
+
+	// defaultResponseTimeout bounds how long a ZCL Default Response is watched
+	// for once APS delivery has been confirmed. Devices only send one when the
+	// command fails or the frame asks for it, so most never arrive.
+	defaultResponseTimeout = 2 * time.Second
+)
+
+// zclWaitKey identifies a ZCL transaction awaiting a Default Response.
+type zclWaitKey struct {
+	nodeID uint16
+	seq    uint8
+}
+
+// nextMessageTag allocates a non-zero message tag for a tracked unicast.
+// Tag 0 is reserved for fire-and-forget sends.
+func (c *Controller) nextMessageTag() uint8 {
+	c.sentMu.Lock()
+	defer c.sentMu.Unlock()
+	for {
+		c.nextTag++
+		if c.nextTag == untrackedMessageTag {
+			continue
+		}
+		if _, busy := c.sentWaiters[c.nextTag]; !busy {
+			return c.nextTag
+		}
+	}
+}
+
+// sendConfirmed sends a ZCL frame to a device and blocks until the NCP reports
+// APS delivery via messageSentHandler. It returns device.ErrTimeout if no
+// delivery report arrives and device.ErrDeliveryFailed if the NCP reports a
+// failure or the device has already rejected the command.
+func (c *Controller) sendConfirmed(ctx context.Context, kd *KnownDevice, clusterID uint16, frame []byte) error {
+	return c.sendTracked(ctx, kd, clusterID, frame, true)
+}
+
+// sendTracked sends a ZCL frame with a message tag and waits for the APS
+// delivery report. If expectDefaultResponse is set the ZCL Default Response
+// is handled as described on AwaitDelivery.
+func (c *Controller) sendTracked(ctx context.Context, kd *KnownDevice, clusterID uint16, frame []byte, expectDefaultResponse bool) error {
+	hdr, _, ok := ParseZCLHeader(frame)
+	if !ok {
+		return fmt.Errorf("ZCL frame too short: %d bytes", len(frame))
+	}
+
+	c.mu.RLock()
+	nodeID := kd.NodeID
+	endpoint := kd.Endpoint
+	c.mu.RUnlock()
+
+	tag := c.nextMessageTag()
+	sent := make(chan uint32, 1)
+	zclKey := zclWaitKey{nodeID: nodeID, seq: hdr.SeqNumber}
+	var defaultResp chan uint8
+
+	c.sentMu.Lock()
+	c.sentWaiters[tag] = sent
+	if expectDefaultResponse {
+		defaultResp = make(chan uint8, 1)
+		c.zclWaiters[zclKey] = defaultResp
+	}
+	c.sentMu.Unlock()
+	release := func() {
+		c.sentMu.Lock()
+		delete(c.sentWaiters, tag)
+		if defaultResp != nil && c.zclWaiters[zclKey] == defaultResp {
+			delete(c.zclWaiters, zclKey)
+		}
+		c.sentMu.Unlock()
+	}
+
+	down := c.ash.Down()
+	if err := c.ezsp.SendUnicastTagged(nodeID, zclProfileHA, clusterID, 1, endpoint, frame, tag); err != nil {
+		release()
+		return err
+	}
+	return AwaitDelivery(ctx, nodeID, clusterID, sent, defaultResp, down, c.stopChan, release)
+}
+
+// AwaitDelivery waits for the delivery report of a tracked unicast: a
+// non-zero status on sent is a delivery failure. If defaultResp is non-nil
+// the ZCL Default Response is handled as described on awaitDefaultResponse.
+// A closed down or stop channel means the link is gone. release is called
+// once neither channel is needed any more, which may be after AwaitDelivery
+// returns.
+func AwaitDelivery(ctx context.Context, nodeID, clusterID uint16, sent <-chan uint32, defaultResp <-chan uint8, down, stop <-chan struct{}, release func()) error {
+	watching := false
+	defer func() {
+		if !watching {
+			release()
+		}
+	}()
+
+	select {
+	case status := <-sent:
+		if status != 0x00 {
+			return fmt.Errorf("%w: node 0x%04X cluster 0x%04X status 0x%02X", device.ErrDeliveryFailed, nodeID, clusterID, status)
+		}
+	case status := <-defaultResp:
+		// The device answered before the APS ack was reported; that is proof of delivery.
+		return zclStatusErr(nodeID, clusterID, status)
+	case <-time.After(deliveryTimeout):
+		return fmt.Errorf("%w: no delivery report from node 0x%04X", device.ErrTimeout, nodeID)
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-down:
+		return device.ErrNotConnected
+	case <-stop:
+		return device.ErrNotConnected
+	}
+
+	if defaultResp == nil {
+		return nil
+	}
+	watching = true
+	return awaitDefaultResponse(nodeID, clusterID, defaultResp, release)
+}
+
+// awaitDefaultResponse settles a command whose delivery the network has
+// confirmed. A Default Response that has already arrived decides the result;
+// otherwise the command succeeded, and a rejection arriving within
+// defaultResponseTimeout is only logged. done is called when the response is
+// no longer watched for.
+func awaitDefaultResponse(nodeID, clusterID uint16, resp <-chan uint8, done func()) error {
+	select {
+	case status := <-resp:
+		done()
+		return zclStatusErr(nodeID, clusterID, status)
+	default:
+	}
+	go func() {
+		defer done()
+		select {
+		case status := <-resp:
+			if err := zclStatusErr(nodeID, clusterID, status); err != nil {
+				log.Warn().Err(err).Msg("Device rejected a delivered command")
+			}
+		case <-time.After(defaultResponseTimeout):
+		}
+	}()
+	return nil
+}
+
+// zclStatusErr maps a ZCL Default Response status to an error.
+func zclStatusErr(nodeID, clusterID uint16, status uint8) error {
+	if status == 0x00 {
+		return nil
+	}
+	return fmt.Errorf("%w: node 0x%04X rejected cluster 0x%04X command with ZCL status 0x%02X", device.ErrDeliveryFailed, nodeID, clusterID, status)
+}
+
+// deliverMessageSent unblocks the sender waiting on the given message tag.
+func (c *Controller) deliverMessageSent(tag uint8, status uint32) {
+	if tag == untrackedMessageTag {
+		return
+	}
+	c.sentMu.Lock()
+	ch, ok := c.sentWaiters[tag]
+	c.sentMu.Unlock()
+	if ok {
+		select {
+		case ch <- status:
+		default:
+		}
+	}
+}
+
+// deliverDefaultResponse unblocks the sender waiting on a ZCL transaction.
+// Returns true if a waiter consumed the response.
+func (c *Controller) deliverDefaultResponse(sender uint16, seq, status uint8) bool {
+	c.sentMu.Lock()
+	ch, ok := c.zclWaiters[zclWaitKey{nodeID: sender, seq: seq}]
+	c.sentMu.Unlock()
+	if !ok {
+		return false
+	}
+	select {
+	case ch <- status:
+	default:
+	}
+	return true
+}
@@ -0,0 +1,83 @@
+package zigbee
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/urmzd/zigbee-skill/pkg/device"
+)
+
+func TestAwaitDelivery(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("APS ack without Default Response", func(t *testing.T) {
+		sent, resp, released := make(chan uint32, 1), make(chan uint8, 1), make(chan struct{})
+		sent <- emberSuccess
+		start := time.Now()
+		if err := AwaitDelivery(ctx, 0x1234, zclClusterOnOff, sent, resp, nil, nil, func() { close(released) }); err != nil {
+			t.Fatal(err)
+		}
+		if d := time.Since(start); d > defaultResponseTimeout/2 {
+			t.Errorf("waited %v for a Default Response", d)
+		}
+		// A late rejection is only logged; the waiter is then released.
+		resp <- 0x81
+		select {
+		case <-released:
+		case <-time.After(time.Second):
+			t.Error("waiter not released after the late Default Response")
+		}
+	})
+
+	t.Run("Default Response already received", func(t *testing.T) {
+		sent, resp := make(chan uint32, 1), make(chan uint8, 1)
+		sent <- emberSuccess
+		resp <- 0x81
+		err := AwaitDelivery(ctx, 0x1234, zclClusterOnOff, sent, resp, nil, nil, func() {})
+		if !errors.Is(err, device.ErrDeliveryFailed) {
+			t.Errorf("err = %v, want ErrDeliveryFailed", err)
+		}
+	})
+
+	t.Run("APS failure", func(t *testing.T) {
+		sent := make(chan uint32, 1)
+		sent <- 0x66
+		released := false
+		err := AwaitDelivery(ctx, 0x1234, zclClusterOnOff, sent, nil, nil, nil, func() { released = true })
+		if !errors.Is(err, device.ErrDeliveryFailed) || !released {
+			t.Errorf("err = %v, released = %v", err, released)
+		}
+	})
+
+	t.Run("link down", func(t *testing.T) {
+		down := make(chan struct{})
+		close(down)
+		err := AwaitDelivery(ctx, 0x1234, zclClusterOnOff, make(chan uint32), nil, down, nil, func() {})
+		if !errors.Is(err, device.ErrNotConnected) {
+			t.Errorf("err = %v, want ErrNotConnected", err)
+		}
+	})
+}
+
+func TestDefaultResponseMatching(t *testing.T) {
+	c := &Controller{zclWaiters: make(map[zclWaitKey]chan uint8)}
+	resp := make(chan uint8, 1)
+	c.zclWaiters[zclWaitKey{nodeID: 0x1234, seq: 0x2A}] = resp
+
+	// Manufacturer-specific Default Response: FC, manufacturer code, seq, cmd,
+	// then the command it answers and the status.
+	msg := []byte{zclFrameManufacturerSpecific | zclDirectionServerToClient, 0x5F, 0x11, 0x2A, zclGlobalDefaultResponse, 0x01, 0x81}
+	hdr, payload, ok := ParseZCLHeader(msg)
+	if !ok || !hdr.IsDefaultResponse() || hdr.SeqNumber != 0x2A || hdr.ManufacturerCode != 0x115F {
+		t.Fatalf("header = %+v, ok = %v", hdr, ok)
+	}
+	_, status, _ := ParseDefaultResponse(payload)
+	if !c.deliverDefaultResponse(0x1234, hdr.SeqNumber, status) || <-resp != 0x81 {
+		t.Error("Default Response not matched to its transaction")
+	}
+	if c.deliverDefaultResponse(0x1234, 0x2B, 0) {
+		t.Error("Default Response matched the wrong transaction")
+	}
+}
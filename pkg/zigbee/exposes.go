@@ -0,0 +1,181 @@
+package zigbee
+
+import (
+	"slices"
+
+	"github.com/urmzd/zigbee-skill/pkg/device"
+)
+
+// StateAccess gives the access of each state key a controller supports.
+// Keys it omits are not exposed.
+type StateAccess map[string]device.Access
+
+// AdapterAccess is what the EZSP, ZNP and deCONZ controllers support:
+// GetDeviceState reads On/Off, and SetDeviceState sends the keys handled by
+// BuildStateCommands. Other values are only cached from commands sent, so
+// they are not claimed as readable, and report is not claimed because not
+// every controller applies incoming reports.
+var AdapterAccess = StateAccess{
+	"state":              device.AccessRead | device.AccessWrite,
+	"brightness":         device.AccessWrite,
+	"brightness_percent": device.AccessWrite,
+	"brightness_step":    device.AccessWrite,
+	"brightness_move":    device.AccessWrite,
+	"color_temp":         device.AccessWrite,
+	"color_temp_step":    device.AccessWrite,
+	"transition":         device.AccessWrite,
+}
+
+// stateKeys lists every state key a device may have, with the clusters that
+// provide it, the capability exposing it and its JSON schema. Both the state
+// schema and the exposes list are generated from it, in this order.
+var stateKeys = []struct {
+	key      string
+	clusters []uint16 // any one of them provides the key
+	cap      string   // empty for request-only keys
+	schema   map[string]any
+}{
+	{"state", []uint16{zclClusterOnOff}, device.CapOnOff, map[string]any{
+		"type": "string", "enum": []string{"ON", "OFF", "TOGGLE"},
+	}},
+	{"brightness", []uint16{zclClusterLevelControl}, device.CapBrightness, map[string]any{
+		"type": "integer", "minimum": 0, "maximum": 254,
+	}},
+	{"brightness_percent", []uint16{zclClusterLevelControl}, "", map[string]any{
+		"type": "number", "minimum": 0, "maximum": 100,
+		"description": "brightness in %",
+	}},
+	{"brightness_step", []uint16{zclClusterLevelControl}, "", map[string]any{
+		"type": "integer", "minimum": -254, "maximum": 254,
+		"description": "change brightness by this amount",
+	}},
+	{"brightness_move", []uint16{zclClusterLevelControl}, "", map[string]any{
+		"oneOf": []any{
+			map[string]any{"type": "integer", "minimum": -255, "maximum": 255},
+			map[string]any{"const": "stop"},
+		},
+		"description": `dim up (positive) or down (negative) at this rate per second until "stop" or 0`,
+	}},
+	{"color_temp", []uint16{zclClusterColorControl}, device.CapColorTemp, map[string]any{
+		"type": "integer", "minimum": 153, "maximum": 500,
+		"description": "color temperature in mireds",
+	}},
+	{"color_temp_step", []uint16{zclClusterColorControl}, "", map[string]any{
+		"type": "integer", "minimum": -347, "maximum": 347,
+		"description": "change color temperature by this many mireds",
+	}},
+	{"color", []uint16{zclClusterColorControl}, device.CapColorXY, map[string]any{
+		"type": "object",
+		"properties": map[string]any{
+			"x": map[string]any{"type": "number", "minimum": 0, "maximum": 1},
+			"y": map[string]any{"type": "number", "minimum": 0, "maximum": 1},
+		},
+		"required":    []string{"x", "y"},
+		"description": "CIE 1931 color coordinates",
+	}},
+	{"transition", []uint16{zclClusterLevelControl, zclClusterColorControl}, "", map[string]any{
+		"type": "number", "minimum": 0, "maximum": 6553.5,
+		"description": "seconds over which brightness and color changes fade (default 1)",
+	}},
+	{"position", []uint16{zclClusterWindowCovering}, device.CapCover, map[string]any{
+		"type": "integer", "minimum": 0, "maximum": 100,
+		"description": "cover position in %",
+	}},
+	{"lock_state", []uint16{zclClusterDoorLock}, device.CapLock, map[string]any{
+		"type": "string", "enum": []string{"LOCK", "UNLOCK"},
+	}},
+	{"heating_setpoint", []uint16{zclClusterThermostat}, device.CapHeatingSetpoint, map[string]any{
+		"type": "number", "minimum": 5, "maximum": 30,
+		"description": "heating setpoint in °C",
+	}},
+	{"local_temperature", []uint16{zclClusterThermostat}, device.CapLocalTemperature, map[string]any{
+		"type": "number", "description": "temperature measured by the thermostat in °C",
+	}},
+	{"temperature", []uint16{zclClusterTemperature}, device.CapTemperature, map[string]any{
+		"type": "number", "description": "temperature in °C",
+	}},
+	{"humidity", []uint16{zclClusterRelativeHumidity}, device.CapHumidity, map[string]any{
+		"type": "number", "description": "relative humidity %",
+	}},
+	{"pressure", []uint16{zclClusterPressure}, device.CapPressure, map[string]any{
+		"type": "number", "description": "pressure in hPa",
+	}},
+	{"illuminance", []uint16{zclClusterIlluminance}, device.CapIlluminance, map[string]any{
+		"type": "number", "description": "illuminance in lx",
+	}},
+	{"occupancy", []uint16{zclClusterOccupancy}, device.CapOccupancy, map[string]any{
+		"type": "boolean",
+	}},
+	{"power", []uint16{zclClusterElectricalMeasure}, device.CapPower, map[string]any{
+		"type": "number", "description": "active power in W",
+	}},
+	{"battery", []uint16{zclClusterPowerConfig}, device.CapBattery, map[string]any{
+		"type": "integer", "minimum": 0, "maximum": 100,
+		"description": "battery level in %",
+	}},
+}
+
+// onOffClusters is assumed for devices with no recognised cluster.
+var onOffClusters = []uint16{zclClusterOnOff}
+
+// knownClusters returns clusters, or onOffClusters when none of them
+// provides a state key.
+func knownClusters(clusters []uint16) []uint16 {
+	for _, k := range stateKeys {
+		for _, c := range k.clusters {
+			if slices.Contains(clusters, c) {
+				return clusters
+			}
+		}
+	}
+	return onOffClusters
+}
+
+// provided reports whether any of clusters provides one of keys.
+func provided(clusters, keys []uint16) bool {
+	return slices.ContainsFunc(keys, func(c uint16) bool { return slices.Contains(clusters, c) })
+}
+
+// BuildStateSchema generates a JSON schema of the state keys the device's
+// clusters provide and access allows. Keys that cannot be written are marked
+// readOnly.
+func BuildStateSchema(clusters []uint16, access StateAccess) map[string]any {
+	clusters = knownClusters(clusters)
+	props := map[string]any{}
+	for _, k := range stateKeys {
+		a := access[k.key]
+		if a == 0 || !provided(clusters, k.clusters) {
+			continue
+		}
+		prop := make(map[string]any, len(k.schema)+1)
+		for name, v := range k.schema {
+			prop[name] = v
+		}
+		if !a.Has(device.AccessWrite) {
+			prop["readOnly"] = true
+		}
+		props[k.key] = prop
+	}
+	return map[string]any{"type": "object", "properties": props}
+}
+
+// BuildCapabilities describes what a device on endpoint can do from its
+// server clusters and access. Devices with no recognised cluster are assumed
+// to be on/off, as in BuildStateSchema.
+func BuildCapabilities(clusters []uint16, endpoint uint8, access StateAccess) []device.Capability {
+	if endpoint == 0 {
+		endpoint = 1
+	}
+	clusters = knownClusters(clusters)
+	caps := []device.Capability{}
+	for _, k := range stateKeys {
+		a := access[k.key]
+		if k.cap == "" || a == 0 || !provided(clusters, k.clusters) {
+			continue
+		}
+		if c, ok := device.NewCapability(k.cap, endpoint, a); ok {
+			caps = append(caps, c)
+		}
+	}
+	return caps
+}
@@ -9,6 +9,7 @@ import (
 	"time"
 
 	"github.com/rs/zerolog/log"
+	"github.com/urmzd/zigbee-skill/pkg/device"
 )
 
 // EZSP frame IDs
@@ -28,15 +29,41 @@ const (
 	ezspSetPolicy               uint16 = 0x0055
 	ezspSetInitialSecurityState uint16 = 0x0068
 	ezspImportTransientKey      uint16 = 0x0111
+	ezspAddTransientLinkKey     uint16 = 0x00AF
 	ezspGetNodeID               uint16 = 0x0027
 	ezspLookupNodeIDByEUI64     uint16 = 0x0060
+	ezspGetValue                uint16 = 0x00AA
+	ezspSetValue                uint16 = 0x00AB
+	ezspGetMfgToken             uint16 = 0x000B
+	ezspSetMfgToken             uint16 = 0x000C
+	ezspGetConfigurationValue   uint16 = 0x0052
+	ezspGetChildData            uint16 = 0x004A
+	ezspSetRadioChannel         uint16 = 0x009A
+
+	// Security: EZSP v12 and earlier
+	ezspGetKey           uint16 = 0x006A
+	ezspGetKeyTableEntry uint16 = 0x0071
+	ezspSetKeyTableEntry uint16 = 0x0072
+
+	// Network key distribution and rotation
+	ezspUnicastCurrentNetworkKey  uint16 = 0x0050
+	ezspBroadcastNextNetworkKey   uint16 = 0x0073
+	ezspBroadcastNetworkKeySwitch uint16 = 0x0074
+
+	// Security manager: EZSP v13+
+	ezspImportLinkKey        uint16 = 0x010E
+	ezspExportLinkKeyByIndex uint16 = 0x010F
+	ezspExportKey            uint16 = 0x0114
+	ezspGetNetworkKeyInfo    uint16 = 0x0116
 
 	// Callbacks
 	ezspTrustCenterJoinHandler  uint16 = 0x0024
 	ezspIncomingMessageHandler  uint16 = 0x0045
 	ezspMessageSentHandler      uint16 = 0x003F
+	ezspKeyEstablishmentHandler uint16 = 0x009B
 	ezspStackStatusHandler      uint16 = 0x0019
 	ezspScanCompleteHandler     uint16 = 0x001C
+	ezspNetworkFoundHandler     uint16 = 0x001B
 	ezspEnergyScanResultHandler uint16 = 0x0048
 
 	// EZSP config IDs
@@ -48,11 +75,20 @@ const (
 	ezspConfigTrustCenterAddressCacheSize uint8 = 0x19
 	ezspConfigSourceRouteTableSize        uint8 = 0x1A
 	ezspConfigAddressTableSize            uint8 = 0x05
+	ezspConfigKeyTableSize                uint8 = 0x1E
 
-	// EZSP protocol version
-	ezspProtocolVersion = 13
+	// EZSP value IDs (getValue/setValue)
+	ezspValueVersionInfo     uint8 = 0x11
+	ezspValueNwkFrameCounter uint8 = 0x23
+	ezspValueAPSFrameCounter uint8 = 0x24
 
-	// EmberStatus values
+	// Manufacturing token IDs (getMfgToken/setMfgToken)
+	ezspMfgCustomEUI64 uint8 = 0x00
+	ezspMfgString      uint8 = 0x01
+	ezspMfgBoardName   uint8 = 0x02
+
+	// EmberStatus values. From v14 these arrive as sl_status_t with the same
+	// numeric values for the conditions used here.
 	emberSuccess     = 0x00
 	emberNotJoined   = 0x93
 	emberNetworkUp   = 0x90
@@ -64,6 +100,15 @@ const (
 	emberJoiningNetwork = 0x01 //nolint:unused
 	emberJoinedNetwork  = 0x02 //nolint:unused
 
+	// Message tag used for unicasts whose messageSentHandler nobody waits on.
+	untrackedMessageTag uint8 = 0x00
+
+	// EmberInitialSecurityBitmask values (Gecko SDK ember-types.h)
+	emberTrustCenterGlobalLinkKey uint16 = 0x0004
+	emberHavePreconfiguredKey     uint16 = 0x0100
+	emberHaveNetworkKey           uint16 = 0x0200
+	emberNoFrameCounterReset      uint16 = 0x1000
+
 	// Send options
 	// EMBER_APS_OPTION_RETRY enables APS-layer retries with acknowledgement,
 	// satisfying BDB 6.10 requirement for APS Acknowledgement usage.
@@ -79,18 +124,24 @@ const (
 	ezspDecisionAllowJoins             uint8 = 0x01 // EZSP_DECISION_ALLOW_JOINS
 	ezspDecisionAllowUnsecuredRejoins  uint8 = 0x02 // EZSP_DECISION_ALLOW_UNSECURED_REJOINS //nolint:unused
 	ezspDecisionSendKeyInClear         uint8 = 0x04 // EZSP_DECISION_SEND_KEY_IN_CLEAR //nolint:unused
-	ezspDecisionJoinsUseInstallCodeKey uint8 = 0x10 // EZSP_DECISION_JOINS_USE_INSTALL_CODE_KEY //nolint:unused
-	ezspDecisionDeferJoins             uint8 = 0x20 // EZSP_DECISION_DEFER_JOINS //nolint:unused
+	ezspDecisionJoinsUseInstallCodeKey uint8 = 0x10 // EZSP_DECISION_JOINS_USE_INSTALL_CODE_KEY
+	ezspDecisionDeferJoins             uint8 = 0x20 // EZSP_DECISION_DEFER_JOINS
 
 	// EZSP TC key request policy decisions (from Gecko SDK ezsp-enum.h)
 	ezspAllowTCKeyRequestsAndSendCurrentKey uint8 = 0x51 //nolint:unused
+	ezspAllowTCKeyRequestAndGenerateNewKey  uint8 = 0x52
 
 	// BDB channel sets (2.4GHz, bitmask where bit N = channel N)
 	bdbcTLPrimaryChannelSet   uint32 = 0x02108800 // channels 11, 15, 20, 25
 	bdbcTLSecondaryChannelSet uint32 = 0x05EF7000 // remaining 2.4GHz channels
 
+	// EmberDeviceUpdate values reported by trustCenterJoinHandler
+	emberUnsecuredJoin uint8 = 0x01
+	emberDeviceLeft    uint8 = 0x02
+
 	// Scan types
 	ezspEnergyScan uint8 = 0x00
+	ezspActiveScan uint8 = 0x01
 
 	// ZDO constants
 	zdoProfileID                   uint16 = 0x0000
@@ -99,14 +150,41 @@ const (
 	zdoClusterSimpleDescriptorReq  uint16 = 0x0004
 	zdoClusterSimpleDescriptorResp uint16 = 0x8004
 	zdoClusterNWKAddrReq           uint16 = 0x0000
+	zdoClusterNodeDescriptorReq    uint16 = 0x0002
 	zdoClusterNWKAddrResp          uint16 = 0x8000
 	zdoClusterDeviceAnnce          uint16 = 0x0013
+	zdoClusterMgmtLqiReq           uint16 = 0x0031
+	zdoClusterMgmtRtgReq           uint16 = 0x0032
 	zdoClusterMgmtLeaveReq         uint16 = 0x0034
+	zdoClusterMgmtPermitJoiningReq uint16 = 0x0036
+	zdoClusterMgmtNWKUpdateReq     uint16 = 0x0038
 
 	// BDB constants
 	bdbcMinCommissioningTime = 180 // seconds
 )
 
+// ezspMaxOutstanding is how many commands may await a response at once.
+// EmberZNet over UART handles a single outstanding command.
+const ezspMaxOutstanding = 1
+
+// Frame control bits (low byte)
+const (
+	ezspFCResponse     = 0x80 // direction: NCP to host
+	ezspFCCallbackMask = 0x18 // callbackType: 0 = response, 1 = sync, 2 = async callback
+	ezspFCOverflow     = 0x01 // the NCP ran out of memory since the last response
+)
+
+// ezspPending is a command waiting for its response.
+type ezspPending struct {
+	frameID uint16
+	ch      chan []byte
+}
+
+// ezspListener receives callbacks of one frame ID.
+type ezspListener struct {
+	fn func(data []byte)
+}
+
 // EZSPLayer handles EZSP command/response framing over ASH.
 type EZSPLayer struct {
 	ash   *ASHLayer
@@ -117,13 +195,29 @@ type EZSPLayer struct {
 	// Starts as legacy; set to extended after version negotiation confirms v8+.
 	extendedFormat bool
 
-	// Response handling
-	responseChan map[uint16]chan []byte
-	responseMu   sync.Mutex
+	// Negotiated version, recorded by NegotiateVersion.
+	protocolVersion uint8
+	stackType       uint8
+	stackVersion    uint16
 
-	// Callback handling
-	callbackHandler func(frameID uint16, data []byte)
-	callbackMu      sync.RWMutex
+	// Struct layouts for the negotiated version, selected by NegotiateVersion.
+	codecV ezspCodec
+	// codecMu guards the frame format, version and codec, which the
+	// supervisor renegotiates while the reader goroutine decodes frames.
+	codecMu sync.RWMutex
+
+	// Outstanding commands, keyed by sequence number. slots bounds how many
+	// may be in flight; the NCP processes one command at a time over UART.
+	pending map[uint8]ezspPending
+	pendMu  sync.Mutex
+	slots   chan struct{}
+
+	// Callback listeners by frame ID
+	listeners  map[uint16][]*ezspListener
+	listenerMu sync.RWMutex
+
+	// scanMu serializes scans; the NCP runs one at a time.
+	scanMu sync.Mutex
 
 	stopChan chan struct{}
 }
@@ -131,10 +225,47 @@ type EZSPLayer struct {
 // NewEZSPLayer creates a new EZSP layer.
 func NewEZSPLayer(ash *ASHLayer) *EZSPLayer {
 	return &EZSPLayer{
-		ash:          ash,
-		responseChan: make(map[uint16]chan []byte),
-		stopChan:     make(chan struct{}),
+		ash:       ash,
+		pending:   make(map[uint8]ezspPending),
+		slots:     make(chan struct{}, ezspMaxOutstanding),
+		listeners: make(map[uint16][]*ezspListener),
+		codecV:    ezspCodecV8{},
+		stopChan:  make(chan struct{}),
+	}
+}
+
+// codec returns the struct codec for the negotiated protocol version.
+func (e *EZSPLayer) codec() ezspCodec {
+	e.codecMu.RLock()
+	defer e.codecMu.RUnlock()
+	return e.codecV
+}
+
+// extended reports whether frames use the extended 5-byte header.
+func (e *EZSPLayer) extended() bool {
+	e.codecMu.RLock()
+	defer e.codecMu.RUnlock()
+	return e.extendedFormat
+}
+
+// setExtended switches the frame header format.
+func (e *EZSPLayer) setExtended(on bool) {
+	e.codecMu.Lock()
+	e.extendedFormat = on
+	e.codecMu.Unlock()
+}
+
+// checkStatus returns an error unless resp starts with a successful
+// EmberStatus (sl_status_t from v14).
+func (e *EZSPLayer) checkStatus(op string, resp []byte) error {
+	status, _, err := e.codec().status(resp)
+	if err != nil {
+		return fmt.Errorf("%s response empty", op)
+	}
+	if status != emberSuccess {
+		return fmt.Errorf("%s failed: status 0x%02X", op, status)
 	}
+	return nil
 }
 
 // Start begins processing EZSP frames from ASH.
@@ -157,11 +288,26 @@ func (e *EZSPLayer) Reinitialize() error {
 	return nil
 }
 
-// SetCallbackHandler sets the handler for async EZSP callbacks.
-func (e *EZSPLayer) SetCallbackHandler(handler func(frameID uint16, data []byte)) {
-	e.callbackMu.Lock()
-	defer e.callbackMu.Unlock()
-	e.callbackHandler = handler
+// Listen registers fn for callbacks with the given frame ID and returns a
+// function that removes it. Several listeners may share a frame ID; they run
+// in registration order on the EZSP reader goroutine and must not block or
+// send EZSP commands.
+func (e *EZSPLayer) Listen(frameID uint16, fn func(data []byte)) (remove func()) {
+	l := &ezspListener{fn: fn}
+	e.listenerMu.Lock()
+	e.listeners[frameID] = append(e.listeners[frameID], l)
+	e.listenerMu.Unlock()
+	return func() {
+		e.listenerMu.Lock()
+		defer e.listenerMu.Unlock()
+		ls := e.listeners[frameID]
+		for i, x := range ls {
+			if x == l {
+				e.listeners[frameID] = append(ls[:i:i], ls[i+1:]...)
+				return
+			}
+		}
+	}
 }
 
 // Close stops the EZSP layer.
@@ -169,8 +315,27 @@ func (e *EZSPLayer) Close() {
 	close(e.stopChan)
 }
 
-// SendCommand sends an EZSP command and waits for the response.
+// SendCommand sends an EZSP command and waits for the response, which is
+// matched by sequence number. It waits for a free slot when the NCP's
+// outstanding-command limit is reached.
 func (e *EZSPLayer) SendCommand(frameID uint16, params []byte) ([]byte, error) {
+	e.codecMu.RLock()
+	version, extended := e.protocolVersion, e.extendedFormat
+	e.codecMu.RUnlock()
+	if err := checkFrame(frameID, version); err != nil {
+		return nil, err
+	}
+
+	down := e.ash.Down()
+	select {
+	case e.slots <- struct{}{}:
+	case <-down:
+		return nil, fmt.Errorf("%w: link lost sending EZSP command 0x%04X", device.ErrNotConnected, frameID)
+	case <-e.stopChan:
+		return nil, fmt.Errorf("stopped")
+	}
+	defer func() { <-e.slots }()
+
 	e.seqMu.Lock()
 	seq := e.seq
 	e.seq++
@@ -178,19 +343,19 @@ func (e *EZSPLayer) SendCommand(frameID uint16, params []byte) ([]byte, error) {
 
 	// Register response channel
 	ch := make(chan []byte, 1)
-	e.responseMu.Lock()
-	e.responseChan[frameID] = ch
-	e.responseMu.Unlock()
+	e.pendMu.Lock()
+	e.pending[seq] = ezspPending{frameID: frameID, ch: ch}
+	e.pendMu.Unlock()
 
 	defer func() {
-		e.responseMu.Lock()
-		delete(e.responseChan, frameID)
-		e.responseMu.Unlock()
+		e.pendMu.Lock()
+		delete(e.pending, seq)
+		e.pendMu.Unlock()
 	}()
 
 	// Build EZSP frame based on negotiated format
 	var frame []byte
-	if e.extendedFormat {
+	if extended {
 		// Extended 5-byte header: seq(1) + frameControl(2) + frameID(2) + params
 		frame = make([]byte, 0, 5+len(params))
 		frame = append(frame, seq)
@@ -220,6 +385,8 @@ func (e *EZSPLayer) SendCommand(frameID uint16, params []byte) ([]byte, error) {
 	select {
 	case resp := <-ch:
 		return resp, nil
+	case <-down:
+		return nil, fmt.Errorf("%w: link lost waiting for EZSP response 0x%04X", device.ErrNotConnected, frameID)
 	case <-time.After(5 * time.Second):
 		return nil, fmt.Errorf("timeout waiting for EZSP response 0x%04X", frameID)
 	case <-e.stopChan:
@@ -239,76 +406,90 @@ func (e *EZSPLayer) readLoop() {
 	}
 }
 
-// processFrame decodes and dispatches an EZSP frame.
+// processFrame decodes an EZSP frame and hands it to the command waiting on
+// its sequence number, or to the callback listeners for its frame ID.
 func (e *EZSPLayer) processFrame(data []byte) {
 	if len(data) < 3 {
 		log.Debug().Int("len", len(data)).Msg("EZSP frame too short")
 		return
 	}
+	seq, fc := data[0], data[1]
+	if fc&ezspFCOverflow != 0 {
+		log.Warn().Msg("EZSP NCP reported memory overflow, callbacks may have been lost")
+	}
 
-	// Try to parse and deliver the frame. In extended mode, try extended first
-	// then legacy fallback — the version response is always legacy even when
-	// the NCP is in extended mode.
-	type parsed struct {
-		frameID uint16
-		params  []byte
-	}
-
-	var candidates []parsed
-
-	if e.extendedFormat && len(data) >= 5 {
-		candidates = append(candidates, parsed{
-			frameID: binary.LittleEndian.Uint16(data[3:5]),
-			params:  data[5:],
-		})
-	}
-	// Always include legacy parse as fallback (or primary in legacy mode).
-	candidates = append(candidates, parsed{
-		frameID: uint16(data[2]),
-		params:  data[3:],
-	})
-
-	for _, c := range candidates {
-		e.responseMu.Lock()
-		ch, ok := e.responseChan[c.frameID]
-		e.responseMu.Unlock()
-
-		if ok {
-			log.Debug().
-				Uint16("frameID", c.frameID).
-				Int("params_len", len(c.params)).
-				Str("raw_hex", hex.EncodeToString(data)).
-				Msg("EZSP RX response")
-			select {
-			case ch <- c.params:
-			default:
-			}
-			return
-		}
+	if fc&ezspFCCallbackMask == 0 && e.deliverResponse(seq, data) {
+		return
 	}
 
-	// No pending response matched — use the preferred parse for callback dispatch.
-	best := candidates[0]
+	frameID, params := uint16(data[2]), data[3:]
+	if e.extended() && len(data) >= 5 {
+		frameID, params = binary.LittleEndian.Uint16(data[3:5]), data[5:]
+	}
 	log.Debug().
-		Uint16("frameID", best.frameID).
-		Int("params_len", len(best.params)).
+		Uint16("frameID", frameID).
+		Int("params_len", len(params)).
 		Str("raw_hex", hex.EncodeToString(data)).
 		Msg("EZSP RX callback")
 
-	e.callbackMu.RLock()
-	handler := e.callbackHandler
-	e.callbackMu.RUnlock()
+	e.listenerMu.RLock()
+	ls := append([]*ezspListener(nil), e.listeners[frameID]...)
+	e.listenerMu.RUnlock()
+	if len(ls) == 0 {
+		log.Debug().Uint16("frameID", frameID).Hex("data", params).Msg("Unhandled EZSP callback")
+	}
+	for _, l := range ls {
+		l.fn(params)
+	}
+}
+
+// deliverResponse hands a response to the command sent with seq. The frame is
+// parsed with the extended header first; the version response is always in
+// the legacy format, even once the NCP has switched. Returns false if no
+// command is waiting on seq with a matching frame ID.
+func (e *EZSPLayer) deliverResponse(seq uint8, data []byte) bool {
+	e.pendMu.Lock()
+	p, ok := e.pending[seq]
+	e.pendMu.Unlock()
+	if !ok {
+		return false
+	}
+
+	var params []byte
+	switch {
+	case e.extended() && len(data) >= 5 && binary.LittleEndian.Uint16(data[3:5]) == p.frameID:
+		params = data[5:]
+	case uint16(data[2]) == p.frameID:
+		params = data[3:]
+	default:
+		log.Warn().Uint8("seq", seq).Uint16("expected", p.frameID).Str("raw_hex", hex.EncodeToString(data)).
+			Msg("EZSP response frame ID does not match command")
+		return false
+	}
 
-	if handler != nil {
-		handler(best.frameID, best.params)
+	log.Debug().
+		Uint8("seq", seq).
+		Uint16("frameID", p.frameID).
+		Int("params_len", len(params)).
+		Str("raw_hex", hex.EncodeToString(data)).
+		Msg("EZSP RX response")
+	select {
+	case p.ch <- params:
+	default:
 	}
+	return true
 }
 
 // NegotiateVersion sends the EZSP version command and validates the response.
 // If the NCP does not support the requested version, it responds with a single
-// byte indicating the version it supports. We then retry with that version.
+// byte indicating the version it supports. We then retry with that version if
+// it lies in the supported range, and select the struct codec to match.
 func (e *EZSPLayer) NegotiateVersion() (uint8, uint8, uint16, error) {
-	desiredVersion := uint8(ezspProtocolVersion)
+	desiredVersion := uint8(ezspMaxProtocolVersion)
+
+	// The version command goes out in the legacy format, including after a
+	// reconnect, when the previous link had switched to the extended one.
+	e.setExtended(false)
 
 	// Version command is always the first EZSP command after ASH connect — start at seq 0.
 	e.seqMu.Lock()
@@ -371,37 +552,98 @@ func (e *EZSPLayer) NegotiateVersion() (uint8, uint8, uint16, error) {
 		Uint16("stackVersion", stackVersion).
 		Msg("EZSP version negotiated")
 
+	if protocolVersion < ezspMinProtocolVersion {
+		return 0, 0, 0, fmt.Errorf("%w: NCP speaks EZSP v%d, need v%d or later (EmberZNet 6.7+)",
+			device.ErrUnsupported, protocolVersion, ezspMinProtocolVersion)
+	}
+
 	// EZSP v8+ requires extended frame format for all non-version commands.
 	// The NCP must see an extended-format version command after ASH reset to
 	// confirm the format switch. The version RESPONSE is always in legacy format
 	// (processFrame's legacy fallback handles this).
-	if protocolVersion >= 8 {
-		if err := e.ash.Reset(); err != nil {
-			return 0, 0, 0, fmt.Errorf("ASH reset for format switch: %w", err)
-		}
-		e.extendedFormat = true
-		e.seqMu.Lock()
-		e.seq = 0
-		e.seqMu.Unlock()
+	if err := e.ash.Reset(); err != nil {
+		return 0, 0, 0, fmt.Errorf("ASH reset for format switch: %w", err)
+	}
+	e.setExtended(true)
+	e.seqMu.Lock()
+	e.seq = 0
+	e.seqMu.Unlock()
 
-		log.Debug().Msg("Sending extended-format version command to confirm format switch")
-		resp, err = e.SendCommand(ezspVersion, []byte{protocolVersion})
-		if err != nil {
-			return 0, 0, 0, fmt.Errorf("extended format confirmation: %w", err)
-		}
-		log.Debug().
-			Int("len", len(resp)).
-			Str("raw", hex.EncodeToString(resp)).
-			Msg("EZSP version response (extended confirm)")
-		if len(resp) < 4 {
-			return 0, 0, 0, fmt.Errorf("extended confirm response too short: %d", len(resp))
-		}
-		log.Info().Msg("Extended EZSP frame format confirmed")
+	log.Debug().Msg("Sending extended-format version command to confirm format switch")
+	resp, err = e.SendCommand(ezspVersion, []byte{protocolVersion})
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("extended format confirmation: %w", err)
+	}
+	log.Debug().
+		Int("len", len(resp)).
+		Str("raw", hex.EncodeToString(resp)).
+		Msg("EZSP version response (extended confirm)")
+	if len(resp) < 4 {
+		return 0, 0, 0, fmt.Errorf("extended confirm response too short: %d", len(resp))
+	}
+	log.Info().Msg("Extended EZSP frame format confirmed")
+
+	if protocolVersion > ezspMaxProtocolVersion {
+		log.Warn().
+			Uint8("protocol", protocolVersion).
+			Msgf("EZSP version newer than v%d, using the v%d layouts", ezspMaxProtocolVersion, ezspMaxProtocolVersion)
 	}
 
+	e.codecMu.Lock()
+	e.protocolVersion = protocolVersion
+	e.codecV = codecFor(protocolVersion)
+	e.stackType = stackType
+	e.stackVersion = stackVersion
+	e.codecMu.Unlock()
+
 	return protocolVersion, stackType, stackVersion, nil
 }
 
+// Version returns the protocol version, stack type and stack version
+// recorded by the last successful NegotiateVersion.
+func (e *EZSPLayer) Version() (protocol uint8, stackType uint8, stackVersion uint16) {
+	e.codecMu.RLock()
+	defer e.codecMu.RUnlock()
+	return e.protocolVersion, e.stackType, e.stackVersion
+}
+
+// GetValue reads an EZSP value (e.g. EZSP_VALUE_VERSION_INFO) from the NCP.
+func (e *EZSPLayer) GetValue(valueID uint8) ([]byte, error) {
+	resp, err := e.SendCommand(ezspGetValue, []byte{valueID})
+	if err != nil {
+		return nil, err
+	}
+	// Response: status + valueLength(1) + value
+	status, data, err := e.codec().status(resp)
+	if err != nil {
+		return nil, fmt.Errorf("getValue 0x%02X response empty", valueID)
+	}
+	if status != emberSuccess {
+		return nil, fmt.Errorf("getValue 0x%02X failed: status 0x%02X", valueID, status)
+	}
+	value, err := lvBytes(data)
+	if err != nil {
+		return nil, fmt.Errorf("getValue 0x%02X: %w", valueID, err)
+	}
+	return value, nil
+}
+
+// GetMfgToken reads a manufacturing token (e.g. board name) from the NCP.
+func (e *EZSPLayer) GetMfgToken(tokenID uint8) ([]byte, error) {
+	resp, err := e.SendCommand(ezspGetMfgToken, []byte{tokenID})
+	if err != nil {
+		return nil, err
+	}
+	if len(resp) < 1 {
+		return nil, fmt.Errorf("getMfgToken 0x%02X response empty", tokenID)
+	}
+	n := int(resp[0])
+	if len(resp) < 1+n {
+		return nil, fmt.Errorf("getMfgToken 0x%02X response truncated", tokenID)
+	}
+	return resp[1 : 1+n], nil
+}
+
 // SetConfigValue sets an EZSP stack configuration value.
 func (e *EZSPLayer) SetConfigValue(configID uint8, value uint16) error {
 	params := []byte{configID, byte(value), byte(value >> 8)}
@@ -409,14 +651,7 @@ func (e *EZSPLayer) SetConfigValue(configID uint8, value uint16) error {
 	if err != nil {
 		return err
 	}
-	if len(resp) < 1 || resp[0] != emberSuccess {
-		status := byte(0xFF)
-		if len(resp) >= 1 {
-			status = resp[0]
-		}
-		return fmt.Errorf("setConfigurationValue 0x%02X failed: status 0x%02X", configID, status)
-	}
-	return nil
+	return e.checkStatus(fmt.Sprintf("setConfigurationValue 0x%02X", configID), resp)
 }
 
 // ConfigureStack sets up the NCP stack configuration for a coordinator.
@@ -443,34 +678,35 @@ func (e *EZSPLayer) ConfigureStack() error {
 }
 
 // GetNetworkParameters retrieves the current network state and parameters.
-func (e *EZSPLayer) GetNetworkParameters() (uint8, *NetworkParams, error) {
+func (e *EZSPLayer) GetNetworkParameters() (uint32, *NetworkParams, error) {
 	resp, err := e.SendCommand(ezspGetNetworkParameters, nil)
 	if err != nil {
 		return 0, nil, err
 	}
 
-	if len(resp) < 2 {
+	status, resp, err := e.codec().status(resp)
+	if err != nil || len(resp) < 1 {
 		return 0, nil, fmt.Errorf("network params response too short")
 	}
-
-	status := resp[0]
-	nodeType := resp[1]
-
-	var params NetworkParams
-	if len(resp) >= 18 {
-		copy(params.ExtendedPanID[:], resp[2:10])
-		params.PanID = binary.LittleEndian.Uint16(resp[10:12])
-		params.RadioTxPower = int8(resp[12])
-		params.RadioChannel = resp[13]
+	nodeType := resp[0]
+	resp = resp[1:]
+
+	// EmberNetworkParameters: extPanID(8) + panID(2) + txPower(1) + channel(1) +
+	// joinMethod(1) + nwkManagerID(2) + nwkUpdateID(1) + channels(4)
+	params := NetworkParams{NodeType: nodeType}
+	if len(resp) >= 12 {
+		copy(params.ExtendedPanID[:], resp[0:8])
+		params.PanID = binary.LittleEndian.Uint16(resp[8:10])
+		params.RadioTxPower = int8(resp[10])
+		params.RadioChannel = resp[11]
+	}
+	if len(resp) >= 20 {
+		params.NwkManagerID = binary.LittleEndian.Uint16(resp[13:15])
+		params.NwkUpdateID = resp[15]
+		params.Channels = binary.LittleEndian.Uint32(resp[16:20])
 	}
 
-	return status, &NetworkParams{
-		NodeType:      nodeType,
-		ExtendedPanID: params.ExtendedPanID,
-		PanID:         params.PanID,
-		RadioTxPower:  params.RadioTxPower,
-		RadioChannel:  params.RadioChannel,
-	}, nil
+	return status, &params, nil
 }
 
 // NetworkParams holds Zigbee network parameters.
@@ -480,73 +716,98 @@ type NetworkParams struct {
 	PanID         uint16
 	RadioTxPower  int8
 	RadioChannel  uint8
+	NwkManagerID  uint16
+	NwkUpdateID   uint8
+	Channels      uint32 // channel mask, bit N = channel N
 }
 
 // NetworkInit tries to resume an existing network.
-func (e *EZSPLayer) NetworkInit() (uint8, error) {
+func (e *EZSPLayer) NetworkInit() (uint32, error) {
 	// networkInitStruct: bitmask (2 bytes) = 0x0000
 	params := []byte{0x00, 0x00}
 	resp, err := e.SendCommand(ezspNetworkInit, params)
 	if err != nil {
 		return 0, err
 	}
-	if len(resp) < 1 {
+	status, _, err := e.codec().status(resp)
+	if err != nil {
 		return 0, fmt.Errorf("networkInit response empty")
 	}
-	return resp[0], nil
+	return status, nil
 }
 
-// SetInitialSecurityState configures the NCP's security parameters before
-// forming or joining a network. Must be called before FormNetwork.
-func (e *EZSPLayer) SetInitialSecurityState() error {
-	// EmberInitialSecurityState:
-	//   bitmask (2) + preconfiguredKey (16) + networkKey (16) +
-	//   keySequence (1) + preconfiguredTrustCenterEui64 (8)
+// InitialSecurityState mirrors EmberInitialSecurityState.
+type InitialSecurityState struct {
+	Bitmask          uint16
+	PreconfiguredKey [16]byte
+	NetworkKey       [16]byte
+	KeySequence      uint8
+	TrustCenterEUI64 [8]byte // all zeros = use local
+}
+
+// wellKnownLinkKey is the Zigbee 3.0 default TC link key "ZigBeeAlliance09".
+var wellKnownLinkKey = [16]byte{
+	0x5A, 0x69, 0x67, 0x42, 0x65, 0x65, 0x41, 0x6C,
+	0x6C, 0x69, 0x61, 0x6E, 0x63, 0x65, 0x30, 0x39,
+}
 
+// DefaultSecurityState returns the coordinator security state used when
+// forming a fresh network: well-known TC link key and a random network key.
+func DefaultSecurityState() InitialSecurityState {
 	// Bitmask for EZSP v8+ (from Gecko SDK ember-types.h):
 	// HAVE_PRECONFIGURED_KEY (0x0100) | HAVE_NETWORK_KEY (0x0200) |
 	// TRUST_CENTER_GLOBAL_LINK_KEY (0x0004)
-	bitmask := uint16(0x0100 | 0x0200 | 0x0004)
-
-	params := make([]byte, 0, 43)
-	params = append(params, byte(bitmask), byte(bitmask>>8))
-
-	// Preconfigured key = well-known TC link key "ZigBeeAlliance09"
-	wellKnownKey := []byte{0x5A, 0x69, 0x67, 0x42, 0x65, 0x65, 0x41, 0x6C,
-		0x6C, 0x69, 0x61, 0x6E, 0x63, 0x65, 0x30, 0x39}
-	params = append(params, wellKnownKey...)
-
+	st := InitialSecurityState{
+		Bitmask:          emberHavePreconfiguredKey | emberHaveNetworkKey | emberTrustCenterGlobalLinkKey,
+		PreconfiguredKey: wellKnownLinkKey,
+	}
 	// Network key = random (let NCP generate, but we must provide 16 bytes)
-	var nwkKey [16]byte
-	for i := range nwkKey {
-		nwkKey[i] = byte(rand.Intn(256))
+	for i := range st.NetworkKey {
+		st.NetworkKey[i] = byte(rand.Intn(256))
 	}
-	params = append(params, nwkKey[:]...)
-
-	params = append(params, 0x00) // keySequence
+	return st
+}
 
-	// Trust Center EUI64 = all zeros (use local)
-	params = append(params, 0, 0, 0, 0, 0, 0, 0, 0)
+// SetInitialSecurityState configures the NCP's security parameters before
+// forming or joining a network. Must be called before FormNetwork.
+func (e *EZSPLayer) SetInitialSecurityState(st InitialSecurityState) error {
+	// EmberInitialSecurityState:
+	//   bitmask (2) + preconfiguredKey (16) + networkKey (16) +
+	//   keySequence (1) + preconfiguredTrustCenterEui64 (8)
+	params := make([]byte, 0, 43)
+	params = append(params, byte(st.Bitmask), byte(st.Bitmask>>8))
+	params = append(params, st.PreconfiguredKey[:]...)
+	params = append(params, st.NetworkKey[:]...)
+	params = append(params, st.KeySequence)
+	params = append(params, st.TrustCenterEUI64[:]...)
 
 	resp, err := e.SendCommand(ezspSetInitialSecurityState, params)
 	if err != nil {
 		return err
 	}
-	if len(resp) < 1 || resp[0] != emberSuccess {
-		status := byte(0xFF)
-		if len(resp) >= 1 {
-			status = resp[0]
-		}
-		return fmt.Errorf("setInitialSecurityState failed: status 0x%02X", status)
+	if err := e.checkStatus("setInitialSecurityState", resp); err != nil {
+		return err
 	}
 	return nil
 }
 
 // ImportTransientKey loads a transient link key into the NCP for a joining device.
-// In EZSP v12+, this replaces the deprecated addTransientLinkKey.
+// In EZSP v13+, this replaces the deprecated addTransientLinkKey.
 // The NCP uses this key to encrypt the APS Transport Key sent to joining devices.
 // Use eui64 all-zeros as a wildcard to apply to any joining device.
 func (e *EZSPLayer) ImportTransientKey(eui64 [8]byte, key [16]byte) error {
+	if !e.securityManagerV13() {
+		// addTransientLinkKey: eui64(8) + key(16)
+		params := make([]byte, 0, 24)
+		params = append(params, eui64[:]...)
+		params = append(params, key[:]...)
+		resp, err := e.SendCommand(ezspAddTransientLinkKey, params)
+		if err != nil {
+			return err
+		}
+		return e.checkStatus("addTransientLinkKey", resp)
+	}
+
 	// params: eui64(8) + plaintext_key(16) + flags(1)
 	params := make([]byte, 0, 25)
 	params = append(params, eui64[:]...)
@@ -557,12 +818,11 @@ func (e *EZSPLayer) ImportTransientKey(eui64 [8]byte, key [16]byte) error {
 	if err != nil {
 		return err
 	}
-	if len(resp) < 1 || resp[0] != emberSuccess {
-		status := byte(0xFF)
-		if len(resp) >= 1 {
-			status = resp[0]
-		}
-		return fmt.Errorf("importTransientKey failed: status 0x%02X", status)
+	if len(resp) < 4 {
+		return fmt.Errorf("importTransientKey response too short: %d bytes", len(resp))
+	}
+	if status := binary.LittleEndian.Uint32(resp[0:4]); status != slStatusOK {
+		return fmt.Errorf("importTransientKey failed: status 0x%04X", status)
 	}
 	return nil
 }
@@ -575,44 +835,41 @@ func (e *EZSPLayer) LeaveNetwork() error {
 	if err != nil {
 		return err
 	}
-	if len(resp) < 1 || resp[0] != emberSuccess {
-		status := byte(0xFF)
-		if len(resp) >= 1 {
-			status = resp[0]
-		}
-		return fmt.Errorf("leaveNetwork failed: status 0x%02X", status)
+	if err := e.checkStatus("leaveNetwork", resp); err != nil {
+		return err
 	}
 	return nil
 }
 
-// FormNetwork creates a new Zigbee network.
-func (e *EZSPLayer) FormNetwork(channel uint8, panID uint16, extPanID [8]byte) error {
+// FormNetwork creates a new Zigbee network. NodeType and Channels are ignored;
+// a zero NwkManagerID means "none" (0xFFFF).
+func (e *EZSPLayer) FormNetwork(p NetworkParams) error {
+	managerID := p.NwkManagerID
+	if managerID == 0 {
+		managerID = 0xFFFF
+	}
 	// EmberNetworkParameters struct for formNetwork
 	params := make([]byte, 0, 32)
-	params = append(params, extPanID[:]...)              // extendedPanId (8)
-	params = append(params, byte(panID), byte(panID>>8)) // panId (2)
-	params = append(params, 3)                           // radioTxPower (1)
-	params = append(params, channel)                     // radioChannel (1)
-	params = append(params, 0x00)                        // joinMethod: USE_MAC_ASSOCIATION (1)
-	params = append(params, 0xFF, 0xFF)                  // nwkManagerId (2)
-	params = append(params, 0x00)                        // nwkUpdateId (1)
-	params = append(params, 0x00, 0x00, 0x00, 0x00)      // channels (4) - not used for form
+	params = append(params, p.ExtendedPanID[:]...)               // extendedPanId (8)
+	params = append(params, byte(p.PanID), byte(p.PanID>>8))     // panId (2)
+	params = append(params, byte(p.RadioTxPower))                // radioTxPower (1)
+	params = append(params, p.RadioChannel)                      // radioChannel (1)
+	params = append(params, 0x00)                                // joinMethod: USE_MAC_ASSOCIATION (1)
+	params = append(params, byte(managerID), byte(managerID>>8)) // nwkManagerId (2)
+	params = append(params, p.NwkUpdateID)                       // nwkUpdateId (1)
+	params = append(params, 0x00, 0x00, 0x00, 0x00)              // channels (4) - not used for form
 
 	resp, err := e.SendCommand(ezspFormNetwork, params)
 	if err != nil {
 		return err
 	}
-	if len(resp) < 1 || resp[0] != emberSuccess {
-		status := byte(0xFF)
-		if len(resp) >= 1 {
-			status = resp[0]
-		}
-		return fmt.Errorf("formNetwork failed: status 0x%02X", status)
+	if err := e.checkStatus("formNetwork", resp); err != nil {
+		return err
 	}
 
 	log.Info().
-		Uint8("channel", channel).
-		Uint16("panID", panID).
+		Uint8("channel", p.RadioChannel).
+		Uint16("panID", p.PanID).
 		Msg("Network formed")
 
 	return nil
@@ -625,12 +882,8 @@ func (e *EZSPLayer) PermitJoining(duration uint8) error {
 	if err != nil {
 		return err
 	}
-	if len(resp) < 1 || resp[0] != emberSuccess {
-		status := byte(0xFF)
-		if len(resp) >= 1 {
-			status = resp[0]
-		}
-		return fmt.Errorf("permitJoining failed: status 0x%02X", status)
+	if err := e.checkStatus("permitJoining", resp); err != nil {
+		return err
 	}
 	return nil
 }
@@ -649,33 +902,29 @@ func (e *EZSPLayer) GetEUI64() ([8]byte, error) {
 	return eui, nil
 }
 
-// SendUnicast sends a unicast message to a device.
+// SendUnicast sends a unicast message to a device without tracking delivery.
 func (e *EZSPLayer) SendUnicast(nodeID uint16, profileID, clusterID uint16, srcEndpoint, dstEndpoint uint8, payload []byte) error {
-	// EmberApsFrame structure
-	apsFrame := make([]byte, 0, 12)
-	apsFrame = append(apsFrame, byte(profileID), byte(profileID>>8)) // profileId
-	apsFrame = append(apsFrame, byte(clusterID), byte(clusterID>>8)) // clusterId
-	apsFrame = append(apsFrame, srcEndpoint)                         // sourceEndpoint
-	apsFrame = append(apsFrame, dstEndpoint)                         // destinationEndpoint
-	options := uint16(emberApsOptionRetry | emberApsOptionEnableRouteDiscovery)
-	apsFrame = append(apsFrame, byte(options), byte(options>>8)) // options
-	apsFrame = append(apsFrame, 0x00, 0x00)                      // groupId
+	return e.SendUnicastTagged(nodeID, profileID, clusterID, srcEndpoint, dstEndpoint, payload, untrackedMessageTag)
+}
+
+// SendUnicastTagged sends a unicast message carrying the given message tag.
+// The NCP echoes the tag in messageSentHandler once the APS ack arrives (or
+// retries are exhausted), which lets the caller correlate delivery results.
+func (e *EZSPLayer) SendUnicastTagged(nodeID uint16, profileID, clusterID uint16, srcEndpoint, dstEndpoint uint8, payload []byte, tag uint8) error {
 	// APS frame counter is managed by the NCP stack (BDB 6.2 / R23.2 §2.2.7).
-	// No host-side tracking is needed.
-	apsFrame = append(apsFrame, 0x00) // sequence (filled by stack)
-
-	// Build sendUnicast params:
-	// type (1) + indexOrDestination (2) + apsFrame (12) + messageTag (1) + messageLength (1) + message
-	params := make([]byte, 0, 4+len(apsFrame)+2+len(payload))
-	params = append(params, 0x00)                          // EMBER_OUTGOING_DIRECT
-	params = append(params, byte(nodeID), byte(nodeID>>8)) // destination
-	params = append(params, apsFrame...)
-	params = append(params, 0x01)               // messageTag
-	params = append(params, byte(len(payload))) // messageLength
-	params = append(params, payload...)
+	// No host-side tracking is needed; the sequence is filled by the stack.
+	aps := apsFrame{
+		profileID:   profileID,
+		clusterID:   clusterID,
+		srcEndpoint: srcEndpoint,
+		dstEndpoint: dstEndpoint,
+		options:     emberApsOptionRetry | emberApsOptionEnableRouteDiscovery,
+	}
+	params := e.codec().sendUnicast(nodeID, aps, tag, payload)
 
 	log.Info().
 		Uint16("nodeID", nodeID).
+		Uint8("tag", tag).
 		Uint16("profileID", profileID).
 		Uint16("clusterID", clusterID).
 		Uint8("srcEP", srcEndpoint).
@@ -689,13 +938,9 @@ func (e *EZSPLayer) SendUnicast(nodeID uint16, profileID, clusterID uint16, srcE
 		log.Error().Err(err).Uint16("nodeID", nodeID).Msg("EZSP SendUnicast command failed")
 		return err
 	}
-	if len(resp) < 1 || resp[0] != emberSuccess {
-		status := byte(0xFF)
-		if len(resp) >= 1 {
-			status = resp[0]
-		}
-		log.Error().Uint8("status", status).Uint16("nodeID", nodeID).Msg("EZSP SendUnicast NCP rejected")
-		return fmt.Errorf("sendUnicast failed: status 0x%02X", status)
+	if err := e.checkStatus("sendUnicast", resp); err != nil {
+		log.Error().Err(err).Uint16("nodeID", nodeID).Msg("EZSP SendUnicast NCP rejected")
+		return err
 	}
 	log.Info().Uint16("nodeID", nodeID).Msg("EZSP SendUnicast accepted by NCP")
 	return nil
@@ -728,14 +973,7 @@ func (e *EZSPLayer) AddEndpoint(endpoint uint8, profileID uint16, deviceID uint1
 	if err != nil {
 		return err
 	}
-	if len(resp) < 1 || resp[0] != emberSuccess {
-		status := byte(0xFF)
-		if len(resp) >= 1 {
-			status = resp[0]
-		}
-		return fmt.Errorf("addEndpoint failed: status 0x%02X", status)
-	}
-	return nil
+	return e.checkStatus("addEndpoint", resp)
 }
 
 // SetPolicy sets an EZSP Trust Center or stack policy (BDB 5.6.1).
@@ -745,14 +983,7 @@ func (e *EZSPLayer) SetPolicy(policyID uint8, decisionID uint8) error {
 	if err != nil {
 		return err
 	}
-	if len(resp) < 1 || resp[0] != emberSuccess {
-		status := byte(0xFF)
-		if len(resp) >= 1 {
-			status = resp[0]
-		}
-		return fmt.Errorf("setPolicy 0x%02X failed: status 0x%02X", policyID, status)
-	}
-	return nil
+	return e.checkStatus(fmt.Sprintf("setPolicy 0x%02X", policyID), resp)
 }
 
 // GetNodeID retrieves the coordinator's short network address.
@@ -780,123 +1011,34 @@ func (e *EZSPLayer) LookupNodeIDByEUI64(eui64 [8]byte) (uint16, error) {
 	return binary.LittleEndian.Uint16(resp[0:2]), nil
 }
 
-// EnergyScan performs an IEEE 802.15.4 energy scan across the given channel mask
-// and returns the channel with the lowest detected energy (BDB 8.1).
-func (e *EZSPLayer) EnergyScan(channelMask uint32, duration uint8) (uint8, error) {
-	type scanResult struct {
-		channel uint8
-		rssi    int8
-	}
-
-	results := make(chan scanResult, 27)
-	done := make(chan uint8, 1)
-
-	e.callbackMu.RLock()
-	origHandler := e.callbackHandler
-	e.callbackMu.RUnlock()
-
-	e.callbackMu.Lock()
-	e.callbackHandler = func(frameID uint16, data []byte) {
-		switch frameID {
-		case ezspEnergyScanResultHandler:
-			if len(data) >= 2 {
-				results <- scanResult{channel: data[0], rssi: int8(data[1])}
-			}
-		case ezspScanCompleteHandler:
-			if len(data) >= 1 {
-				done <- data[0]
-			}
-		default:
-			if origHandler != nil {
-				origHandler(frameID, data)
-			}
-		}
-	}
-	e.callbackMu.Unlock()
-
-	defer func() {
-		e.callbackMu.Lock()
-		e.callbackHandler = origHandler
-		e.callbackMu.Unlock()
-	}()
-
-	params := make([]byte, 7)
-	params[0] = ezspEnergyScan
-	binary.LittleEndian.PutUint32(params[1:5], channelMask)
-	params[5] = duration
-	params[6] = 0
-
-	resp, err := e.SendCommand(ezspStartScan, params)
+// SetRadioChannel moves the NCP to another channel without notifying the network.
+func (e *EZSPLayer) SetRadioChannel(channel uint8) error {
+	resp, err := e.SendCommand(ezspSetRadioChannel, []byte{channel})
 	if err != nil {
-		return 0, fmt.Errorf("startScan: %w", err)
-	}
-	if len(resp) < 1 || resp[0] != emberSuccess {
-		status := byte(0xFF)
-		if len(resp) >= 1 {
-			status = resp[0]
-		}
-		return 0, fmt.Errorf("startScan failed: status 0x%02X", status)
+		return err
 	}
-
-	var bestChannel uint8
-	bestRSSI := int8(127)
-
-	timeout := time.After(30 * time.Second)
-	for {
-		select {
-		case r := <-results:
-			log.Debug().Uint8("channel", r.channel).Int8("rssi", r.rssi).Msg("Energy scan result")
-			if r.rssi < bestRSSI {
-				bestRSSI = r.rssi
-				bestChannel = r.channel
-			}
-		case status := <-done:
-			if status != emberSuccess {
-				log.Warn().Uint8("status", status).Msg("Scan completed with error")
-			}
-			if bestChannel == 0 {
-				return 0, fmt.Errorf("no channels found in energy scan")
-			}
-			log.Info().Uint8("channel", bestChannel).Int8("rssi", bestRSSI).Msg("Best channel from energy scan")
-			return bestChannel, nil
-		case <-timeout:
-			return 0, fmt.Errorf("energy scan timed out")
-		case <-e.stopChan:
-			return 0, fmt.Errorf("stopped")
-		}
+	if err := e.checkStatus(fmt.Sprintf("setRadioChannel %d", channel), resp); err != nil {
+		return err
 	}
+	return nil
 }
 
 // SendBroadcast sends a broadcast message (used for ZDO Device_annce etc).
 func (e *EZSPLayer) SendBroadcast(destination uint16, profileID, clusterID uint16, srcEndpoint, dstEndpoint uint8, payload []byte, radius uint8) error {
-	apsFrame := make([]byte, 0, 12)
-	apsFrame = append(apsFrame, byte(profileID), byte(profileID>>8))
-	apsFrame = append(apsFrame, byte(clusterID), byte(clusterID>>8))
-	apsFrame = append(apsFrame, srcEndpoint)
-	apsFrame = append(apsFrame, dstEndpoint)
-	options := uint16(0)
-	apsFrame = append(apsFrame, byte(options), byte(options>>8))
-	apsFrame = append(apsFrame, 0x00, 0x00) // groupId
-	apsFrame = append(apsFrame, 0x00)       // sequence (filled by stack)
-
-	params := make([]byte, 0, 2+len(apsFrame)+3+len(payload))
-	params = append(params, byte(destination), byte(destination>>8))
-	params = append(params, apsFrame...)
-	params = append(params, radius)
-	params = append(params, 0x01)               // messageTag
-	params = append(params, byte(len(payload))) // messageLength
-	params = append(params, payload...)
+	aps := apsFrame{
+		profileID:   profileID,
+		clusterID:   clusterID,
+		srcEndpoint: srcEndpoint,
+		dstEndpoint: dstEndpoint,
+	}
+	params := e.codec().sendBroadcast(destination, aps, radius, 0x01, payload)
 
 	resp, err := e.SendCommand(ezspSendBroadcast, params)
 	if err != nil {
 		return err
 	}
-	if len(resp) < 1 || resp[0] != emberSuccess {
-		status := byte(0xFF)
-		if len(resp) >= 1 {
-			status = resp[0]
-		}
-		return fmt.Errorf("sendBroadcast failed: status 0x%02X", status)
+	if err := e.checkStatus("sendBroadcast", resp); err != nil {
+		return err
 	}
 	return nil
 }
@@ -0,0 +1,295 @@
+package zigbee
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/urmzd/zigbee-skill/pkg/device"
+)
+
+// Supported EZSP protocol versions. v8 (EmberZNet 6.7) introduced the extended
+// frame format this host speaks; v14 (EmberZNet 8.0) widened EmberStatus to the
+// 4-byte sl_status_t and reworked the message structures. NCPs newer than
+// ezspMaxProtocolVersion are driven with the v14 codec.
+const (
+	ezspMinProtocolVersion = 8
+	ezspMaxProtocolVersion = 14
+)
+
+// ezspFrameDef names a frame ID and the protocol versions that define it.
+type ezspFrameDef struct {
+	name  string
+	since uint8 // first version with the frame
+	until uint8 // last version with the frame; 0 = still current
+}
+
+// ezspFrames lists the frames this host sends, so that a command the NCP's
+// protocol version lacks fails up front instead of timing out.
+var ezspFrames = map[uint16]ezspFrameDef{
+	ezspVersion:                   {name: "version"},
+	ezspAddEndpoint:               {name: "addEndpoint", since: 8},
+	ezspSetConfigurationValue:     {name: "setConfigurationValue", since: 8},
+	ezspGetConfigurationValue:     {name: "getConfigurationValue", since: 8},
+	ezspGetNetworkParameters:      {name: "getNetworkParameters", since: 8},
+	ezspNetworkInit:               {name: "networkInit", since: 8},
+	ezspStartScan:                 {name: "startScan", since: 8},
+	ezspLeaveNetwork:              {name: "leaveNetwork", since: 8},
+	ezspFormNetwork:               {name: "formNetwork", since: 8},
+	ezspPermitJoining:             {name: "permitJoining", since: 8},
+	ezspSendUnicast:               {name: "sendUnicast", since: 8},
+	ezspSendBroadcast:             {name: "sendBroadcast", since: 8},
+	ezspGetEUI64:                  {name: "getEui64", since: 8},
+	ezspSetPolicy:                 {name: "setPolicy", since: 8},
+	ezspSetInitialSecurityState:   {name: "setInitialSecurityState", since: 8},
+	ezspGetNodeID:                 {name: "getNodeId", since: 8},
+	ezspLookupNodeIDByEUI64:       {name: "lookupNodeIdByEui64", since: 8},
+	ezspGetValue:                  {name: "getValue", since: 8},
+	ezspSetValue:                  {name: "setValue", since: 8},
+	ezspGetMfgToken:               {name: "getMfgToken", since: 8},
+	ezspSetMfgToken:               {name: "setMfgToken", since: 8},
+	ezspGetChildData:              {name: "getChildData", since: 8},
+	ezspSetRadioChannel:           {name: "setRadioChannel", since: 8},
+	ezspUnicastCurrentNetworkKey:  {name: "unicastCurrentNetworkKey", since: 8},
+	ezspBroadcastNextNetworkKey:   {name: "broadcastNextNetworkKey", since: 8},
+	ezspBroadcastNetworkKeySwitch: {name: "broadcastNetworkKeySwitch", since: 8},
+
+	// Replaced by the security manager in v13.
+	ezspGetKey:              {name: "getKey", since: 8, until: 12},
+	ezspGetKeyTableEntry:    {name: "getKeyTableEntry", since: 8, until: 12},
+	ezspSetKeyTableEntry:    {name: "setKeyTableEntry", since: 8, until: 12},
+	ezspAddTransientLinkKey: {name: "addTransientLinkKey", since: 8, until: 12},
+
+	ezspImportTransientKey:   {name: "importTransientKey", since: 13},
+	ezspImportLinkKey:        {name: "importLinkKey", since: 13},
+	ezspExportLinkKeyByIndex: {name: "exportLinkKeyByIndex", since: 13},
+	ezspExportKey:            {name: "exportKey", since: 13},
+	ezspGetNetworkKeyInfo:    {name: "getNetworkKeyInfo", since: 13},
+}
+
+// checkFrame reports an error if version does not define frameID. Version 0
+// means negotiation has not happened yet; anything goes.
+func checkFrame(frameID uint16, version uint8) error {
+	def, ok := ezspFrames[frameID]
+	if !ok || version == 0 {
+		return nil
+	}
+	if version < def.since || (def.until != 0 && version > def.until) {
+		return fmt.Errorf("%w: %s is not available in EZSP v%d", device.ErrUnsupported, def.name, version)
+	}
+	return nil
+}
+
+// apsFrame mirrors EmberApsFrame (11 bytes on the wire).
+type apsFrame struct {
+	profileID   uint16
+	clusterID   uint16
+	srcEndpoint uint8
+	dstEndpoint uint8
+	options     uint16
+	groupID     uint16
+	sequence    uint8
+}
+
+func (f apsFrame) appendTo(b []byte) []byte {
+	b = append(b, byte(f.profileID), byte(f.profileID>>8))
+	b = append(b, byte(f.clusterID), byte(f.clusterID>>8))
+	b = append(b, f.srcEndpoint, f.dstEndpoint)
+	b = append(b, byte(f.options), byte(f.options>>8))
+	b = append(b, byte(f.groupID), byte(f.groupID>>8))
+	return append(b, f.sequence)
+}
+
+func decodeAPSFrame(b []byte) apsFrame {
+	return apsFrame{
+		profileID:   binary.LittleEndian.Uint16(b[0:2]),
+		clusterID:   binary.LittleEndian.Uint16(b[2:4]),
+		srcEndpoint: b[4],
+		dstEndpoint: b[5],
+		options:     binary.LittleEndian.Uint16(b[6:8]),
+		groupID:     binary.LittleEndian.Uint16(b[8:10]),
+		sequence:    b[10],
+	}
+}
+
+// incomingMessage is a decoded incomingMessageHandler callback.
+type incomingMessage struct {
+	msgType uint8
+	aps     apsFrame
+	lqi     uint8
+	rssi    int8
+	sender  uint16
+	message []byte
+}
+
+// messageSent is a decoded messageSentHandler callback.
+type messageSent struct {
+	msgType     uint8
+	destination uint16
+	aps         apsFrame
+	tag         uint8
+	status      uint32
+}
+
+// ezspCodec encodes and decodes the structures whose layout depends on the
+// negotiated protocol version. Message tags stay one byte on the host side;
+// v14 widens them on the wire.
+type ezspCodec interface {
+	// status splits the leading EmberStatus (sl_status_t from v14) off a
+	// response or callback.
+	status(b []byte) (uint32, []byte, error)
+	sendUnicast(destination uint16, aps apsFrame, tag uint8, payload []byte) []byte
+	sendBroadcast(destination uint16, aps apsFrame, radius, tag uint8, payload []byte) []byte
+	incomingMessage(b []byte) (incomingMessage, error)
+	messageSent(b []byte) (messageSent, error)
+}
+
+// codecFor returns the codec for a negotiated protocol version.
+func codecFor(version uint8) ezspCodec {
+	if version >= 14 {
+		return ezspCodecV14{}
+	}
+	return ezspCodecV8{}
+}
+
+// lvBytes splits a length-prefixed byte string off b.
+func lvBytes(b []byte) ([]byte, error) {
+	if len(b) < 1 || len(b) < 1+int(b[0]) {
+		return nil, fmt.Errorf("message truncated")
+	}
+	return b[1 : 1+int(b[0])], nil
+}
+
+// ezspCodecV8 covers EZSP v8 through v13 (EmberZNet 6.7 to 7.4).
+type ezspCodecV8 struct{}
+
+func (ezspCodecV8) status(b []byte) (uint32, []byte, error) {
+	if len(b) < 1 {
+		return 0, nil, fmt.Errorf("status missing")
+	}
+	return uint32(b[0]), b[1:], nil
+}
+
+// sendUnicast: type(1) + indexOrDestination(2) + apsFrame(11) + messageTag(1) +
+// messageLength(1) + message
+func (ezspCodecV8) sendUnicast(destination uint16, aps apsFrame, tag uint8, payload []byte) []byte {
+	b := make([]byte, 0, 16+len(payload))
+	b = append(b, 0x00) // EMBER_OUTGOING_DIRECT
+	b = append(b, byte(destination), byte(destination>>8))
+	b = aps.appendTo(b)
+	b = append(b, tag, byte(len(payload)))
+	return append(b, payload...)
+}
+
+// sendBroadcast: destination(2) + apsFrame(11) + radius(1) + messageTag(1) +
+// messageLength(1) + message
+func (ezspCodecV8) sendBroadcast(destination uint16, aps apsFrame, radius, tag uint8, payload []byte) []byte {
+	b := make([]byte, 0, 16+len(payload))
+	b = append(b, byte(destination), byte(destination>>8))
+	b = aps.appendTo(b)
+	b = append(b, radius, tag, byte(len(payload)))
+	return append(b, payload...)
+}
+
+// incomingMessage: type(1) + apsFrame(11) + lastHopLqi(1) + lastHopRssi(1) +
+// sender(2) + bindingIndex(1) + addressIndex(1) + messageLength(1) + message
+func (ezspCodecV8) incomingMessage(b []byte) (incomingMessage, error) {
+	if len(b) < 19 {
+		return incomingMessage{}, fmt.Errorf("incomingMessageHandler too short: %d bytes", len(b))
+	}
+	msg, err := lvBytes(b[18:])
+	if err != nil {
+		return incomingMessage{}, fmt.Errorf("incomingMessageHandler: %w", err)
+	}
+	return incomingMessage{
+		msgType: b[0],
+		aps:     decodeAPSFrame(b[1:12]),
+		lqi:     b[12],
+		rssi:    int8(b[13]),
+		sender:  binary.LittleEndian.Uint16(b[14:16]),
+		message: msg,
+	}, nil
+}
+
+// messageSent: type(1) + indexOrDestination(2) + apsFrame(11) + messageTag(1) +
+// status(1) + messageLength(1) + message
+func (ezspCodecV8) messageSent(b []byte) (messageSent, error) {
+	if len(b) < 16 {
+		return messageSent{}, fmt.Errorf("messageSentHandler too short: %d bytes", len(b))
+	}
+	return messageSent{
+		msgType:     b[0],
+		destination: binary.LittleEndian.Uint16(b[1:3]),
+		aps:         decodeAPSFrame(b[3:14]),
+		tag:         b[14],
+		status:      uint32(b[15]),
+	}, nil
+}
+
+// ezspCodecV14 covers EZSP v14 (EmberZNet 8.0) and later.
+type ezspCodecV14 struct{}
+
+func (ezspCodecV14) status(b []byte) (uint32, []byte, error) {
+	if len(b) < 4 {
+		return 0, nil, fmt.Errorf("status missing")
+	}
+	return binary.LittleEndian.Uint32(b[0:4]), b[4:], nil
+}
+
+// sendUnicast: type(1) + indexOrDestination(2) + apsFrame(11) + messageTag(2) +
+// messageLength(1) + message
+func (ezspCodecV14) sendUnicast(destination uint16, aps apsFrame, tag uint8, payload []byte) []byte {
+	b := make([]byte, 0, 17+len(payload))
+	b = append(b, 0x00) // EMBER_OUTGOING_DIRECT
+	b = append(b, byte(destination), byte(destination>>8))
+	b = aps.appendTo(b)
+	b = append(b, tag, 0x00, byte(len(payload)))
+	return append(b, payload...)
+}
+
+// sendBroadcast: alias(2) + destination(2) + nwkSequence(1) + apsFrame(11) +
+// radius(1) + messageTag(2) + messageLength(1) + message
+func (ezspCodecV14) sendBroadcast(destination uint16, aps apsFrame, radius, tag uint8, payload []byte) []byte {
+	b := make([]byte, 0, 20+len(payload))
+	b = append(b, 0xFF, 0xFF) // alias: null node ID, send as ourselves
+	b = append(b, byte(destination), byte(destination>>8))
+	b = append(b, 0x00) // nwkSequence, only used with an alias
+	b = aps.appendTo(b)
+	b = append(b, radius, tag, 0x00, byte(len(payload)))
+	return append(b, payload...)
+}
+
+// incomingMessage: type(1) + apsFrame(11) + EmberRxPacketInfo(senderShortId(2) +
+// senderLongId(8) + bindingIndex(1) + addressIndex(1) + lastHopLqi(1) +
+// lastHopRssi(1) + lastHopTimestamp(4)) + messageLength(1) + message
+func (ezspCodecV14) incomingMessage(b []byte) (incomingMessage, error) {
+	if len(b) < 31 {
+		return incomingMessage{}, fmt.Errorf("incomingMessageHandler too short: %d bytes", len(b))
+	}
+	msg, err := lvBytes(b[30:])
+	if err != nil {
+		return incomingMessage{}, fmt.Errorf("incomingMessageHandler: %w", err)
+	}
+	return incomingMessage{
+		msgType: b[0],
+		aps:     decodeAPSFrame(b[1:12]),
+		sender:  binary.LittleEndian.Uint16(b[12:14]),
+		lqi:     b[24],
+		rssi:    int8(b[25]),
+		message: msg,
+	}, nil
+}
+
+// messageSent: status(4) + type(1) + indexOrDestination(2) + apsFrame(11) +
+// messageTag(2) + messageLength(1) + message
+func (ezspCodecV14) messageSent(b []byte) (messageSent, error) {
+	if len(b) < 20 {
+		return messageSent{}, fmt.Errorf("messageSentHandler too short: %d bytes", len(b))
+	}
+	return messageSent{
+		status:      binary.LittleEndian.Uint32(b[0:4]),
+		msgType:     b[4],
+		destination: binary.LittleEndian.Uint16(b[5:7]),
+		aps:         decodeAPSFrame(b[7:18]),
+		tag:         b[18],
+	}, nil
+}
@@ -0,0 +1,334 @@
+package zigbee
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// EmberKeyType / sl_zb_sec_man_key_type values used when exporting keys.
+const (
+	emberKeyTypeTrustCenterLink uint8 = 0x01 // EMBER_TRUST_CENTER_LINK_KEY
+	emberKeyTypeCurrentNetwork  uint8 = 0x03 // EMBER_CURRENT_NETWORK_KEY
+
+	secManKeyTypeNetwork uint8 = 0x01 // SL_ZB_SEC_MAN_KEY_TYPE_NETWORK
+	secManKeyTypeTCLink  uint8 = 0x02 // SL_ZB_SEC_MAN_KEY_TYPE_TC_LINK
+
+	// slStatusOK is sl_status_t SL_STATUS_OK, returned by security manager commands.
+	slStatusOK uint32 = 0x0000
+)
+
+// KeyEntry is a network key or link key exported from the NCP together with
+// its frame counters.
+type KeyEntry struct {
+	PartnerEUI64         [8]byte
+	Key                  [16]byte
+	SequenceNumber       uint8
+	OutgoingFrameCounter uint32
+	IncomingFrameCounter uint32
+}
+
+// ChildEntry is a record from the NCP child table.
+type ChildEntry struct {
+	EUI64  [8]byte
+	Type   uint8 // EmberNodeType
+	NodeID uint16
+}
+
+// securityManagerV13 reports whether the NCP uses the EZSP v13 security manager
+// commands (exportKey, exportLinkKeyByIndex) instead of getKey/getKeyTableEntry.
+func (e *EZSPLayer) securityManagerV13() bool {
+	return e.protocolVersion >= 13
+}
+
+// GetConfigValue reads an EZSP stack configuration value.
+func (e *EZSPLayer) GetConfigValue(configID uint8) (uint16, error) {
+	resp, err := e.SendCommand(ezspGetConfigurationValue, []byte{configID})
+	if err != nil {
+		return 0, err
+	}
+	// Response: status + value(2)
+	status, data, err := e.codec().status(resp)
+	if err != nil || len(data) < 2 {
+		return 0, fmt.Errorf("getConfigurationValue 0x%02X response too short", configID)
+	}
+	if status != emberSuccess {
+		return 0, fmt.Errorf("getConfigurationValue 0x%02X failed: status 0x%02X", configID, status)
+	}
+	return binary.LittleEndian.Uint16(data[0:2]), nil
+}
+
+// SetValue writes an EZSP value (e.g. the NWK frame counter) on the NCP.
+func (e *EZSPLayer) SetValue(valueID uint8, value []byte) error {
+	params := make([]byte, 0, 2+len(value))
+	params = append(params, valueID, byte(len(value)))
+	params = append(params, value...)
+	resp, err := e.SendCommand(ezspSetValue, params)
+	if err != nil {
+		return err
+	}
+	return e.checkStatus(fmt.Sprintf("setValue 0x%02X", valueID), resp)
+}
+
+// SetMfgToken writes a manufacturing token. Tokens such as the custom EUI64
+// can only be written once on most adapters.
+func (e *EZSPLayer) SetMfgToken(tokenID uint8, data []byte) error {
+	params := make([]byte, 0, 2+len(data))
+	params = append(params, tokenID, byte(len(data)))
+	params = append(params, data...)
+	resp, err := e.SendCommand(ezspSetMfgToken, params)
+	if err != nil {
+		return err
+	}
+	if err := e.checkStatus(fmt.Sprintf("setMfgToken 0x%02X", tokenID), resp); err != nil {
+		return err
+	}
+	return nil
+}
+
+// GetNetworkKey exports the current network key, its sequence number and the
+// outgoing NWK frame counter.
+func (e *EZSPLayer) GetNetworkKey() (*KeyEntry, error) {
+	if !e.securityManagerV13() {
+		return e.getKey(emberKeyTypeCurrentNetwork)
+	}
+
+	key, err := e.exportKey(secManKeyTypeNetwork)
+	if err != nil {
+		return nil, err
+	}
+	// getNetworkKeyInfo response: status(4) + networkKeySet(1) + alternateKeySet(1) +
+	//   sequenceNumber(1) + altSequenceNumber(1) + frameCounter(4)
+	resp, err := e.SendCommand(ezspGetNetworkKeyInfo, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp) < 12 {
+		return nil, fmt.Errorf("getNetworkKeyInfo response too short: %d bytes", len(resp))
+	}
+	if status := binary.LittleEndian.Uint32(resp[0:4]); status != slStatusOK {
+		return nil, fmt.Errorf("getNetworkKeyInfo failed: status 0x%04X", status)
+	}
+	return &KeyEntry{
+		Key:                  key,
+		SequenceNumber:       resp[6],
+		OutgoingFrameCounter: binary.LittleEndian.Uint32(resp[8:12]),
+	}, nil
+}
+
+// GetTrustCenterLinkKey exports the preconfigured/global TC link key.
+func (e *EZSPLayer) GetTrustCenterLinkKey() (*KeyEntry, error) {
+	if !e.securityManagerV13() {
+		return e.getKey(emberKeyTypeTrustCenterLink)
+	}
+	key, err := e.exportKey(secManKeyTypeTCLink)
+	if err != nil {
+		return nil, err
+	}
+	return &KeyEntry{Key: key}, nil
+}
+
+// exportKey exports a key by security manager context (EZSP v13+).
+func (e *EZSPLayer) exportKey(keyType uint8) ([16]byte, error) {
+	// sl_zb_sec_man_context_t: coreKeyType(1) + keyIndex(1) + derivedType(2) +
+	//   eui64(8) + multiNetworkIndex(1) + flags(1) + psaKeyAlgPermission(4)
+	params := make([]byte, 18)
+	params[0] = keyType
+
+	var key [16]byte
+	resp, err := e.SendCommand(ezspExportKey, params)
+	if err != nil {
+		return key, err
+	}
+	// Response: key(16) + status(4)
+	if len(resp) < 20 {
+		return key, fmt.Errorf("exportKey response too short: %d bytes", len(resp))
+	}
+	if status := binary.LittleEndian.Uint32(resp[16:20]); status != slStatusOK {
+		return key, fmt.Errorf("exportKey 0x%02X failed: status 0x%04X", keyType, status)
+	}
+	copy(key[:], resp[0:16])
+	return key, nil
+}
+
+// getKey exports a key with the pre-v13 getKey command.
+func (e *EZSPLayer) getKey(keyType uint8) (*KeyEntry, error) {
+	resp, err := e.SendCommand(ezspGetKey, []byte{keyType})
+	if err != nil {
+		return nil, err
+	}
+	status, data, err := e.codec().status(resp)
+	if err != nil {
+		return nil, fmt.Errorf("getKey 0x%02X response empty", keyType)
+	}
+	if status != emberSuccess {
+		return nil, fmt.Errorf("getKey 0x%02X failed: status 0x%02X", keyType, status)
+	}
+	return parseEmberKeyStruct(data)
+}
+
+// parseEmberKeyStruct decodes EmberKeyStruct: bitmask(2) + type(1) + key(16) +
+// outgoingFrameCounter(4) + incomingFrameCounter(4) + sequenceNumber(1) + partnerEUI64(8).
+func parseEmberKeyStruct(b []byte) (*KeyEntry, error) {
+	if len(b) < 36 {
+		return nil, fmt.Errorf("EmberKeyStruct too short: %d bytes", len(b))
+	}
+	k := &KeyEntry{
+		OutgoingFrameCounter: binary.LittleEndian.Uint32(b[19:23]),
+		IncomingFrameCounter: binary.LittleEndian.Uint32(b[23:27]),
+		SequenceNumber:       b[27],
+	}
+	copy(k.Key[:], b[3:19])
+	copy(k.PartnerEUI64[:], b[28:36])
+	return k, nil
+}
+
+// GetLinkKeys exports every populated entry of the TC link key table.
+func (e *EZSPLayer) GetLinkKeys() ([]KeyEntry, error) {
+	size, err := e.GetConfigValue(ezspConfigKeyTableSize)
+	if err != nil {
+		return nil, err
+	}
+	var out []KeyEntry
+	for i := range int(size) {
+		k, err := e.getLinkKey(uint8(i))
+		if err != nil || k == nil {
+			continue // empty slot
+		}
+		out = append(out, *k)
+	}
+	return out, nil
+}
+
+// getLinkKey exports a single key table entry; returns nil for empty slots.
+func (e *EZSPLayer) getLinkKey(index uint8) (*KeyEntry, error) {
+	if !e.securityManagerV13() {
+		resp, err := e.SendCommand(ezspGetKeyTableEntry, []byte{index})
+		if err != nil {
+			return nil, err
+		}
+		status, data, err := e.codec().status(resp)
+		if err != nil || status != emberSuccess {
+			return nil, nil
+		}
+		return parseEmberKeyStruct(data)
+	}
+
+	resp, err := e.SendCommand(ezspExportLinkKeyByIndex, []byte{index})
+	if err != nil {
+		return nil, err
+	}
+	// Response: eui64(8) + key(16) + metadata(bitmask 2, outFC 4, inFC 4, ttl 2) + status(4)
+	if len(resp) < 40 {
+		return nil, fmt.Errorf("exportLinkKeyByIndex response too short: %d bytes", len(resp))
+	}
+	if status := binary.LittleEndian.Uint32(resp[36:40]); status != slStatusOK {
+		return nil, nil
+	}
+	k := &KeyEntry{
+		OutgoingFrameCounter: binary.LittleEndian.Uint32(resp[26:30]),
+		IncomingFrameCounter: binary.LittleEndian.Uint32(resp[30:34]),
+	}
+	copy(k.PartnerEUI64[:], resp[0:8])
+	copy(k.Key[:], resp[8:24])
+	return k, nil
+}
+
+// ImportLinkKey writes a TC link key for a device into the given key table slot.
+func (e *EZSPLayer) ImportLinkKey(index uint8, eui64 [8]byte, key [16]byte) error {
+	if !e.securityManagerV13() {
+		// setKeyTableEntry: index(1) + address(8) + linkKey(1 bool) + keyData(16)
+		params := make([]byte, 0, 26)
+		params = append(params, index)
+		params = append(params, eui64[:]...)
+		params = append(params, 0x01)
+		params = append(params, key[:]...)
+		resp, err := e.SendCommand(ezspSetKeyTableEntry, params)
+		if err != nil {
+			return err
+		}
+		return e.checkStatus(fmt.Sprintf("setKeyTableEntry %d", index), resp)
+	}
+
+	params := make([]byte, 0, 25)
+	params = append(params, index)
+	params = append(params, eui64[:]...)
+	params = append(params, key[:]...)
+	resp, err := e.SendCommand(ezspImportLinkKey, params)
+	if err != nil {
+		return err
+	}
+	if len(resp) < 4 {
+		return fmt.Errorf("importLinkKey response too short: %d bytes", len(resp))
+	}
+	if status := binary.LittleEndian.Uint32(resp[0:4]); status != slStatusOK {
+		return fmt.Errorf("importLinkKey %d failed: status 0x%04X", index, status)
+	}
+	return nil
+}
+
+// GetChildren reads every populated entry of the NCP child table.
+func (e *EZSPLayer) GetChildren() ([]ChildEntry, error) {
+	size, err := e.GetConfigValue(ezspConfigMaxEndDeviceChildren)
+	if err != nil {
+		return nil, err
+	}
+	var out []ChildEntry
+	for i := range int(size) {
+		resp, err := e.SendCommand(ezspGetChildData, []byte{uint8(i)})
+		if err != nil {
+			return out, err
+		}
+		// Response: status + EmberChildData: eui64(8) + type(1) + id(2) + ...
+		status, data, err := e.codec().status(resp)
+		if err != nil || status != emberSuccess || len(data) < 11 {
+			continue
+		}
+		var ch ChildEntry
+		copy(ch.EUI64[:], data[0:8])
+		ch.Type = data[8]
+		ch.NodeID = binary.LittleEndian.Uint16(data[9:11])
+		out = append(out, ch)
+	}
+	return out, nil
+}
+
+// UnicastCurrentNetworkKey sends the network key to a device whose join the
+// Trust Center deferred, completing the join.
+func (e *EZSPLayer) UnicastCurrentNetworkKey(nodeID uint16, ieee [8]byte, parent uint16) error {
+	// targetShort(2) + targetLong(8) + parentShortId(2)
+	params := make([]byte, 12)
+	binary.LittleEndian.PutUint16(params[0:2], nodeID)
+	copy(params[2:10], ieee[:])
+	binary.LittleEndian.PutUint16(params[10:12], parent)
+	resp, err := e.SendCommand(ezspUnicastCurrentNetworkKey, params)
+	if err != nil {
+		return err
+	}
+	return e.checkStatus("unicastCurrentNetworkKey", resp)
+}
+
+// BroadcastNextNetworkKey distributes key as the alternate network key to all
+// devices. It takes effect when BroadcastNetworkKeySwitch is sent.
+func (e *EZSPLayer) BroadcastNextNetworkKey(key [16]byte) error {
+	resp, err := e.SendCommand(ezspBroadcastNextNetworkKey, key[:])
+	if err != nil {
+		return err
+	}
+	if err := e.checkStatus("broadcastNextNetworkKey", resp); err != nil {
+		return err
+	}
+	return nil
+}
+
+// BroadcastNetworkKeySwitch tells all devices to switch to the alternate
+// network key. The NWK outgoing frame counter restarts from zero.
+func (e *EZSPLayer) BroadcastNetworkKeySwitch() error {
+	resp, err := e.SendCommand(ezspBroadcastNetworkKeySwitch, nil)
+	if err != nil {
+		return err
+	}
+	if err := e.checkStatus("broadcastNetworkKeySwitch", resp); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,312 @@
+package zigbee
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/urmzd/zigbee-skill/pkg/device"
+)
+
+func TestEZSPResponsesMatchedBySequence(t *testing.T) {
+	e := NewEZSPLayer(nil)
+	e.extendedFormat = true
+
+	// Two concurrent sendUnicast commands share a frame ID.
+	first, second := make(chan []byte, 1), make(chan []byte, 1)
+	e.pending[5] = ezspPending{frameID: ezspSendUnicast, ch: first}
+	e.pending[6] = ezspPending{frameID: ezspSendUnicast, ch: second}
+
+	// Responses: seq(1) + FC(2) + frameID(2) + status(1) + messageTag(1)
+	e.processFrame([]byte{6, ezspFCResponse, 0x01, byte(ezspSendUnicast), 0x00, 0x00, 0x02})
+	e.processFrame([]byte{5, ezspFCResponse, 0x01, byte(ezspSendUnicast), 0x00, 0x00, 0x01})
+
+	if got := <-first; !bytes.Equal(got, []byte{0x00, 0x01}) {
+		t.Errorf("seq 5 got %x, want 0001", got)
+	}
+	if got := <-second; !bytes.Equal(got, []byte{0x00, 0x02}) {
+		t.Errorf("seq 6 got %x, want 0002", got)
+	}
+}
+
+func TestEZSPLegacyVersionResponse(t *testing.T) {
+	e := NewEZSPLayer(nil)
+	e.extendedFormat = true
+	ch := make(chan []byte, 1)
+	e.pending[0] = ezspPending{frameID: ezspVersion, ch: ch}
+
+	// The version response keeps the legacy 3-byte header after the switch.
+	e.processFrame([]byte{0, ezspFCResponse, byte(ezspVersion), 13, 2, 0x30, 0x74})
+	if got := <-ch; !bytes.Equal(got, []byte{13, 2, 0x30, 0x74}) {
+		t.Errorf("version response = %x", got)
+	}
+}
+
+func TestEZSPCallbackListeners(t *testing.T) {
+	e := NewEZSPLayer(nil)
+	e.extendedFormat = true
+
+	// A command is outstanding on seq 3; an async callback reusing that
+	// sequence number must still reach the listeners.
+	resp := make(chan []byte, 1)
+	e.pending[3] = ezspPending{frameID: ezspStartScan, ch: resp}
+
+	var a, b int
+	e.Listen(ezspStackStatusHandler, func([]byte) { a++ })
+	removeB := e.Listen(ezspStackStatusHandler, func([]byte) { b++ })
+
+	callback := []byte{3, ezspFCResponse | 0x10, 0x01, byte(ezspStackStatusHandler), 0x00, emberNetworkUp}
+	e.processFrame(callback)
+	removeB()
+	e.processFrame(callback)
+
+	if a != 2 || b != 1 {
+		t.Errorf("listener calls a=%d b=%d, want 2 and 1", a, b)
+	}
+	if len(resp) != 0 {
+		t.Error("callback was delivered as a command response")
+	}
+}
+
+func TestEZSPCodecIncomingMessage(t *testing.T) {
+	aps := apsFrame{profileID: zclProfileHA, clusterID: 0x0006, srcEndpoint: 1, dstEndpoint: 1}
+	msg := []byte{0x18, 0x01, 0x0A}
+
+	// v8-v13: type + apsFrame + lqi + rssi + sender + bindingIndex + addressIndex + message
+	v8 := aps.appendTo([]byte{0x00})
+	v8 = append(v8, 200, 0xC4, 0x34, 0x12, 0xFF, 0xFF, byte(len(msg)))
+	v8 = append(v8, msg...)
+
+	// v14: type + apsFrame + EmberRxPacketInfo + message
+	v14 := aps.appendTo([]byte{0x00})
+	v14 = append(v14, 0x34, 0x12)                 // senderShortId
+	v14 = append(v14, 1, 2, 3, 4, 5, 6, 7, 8)     // senderLongId
+	v14 = append(v14, 0xFF, 0xFF, 200, 0xC4)      // bindingIndex, addressIndex, lqi, rssi
+	v14 = append(v14, 0, 0, 0, 0, byte(len(msg))) // lastHopTimestamp
+	v14 = append(v14, msg...)
+
+	for _, tc := range []struct {
+		version uint8
+		data    []byte
+	}{{8, v8}, {13, v8}, {14, v14}, {16, v14}} {
+		im, err := codecFor(tc.version).incomingMessage(tc.data)
+		if err != nil {
+			t.Fatalf("v%d: %v", tc.version, err)
+		}
+		if im.sender != 0x1234 || im.lqi != 200 || im.rssi != -60 || im.aps != aps || !bytes.Equal(im.message, msg) {
+			t.Errorf("v%d decoded %+v", tc.version, im)
+		}
+	}
+}
+
+func TestEZSPCodecMessageTags(t *testing.T) {
+	aps := apsFrame{profileID: zclProfileHA, clusterID: 0x0006}
+
+	// sendUnicast widens messageTag to uint16 in v14.
+	v8 := codecFor(8).sendUnicast(0x1234, aps, 0x42, []byte{0xAA})
+	v14 := codecFor(14).sendUnicast(0x1234, aps, 0x42, []byte{0xAA})
+	if want := []byte{0x42, 0x01, 0xAA}; !bytes.Equal(v8[14:], want) {
+		t.Errorf("v8 sendUnicast tail = %x, want %x", v8[14:], want)
+	}
+	if want := []byte{0x42, 0x00, 0x01, 0xAA}; !bytes.Equal(v14[14:], want) {
+		t.Errorf("v14 sendUnicast tail = %x, want %x", v14[14:], want)
+	}
+
+	// messageSentHandler moves the sl_status_t to the front in v14.
+	sent := []byte{0x02, 0x00, 0x00, 0x00, 0x00, 0x34, 0x12}
+	sent = aps.appendTo(sent)
+	sent = append(sent, 0x42, 0x00, 0x00)
+	ms, err := codecFor(14).messageSent(sent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ms.status != 0x02 || ms.tag != 0x42 || ms.destination != 0x1234 {
+		t.Errorf("v14 messageSent = %+v", ms)
+	}
+}
+
+func TestEZSPFrameVersions(t *testing.T) {
+	if err := checkFrame(ezspGetKey, 8); err != nil {
+		t.Errorf("getKey on v8: %v", err)
+	}
+	if err := checkFrame(ezspGetKey, 13); !errors.Is(err, device.ErrUnsupported) {
+		t.Errorf("getKey on v13 = %v, want ErrUnsupported", err)
+	}
+	if err := checkFrame(ezspImportTransientKey, 12); !errors.Is(err, device.ErrUnsupported) {
+		t.Errorf("importTransientKey on v12 = %v, want ErrUnsupported", err)
+	}
+	if err := checkFrame(ezspImportTransientKey, 14); err != nil {
+		t.Errorf("importTransientKey on v14: %v", err)
+	}
+}
+
+// fakeNCP answers EZSP commands over a lossless ASH link. Handlers are keyed
+// by frame ID and return the response parameters; commands without a
+// handler get an empty response.
+type fakeNCP struct {
+	mu       sync.Mutex
+	handlers map[uint16]func(params []byte) []byte
+	calls    []uint16
+	legacy   int // commands received with the legacy 3-byte header
+}
+
+// newFakeNCP returns an EZSP layer speaking the given protocol version to a
+// fake NCP.
+func newFakeNCP(t *testing.T, version uint8) (*EZSPLayer, *fakeNCP) {
+	t.Helper()
+	n := &fakeNCP{handlers: make(map[uint16]func([]byte) []byte)}
+	host := NewASHLayer(n.connect(t), ASHConfig{WindowSize: 3})
+	connectASH(host)
+
+	e := NewEZSPLayer(host)
+	e.extendedFormat = true
+	e.protocolVersion = version
+	e.codecV = codecFor(version)
+	e.Start()
+	t.Cleanup(func() {
+		e.Close()
+		host.Close()
+	})
+	return e, n
+}
+
+// connect opens a new serial line to the NCP and returns the host's end.
+func (n *fakeNCP) connect(t *testing.T) Transport {
+	ab, ba := newLossyLink(1, 0), newLossyLink(2, 0)
+	peer := NewASHLayer(&lossyEnd{tx: ba, rx: ab}, ASHConfig{WindowSize: 3})
+	connectASH(peer)
+
+	done := make(chan struct{})
+	go n.serve(peer, done)
+	t.Cleanup(func() {
+		close(done)
+		peer.Close()
+	})
+	return &ncpEnd{lossyEnd: lossyEnd{tx: ab, rx: ba}, peer: peer}
+}
+
+// serve answers the commands arriving on peer until done is closed. The
+// version response always uses the legacy header, as on a real NCP.
+func (n *fakeNCP) serve(peer *ASHLayer, done chan struct{}) {
+	for {
+		var data []byte
+		select {
+		case data = <-peer.RecvData():
+		case <-done:
+			return
+		}
+		var frameID uint16
+		var params []byte
+		switch {
+		case len(data) == 4: // legacy header, only used for the version command
+			frameID, params = uint16(data[2]), data[3:]
+		case len(data) >= 5:
+			frameID, params = binary.LittleEndian.Uint16(data[3:5]), data[5:]
+		default:
+			continue
+		}
+		n.mu.Lock()
+		n.calls = append(n.calls, frameID)
+		if len(data) == 4 {
+			n.legacy++
+		}
+		h := n.handlers[frameID]
+		n.mu.Unlock()
+		var resp []byte
+		if h != nil {
+			resp = h(params)
+		}
+		frame := []byte{data[0], ezspFCResponse, 0x01, byte(frameID), byte(frameID >> 8)}
+		if frameID == ezspVersion {
+			frame = []byte{data[0], ezspFCResponse, byte(frameID)}
+		}
+		if err := peer.SendData(append(frame, resp...)); err != nil {
+			return
+		}
+	}
+}
+
+// ncpEnd is the host's end of a line to a fake NCP. The NCP answers RST with
+// RSTACK and starts a new ASH session.
+type ncpEnd struct {
+	lossyEnd
+	peer *ASHLayer
+}
+
+func (e *ncpEnd) Write(p []byte) (int, error) {
+	if !bytes.Equal(p, buildControlFrame(ashFrameRST)) {
+		return e.lossyEnd.Write(p)
+	}
+	e.peer.stateMu.Lock()
+	e.peer.state = ashStateResetPending
+	e.peer.stateMu.Unlock()
+	e.peer.handleRSTACK(nil)
+	e.rx.send(buildControlFrame(ashFrameRSTACK))
+	return len(p), nil
+}
+
+func (n *fakeNCP) handle(frameID uint16, h func(params []byte) []byte) {
+	n.mu.Lock()
+	n.handlers[frameID] = h
+	n.mu.Unlock()
+}
+
+func (n *fakeNCP) sent() []uint16 {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return append([]uint16(nil), n.calls...)
+}
+
+// statusBytes encodes status as the version's EmberStatus or sl_status_t.
+func statusBytes(version uint8, status uint32) []byte {
+	if version >= 14 {
+		return binary.LittleEndian.AppendUint32(nil, status)
+	}
+	return []byte{byte(status)}
+}
+
+func TestEZSPStatusResponses(t *testing.T) {
+	for _, version := range []uint8{12, 13, 14} {
+		e, ncp := newFakeNCP(t, version)
+		ok := func(data ...byte) func([]byte) []byte {
+			return func([]byte) []byte { return append(statusBytes(version, emberSuccess), data...) }
+		}
+		ncp.handle(ezspGetValue, ok(4, 0x78, 0x56, 0x34, 0x12))
+		ncp.handle(ezspGetConfigurationValue, ok(0x34, 0x12))
+		ncp.handle(ezspSetValue, ok())
+		ncp.handle(ezspSetConfigurationValue, ok())
+		ncp.handle(ezspAddEndpoint, ok())
+		ncp.handle(ezspSetPolicy, func([]byte) []byte { return statusBytes(version, emberInvalidCall) })
+
+		if v, err := e.GetValue(ezspValueAPSFrameCounter); err != nil || !bytes.Equal(v, []byte{0x78, 0x56, 0x34, 0x12}) {
+			t.Errorf("v%d getValue = %x, %v", version, v, err)
+		}
+		if v, err := e.GetConfigValue(ezspConfigKeyTableSize); err != nil || v != 0x1234 {
+			t.Errorf("v%d getConfigurationValue = 0x%04X, %v", version, v, err)
+		}
+		if err := e.SetValue(ezspValueAPSFrameCounter, []byte{1, 0, 0, 0}); err != nil {
+			t.Errorf("v%d setValue: %v", version, err)
+		}
+		if err := e.SetConfigValue(ezspConfigMaxHops, 30); err != nil {
+			t.Errorf("v%d setConfigurationValue: %v", version, err)
+		}
+		if err := e.AddEndpoint(1, zclProfileHA, 0x0005, nil, nil); err != nil {
+			t.Errorf("v%d addEndpoint: %v", version, err)
+		}
+		if err := e.SetPolicy(ezspPolicyTrustCenterPolicy, ezspDecisionAllowJoins); err == nil {
+			t.Errorf("v%d setPolicy ignored a failure status", version)
+		}
+
+		if version < 13 {
+			// getKey: status + EmberKeyStruct, sequence number at offset 27.
+			key := make([]byte, 36)
+			key[27] = 7
+			ncp.handle(ezspGetKey, ok(key...))
+			if k, err := e.GetNetworkKey(); err != nil || k.SequenceNumber != 7 {
+				t.Errorf("v%d getKey = %+v, %v", version, k, err)
+			}
+		}
+	}
+}
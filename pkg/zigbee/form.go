@@ -0,0 +1,251 @@
+package zigbee
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/urmzd/zigbee-skill/pkg/device"
+)
+
+const (
+	// defaultTxPower is the radio power (dBm) used when none is configured.
+	defaultTxPower = 3
+
+	// channelChangeTimeout bounds the wait for the NCP to act on its own
+	// Mgmt_NWK_Update_req. Devices switch after the broadcast delivery time
+	// (nwkcNetworkBroadcastDeliveryTime, about 9 s).
+	channelChangeTimeout = 15 * time.Second
+)
+
+// formParams is a fully resolved set of network formation parameters.
+type formParams struct {
+	network  NetworkParams
+	security InitialSecurityState
+}
+
+// resolveFormParams validates opts and fills in random PAN IDs and network
+// key where unset. An unset channel stays zero; formWith picks the quietest.
+func resolveFormParams(opts device.FormOptions) (*formParams, error) {
+	p := &formParams{security: DefaultSecurityState()}
+
+	switch {
+	case opts.Channel == 0:
+	case opts.Channel >= 11 && opts.Channel <= 26:
+		p.network.RadioChannel = uint8(opts.Channel)
+	default:
+		return nil, fmt.Errorf("%w: channel must be 11-26, got %d", device.ErrValidation, opts.Channel)
+	}
+
+	if opts.PanID != "" {
+		pan, err := strconv.ParseUint(strings.TrimPrefix(strings.ToLower(opts.PanID), "0x"), 16, 16)
+		if err != nil || pan == 0xFFFF {
+			return nil, fmt.Errorf("%w: invalid PAN ID %q", device.ErrValidation, opts.PanID)
+		}
+		p.network.PanID = uint16(pan)
+	} else {
+		p.network.PanID = uint16(rand.Intn(0xFFFE) + 1)
+	}
+
+	if opts.ExtendedPanID != "" {
+		ext, err := parseBackupEUI64(strings.ReplaceAll(opts.ExtendedPanID, ":", ""))
+		if err != nil || ext == [8]byte{} || ext == [8]byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF} {
+			return nil, fmt.Errorf("%w: invalid extended PAN ID %q", device.ErrValidation, opts.ExtendedPanID)
+		}
+		p.network.ExtendedPanID = ext
+	} else {
+		for i := range p.network.ExtendedPanID {
+			p.network.ExtendedPanID[i] = byte(rand.Intn(256))
+		}
+	}
+
+	if opts.NetworkKey != "" {
+		key, err := hex.DecodeString(strings.ReplaceAll(opts.NetworkKey, ":", ""))
+		if err != nil || len(key) != 16 {
+			return nil, fmt.Errorf("%w: network key must be 16 hex bytes", device.ErrValidation)
+		}
+		copy(p.security.NetworkKey[:], key)
+	}
+
+	p.network.RadioTxPower = defaultTxPower
+	if opts.TxPower != nil {
+		if *opts.TxPower < -30 || *opts.TxPower > 20 {
+			return nil, fmt.Errorf("%w: tx power must be -30..20 dBm, got %d", device.ErrValidation, *opts.TxPower)
+		}
+		p.network.RadioTxPower = int8(*opts.TxPower)
+	}
+	return p, nil
+}
+
+// quietestChannel energy-scans the BDB primary channels, then the secondary
+// ones, and falls back to channel 15 (BDB 8.1).
+func (c *Controller) quietestChannel() uint8 {
+	for _, set := range []uint32{bdbcTLPrimaryChannelSet, bdbcTLSecondaryChannelSet} {
+		results, err := c.ezsp.EnergyScan(set, defaultEnergyScanDuration)
+		if err != nil {
+			log.Warn().Err(err).Uint32("channels", set).Msg("Energy scan failed")
+			continue
+		}
+		best := quietestOf(results)
+		log.Info().Uint8("channel", best.Channel).Int8("rssi", best.RSSI).Msg("Best channel from energy scan")
+		return best.Channel
+	}
+	log.Warn().Msg("Energy scans failed, defaulting to channel 15")
+	return 15
+}
+
+// formWith sets the security state and forms the network, then announces the
+// coordinator. A zero channel is replaced by the quietest one.
+func (c *Controller) formWith(p *formParams) error {
+	if p.network.RadioChannel == 0 {
+		p.network.RadioChannel = c.quietestChannel()
+	}
+	if err := c.ezsp.SetInitialSecurityState(p.security); err != nil {
+		return fmt.Errorf("set initial security state: %w", err)
+	}
+	if err := c.ezsp.FormNetwork(p.network); err != nil {
+		return fmt.Errorf("form network: %w", err)
+	}
+
+	// Wait briefly for network to come up
+	time.Sleep(500 * time.Millisecond)
+
+	if err := c.broadcastDeviceAnnce(); err != nil {
+		log.Warn().Err(err).Msg("Failed to broadcast Device_annce after formation (non-fatal)")
+	}
+	return nil
+}
+
+// resetNCP leaves the current network and resets the NCP so a network can be
+// formed from scratch.
+func (c *Controller) resetNCP() error {
+	log.Info().Msg("Leaving current network")
+	if err := c.ezsp.LeaveNetwork(); err != nil {
+		log.Warn().Err(err).Msg("Leave network failed (continuing)")
+	}
+	if err := c.ash.Reset(); err != nil {
+		return fmt.Errorf("ASH reset: %w", err)
+	}
+	if _, _, _, err := c.ezsp.NegotiateVersion(); err != nil {
+		return fmt.Errorf("version negotiation: %w", err)
+	}
+	return c.configureNCP()
+}
+
+// FormNetwork replaces the current network with one formed from opts. Devices
+// joined to the old network stay orphaned unless the new one reuses its
+// PAN IDs, channel and network key.
+func (c *Controller) FormNetwork(ctx context.Context, opts device.FormOptions) (*device.NetworkInfo, error) {
+	if !c.IsConnected() {
+		return nil, device.ErrNotConnected
+	}
+	// Validate before leaving the current network, so a typo doesn't cost
+	// the user their network.
+	p, err := resolveFormParams(opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.resetNCP(); err != nil {
+		return nil, err
+	}
+	if err := c.formWith(p); err != nil {
+		return nil, err
+	}
+	c.notifyNetworkChange()
+	return c.NetworkInfo(ctx)
+}
+
+// ChangeChannel broadcasts Mgmt_NWK_Update_req so that every device moves to
+// the new channel together with the coordinator, keeping their membership.
+func (c *Controller) ChangeChannel(ctx context.Context, channel int) error {
+	if !c.IsConnected() {
+		return device.ErrNotConnected
+	}
+	if channel < 11 || channel > 26 {
+		return fmt.Errorf("%w: channel must be 11-26, got %d", device.ErrValidation, channel)
+	}
+	_, params, err := c.ezsp.GetNetworkParameters()
+	if err != nil {
+		return fmt.Errorf("get network parameters: %w", err)
+	}
+	if int(params.RadioChannel) == channel {
+		return nil
+	}
+
+	// Mgmt_NWK_Update_req: seq(1) + ScanChannels(4) + ScanDuration(1) + nwkUpdateId(1).
+	// ScanDuration 0xFE with a single channel in the mask means "change channel".
+	payload := make([]byte, 7)
+	payload[0] = nextZDOSeq()
+	mask := uint32(1) << channel
+	payload[1], payload[2], payload[3], payload[4] = byte(mask), byte(mask>>8), byte(mask>>16), byte(mask>>24)
+	payload[5] = 0xFE
+	payload[6] = params.NwkUpdateID + 1
+
+	log.Info().Uint8("from", params.RadioChannel).Int("to", channel).Msg("Broadcasting channel change")
+	if err := c.ezsp.SendBroadcast(0xFFFD, zdoProfileID, zdoClusterMgmtNWKUpdateReq, 0, 0, payload, 0); err != nil {
+		return fmt.Errorf("send Mgmt_NWK_Update_req: %w", err)
+	}
+
+	// The NCP normally handles its own broadcast; fall back to moving the
+	// radio directly if it hasn't switched once devices have.
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	deadline := time.After(channelChangeTimeout)
+wait:
+	for {
+		select {
+		case <-ticker.C:
+			if _, p, err := c.ezsp.GetNetworkParameters(); err == nil && int(p.RadioChannel) == channel {
+				break wait
+			}
+		case <-deadline:
+			log.Warn().Int("channel", channel).Msg("NCP did not follow its own channel change, setting radio channel")
+			if err := c.ezsp.SetRadioChannel(uint8(channel)); err != nil {
+				return err
+			}
+			break wait
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-c.stopChan:
+			return device.ErrNotConnected
+		}
+	}
+
+	c.notifyNetworkChange()
+	return nil
+}
+
+// SetOnNetworkChange registers a callback invoked with the current network
+// settings after the network is formed or changes channel.
+func (c *Controller) SetOnNetworkChange(fn func(device.FormOptions)) { c.onNetworkChange = fn }
+
+// notifyNetworkChange reads the current settings and passes them to the
+// registered callback.
+func (c *Controller) notifyNetworkChange() {
+	if c.onNetworkChange == nil {
+		return
+	}
+	_, params, err := c.ezsp.GetNetworkParameters()
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to read network parameters for persistence")
+		return
+	}
+	txPower := int(params.RadioTxPower)
+	opts := device.FormOptions{
+		Channel:       int(params.RadioChannel),
+		PanID:         fmt.Sprintf("0x%04x", params.PanID),
+		ExtendedPanID: FormatIEEE(params.ExtendedPanID),
+		TxPower:       &txPower,
+	}
+	if k, err := c.ezsp.GetNetworkKey(); err == nil {
+		opts.NetworkKey = hex.EncodeToString(k.Key[:])
+	} else {
+		log.Warn().Err(err).Msg("Failed to export network key for persistence")
+	}
+	c.onNetworkChange(opts)
+}
@@ -0,0 +1,157 @@
+package zigbee
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/urmzd/zigbee-skill/pkg/device"
+)
+
+func TestResolveFormParams(t *testing.T) {
+	power := func(p int) *int { return &p }
+
+	p, err := resolveFormParams(device.FormOptions{
+		Channel:       15,
+		PanID:         "0x1A62",
+		ExtendedPanID: "dd:dd:dd:dd:dd:dd:dd:01",
+		NetworkKey:    "01:03:05:07:09:0b:0d:0f:00:02:04:06:08:0a:0c:0d",
+		TxPower:       power(-5),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.network.RadioChannel != 15 || p.network.PanID != 0x1A62 || p.network.RadioTxPower != -5 {
+		t.Errorf("network = %+v", p.network)
+	}
+	// Extended PAN IDs are written most significant byte first, like EUI64s.
+	if want := [8]byte{0x01, 0xdd, 0xdd, 0xdd, 0xdd, 0xdd, 0xdd, 0xdd}; p.network.ExtendedPanID != want {
+		t.Errorf("extended PAN ID = % x, want % x", p.network.ExtendedPanID, want)
+	}
+	if want := []byte{1, 3, 5, 7, 9, 11, 13, 15, 0, 2, 4, 6, 8, 10, 12, 13}; !bytes.Equal(p.security.NetworkKey[:], want) {
+		t.Errorf("network key = % x", p.security.NetworkKey)
+	}
+
+	p, err = resolveFormParams(device.FormOptions{PanID: "1a62"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.network.RadioChannel != 0 || p.network.PanID != 0x1A62 || p.network.RadioTxPower != defaultTxPower {
+		t.Errorf("defaults = %+v", p.network)
+	}
+	if p.network.ExtendedPanID == [8]byte{} {
+		t.Error("extended PAN ID not generated")
+	}
+
+	for _, tt := range []struct {
+		name string
+		opts device.FormOptions
+	}{
+		{"channel below band", device.FormOptions{Channel: 10}},
+		{"channel above band", device.FormOptions{Channel: 27}},
+		{"broadcast PAN ID", device.FormOptions{PanID: "0xffff"}},
+		{"PAN ID not hex", device.FormOptions{PanID: "xyz"}},
+		{"PAN ID too long", device.FormOptions{PanID: "0x12345"}},
+		{"extended PAN ID zero", device.FormOptions{ExtendedPanID: "00:00:00:00:00:00:00:00"}},
+		{"extended PAN ID all ones", device.FormOptions{ExtendedPanID: "ff:ff:ff:ff:ff:ff:ff:ff"}},
+		{"extended PAN ID not hex", device.FormOptions{ExtendedPanID: "zz:dd:dd:dd:dd:dd:dd:dd"}},
+		{"extended PAN ID short", device.FormOptions{ExtendedPanID: "dd:dd:dd:dd"}},
+		{"key short", device.FormOptions{NetworkKey: "0102030405060708090a0b0c0d0e0f"}},
+		{"key not hex", device.FormOptions{NetworkKey: "0102030405060708090a0b0c0d0e0fzz"}},
+		{"tx power too high", device.FormOptions{TxPower: power(21)}},
+		{"tx power too low", device.FormOptions{TxPower: power(-31)}},
+	} {
+		if _, err := resolveFormParams(tt.opts); !errors.Is(err, device.ErrValidation) {
+			t.Errorf("%s: err = %v, want ErrValidation", tt.name, err)
+		}
+	}
+}
+
+func TestChangeChannel(t *testing.T) {
+	e, ncp := newFakeNCP(t, 13)
+	stop := make(chan struct{})
+	t.Cleanup(func() { close(stop) })
+	c := &Controller{ash: e.ash, ezsp: e, connected: true, stopChan: stop}
+
+	var persisted []device.FormOptions
+	c.SetOnNetworkChange(func(opts device.FormOptions) { persisted = append(persisted, opts) })
+
+	// The NCP acts on its own broadcast, so it reports the new channel once
+	// the request has been sent.
+	var mu sync.Mutex
+	channel := uint8(15)
+	var payload []byte
+	ncp.handle(ezspGetNetworkParameters, func([]byte) []byte {
+		mu.Lock()
+		defer mu.Unlock()
+		// status(1) + nodeType(1) + extPanID(8) + panID(2) + txPower(1) +
+		// channel(1) + joinMethod(1) + nwkManagerID(2) + nwkUpdateID(1) + channels(4)
+		b := []byte{0x00, 0x01, 1, 2, 3, 4, 5, 6, 7, 8, 0x62, 0x1A, 3, channel, 0, 0, 0, 4}
+		return binary.LittleEndian.AppendUint32(b, 1<<channel)
+	})
+	// sendBroadcast v13: destination(2) + apsFrame(11) + radius(1) + tag(1) + length(1) + message
+	ncp.handle(ezspSendBroadcast, func(p []byte) []byte {
+		mu.Lock()
+		defer mu.Unlock()
+		if dest := binary.LittleEndian.Uint16(p[0:2]); dest != 0xFFFD {
+			t.Errorf("broadcast to 0x%04X", dest)
+		}
+		if cluster := binary.LittleEndian.Uint16(p[4:6]); cluster != zdoClusterMgmtNWKUpdateReq {
+			t.Errorf("cluster = 0x%04X", cluster)
+		}
+		payload = append([]byte(nil), p[16:]...)
+		channel = 20
+		return []byte{0x00, 0x00}
+	})
+	key := []byte{1, 3, 5, 7, 9, 11, 13, 15, 0, 2, 4, 6, 8, 10, 12, 13}
+	ncp.handle(ezspExportKey, func([]byte) []byte { return append(append([]byte(nil), key...), 0, 0, 0, 0) })
+	ncp.handle(ezspGetNetworkKeyInfo, func([]byte) []byte { return make([]byte, 12) })
+
+	if err := c.ChangeChannel(context.Background(), 20); err != nil {
+		t.Fatal(err)
+	}
+
+	// seq(1) + ScanChannels(4) + ScanDuration(1) + nwkUpdateId(1)
+	if len(payload) != 7 {
+		t.Fatalf("Mgmt_NWK_Update_req = % x", payload)
+	}
+	if mask := binary.LittleEndian.Uint32(payload[1:5]); mask != 1<<20 {
+		t.Errorf("channel mask = 0x%08X, want 0x%08X", mask, uint32(1<<20))
+	}
+	if payload[5] != 0xFE {
+		t.Errorf("scan duration = 0x%02X, want 0xFE", payload[5])
+	}
+	if payload[6] != 5 {
+		t.Errorf("nwkUpdateId = %d, want 5", payload[6])
+	}
+	for _, id := range ncp.sent() {
+		if id == ezspSetRadioChannel {
+			t.Error("radio channel set although the NCP followed the broadcast")
+		}
+	}
+
+	if len(persisted) != 1 {
+		t.Fatalf("network change persisted %d times", len(persisted))
+	}
+	got := persisted[0]
+	if got.Channel != 20 || got.PanID != "0x1a62" || got.ExtendedPanID != "08:07:06:05:04:03:02:01" {
+		t.Errorf("persisted %+v", got)
+	}
+	if got.NetworkKey != "01030507090b0d0f00020406080a0c0d" {
+		t.Errorf("persisted key %q", got.NetworkKey)
+	}
+
+	// Asking for the current channel sends nothing.
+	if err := c.ChangeChannel(context.Background(), 20); err != nil {
+		t.Fatal(err)
+	}
+	if len(persisted) != 1 {
+		t.Error("unchanged channel persisted")
+	}
+	if err := c.ChangeChannel(context.Background(), 27); !errors.Is(err, device.ErrValidation) {
+		t.Errorf("channel 27: err = %v, want ErrValidation", err)
+	}
+}
@@ -0,0 +1,109 @@
+package zigbee
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"github.com/urmzd/zigbee-skill/pkg/device"
+)
+
+// NetworkInfo reports the coordinator's network parameters together with the
+// negotiated EZSP version and NCP firmware details.
+func (c *Controller) NetworkInfo(_ context.Context) (*device.NetworkInfo, error) {
+	if !c.IsConnected() {
+		return nil, device.ErrNotConnected
+	}
+
+	status, params, err := c.ezsp.GetNetworkParameters()
+	if err != nil {
+		return nil, fmt.Errorf("get network parameters: %w", err)
+	}
+	eui, err := c.ezsp.GetEUI64()
+	if err != nil {
+		return nil, fmt.Errorf("get EUI64: %w", err)
+	}
+
+	proto, _, stackVer := c.ezsp.Version()
+	info := &device.NetworkInfo{
+		NetworkUp:       status == emberSuccess,
+		Channel:         int(params.RadioChannel),
+		PanID:           fmt.Sprintf("0x%04x", params.PanID),
+		ExtendedPanID:   FormatIEEE(params.ExtendedPanID),
+		TxPower:         int(params.RadioTxPower),
+		NodeType:        emberNodeTypeName(params.NodeType),
+		CoordinatorIEEE: FormatIEEE(eui),
+		Adapter: device.AdapterInfo{
+			Protocol:        "ezsp",
+			ProtocolVersion: int(proto),
+			StackVersion:    formatStackVersion(stackVer),
+		},
+	}
+
+	// Firmware details are informational; older NCPs may not support every query.
+	if v, err := c.ezsp.GetValue(ezspValueVersionInfo); err == nil && len(v) >= 7 {
+		info.Adapter.FirmwareBuild = int(binary.LittleEndian.Uint16(v[0:2]))
+		info.Adapter.FirmwareVersion = fmt.Sprintf("%d.%d.%d.%d %s", v[2], v[3], v[4], v[5], emberVersionTypeName(v[6]))
+	} else if err != nil {
+		log.Debug().Err(err).Msg("getValue(VERSION_INFO) failed")
+	}
+	if tok, err := c.ezsp.GetMfgToken(ezspMfgString); err == nil {
+		info.Adapter.Manufacturer = tokenString(tok)
+	}
+	if tok, err := c.ezsp.GetMfgToken(ezspMfgBoardName); err == nil {
+		info.Adapter.Board = tokenString(tok)
+	}
+
+	return info, nil
+}
+
+// formatStackVersion renders a nibble-encoded EmberZNet version (0x7420 -> "7.4.2.0").
+func formatStackVersion(v uint16) string {
+	return fmt.Sprintf("%d.%d.%d.%d", v>>12&0xF, v>>8&0xF, v>>4&0xF, v&0xF)
+}
+
+// emberNodeTypeName maps EmberNodeType to a readable name.
+func emberNodeTypeName(t uint8) string {
+	switch t {
+	case 1:
+		return device.NodeTypeCoordinator
+	case 2:
+		return device.NodeTypeRouter
+	case 3:
+		return device.NodeTypeEndDevice
+	case 4:
+		return "sleepy_end_device"
+	case 5:
+		return "mobile_end_device"
+	default:
+		return device.NodeTypeUnknown
+	}
+}
+
+// emberVersionTypeName maps EmberVersionType to its release label.
+func emberVersionTypeName(t uint8) string {
+	switch t {
+	case 0x00:
+		return "pre-release"
+	case 0x33:
+		return "alpha"
+	case 0x44:
+		return "beta"
+	case 0xAA:
+		return "GA"
+	default:
+		return fmt.Sprintf("type-0x%02X", t)
+	}
+}
+
+// tokenString decodes a manufacturing token string, which is padded with
+// 0x00 or erased-flash 0xFF bytes.
+func tokenString(b []byte) string {
+	end := len(b)
+	for end > 0 && (b[end-1] == 0x00 || b[end-1] == 0xFF) {
+		end--
+	}
+	return strings.TrimSpace(string(b[:end]))
+}
@@ -0,0 +1,68 @@
+package zigbee
+
+import (
+	"testing"
+
+	"github.com/urmzd/zigbee-skill/pkg/device"
+)
+
+func TestFormatStackVersion(t *testing.T) {
+	for v, want := range map[uint16]string{
+		0x7420: "7.4.2.0",
+		0x0700: "0.7.0.0",
+		0x6A31: "6.10.3.1",
+		0x0000: "0.0.0.0",
+	} {
+		if got := formatStackVersion(v); got != want {
+			t.Errorf("formatStackVersion(0x%04X) = %q, want %q", v, got, want)
+		}
+	}
+}
+
+func TestEmberNodeTypeName(t *testing.T) {
+	for nodeType, want := range map[uint8]string{
+		0: device.NodeTypeUnknown,
+		1: device.NodeTypeCoordinator,
+		2: device.NodeTypeRouter,
+		3: device.NodeTypeEndDevice,
+		4: "sleepy_end_device",
+		5: "mobile_end_device",
+		9: device.NodeTypeUnknown,
+	} {
+		if got := emberNodeTypeName(nodeType); got != want {
+			t.Errorf("emberNodeTypeName(%d) = %q, want %q", nodeType, got, want)
+		}
+	}
+}
+
+func TestEmberVersionTypeName(t *testing.T) {
+	for versionType, want := range map[uint8]string{
+		0x00: "pre-release",
+		0x33: "alpha",
+		0x44: "beta",
+		0xAA: "GA",
+		0x12: "type-0x12",
+	} {
+		if got := emberVersionTypeName(versionType); got != want {
+			t.Errorf("emberVersionTypeName(0x%02X) = %q, want %q", versionType, got, want)
+		}
+	}
+}
+
+func TestTokenString(t *testing.T) {
+	tests := []struct {
+		token []byte
+		want  string
+	}{
+		{[]byte("SONOFF\x00\x00\x00"), "SONOFF"},
+		{[]byte("ZBDongle-E\xFF\xFF\xFF\xFF"), "ZBDongle-E"},
+		{[]byte(" board \x00\xFF\x00"), "board"},
+		{[]byte{0xFF, 0xFF, 0xFF, 0xFF}, ""}, // erased flash
+		{nil, ""},
+	}
+	for _, tt := range tests {
+		if got := tokenString(tt.token); got != tt.want {
+			t.Errorf("tokenString(% X) = %q, want %q", tt.token, got, tt.want)
+		}
+	}
+}
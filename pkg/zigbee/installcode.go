@@ -0,0 +1,172 @@
+package zigbee
+
+import (
+	"context"
+	"crypto/aes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"github.com/urmzd/zigbee-skill/pkg/device"
+)
+
+// InstallCode is a parsed Zigbee install code, optionally carrying the IEEE
+// address of the device it belongs to (QR formats include it).
+type InstallCode struct {
+	Code []byte   // install code including its trailing CRC-16
+	IEEE *[8]byte // little-endian, nil if the input did not include it
+}
+
+// Install code QR payload formats seen on devices:
+//
+//	Z:<ieee>$I:<code>[$...|%...]   Zigbee Alliance install code QR
+//	G$M:<model>$A:<ieee>$I:<code>  Aqara
+//	<ieee>|<code>                  plain pair
+var (
+	zigbeeQRPattern = regexp.MustCompile(`(?i)^Z:([0-9a-f]{16})\$I:([0-9a-f]+)`)
+	aqaraQRPattern  = regexp.MustCompile(`(?i)^G\$M:[^$]*\$A:([0-9a-f]{16})\$I:([0-9a-f]+)`)
+	dskPattern      = regexp.MustCompile(`^\d{5}(-\d{5})+$`)
+)
+
+// ParseInstallCode parses an install code given as hex (separators allowed),
+// as a DSK (5-digit decimal groups, one per 16-bit word) or as a QR payload,
+// and validates its length and CRC.
+func ParseInstallCode(s string) (*InstallCode, error) {
+	s = strings.TrimSpace(s)
+	ic := &InstallCode{}
+	codeStr := s
+
+	if m := zigbeeQRPattern.FindStringSubmatch(s); m != nil {
+		ic.IEEE, codeStr = mustEUI64(m[1]), m[2]
+	} else if m := aqaraQRPattern.FindStringSubmatch(s); m != nil {
+		ic.IEEE, codeStr = mustEUI64(m[1]), m[2]
+	} else if ieee, code, ok := strings.Cut(s, "|"); ok {
+		addr, err := parseBackupEUI64(strings.ReplaceAll(strings.TrimSpace(ieee), ":", ""))
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid IEEE address in install code", device.ErrValidation)
+		}
+		ic.IEEE, codeStr = &addr, code
+	}
+
+	var code []byte
+	if dskPattern.MatchString(codeStr) {
+		for _, group := range strings.Split(codeStr, "-") {
+			v, err := strconv.ParseUint(group, 10, 16)
+			if err != nil {
+				return nil, fmt.Errorf("%w: invalid DSK group %q", device.ErrValidation, group)
+			}
+			code = binary.BigEndian.AppendUint16(code, uint16(v))
+		}
+	} else {
+		clean := strings.NewReplacer(" ", "", "-", "", ":", "").Replace(codeStr)
+		var err error
+		if code, err = hex.DecodeString(clean); err != nil {
+			return nil, fmt.Errorf("%w: install code is not hex", device.ErrValidation)
+		}
+	}
+
+	switch len(code) {
+	case 8, 10, 14, 18: // 6, 8, 12 or 16 bytes + CRC-16
+	default:
+		return nil, fmt.Errorf("%w: install code must be 8, 10, 14 or 18 bytes including CRC, got %d",
+			device.ErrValidation, len(code))
+	}
+	n := len(code) - 2
+	want := binary.LittleEndian.Uint16(code[n:])
+	if got := installCodeCRC(code[:n]); got != want {
+		return nil, fmt.Errorf("%w: install code CRC mismatch (got %04X, expected %04X)", device.ErrValidation, want, got)
+	}
+	ic.Code = code
+	return ic, nil
+}
+
+// LinkKey derives the device's preconfigured link key from the install code
+// with the AES-MMO hash (Zigbee spec B.6).
+func (ic *InstallCode) LinkKey() [16]byte {
+	return aesMMOHash(ic.Code)
+}
+
+func mustEUI64(s string) *[8]byte {
+	addr, _ := parseBackupEUI64(s) // regex guarantees 16 hex digits
+	return &addr
+}
+
+// installCodeCRC computes CRC-16/X-25 (reflected CCITT, init and xorout 0xFFFF).
+func installCodeCRC(data []byte) uint16 {
+	crc := uint16(0xFFFF)
+	for _, b := range data {
+		crc ^= uint16(b)
+		for range 8 {
+			if crc&1 != 0 {
+				crc = crc>>1 ^ 0x8408
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+	return ^crc
+}
+
+// aesMMOHash is the Matyas-Meyer-Oseas hash over AES-128. The message is
+// padded with a 1 bit, zeros and its bit length (16-bit big-endian) to a
+// multiple of the block size; each block is encrypted with the previous
+// hash as the key and XORed with itself.
+func aesMMOHash(msg []byte) [16]byte {
+	const bs = aes.BlockSize
+	padded := append([]byte(nil), msg...)
+	padded = append(padded, 0x80)
+	for len(padded)%bs != bs-2 {
+		padded = append(padded, 0x00)
+	}
+	padded = binary.BigEndian.AppendUint16(padded, uint16(len(msg)*8))
+
+	var h [16]byte
+	for i := 0; i < len(padded); i += bs {
+		block, _ := aes.NewCipher(h[:]) // 16-byte key never fails
+		var out [16]byte
+		block.Encrypt(out[:], padded[i:i+bs])
+		for j := range out {
+			h[j] = out[j] ^ padded[i+j]
+		}
+	}
+	return h
+}
+
+// AddInstallCode derives a device's link key from its install code and loads
+// it as a transient key for that device only, so it can join during the next
+// permit-join window. ieee may be empty if the code is a QR payload that
+// includes the address. Returns the device's IEEE address.
+func (c *Controller) AddInstallCode(_ context.Context, ieee, code string) (string, error) {
+	if !c.IsConnected() {
+		return "", device.ErrNotConnected
+	}
+	ic, err := ParseInstallCode(code)
+	if err != nil {
+		return "", err
+	}
+
+	var addr [8]byte
+	switch {
+	case ieee != "":
+		if addr, err = parseBackupEUI64(strings.ReplaceAll(ieee, ":", "")); err != nil {
+			return "", fmt.Errorf("%w: invalid IEEE address %q", device.ErrValidation, ieee)
+		}
+		if ic.IEEE != nil && *ic.IEEE != addr {
+			return "", fmt.Errorf("%w: install code belongs to %s, not %s", device.ErrValidation, FormatIEEE(*ic.IEEE), ieee)
+		}
+	case ic.IEEE != nil:
+		addr = *ic.IEEE
+	default:
+		return "", fmt.Errorf("%w: IEEE address required for install code", device.ErrValidation)
+	}
+
+	if err := c.ezsp.ImportTransientKey(addr, ic.LinkKey()); err != nil {
+		return "", fmt.Errorf("import install code key: %w", err)
+	}
+	log.Info().Str("ieee", FormatIEEE(addr)).Msg("Install code key imported")
+	return FormatIEEE(addr), nil
+}
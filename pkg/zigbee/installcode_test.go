@@ -0,0 +1,65 @@
+package zigbee
+
+import (
+	"encoding/hex"
+	"errors"
+	"testing"
+
+	"github.com/urmzd/zigbee-skill/pkg/device"
+)
+
+// Example install code and derived key from the Zigbee install code documentation.
+const (
+	sampleInstallCode = "83FED3407A939723A5C639B26916D505C3B5"
+	sampleLinkKey     = "66b6900981e1ee3ca4206b6b861c02bb"
+)
+
+func TestParseInstallCode_LinkKey(t *testing.T) {
+	ic, err := ParseInstallCode(sampleInstallCode)
+	if err != nil {
+		t.Fatalf("ParseInstallCode: %v", err)
+	}
+	key := ic.LinkKey()
+	if got := hex.EncodeToString(key[:]); got != sampleLinkKey {
+		t.Errorf("link key = %s, want %s", got, sampleLinkKey)
+	}
+	if ic.IEEE != nil {
+		t.Errorf("plain install code should not carry an IEEE address")
+	}
+}
+
+func TestParseInstallCode_Formats(t *testing.T) {
+	for _, in := range []string{
+		"83FE D340 7A93 9723 A5C6 39B2 6916 D505 C3B5",
+		"Z:00158D0001020304$I:83FED3407A939723A5C639B26916D505C3B5",
+		"G$M:lumi.sensor$A:00158D0001020304$I:83FED3407A939723A5C639B26916D505C3B5",
+		"00:15:8d:00:01:02:03:04|83FED3407A939723A5C639B26916D505C3B5",
+		"33790-54080-31379-38691-42438-14770-26902-54533-50101",
+	} {
+		ic, err := ParseInstallCode(in)
+		if err != nil {
+			t.Errorf("%q: %v", in, err)
+			continue
+		}
+		if key := ic.LinkKey(); hex.EncodeToString(key[:]) != sampleLinkKey {
+			t.Errorf("%q: wrong link key", in)
+		}
+	}
+
+	ic, _ := ParseInstallCode("Z:00158D0001020304$I:83FED3407A939723A5C639B26916D505C3B5")
+	if ic.IEEE == nil || FormatIEEE(*ic.IEEE) != "00:15:8d:00:01:02:03:04" {
+		t.Errorf("QR IEEE not parsed: %v", ic.IEEE)
+	}
+}
+
+func TestParseInstallCode_Invalid(t *testing.T) {
+	for _, in := range []string{
+		"83FED3407A939723A5C639B26916D505C3B6", // bad CRC
+		"83FED3407A93",                         // bad length
+		"not-an-install-code",
+	} {
+		if _, err := ParseInstallCode(in); !errors.Is(err, device.ErrValidation) {
+			t.Errorf("%q: expected ErrValidation, got %v", in, err)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package zigbee
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/urmzd/zigbee-skill/pkg/device"
+)
+
+// JoinPolicy restricts which devices may join the network.
+type JoinPolicy struct {
+	// Allow lists IEEE address prefixes (e.g. OUIs like "00:15:8d") that may
+	// join. Empty allows any device.
+	Allow []string
+	// Deny lists IEEE addresses or prefixes that are always rejected, even if
+	// they were paired before.
+	Deny []string
+	// MaxNewDevices caps new devices per permit-join session; 0 is unlimited.
+	// Joining closes once the cap is reached.
+	MaxNewDevices int
+}
+
+// restricts reports whether the policy can reject a join, in which case the
+// Trust Center defers joins until the host admits them.
+func (p JoinPolicy) restricts() bool {
+	return len(p.Allow) > 0 || len(p.Deny) > 0 || p.MaxNewDevices > 0
+}
+
+// normalizeIEEEPrefix lowercases an address or prefix and strips separators.
+func normalizeIEEEPrefix(s string) string {
+	return strings.NewReplacer(":", "", "-", "", " ", "").Replace(strings.ToLower(s))
+}
+
+func matchesAnyPrefix(ieee string, prefixes []string) bool {
+	addr := normalizeIEEEPrefix(ieee)
+	for _, p := range prefixes {
+		if p = normalizeIEEEPrefix(p); p != "" && strings.HasPrefix(addr, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// admitJoin applies the join policy to a device reported by
+// trustCenterJoinHandler. It returns a rejection reason, or "" to admit.
+func (c *Controller) admitJoin(ieee string, known bool) string {
+	p := c.opts.JoinPolicy
+	if matchesAnyPrefix(ieee, p.Deny) {
+		return "denied by join policy"
+	}
+	if known {
+		return ""
+	}
+	if len(p.Allow) > 0 && !matchesAnyPrefix(ieee, p.Allow) {
+		return "not in join allow-list"
+	}
+	if p.MaxNewDevices > 0 {
+		c.joinMu.Lock()
+		defer c.joinMu.Unlock()
+		if c.sessionJoins >= p.MaxNewDevices {
+			return fmt.Sprintf("session limit of %d new devices reached", p.MaxNewDevices)
+		}
+		c.sessionJoins++
+		if c.sessionJoins == p.MaxNewDevices {
+			log.Info().Int("max", p.MaxNewDevices).Msg("Join session limit reached, closing network")
+			go func() {
+				if err := c.PermitJoin(context.Background(), false, 0); err != nil {
+					log.Warn().Err(err).Msg("Failed to close network after session limit")
+				}
+			}()
+		}
+	}
+	return ""
+}
+
+// resetJoinSession starts a new permit-join session for MaxNewDevices.
+func (c *Controller) resetJoinSession() {
+	c.joinMu.Lock()
+	c.sessionJoins = 0
+	c.joinMu.Unlock()
+}
+
+// rejectJoin publishes a device_rejected event. A deferred join is refused by
+// withholding the network key; the device gives up waiting for it. A device
+// that already holds the key (a rejoin) is asked to leave without rejoining.
+func (c *Controller) rejectJoin(nodeID uint16, ieee [8]byte, deferred bool, reason string) {
+	ieeeStr := FormatIEEE(ieee)
+	log.Warn().Str("ieee", ieeeStr).Uint16("nodeID", nodeID).Str("reason", reason).Msg("Rejecting join")
+
+	c.Publish(device.Event{
+		Type:      device.EventDeviceRejected,
+		Device:    &device.Device{ID: ieeeStr},
+		Reason:    reason,
+		Timestamp: time.Now(),
+	})
+	if deferred {
+		return
+	}
+
+	// Callbacks must not send EZSP commands on the reader goroutine.
+	go func() {
+		// Mgmt_Leave_req: seq(1) + IEEE address(8) + options(1): no rejoin, keep children
+		payload := make([]byte, 10)
+		payload[0] = nextZDOSeq()
+		copy(payload[1:9], ieee[:])
+		if err := c.ezsp.SendUnicast(nodeID, zdoProfileID, zdoClusterMgmtLeaveReq, 0, 0, payload); err != nil {
+			log.Warn().Err(err).Str("ieee", ieeeStr).Msg("Failed to send Mgmt_Leave_req to rejected device")
+		}
+	}()
+}
+
+// sendNetworkKey completes an admitted deferred join by sending the device
+// the network key through its parent.
+func (c *Controller) sendNetworkKey(nodeID uint16, ieee [8]byte, parent uint16) {
+	go func() {
+		if err := c.ezsp.UnicastCurrentNetworkKey(nodeID, ieee, parent); err != nil {
+			log.Warn().Err(err).Str("ieee", FormatIEEE(ieee)).Msg("Failed to send network key to admitted device")
+		}
+	}()
+}
@@ -0,0 +1,90 @@
+package zigbee
+
+import (
+	"testing"
+	"time"
+
+	"github.com/urmzd/zigbee-skill/pkg/device"
+)
+
+func TestAdmitJoin(t *testing.T) {
+	c := &Controller{opts: Options{JoinPolicy: JoinPolicy{
+		Allow: []string{"00:15:8d", "54EF44"},
+		Deny:  []string{"00:15:8d:00:00:00:00:99"},
+	}}}
+
+	cases := []struct {
+		ieee   string
+		known  bool
+		reason string // empty = admitted
+	}{
+		{"00:15:8d:00:01:02:03:04", false, ""},
+		{"54:ef:44:10:00:00:00:01", false, ""},
+		{"a4:c1:38:00:00:00:00:01", false, "not in join allow-list"},
+		{"a4:c1:38:00:00:00:00:01", true, ""}, // already paired
+		{"00:15:8d:00:00:00:00:99", false, "denied by join policy"},
+		{"00:15:8d:00:00:00:00:99", true, "denied by join policy"},
+	}
+	for _, tc := range cases {
+		if reason := c.admitJoin(tc.ieee, tc.known); reason != tc.reason {
+			t.Errorf("admitJoin(%s, known=%v) = %q, want %q", tc.ieee, tc.known, reason, tc.reason)
+		}
+	}
+}
+
+func TestDeferredJoin(t *testing.T) {
+	e, ncp := newFakeNCP(t, 13)
+	keySent := make(chan []byte, 1)
+	ncp.handle(ezspUnicastCurrentNetworkKey, func(p []byte) []byte {
+		keySent <- p
+		return statusBytes(13, 0)
+	})
+	stop := make(chan struct{})
+	t.Cleanup(func() { close(stop) })
+	c := &Controller{
+		ash: e.ash, ezsp: e, connected: true, stopChan: stop,
+		KnownDevices: NewKnownDevices(nil),
+		opts:         Options{JoinPolicy: JoinPolicy{Allow: []string{"00:15:8d"}}},
+	}
+	rejected := c.Subscribe(device.EventFilter{Types: []string{device.EventDeviceRejected}})
+	defer c.Unsubscribe(rejected)
+
+	// trustCenterJoinHandler: nodeID(2) + EUI64(8) + status(1) + decision(1) + parent(2)
+	join := func(nodeID uint16, ieee [8]byte) {
+		data := []byte{byte(nodeID), byte(nodeID >> 8)}
+		data = append(data, ieee[:]...)
+		data = append(data, emberUnsecuredJoin, 0x03, 0x00, 0x00)
+		c.handleTrustCenterJoin(data)
+	}
+
+	denied := [8]byte{0x01, 0, 0, 0, 0, 0x38, 0xC1, 0xA4}  // a4:c1:38:...
+	allowed := [8]byte{0x01, 0, 0, 0, 0, 0x8D, 0x15, 0x00} // 00:15:8d:...
+
+	join(0x1234, denied)
+	select {
+	case evt := <-rejected:
+		if evt.Device.ID != FormatIEEE(denied) {
+			t.Errorf("rejected %s", evt.Device.ID)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no device_rejected event")
+	}
+
+	join(0x5678, allowed)
+	select {
+	case p := <-keySent:
+		if p[0] != 0x78 || p[1] != 0x56 {
+			t.Errorf("network key sent to %x, want 0x5678", p[0:2])
+		}
+	case <-time.After(time.Second):
+		t.Fatal("network key not sent to admitted device")
+	}
+	for _, id := range ncp.sent() {
+		if id == ezspSendUnicast {
+			t.Error("Mgmt_Leave_req sent for a deferred join")
+		}
+	}
+	if _, ok := c.devices[FormatIEEE(denied)]; ok {
+		t.Error("rejected device added to the device list")
+	}
+}
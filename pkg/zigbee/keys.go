@@ -0,0 +1,183 @@
+package zigbee
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/urmzd/zigbee-skill/pkg/device"
+)
+
+// networkKeySwitchDelay is the wait between distributing the next network key
+// and switching to it. Routers receive the broadcast within
+// nwkcNetworkBroadcastDeliveryTime; sleepy children need a few poll intervals
+// to collect it from their parent.
+var networkKeySwitchDelay = 30 * time.Second
+
+// EmberKeyStatus values reported by zigbeeKeyEstablishmentHandler.
+const (
+	emberKeyStatusTCRespondedToKeyRequest   uint8 = 0x06
+	emberKeyStatusTCResponseFailed          uint8 = 0x08
+	emberKeyStatusTCRequestKeyTypeUnsupport uint8 = 0x09
+	emberKeyStatusTCNoLinkKeyForRequester   uint8 = 0x0A
+	emberKeyStatusTCFailedToGenerateNewKey  uint8 = 0x12
+	emberKeyStatusTCFailedToSendTCKey       uint8 = 0x13
+	emberKeyStatusTCRequesterVerifyTimeout  uint8 = 0x32
+	emberKeyStatusTCRequesterVerifyFailure  uint8 = 0x33
+	emberKeyStatusTCRequesterVerifySuccess  uint8 = 0x34
+	emberKeyStatusVerifyLinkKeyFailure      uint8 = 0x64
+	emberKeyStatusVerifyLinkKeySuccess      uint8 = 0x65
+)
+
+// handleKeyEstablishment processes zigbeeKeyEstablishmentHandler (0x009B),
+// which reports progress of a device's TC link key update.
+func (c *Controller) handleKeyEstablishment(data []byte) {
+	// Format: partner EUI64(8) + EmberKeyStatus(1)
+	if len(data) < 9 {
+		return
+	}
+	var ieee [8]byte
+	copy(ieee[:], data[0:8])
+	status := data[8]
+
+	var s string
+	switch status {
+	case emberKeyStatusTCRespondedToKeyRequest:
+		s = device.LinkKeyStatusKeySent
+	case emberKeyStatusTCRequesterVerifySuccess, emberKeyStatusVerifyLinkKeySuccess:
+		s = device.LinkKeyStatusVerified
+	case emberKeyStatusTCResponseFailed, emberKeyStatusTCFailedToSendTCKey,
+		emberKeyStatusTCRequesterVerifyTimeout, emberKeyStatusTCRequesterVerifyFailure,
+		emberKeyStatusVerifyLinkKeyFailure, emberKeyStatusTCFailedToGenerateNewKey,
+		emberKeyStatusTCNoLinkKeyForRequester, emberKeyStatusTCRequestKeyTypeUnsupport:
+		s = device.LinkKeyStatusFailed
+	default:
+		log.Debug().Str("ieee", FormatIEEE(ieee)).Uint8("status", status).Msg("Key establishment event")
+		return
+	}
+	log.Info().Str("ieee", FormatIEEE(ieee)).Str("status", s).Uint8("code", status).Msg("TC link key update")
+
+	c.mu.Lock()
+	kd, ok := c.devices[FormatIEEE(ieee)]
+	changed := ok && kd.LinkKeyStatus != s
+	if changed {
+		kd.LinkKeyStatus = s
+	}
+	c.mu.Unlock()
+	if changed {
+		c.NotifyDeviceChange()
+	}
+}
+
+// RotateNetworkKey broadcasts a new random network key, waits for it to
+// reach sleepy devices, then broadcasts the key switch. Switching restarts
+// the NWK frame counter, so rotation is also the remedy for a counter
+// approaching its limit.
+func (c *Controller) RotateNetworkKey(ctx context.Context) (*device.KeyRotation, error) {
+	if !c.IsConnected() {
+		return nil, device.ErrNotConnected
+	}
+	before, err := c.ezsp.GetNetworkKey()
+	if err != nil {
+		return nil, fmt.Errorf("read network key: %w", err)
+	}
+
+	var next [16]byte
+	if _, err := rand.Read(next[:]); err != nil {
+		return nil, fmt.Errorf("generate network key: %w", err)
+	}
+	log.Info().Uint8("sequence", before.SequenceNumber).Msg("Broadcasting next network key")
+	if err := c.ezsp.BroadcastNextNetworkKey(next); err != nil {
+		return nil, err
+	}
+
+	select {
+	case <-time.After(networkKeySwitchDelay):
+	case <-ctx.Done():
+		// The next key is already out; switching later with another rotate is safe.
+		return nil, ctx.Err()
+	case <-c.stopChan:
+		return nil, device.ErrNotConnected
+	}
+
+	log.Info().Msg("Broadcasting network key switch")
+	if err := c.ezsp.BroadcastNetworkKeySwitch(); err != nil {
+		return nil, err
+	}
+
+	after, err := c.ezsp.GetNetworkKey()
+	if err != nil {
+		return nil, fmt.Errorf("read network key after switch: %w", err)
+	}
+	if after.SequenceNumber == before.SequenceNumber {
+		return nil, fmt.Errorf("network key sequence did not advance (still %d)", after.SequenceNumber)
+	}
+	c.notifyNetworkChange()
+
+	return &device.KeyRotation{
+		PreviousSequence:     int(before.SequenceNumber),
+		Sequence:             int(after.SequenceNumber),
+		PreviousFrameCounter: before.OutgoingFrameCounter,
+		FrameCounter:         after.OutgoingFrameCounter,
+	}, nil
+}
+
+// KeyTable reports the network key sequence and frame counter, and for every
+// known device whether it holds a unique TC link key.
+func (c *Controller) KeyTable(_ context.Context) (*device.KeyTable, error) {
+	if !c.IsConnected() {
+		return nil, device.ErrNotConnected
+	}
+	nwk, err := c.ezsp.GetNetworkKey()
+	if err != nil {
+		return nil, fmt.Errorf("read network key: %w", err)
+	}
+	entries, err := c.ezsp.GetLinkKeys()
+	if err != nil {
+		return nil, fmt.Errorf("read key table: %w", err)
+	}
+	byIEEE := make(map[string]KeyEntry, len(entries))
+	for _, e := range entries {
+		byIEEE[FormatIEEE(e.PartnerEUI64)] = e
+	}
+
+	t := &device.KeyTable{
+		NetworkKeySequence:     int(nwk.SequenceNumber),
+		NetworkKeyFrameCounter: nwk.OutgoingFrameCounter,
+	}
+	c.mu.RLock()
+	for ieee, kd := range c.devices {
+		info := device.LinkKeyInfo{
+			IEEEAddress: ieee,
+			Name:        kd.FriendlyName,
+			Status:      kd.LinkKeyStatus,
+		}
+		if e, ok := byIEEE[ieee]; ok {
+			info.InKeyTable = true
+			info.OutgoingFrameCounter = e.OutgoingFrameCounter
+			info.IncomingFrameCounter = e.IncomingFrameCounter
+			delete(byIEEE, ieee)
+		}
+		if info.Status == "" {
+			info.Status = device.LinkKeyStatusUnknown
+		}
+		t.LinkKeys = append(t.LinkKeys, info)
+	}
+	c.mu.RUnlock()
+
+	// Keys for devices no longer in the device list.
+	for ieee, e := range byIEEE {
+		t.LinkKeys = append(t.LinkKeys, device.LinkKeyInfo{
+			IEEEAddress:          ieee,
+			Status:               device.LinkKeyStatusUnknown,
+			InKeyTable:           true,
+			OutgoingFrameCounter: e.OutgoingFrameCounter,
+			IncomingFrameCounter: e.IncomingFrameCounter,
+		})
+	}
+	sort.Slice(t.LinkKeys, func(i, j int) bool { return t.LinkKeys[i].IEEEAddress < t.LinkKeys[j].IEEEAddress })
+	return t, nil
+}
@@ -0,0 +1,124 @@
+package zigbee
+
+import (
+	"context"
+	"encoding/binary"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/urmzd/zigbee-skill/pkg/device"
+)
+
+func TestRotateNetworkKey(t *testing.T) {
+	defer func(d time.Duration) { networkKeySwitchDelay = d }(networkKeySwitchDelay)
+	networkKeySwitchDelay = 10 * time.Millisecond
+
+	for _, version := range []uint8{12, 13, 14} {
+		e, ncp := newFakeNCP(t, version)
+		c := &Controller{ash: e.ash, ezsp: e, connected: true, stopChan: make(chan struct{})}
+
+		// The key sequence and frame counter change only on the switch.
+		var mu sync.Mutex
+		seq, counter := uint8(3), uint32(0x1000)
+		var next []byte
+		key := func() (uint8, uint32) {
+			mu.Lock()
+			defer mu.Unlock()
+			return seq, counter
+		}
+		ncp.handle(ezspBroadcastNextNetworkKey, func(p []byte) []byte {
+			mu.Lock()
+			next = append([]byte(nil), p...)
+			mu.Unlock()
+			return statusBytes(version, 0)
+		})
+		ncp.handle(ezspBroadcastNetworkKeySwitch, func([]byte) []byte {
+			mu.Lock()
+			seq, counter = seq+1, 0
+			mu.Unlock()
+			return statusBytes(version, 0)
+		})
+		// v12: getKey returns EmberStatus + EmberKeyStruct.
+		ncp.handle(ezspGetKey, func([]byte) []byte {
+			s, fc := key()
+			b := make([]byte, 37)
+			binary.LittleEndian.PutUint32(b[20:24], fc)
+			b[28] = s
+			return b
+		})
+		// v13+: exportKey returns key(16) + status(4); getNetworkKeyInfo
+		// returns status(4) + sets(2) + sequence(1) + altSequence(1) + counter(4).
+		ncp.handle(ezspExportKey, func([]byte) []byte { return make([]byte, 20) })
+		ncp.handle(ezspGetNetworkKeyInfo, func([]byte) []byte {
+			s, fc := key()
+			b := make([]byte, 12)
+			b[6] = s
+			binary.LittleEndian.PutUint32(b[8:12], fc)
+			return b
+		})
+
+		r, err := c.RotateNetworkKey(context.Background())
+		if err != nil {
+			t.Fatalf("v%d: %v", version, err)
+		}
+		want := device.KeyRotation{PreviousSequence: 3, Sequence: 4, PreviousFrameCounter: 0x1000, FrameCounter: 0}
+		if *r != want {
+			t.Errorf("v%d: rotation = %+v, want %+v", version, *r, want)
+		}
+		if len(next) != 16 {
+			t.Errorf("v%d: broadcast key length %d", version, len(next))
+		}
+		calls := slices.DeleteFunc(ncp.sent(), func(id uint16) bool {
+			return id != ezspBroadcastNextNetworkKey && id != ezspBroadcastNetworkKeySwitch
+		})
+		if !slices.Equal(calls, []uint16{ezspBroadcastNextNetworkKey, ezspBroadcastNetworkKeySwitch}) {
+			t.Errorf("v%d: broadcasts = %04x", version, calls)
+		}
+	}
+}
+
+func TestRotateNetworkKeyRejected(t *testing.T) {
+	e, ncp := newFakeNCP(t, 14)
+	c := &Controller{ash: e.ash, ezsp: e, connected: true, stopChan: make(chan struct{})}
+	ncp.handle(ezspExportKey, func([]byte) []byte { return make([]byte, 20) })
+	ncp.handle(ezspGetNetworkKeyInfo, func([]byte) []byte { return make([]byte, 12) })
+	ncp.handle(ezspBroadcastNextNetworkKey, func([]byte) []byte { return statusBytes(14, 0x0C) })
+
+	if _, err := c.RotateNetworkKey(context.Background()); err == nil {
+		t.Fatal("rotation succeeded after broadcastNextNetworkKey failed")
+	}
+	if slices.Contains(ncp.sent(), ezspBroadcastNetworkKeySwitch) {
+		t.Error("key switch sent after the next key was rejected")
+	}
+}
+
+func TestHandleKeyEstablishment(t *testing.T) {
+	ieee := [8]byte{1, 2, 3, 4, 5, 6, 7, 8}
+	for _, tc := range []struct {
+		status  uint8
+		want    string
+		changed bool
+	}{
+		{emberKeyStatusTCRespondedToKeyRequest, device.LinkKeyStatusKeySent, true},
+		{emberKeyStatusTCRequesterVerifySuccess, device.LinkKeyStatusVerified, true},
+		{emberKeyStatusVerifyLinkKeySuccess, device.LinkKeyStatusVerified, true},
+		{emberKeyStatusTCRequesterVerifyTimeout, device.LinkKeyStatusFailed, true},
+		{emberKeyStatusTCNoLinkKeyForRequester, device.LinkKeyStatusFailed, true},
+		{0x01, device.LinkKeyStatusUnknown, false}, // progress events leave the status alone
+	} {
+		var changes int
+		c := &Controller{KnownDevices: &KnownDevices{
+			devices:        map[string]*KnownDevice{FormatIEEE(ieee): {LinkKeyStatus: device.LinkKeyStatusUnknown}},
+			onDeviceChange: func() { changes++ },
+		}}
+		c.handleKeyEstablishment(append(ieee[:], tc.status))
+		if got := c.devices[FormatIEEE(ieee)].LinkKeyStatus; got != tc.want {
+			t.Errorf("status 0x%02X: link key status %q, want %q", tc.status, got, tc.want)
+		}
+		if (changes == 1) != tc.changed || changes > 1 {
+			t.Errorf("status 0x%02X: %d change notifications", tc.status, changes)
+		}
+	}
+}
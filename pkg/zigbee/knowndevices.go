@@ -0,0 +1,374 @@
+package zigbee
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/urmzd/zigbee-skill/pkg/device"
+)
+
+// stateReadTimeout bounds the wait for a Read Attributes Response.
+const stateReadTimeout = 5 * time.Second
+
+// Sender delivers commands to devices for a KnownDevices table.
+type Sender interface {
+	IsConnected() bool
+	// SendZCL sends a ZCL frame to kd and waits for APS delivery. If
+	// expectDefaultResponse is set the ZCL Default Response is handled as
+	// described on AwaitDelivery.
+	SendZCL(ctx context.Context, kd *KnownDevice, clusterID uint16, frame []byte, expectDefaultResponse bool) error
+	// SendLeave asks kd to leave the network.
+	SendLeave(kd *KnownDevice) error
+}
+
+// KnownDevices keeps the devices known to a coordinator and implements the
+// device.Controller methods that only need that bookkeeping. The EZSP, ZNP
+// and deCONZ controllers embed it and send through their own radio layer.
+type KnownDevices struct {
+	sender Sender
+	events *device.Bus
+
+	devices map[string]*KnownDevice // IEEE string -> device
+	mu      sync.RWMutex            // guards devices and the fields of their entries
+
+	onDeviceChange func()
+	onStateChange  func(string, device.DeviceState)
+}
+
+// NewKnownDevices returns an empty KnownDevices table that sends through sender.
+func NewKnownDevices(sender Sender) *KnownDevices {
+	return &KnownDevices{
+		sender:  sender,
+		events:  device.NewBus(),
+		devices: make(map[string]*KnownDevice),
+	}
+}
+
+// View calls fn with the device map locked for reading.
+func (t *KnownDevices) View(fn func(devices map[string]*KnownDevice)) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	fn(t.devices)
+}
+
+// Update calls fn with the device map locked for writing.
+func (t *KnownDevices) Update(fn func(devices map[string]*KnownDevice)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	fn(t.devices)
+}
+
+// SetOnDeviceChange registers a callback invoked after the device list changes.
+func (t *KnownDevices) SetOnDeviceChange(fn func()) { t.onDeviceChange = fn }
+
+// SetOnStateChange registers a callback invoked with a device's IEEE address
+// and a copy of its state after the cached state changes.
+func (t *KnownDevices) SetOnStateChange(fn func(string, device.DeviceState)) { t.onStateChange = fn }
+
+// NotifyDeviceChange calls the device change callback if set.
+func (t *KnownDevices) NotifyDeviceChange() {
+	if t.onDeviceChange != nil {
+		t.onDeviceChange()
+	}
+}
+
+// notifyStateChange calls the state callback if set and publishes a
+// state_changed event. It must not be called with the registry locked.
+func (t *KnownDevices) notifyStateChange(ieee [8]byte, state device.DeviceState) {
+	id := FormatIEEE(ieee)
+	if t.onStateChange != nil {
+		t.onStateChange(id, state)
+	}
+	t.Publish(device.Event{Type: device.EventStateChanged, DeviceID: id, State: state, Timestamp: time.Now()})
+}
+
+// Publish sends an event to the matching subscribers.
+func (t *KnownDevices) Publish(evt device.Event) {
+	t.events.Publish(evt)
+}
+
+// PublishInterview reports the progress of a new device's interview; err is
+// set for the failed stage.
+func (t *KnownDevices) PublishInterview(ieee, stage string, err error) {
+	evt := device.Event{Type: device.EventInterview, DeviceID: ieee, Stage: stage, Timestamp: time.Now()}
+	if err != nil {
+		evt.Error = err.Error()
+	}
+	t.Publish(evt)
+}
+
+// PublishAvailability emits a device_online or device_offline event.
+func (t *KnownDevices) PublishAvailability(ieee string, kd *KnownDevice, available bool) {
+	evType := device.EventDeviceOffline
+	if available {
+		evType = device.EventDeviceOnline
+	}
+	log.Info().Str("device", ieee).Str("event", evType).Msg("Device availability changed")
+
+	t.mu.RLock()
+	dev := ToDevice(ieee, kd)
+	t.mu.RUnlock()
+	t.Publish(device.Event{Type: evType, Device: &dev, Timestamp: time.Now()})
+}
+
+// MarkSeen refreshes last-seen and link quality for the sending device and
+// flips an offline device back online.
+func (t *KnownDevices) MarkSeen(nodeID uint16, lqi uint8) {
+	t.markSeen(nodeID, lqi, 0)
+}
+
+// markSeen is MarkSeen for radios that also report the last-hop RSSI. Any
+// traffic also clears the device's ping backoff.
+func (t *KnownDevices) markSeen(nodeID uint16, lqi uint8, rssi int8) {
+	t.mu.Lock()
+	ieee, kd := deviceByNodeID(t.devices, nodeID)
+	if kd == nil {
+		t.mu.Unlock()
+		return
+	}
+	kd.LastSeen = time.Now()
+	kd.LinkQuality = lqi
+	kd.RSSI = rssi
+	kd.heard = true
+	cameOnline := !kd.Available
+	kd.Available = true
+	kd.pingBackoff, kd.nextPing = 0, time.Time{}
+	t.mu.Unlock()
+
+	if cameOnline {
+		t.PublishAvailability(ieee, kd, true)
+	}
+}
+
+// UpdateState applies attribute values read from or reported by a device
+// and wakes a pending GetDeviceState.
+func (t *KnownDevices) UpdateState(nodeID, clusterID uint16, attrs map[uint16][]byte) {
+	t.mu.Lock()
+	_, kd := deviceByNodeID(t.devices, nodeID)
+	if kd == nil || !kd.applyAttributes(clusterID, attrs) {
+		t.mu.Unlock()
+		return
+	}
+	state := CopyState(kd.State)
+	t.mu.Unlock()
+	t.notifyStateChange(kd.IEEEAddress, state)
+}
+
+// IEEEForNodeID returns the IEEE address of the known device using nodeID.
+func (t *KnownDevices) IEEEForNodeID(nodeID uint16) (string, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	ieee, kd := deviceByNodeID(t.devices, nodeID)
+	return ieee, kd != nil
+}
+
+// deviceByNodeID finds a device by short address; 0 is never a device's.
+func deviceByNodeID(devices map[string]*KnownDevice, nodeID uint16) (string, *KnownDevice) {
+	if nodeID == 0 {
+		return "", nil
+	}
+	for ieee, kd := range devices {
+		if kd.NodeID == nodeID {
+			return ieee, kd
+		}
+	}
+	return "", nil
+}
+
+// resolve finds a device by IEEE address or friendly name. Must be called
+// with mu held.
+func (t *KnownDevices) resolve(id string) (string, *KnownDevice, bool) {
+	if kd, ok := t.devices[id]; ok {
+		return id, kd, true
+	}
+	for ieee, kd := range t.devices {
+		if strings.EqualFold(kd.FriendlyName, id) {
+			return ieee, kd, true
+		}
+	}
+	return "", nil, false
+}
+
+// ExportDevices returns a snapshot of all known devices for persistence.
+func (t *KnownDevices) ExportDevices() []ExportedDevice {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	out := make([]ExportedDevice, 0, len(t.devices))
+	for ieee, kd := range t.devices {
+		out = append(out, exportDevice(ieee, kd))
+	}
+	return out
+}
+
+// --- device.Controller interface ---
+
+func (t *KnownDevices) ListDevices(_ context.Context) ([]device.Device, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	devices := make([]device.Device, 0, len(t.devices))
+	for ieee, kd := range t.devices {
+		devices = append(devices, ToDevice(ieee, kd))
+	}
+	return devices, nil
+}
+
+func (t *KnownDevices) GetDevice(_ context.Context, id string) (*device.Device, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	ieee, kd, ok := t.resolve(id)
+	if !ok {
+		return nil, device.ErrNotFound
+	}
+	dev := ToDevice(ieee, kd)
+	return &dev, nil
+}
+
+func (t *KnownDevices) RenameDevice(_ context.Context, id, newName string) error {
+	t.mu.Lock()
+	_, kd, ok := t.resolve(id)
+	if !ok {
+		t.mu.Unlock()
+		return device.ErrNotFound
+	}
+	kd.FriendlyName = newName
+	t.mu.Unlock()
+	t.NotifyDeviceChange()
+	return nil
+}
+
+func (t *KnownDevices) RemoveDevice(_ context.Context, id string, force bool) error {
+	t.mu.Lock()
+	ieee, kd, ok := t.resolve(id)
+	if !ok {
+		t.mu.Unlock()
+		return device.ErrNotFound
+	}
+	delete(t.devices, ieee)
+	t.mu.Unlock()
+
+	if err := t.sender.SendLeave(kd); err != nil {
+		log.Warn().Err(err).Str("device", ieee).Msg("Failed to send ZDO Leave request (device removed locally)")
+	}
+	t.NotifyDeviceChange()
+	return nil
+}
+
+func (t *KnownDevices) ClearDevices(_ context.Context) error {
+	t.mu.Lock()
+	devices := t.devices
+	t.devices = make(map[string]*KnownDevice)
+	t.mu.Unlock()
+
+	for ieee, kd := range devices {
+		if err := t.sender.SendLeave(kd); err != nil {
+			log.Warn().Err(err).Str("device", ieee).Msg("Failed to send ZDO Leave request")
+		}
+	}
+	t.NotifyDeviceChange()
+	return nil
+}
+
+// readyDevice resolves id to a device with a known short address.
+func (t *KnownDevices) readyDevice(id string) (*KnownDevice, error) {
+	if !t.sender.IsConnected() {
+		return nil, device.ErrNotConnected
+	}
+	t.mu.RLock()
+	_, kd, ok := t.resolve(id)
+	var nodeID uint16
+	if ok {
+		nodeID = kd.NodeID
+	}
+	t.mu.RUnlock()
+	if !ok {
+		return nil, device.ErrNotFound
+	}
+	if nodeID == 0 {
+		return nil, fmt.Errorf("%w: device %s has not rejoined the network (try power-cycling it)", device.ErrTimeout, id)
+	}
+	return kd, nil
+}
+
+func (t *KnownDevices) GetDeviceState(ctx context.Context, id string) (device.DeviceState, error) {
+	kd, err := t.readyDevice(id)
+	if err != nil {
+		return nil, err
+	}
+	noCache := device.NoCache(ctx)
+
+	ch := make(chan struct{}, 1)
+	t.mu.Lock()
+	if noCache {
+		kd.State = make(device.DeviceState)
+		kd.staleKeys = nil
+	}
+	kd.stateUpdate = ch
+	t.mu.Unlock()
+	defer func() {
+		t.mu.Lock()
+		kd.stateUpdate = nil
+		t.mu.Unlock()
+	}()
+
+	if err := t.sender.SendZCL(ctx, kd, zclClusterOnOff, BuildReadAttributesCommand(zclAttrOnOff), false); err != nil {
+		log.Warn().Err(err).Str("device", id).Msg("ReadAttributes not delivered")
+	}
+
+	select {
+	case <-ch:
+	case <-time.After(stateReadTimeout):
+		if noCache {
+			return nil, fmt.Errorf("%w: device %q did not respond within timeout", device.ErrTimeout, id)
+		}
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return CopyState(kd.State), nil
+}
+
+// SetDeviceState sends the requested changes and updates the cached state only
+// for commands whose delivery was confirmed.
+func (t *KnownDevices) SetDeviceState(ctx context.Context, id string, state map[string]any) (_ device.DeviceState, err error) {
+	kd, err := t.readyDevice(id)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { t.Publish(device.CommandResultEvent(FormatIEEE(kd.IEEEAddress), state, err)) }()
+
+	cmds, err := BuildStateCommands(state)
+	if err != nil {
+		return nil, err
+	}
+	for _, cmd := range cmds {
+		if err := t.sender.SendZCL(ctx, kd, cmd.Cluster, cmd.Frame, true); err != nil {
+			return nil, fmt.Errorf("send %s command: %w", cmd.Name, err)
+		}
+		t.mu.Lock()
+		cmd.Apply(kd.State)
+		kd.touchState(cmd.Confirms...)
+		applied := CopyState(kd.State)
+		t.mu.Unlock()
+		t.notifyStateChange(kd.IEEEAddress, applied)
+	}
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return CopyState(kd.State), nil
+}
+
+// --- device.EventSubscriber interface ---
+
+func (t *KnownDevices) Subscribe(filter device.EventFilter) chan device.Event {
+	return t.events.Subscribe(filter)
+}
+
+func (t *KnownDevices) Unsubscribe(ch chan device.Event) {
+	t.events.Unsubscribe(ch)
+}
@@ -0,0 +1,129 @@
+package zigbee
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/urmzd/zigbee-skill/pkg/device"
+)
+
+// fakeSender records what a KnownDevices table sends.
+type fakeSender struct {
+	err    error
+	frames []uint16 // clusters of sent ZCL frames
+	leaves []uint16 // node IDs asked to leave
+}
+
+func (f *fakeSender) IsConnected() bool { return true }
+
+func (f *fakeSender) SendZCL(_ context.Context, _ *KnownDevice, clusterID uint16, _ []byte, _ bool) error {
+	f.frames = append(f.frames, clusterID)
+	return f.err
+}
+
+func (f *fakeSender) SendLeave(kd *KnownDevice) error {
+	f.leaves = append(f.leaves, kd.NodeID)
+	return nil
+}
+
+func newTestDevices(s Sender) *KnownDevices {
+	d := NewKnownDevices(s)
+	d.Update(func(devices map[string]*KnownDevice) {
+		devices["00:11:22:33:44:55:66:77"] = &KnownDevice{
+			IEEEAddress:  [8]byte{0x77, 0x66, 0x55, 0x44, 0x33, 0x22, 0x11, 0x00},
+			NodeID:       0x1234,
+			FriendlyName: "lamp",
+			Endpoint:     1,
+			State:        device.DeviceState{"state": "OFF"},
+		}
+	})
+	return d
+}
+
+func TestKnownDevicesSetDeviceState(t *testing.T) {
+	s := &fakeSender{}
+	d := newTestDevices(s)
+	state, err := d.SetDeviceState(context.Background(), "lamp", map[string]any{"state": "ON"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state["state"] != "ON" || len(s.frames) != 1 || s.frames[0] != zclClusterOnOff {
+		t.Errorf("state = %v, frames = %v", state, s.frames)
+	}
+
+	s.err = device.ErrDeliveryFailed
+	if _, err := d.SetDeviceState(context.Background(), "lamp", map[string]any{"state": "OFF"}); !errors.Is(err, device.ErrDeliveryFailed) {
+		t.Fatalf("err = %v, want ErrDeliveryFailed", err)
+	}
+	dev, _ := d.GetDevice(context.Background(), "lamp")
+	if dev.State["state"] != "ON" {
+		t.Errorf("cached state = %v after a failed command", dev.State)
+	}
+}
+
+func TestKnownDevicesUpdateState(t *testing.T) {
+	d := newTestDevices(&fakeSender{})
+	var changed string
+	d.SetOnStateChange(func(ieee string, _ device.DeviceState) { changed = ieee })
+
+	d.UpdateState(0x1234, zclClusterLevelControl, map[uint16][]byte{zclAttrCurrentLevel: {0x80}})
+	dev, _ := d.GetDevice(context.Background(), "lamp")
+	if dev.State["brightness"] != 128 || changed != "00:11:22:33:44:55:66:77" {
+		t.Errorf("state = %v, changed = %q", dev.State, changed)
+	}
+}
+
+func TestKnownDevicesRemoveDevice(t *testing.T) {
+	s := &fakeSender{}
+	d := newTestDevices(s)
+	if err := d.RemoveDevice(context.Background(), "LAMP", false); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.leaves) != 1 || s.leaves[0] != 0x1234 {
+		t.Errorf("leaves = %v", s.leaves)
+	}
+	if _, err := d.GetDevice(context.Background(), "lamp"); !errors.Is(err, device.ErrNotFound) {
+		t.Errorf("err = %v, want ErrNotFound", err)
+	}
+}
+
+func TestKnownDevicesRestoredStateStaysStalePerKey(t *testing.T) {
+	d := newTestDevices(&fakeSender{})
+	d.Update(func(devices map[string]*KnownDevice) {
+		devices["00:11:22:33:44:55:66:77"].RestoreState(device.DeviceState{"state": "ON", "brightness": 40}, time.Now())
+	})
+	stale := func() bool {
+		dev, _ := d.GetDevice(context.Background(), "lamp")
+		return dev.StateStale
+	}
+
+	// Reading on/off confirms the on/off state but not the restored brightness.
+	d.UpdateState(0x1234, zclClusterOnOff, map[uint16][]byte{zclAttrOnOff: {0x01}})
+	if !stale() {
+		t.Fatal("state not stale with brightness unconfirmed")
+	}
+	// A relative step derives brightness from the restored value.
+	if _, err := d.SetDeviceState(context.Background(), "lamp", map[string]any{"brightness_step": -10}); err != nil {
+		t.Fatal(err)
+	}
+	if !stale() {
+		t.Fatal("state not stale after a relative step")
+	}
+	d.UpdateState(0x1234, zclClusterLevelControl, map[uint16][]byte{zclAttrCurrentLevel: {0x20}})
+	if stale() {
+		t.Error("state still stale after every key was confirmed")
+	}
+}
+
+func TestKnownDevicesReportsZeroLinkQuality(t *testing.T) {
+	d := newTestDevices(&fakeSender{})
+	if dev, _ := d.GetDevice(context.Background(), "lamp"); dev.LinkQuality != nil {
+		t.Fatalf("link quality = %d before any message", *dev.LinkQuality)
+	}
+	d.MarkSeen(0x1234, 0)
+	if dev, _ := d.GetDevice(context.Background(), "lamp"); dev.LinkQuality == nil || *dev.LinkQuality != 0 {
+		t.Errorf("link quality = %v after a message at LQI 0, want 0", dev.LinkQuality)
+	}
+}
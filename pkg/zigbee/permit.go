@@ -0,0 +1,207 @@
+package zigbee
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/urmzd/zigbee-skill/pkg/device"
+)
+
+// maxPermitChunk is the longest permit-join window a single permitJoining or
+// Mgmt_Permit_Joining_req may open; 0xFF would mean "forever" on old stacks.
+const maxPermitChunk = 254
+
+// PermitJoinVia opens joining on a single router, or on every router and the
+// coordinator when via is device.PermitJoinViaAll. When a single router is
+// chosen the coordinator itself stays closed, so devices pair through that
+// router even if the coordinator is in range.
+func (c *Controller) PermitJoinVia(ctx context.Context, via string, duration int) error {
+	if !c.IsConnected() {
+		return device.ErrNotConnected
+	}
+	if via == "" {
+		return c.PermitJoin(ctx, true, duration)
+	}
+	if strings.EqualFold(via, device.PermitJoinViaAll) {
+		c.prepareJoinSession()
+		return c.joinWindow.Open(duration, func(d uint8) error {
+			if err := c.ezsp.PermitJoining(d); err != nil {
+				return err
+			}
+			return c.broadcastPermitJoin(d)
+		}, c.stopChan)
+	}
+
+	c.mu.RLock()
+	_, kd, ok := c.resolve(via)
+	var nodeID uint16
+	var sleepy bool
+	if ok {
+		nodeID, sleepy = kd.NodeID, kd.Sleepy
+	}
+	c.mu.RUnlock()
+	switch {
+	case !ok:
+		return fmt.Errorf("%w: device %s", device.ErrNotFound, via)
+	case sleepy:
+		return fmt.Errorf("%w: %s is an end device and cannot accept joins", device.ErrValidation, via)
+	case nodeID == 0:
+		return fmt.Errorf("%w: %s has no network address yet", device.ErrValidation, via)
+	}
+	// Mains-powered end devices keep their receiver on, so only the node
+	// descriptor tells them apart from routers.
+	logicalType, err := c.logicalType(ctx, nodeID)
+	if err != nil {
+		return fmt.Errorf("read node descriptor of %s: %w", via, err)
+	}
+	if logicalType != 1 { // router
+		return fmt.Errorf("%w: %s is not a router (%s) and cannot accept joins", device.ErrValidation, via, zdoNodeType(logicalType))
+	}
+
+	c.prepareJoinSession()
+	c.joinWindow.Close()
+	if err := c.ezsp.PermitJoining(0); err != nil {
+		log.Warn().Err(err).Msg("Failed to close coordinator for targeted permit-join")
+	}
+	return c.joinWindow.Open(duration, func(d uint8) error {
+		// Re-read the address on every re-issue in case the router rejoined.
+		// Re-issues outlive the caller's context, so only zdoRequest's timeout applies.
+		c.mu.RLock()
+		id := kd.NodeID
+		c.mu.RUnlock()
+		return c.permitJoinOn(context.Background(), id, d)
+	}, c.stopChan)
+}
+
+// logicalType reads a device's logical type (0 = coordinator, 1 = router,
+// 2 = end device) from its node descriptor.
+func (c *Controller) logicalType(ctx context.Context, nodeID uint16) (uint8, error) {
+	// Node_Desc_req: NWKAddrOfInterest(2)
+	resp, err := c.zdoRequest(ctx, nodeID, zdoClusterNodeDescriptorReq, []byte{byte(nodeID), byte(nodeID >> 8)})
+	if err != nil {
+		return 0, err
+	}
+	if statusByte(resp) != 0x00 {
+		return 0, fmt.Errorf("%w: Node_Desc_rsp status 0x%02X", device.ErrDeliveryFailed, statusByte(resp))
+	}
+	// Node_Desc_rsp: seq(1) + status(1) + NWKAddrOfInterest(2) + NodeDescriptor(13)
+	if len(resp) < 5 {
+		return 0, fmt.Errorf("Node_Desc_rsp too short: %d bytes", len(resp))
+	}
+	return resp[4] & 0x07, nil
+}
+
+// prepareJoinSession starts a new join-policy session and loads the well-known
+// TC link key ("ZigBeeAlliance09") as a transient key so the NCP can encrypt
+// the APS Transport Key for joining devices. The key is skipped when only
+// install-code joins are allowed.
+func (c *Controller) prepareJoinSession() {
+	c.resetJoinSession()
+	if c.opts.RequireInstallCode {
+		return
+	}
+	var wildcardEui [8]byte
+	if err := c.ezsp.ImportTransientKey(wildcardEui, wellKnownLinkKey); err != nil {
+		log.Warn().Err(err).Msg("Failed to import transient link key (join may fail)")
+	}
+}
+
+// JoinWindow keeps permit joining open for longer than one request allows by
+// re-issuing it in 254s chunks. The zero value is ready to use.
+type JoinWindow struct {
+	mu   sync.Mutex
+	stop chan struct{} // closed to stop re-issuing the current window
+}
+
+// Open opens joining for duration seconds with open, and re-issues it until
+// the total is met, the window is closed or done is closed. Durations below
+// bdbcMinCommissioningTime are raised to it (BDB 9.7).
+func (w *JoinWindow) Open(duration int, open func(uint8) error, done <-chan struct{}) error {
+	duration = max(duration, bdbcMinCommissioningTime)
+	chunk := min(duration, maxPermitChunk)
+	if err := open(uint8(chunk)); err != nil {
+		return err
+	}
+
+	stop := make(chan struct{})
+	w.mu.Lock()
+	if w.stop != nil {
+		close(w.stop)
+	}
+	w.stop = stop
+	w.mu.Unlock()
+
+	if remaining := duration - chunk; remaining > 0 {
+		go reissuePermitJoin(chunk, remaining, open, stop, done)
+	}
+	return nil
+}
+
+// Close stops re-issuing the current window. Joining itself stays open until
+// the last request expires or is overridden.
+func (w *JoinWindow) Close() {
+	w.mu.Lock()
+	if w.stop != nil {
+		close(w.stop)
+		w.stop = nil
+	}
+	w.mu.Unlock()
+}
+
+// reissuePermitJoin extends permit joining in 254s chunks until the total duration is met.
+func reissuePermitJoin(current, remaining int, open func(uint8) error, stop, done <-chan struct{}) {
+	for remaining > 0 {
+		// Wait until just before the current permit window expires, then re-issue
+		select {
+		case <-time.After(time.Duration(current-4) * time.Second):
+		case <-stop:
+			return
+		case <-done:
+			return
+		}
+		current = min(remaining, maxPermitChunk)
+		if err := open(uint8(current)); err != nil {
+			log.Warn().Err(err).Msg("Failed to re-issue permit joining")
+			return
+		}
+		remaining -= current
+	}
+}
+
+// permitJoinOn sends Mgmt_Permit_Joining_req to one router and waits for it
+// to confirm.
+func (c *Controller) permitJoinOn(ctx context.Context, nodeID uint16, duration uint8) error {
+	// Mgmt_Permit_Joining_req: PermitDuration(1) + TC_Significance(1)
+	resp, err := c.zdoRequest(ctx, nodeID, zdoClusterMgmtPermitJoiningReq, []byte{duration, 0x01})
+	if err != nil {
+		return err
+	}
+	if statusByte(resp) != 0x00 {
+		return fmt.Errorf("%w: Mgmt_Permit_Joining_rsp status 0x%02X", device.ErrDeliveryFailed, statusByte(resp))
+	}
+	log.Info().Uint16("router", nodeID).Uint8("duration", duration).Msg("Permit joining opened on router")
+	return nil
+}
+
+// broadcastPermitJoin sends Mgmt_Permit_Joining_req to all routers. Routers
+// do not answer broadcasts, so delivery is not confirmed.
+func (c *Controller) broadcastPermitJoin(duration uint8) error {
+	payload := []byte{nextZDOSeq(), duration, 0x01}
+	return c.ezsp.SendBroadcast(0xFFFC, zdoProfileID, zdoClusterMgmtPermitJoiningReq, 0, 0, payload, 0)
+}
+
+// ieeeForNodeID maps a short address to the IEEE address of the coordinator
+// or a known device, falling back to the hex short address.
+func (c *Controller) ieeeForNodeID(nodeID uint16) string {
+	if nodeID == 0x0000 && c.coordIEEE != "" {
+		return c.coordIEEE
+	}
+	if ieee, ok := c.IEEEForNodeID(nodeID); ok {
+		return ieee
+	}
+	return fmt.Sprintf("0x%04x", nodeID)
+}
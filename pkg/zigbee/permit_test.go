@@ -0,0 +1,55 @@
+package zigbee
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/urmzd/zigbee-skill/pkg/device"
+)
+
+func TestPermitJoinViaChecksNodeType(t *testing.T) {
+	e, ncp := newFakeNCP(t, 13)
+	stop := make(chan struct{})
+	t.Cleanup(func() { close(stop) })
+	c := &Controller{
+		ash: e.ash, ezsp: e, connected: true, stopChan: stop,
+		KnownDevices: &KnownDevices{devices: map[string]*KnownDevice{
+			"router":        {NodeID: 0x1111, FriendlyName: "router"},
+			"mains-end-dev": {NodeID: 0x2222, FriendlyName: "mains-end-dev"},
+		}},
+		zdoWaiters: make(map[zdoWaitKey]chan []byte),
+	}
+	logicalTypes := map[uint16]uint8{0x1111: 1, 0x2222: 2}
+
+	// Answer ZDO requests as the addressed device would. sendUnicast v13:
+	// type(1) + destination(2) + apsFrame(11) + tag(1) + length(1) + message
+	ncp.handle(ezspSendUnicast, func(p []byte) []byte {
+		dest := binary.LittleEndian.Uint16(p[1:3])
+		cluster := binary.LittleEndian.Uint16(p[5:7])
+		msg := p[16:]
+		switch cluster {
+		case zdoClusterNodeDescriptorReq:
+			rsp := []byte{msg[0], 0x00, byte(dest), byte(dest >> 8), logicalTypes[dest]}
+			c.deliverZDOResponse(dest, cluster|0x8000, append(rsp, make([]byte, 12)...))
+		case zdoClusterMgmtPermitJoiningReq:
+			c.deliverZDOResponse(dest, cluster|0x8000, []byte{msg[0], 0x00})
+		}
+		return []byte{0x00, 0x00}
+	})
+
+	err := c.PermitJoinVia(context.Background(), "mains-end-dev", 180)
+	if !errors.Is(err, device.ErrValidation) {
+		t.Fatalf("permit join via end device = %v, want ErrValidation", err)
+	}
+	if slices.Contains(ncp.sent(), ezspPermitJoining) {
+		t.Error("coordinator joining changed for a rejected router")
+	}
+
+	if err := c.PermitJoinVia(context.Background(), "router", 180); err != nil {
+		t.Fatalf("permit join via router: %v", err)
+	}
+	c.joinWindow.Close()
+}
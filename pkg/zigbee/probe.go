@@ -0,0 +1,61 @@
+package zigbee
+
+import (
+	"time"
+)
+
+// probeTimeout bounds the wait for RSTACK while probing. The NCP resets on
+// RST, which takes a little over a second on most adapters.
+const probeTimeout = 3 * time.Second
+
+// ProbeASH reports whether an EZSP NCP answers an ASH RST on portPath. The
+// port is closed before returning.
+func ProbeASH(portPath string) bool {
+	s, err := OpenSerial(portPath)
+	if err != nil {
+		return false
+	}
+	defer func() { _ = s.Close() }()
+	return probeASH(s, probeTimeout)
+}
+
+// probeASH sends RST over t and waits for a valid RSTACK frame. Reads block,
+// so a transport that stays silent is abandoned to the caller's Close.
+func probeASH(t Transport, timeout time.Duration) bool {
+	if _, err := t.Write(append([]byte{ashCancelByte}, buildControlFrame(ashFrameRST)...)); err != nil {
+		return false
+	}
+	got := make(chan bool, 1)
+	go func() {
+		var buf []byte
+		for {
+			b, err := t.ReadByte()
+			if err != nil {
+				got <- false
+				return
+			}
+			switch b {
+			case ashCancelByte, ashSubstitute:
+				buf = buf[:0]
+			case ashFlagByte:
+				raw := ashUnstuff(buf)
+				buf = buf[:0]
+				if len(raw) >= 3 && raw[0] == ashFrameRSTACK &&
+					uint16(raw[len(raw)-2])<<8|uint16(raw[len(raw)-1]) == crcCCITT(raw[:len(raw)-2]) {
+					got <- true
+					return
+				}
+			default:
+				if len(buf) < ashMaxFrameLen {
+					buf = append(buf, b)
+				}
+			}
+		}
+	}()
+	select {
+	case ok := <-got:
+		return ok
+	case <-time.After(timeout):
+		return false
+	}
+}
@@ -0,0 +1,279 @@
+package zigbee
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/urmzd/zigbee-skill/pkg/device"
+)
+
+const (
+	// defaultEnergyScanDuration and defaultActiveScanDuration are scan duration
+	// exponents: each channel is scanned for (2^n + 1) × 15.36 ms.
+	defaultEnergyScanDuration = 4
+	defaultActiveScanDuration = 3
+
+	// scanTimeout bounds a whole scan across all requested channels.
+	scanTimeout = 60 * time.Second
+
+	// allChannelsMask covers 2.4 GHz channels 11-26.
+	allChannelsMask uint32 = 0x07FFF800
+)
+
+// ChannelEnergy is the maximum energy detected on one channel.
+type ChannelEnergy struct {
+	Channel uint8
+	RSSI    int8 // dBm
+}
+
+// FoundNetwork is a beacon received during an active scan (EmberZigbeeNetwork).
+type FoundNetwork struct {
+	Channel       uint8
+	PanID         uint16
+	ExtendedPanID [8]byte
+	AllowingJoin  bool
+	StackProfile  uint8
+	NwkUpdateID   uint8
+	LQI           uint8
+	RSSI          int8
+}
+
+// EnergyScan performs an IEEE 802.15.4 energy scan across the given channel
+// mask and returns the energy measured on each channel, ordered by channel.
+func (e *EZSPLayer) EnergyScan(channelMask uint32, duration uint8) ([]ChannelEnergy, error) {
+	var results []ChannelEnergy
+	err := e.scan(ezspEnergyScan, channelMask, duration, func(frameID uint16, data []byte) {
+		if frameID == ezspEnergyScanResultHandler && len(data) >= 2 {
+			log.Debug().Uint8("channel", data[0]).Int8("rssi", int8(data[1])).Msg("Energy scan result")
+			results = append(results, ChannelEnergy{Channel: data[0], RSSI: int8(data[1])})
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(results) == 0 {
+		return nil, fmt.Errorf("no channels found in energy scan")
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Channel < results[j].Channel })
+	return results, nil
+}
+
+// ActiveScan sends beacon requests across the given channel mask and returns
+// every network that answered.
+func (e *EZSPLayer) ActiveScan(channelMask uint32, duration uint8) ([]FoundNetwork, error) {
+	var found []FoundNetwork
+	err := e.scan(ezspActiveScan, channelMask, duration, func(frameID uint16, data []byte) {
+		// networkFoundHandler: EmberZigbeeNetwork{channel(1) + panId(2) + extendedPanId(8) +
+		//   allowingJoin(1) + stackProfile(1) + nwkUpdateId(1)} + lastHopLqi(1) + lastHopRssi(1)
+		if frameID != ezspNetworkFoundHandler || len(data) < 16 {
+			return
+		}
+		n := FoundNetwork{
+			Channel:      data[0],
+			PanID:        binary.LittleEndian.Uint16(data[1:3]),
+			AllowingJoin: data[11] != 0,
+			StackProfile: data[12],
+			NwkUpdateID:  data[13],
+			LQI:          data[14],
+			RSSI:         int8(data[15]),
+		}
+		copy(n.ExtendedPanID[:], data[3:11])
+		found = append(found, n)
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(found, func(i, j int) bool {
+		if found[i].Channel != found[j].Channel {
+			return found[i].Channel < found[j].Channel
+		}
+		return found[i].PanID < found[j].PanID
+	})
+	return found, nil
+}
+
+// scan runs startScan and feeds scan callbacks to onResult until
+// scanCompleteHandler arrives.
+func (e *EZSPLayer) scan(scanType uint8, channelMask uint32, duration uint8, onResult func(frameID uint16, data []byte)) error {
+	e.scanMu.Lock()
+	defer e.scanMu.Unlock()
+
+	type result struct {
+		frameID uint16
+		data    []byte
+	}
+	results := make(chan result, 64)
+	done := make(chan uint32, 1)
+
+	for _, frameID := range []uint16{ezspEnergyScanResultHandler, ezspNetworkFoundHandler} {
+		defer e.Listen(frameID, func(data []byte) {
+			select {
+			case results <- result{frameID, data}:
+			default:
+			}
+		})()
+	}
+	defer e.Listen(ezspScanCompleteHandler, func(data []byte) {
+		// scanCompleteHandler: channel(1) + status
+		if len(data) < 1 {
+			return
+		}
+		if status, _, err := e.codec().status(data[1:]); err == nil {
+			select {
+			case done <- status:
+			default:
+			}
+		}
+	})()
+
+	params := make([]byte, 7)
+	params[0] = scanType
+	binary.LittleEndian.PutUint32(params[1:5], channelMask)
+	params[5] = duration
+	params[6] = 0
+
+	resp, err := e.SendCommand(ezspStartScan, params)
+	if err != nil {
+		return fmt.Errorf("startScan: %w", err)
+	}
+	if err := e.checkStatus("startScan", resp); err != nil {
+		return err
+	}
+
+	timeout := time.After(scanTimeout)
+	for {
+		select {
+		case r := <-results:
+			onResult(r.frameID, r.data)
+		case status := <-done:
+			// Drain results that raced with completion.
+			for len(results) > 0 {
+				r := <-results
+				onResult(r.frameID, r.data)
+			}
+			if status != emberSuccess {
+				log.Warn().Uint32("status", status).Msg("Scan completed with error")
+			}
+			return nil
+		case <-timeout:
+			return fmt.Errorf("scan timed out")
+		case <-e.stopChan:
+			return fmt.Errorf("stopped")
+		}
+	}
+}
+
+// quietestOf returns the channel with the lowest measured energy.
+func quietestOf(results []ChannelEnergy) ChannelEnergy {
+	best := results[0]
+	for _, r := range results[1:] {
+		if r.RSSI < best.RSSI {
+			best = r
+		}
+	}
+	return best
+}
+
+// channelMask builds a channel bitmask; no channels means all of 11-26.
+func channelMask(channels []int) (uint32, error) {
+	if len(channels) == 0 {
+		return allChannelsMask, nil
+	}
+	var mask uint32
+	for _, ch := range channels {
+		if ch < 11 || ch > 26 {
+			return 0, fmt.Errorf("%w: channel must be 11-26, got %d", device.ErrValidation, ch)
+		}
+		mask |= 1 << ch
+	}
+	return mask, nil
+}
+
+// scanDuration validates a duration exponent; zero selects def.
+func scanDuration(d, def int) (uint8, error) {
+	if d == 0 {
+		return uint8(def), nil
+	}
+	if d < 0 || d > 14 {
+		return 0, fmt.Errorf("%w: scan duration must be 0-14, got %d", device.ErrValidation, d)
+	}
+	return uint8(d), nil
+}
+
+// EnergyScan measures the energy on each requested channel (all of 11-26 if
+// none are given) and marks the channel the network is on.
+func (c *Controller) EnergyScan(_ context.Context, channels []int, duration int) ([]device.ChannelEnergy, error) {
+	if !c.IsConnected() {
+		return nil, device.ErrNotConnected
+	}
+	mask, err := channelMask(channels)
+	if err != nil {
+		return nil, err
+	}
+	dur, err := scanDuration(duration, defaultEnergyScanDuration)
+	if err != nil {
+		return nil, err
+	}
+	results, err := c.ezsp.EnergyScan(mask, dur)
+	if err != nil {
+		return nil, err
+	}
+
+	var current uint8
+	if status, params, err := c.ezsp.GetNetworkParameters(); err == nil && status == emberSuccess {
+		current = params.RadioChannel
+	}
+	out := make([]device.ChannelEnergy, 0, len(results))
+	for _, r := range results {
+		out = append(out, device.ChannelEnergy{
+			Channel: int(r.Channel),
+			RSSI:    int(r.RSSI),
+			Current: r.Channel == current,
+		})
+	}
+	return out, nil
+}
+
+// ActiveScan lists the Zigbee networks whose routers answer a beacon request
+// on the requested channels (all of 11-26 if none are given).
+func (c *Controller) ActiveScan(_ context.Context, channels []int, duration int) ([]device.PANInfo, error) {
+	if !c.IsConnected() {
+		return nil, device.ErrNotConnected
+	}
+	mask, err := channelMask(channels)
+	if err != nil {
+		return nil, err
+	}
+	dur, err := scanDuration(duration, defaultActiveScanDuration)
+	if err != nil {
+		return nil, err
+	}
+	found, err := c.ezsp.ActiveScan(mask, dur)
+	if err != nil {
+		return nil, err
+	}
+
+	var ownExt [8]byte
+	if _, params, err := c.ezsp.GetNetworkParameters(); err == nil {
+		ownExt = params.ExtendedPanID
+	}
+	out := make([]device.PANInfo, 0, len(found))
+	for _, n := range found {
+		out = append(out, device.PANInfo{
+			Channel:       int(n.Channel),
+			PanID:         fmt.Sprintf("0x%04x", n.PanID),
+			ExtendedPanID: FormatIEEE(n.ExtendedPanID),
+			PermitJoining: n.AllowingJoin,
+			StackProfile:  int(n.StackProfile),
+			NwkUpdateID:   int(n.NwkUpdateID),
+			LinkQuality:   int(n.LQI),
+			RSSI:          int(n.RSSI),
+			Own:           n.ExtendedPanID == ownExt,
+		})
+	}
+	return out, nil
+}
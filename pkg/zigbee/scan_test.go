@@ -0,0 +1,144 @@
+package zigbee
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/urmzd/zigbee-skill/pkg/device"
+)
+
+func TestChannelMask(t *testing.T) {
+	if mask, err := channelMask(nil); err != nil || mask != allChannelsMask {
+		t.Errorf("no channels = 0x%08X, %v; want 0x%08X", mask, err, allChannelsMask)
+	}
+	if mask, err := channelMask([]int{11, 26, 11}); err != nil || mask != 1<<11|1<<26 {
+		t.Errorf("11, 26 = 0x%08X, %v", mask, err)
+	}
+	for _, ch := range []int{0, 10, 27, -1} {
+		if _, err := channelMask([]int{15, ch}); !errors.Is(err, device.ErrValidation) {
+			t.Errorf("channel %d: err = %v, want ErrValidation", ch, err)
+		}
+	}
+}
+
+func TestScanDuration(t *testing.T) {
+	for _, tt := range []struct{ in, want int }{{0, 4}, {1, 1}, {14, 14}} {
+		if d, err := scanDuration(tt.in, 4); err != nil || int(d) != tt.want {
+			t.Errorf("scanDuration(%d) = %d, %v; want %d", tt.in, d, err, tt.want)
+		}
+	}
+	for _, d := range []int{-1, 15} {
+		if _, err := scanDuration(d, 4); !errors.Is(err, device.ErrValidation) {
+			t.Errorf("duration %d: err = %v, want ErrValidation", d, err)
+		}
+	}
+}
+
+func TestQuietestOf(t *testing.T) {
+	// Ties go to the lowest channel, the first in scan order.
+	got := quietestOf([]ChannelEnergy{{11, -60}, {15, -90}, {20, -90}, {25, -70}})
+	if got != (ChannelEnergy{15, -90}) {
+		t.Errorf("quietest = %+v, want channel 15", got)
+	}
+	if got := quietestOf([]ChannelEnergy{{26, -75}}); got.Channel != 26 {
+		t.Errorf("single channel = %+v", got)
+	}
+}
+
+// scanNCP answers startScan with the given callbacks, followed by
+// scanCompleteHandler, and records the startScan parameters.
+func scanNCP(t *testing.T, results map[uint16][][]byte) (*Controller, *[]byte) {
+	e, ncp := newFakeNCP(t, 13)
+	stop := make(chan struct{})
+	t.Cleanup(func() { close(stop) })
+	c := &Controller{ash: e.ash, ezsp: e, connected: true, stopChan: stop}
+
+	callback := func(frameID uint16, params []byte) {
+		e.processFrame(append([]byte{0, ezspFCResponse | 0x10, 0x01, byte(frameID), byte(frameID >> 8)}, params...))
+	}
+	var start []byte
+	ncp.handle(ezspStartScan, func(p []byte) []byte {
+		start = append([]byte(nil), p...)
+		for frameID, rs := range results {
+			for _, r := range rs {
+				callback(frameID, r)
+			}
+		}
+		callback(ezspScanCompleteHandler, []byte{0, emberSuccess})
+		return statusBytes(13, 0)
+	})
+	ncp.handle(ezspGetNetworkParameters, func([]byte) []byte {
+		// status(1) + nodeType(1) + extPanID(8) + panID(2) + txPower(1) + channel(1) + ...
+		return []byte{0x00, 0x01, 1, 2, 3, 4, 5, 6, 7, 8, 0x62, 0x1A, 3, 15}
+	})
+	return c, &start
+}
+
+func TestEnergyScan(t *testing.T) {
+	c, start := scanNCP(t, map[uint16][][]byte{
+		// energyScanResultHandler: channel(1) + maxRssiValue(1)
+		ezspEnergyScanResultHandler: {{20, 0xB5}, {11, 0xC4}, {15, 0xA6}, {25}},
+	})
+
+	got, err := c.EnergyScan(context.Background(), []int{11, 15, 20}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []device.ChannelEnergy{
+		{Channel: 11, RSSI: -60},
+		{Channel: 15, RSSI: -90, Current: true},
+		{Channel: 20, RSSI: -75},
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("energy = %+v, want %+v", got, want)
+	}
+	// startScan: scanType(1) + channelMask(4) + duration(1)
+	if (*start)[0] != ezspEnergyScan {
+		t.Errorf("scan type = %d", (*start)[0])
+	}
+	if mask := binary.LittleEndian.Uint32((*start)[1:5]); mask != 1<<11|1<<15|1<<20 {
+		t.Errorf("channel mask = 0x%08X", mask)
+	}
+	if (*start)[5] != 2 {
+		t.Errorf("duration = %d, want 2", (*start)[5])
+	}
+}
+
+func TestActiveScan(t *testing.T) {
+	network := func(channel uint8, pan uint16, ext byte, join bool, lqi uint8, rssi int8) []byte {
+		b := []byte{channel, byte(pan), byte(pan >> 8)}
+		b = append(b, ext, 2, 3, 4, 5, 6, 7, 8)
+		var j byte
+		if join {
+			j = 1
+		}
+		return append(b, j, 2, 7, lqi, byte(rssi))
+	}
+	c, start := scanNCP(t, map[uint16][][]byte{
+		ezspNetworkFoundHandler: {
+			network(20, 0x2222, 0x09, true, 180, -70),
+			network(15, 0x1A62, 0x01, false, 255, -40),
+			network(15, 0x0042, 0x0A, false, 90, -85),
+			{15, 0x42, 0x00}, // truncated
+		},
+	})
+
+	got, err := c.ActiveScan(context.Background(), nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []device.PANInfo{
+		{Channel: 15, PanID: "0x0042", ExtendedPanID: "08:07:06:05:04:03:02:0a", StackProfile: 2, NwkUpdateID: 7, LinkQuality: 90, RSSI: -85},
+		{Channel: 15, PanID: "0x1a62", ExtendedPanID: "08:07:06:05:04:03:02:01", StackProfile: 2, NwkUpdateID: 7, LinkQuality: 255, RSSI: -40, Own: true},
+		{Channel: 20, PanID: "0x2222", ExtendedPanID: "08:07:06:05:04:03:02:09", PermitJoining: true, StackProfile: 2, NwkUpdateID: 7, LinkQuality: 180, RSSI: -70},
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("networks = %+v\nwant %+v", got, want)
+	}
+	if (*start)[0] != ezspActiveScan || binary.LittleEndian.Uint32((*start)[1:5]) != allChannelsMask || (*start)[5] != defaultActiveScanDuration {
+		t.Errorf("startScan = % x", *start)
+	}
+}
@@ -0,0 +1,299 @@
+package zigbee
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/urmzd/zigbee-skill/pkg/device"
+)
+
+// defaultTransition is used for level and color changes when the request
+// has no "transition", in tenths of a second.
+const defaultTransition uint16 = 10
+
+// StateCommand is one ZCL command translated from a SetDeviceState request.
+type StateCommand struct {
+	Name    string // "on/off", "level" or "color", for error messages
+	Cluster uint16
+	Frame   []byte
+	// Apply updates the cached state once the command is delivered.
+	Apply func(state device.DeviceState)
+	// Confirms lists the keys Apply sets to a known value; relative
+	// commands derive theirs from the cached state and confirm nothing.
+	Confirms []string
+}
+
+// StateRequest is a validated SetDeviceState request. Keys handled:
+//
+//   - state: ON, OFF or TOGGLE
+//   - brightness (0-254) or brightness_percent (0-100): Move to Level
+//   - brightness_step (-254 to 254): Step
+//   - brightness_move: Move at the signed rate in units per second, or Stop
+//     for 0 or "stop"
+//   - color_temp (mireds) or color_temp_step (signed mireds)
+//   - transition: seconds for level and color changes (default 1)
+//
+// Other keys are ignored; BuildStateCommands rejects them.
+type StateRequest struct {
+	State         string // ON, OFF, TOGGLE or empty
+	Level         *uint8
+	LevelStep     int
+	LevelMove     *int // rate in units per second; 0 stops
+	ColorTemp     *int
+	ColorTempStep int
+	Transition    uint16 // tenths of a second
+}
+
+// ParseStateRequest validates every key of req it handles.
+func ParseStateRequest(req map[string]any) (StateRequest, error) {
+	r := StateRequest{Transition: defaultTransition}
+	if v, ok := req["transition"]; ok {
+		t, ok := number(v)
+		if !ok || t < 0 || t > 6553.5 {
+			return r, fmt.Errorf("%w: transition must be a number of seconds between 0 and 6553.5", device.ErrValidation)
+		}
+		r.Transition = uint16(math.Round(t * 10))
+	}
+	if err := exclusive(req, "brightness", "brightness_percent", "brightness_step", "brightness_move"); err != nil {
+		return r, err
+	}
+	if err := exclusive(req, "color_temp", "color_temp_step"); err != nil {
+		return r, err
+	}
+
+	if v, ok := req["state"]; ok {
+		s, ok := v.(string)
+		if !ok {
+			return r, fmt.Errorf("%w: state must be a string", device.ErrValidation)
+		}
+		switch r.State = strings.ToUpper(s); r.State {
+		case "ON", "OFF", "TOGGLE":
+		default:
+			return r, fmt.Errorf("%w: invalid state value %q", device.ErrValidation, s)
+		}
+	}
+
+	level, ok, err := absoluteLevel(req)
+	if err != nil {
+		return r, err
+	} else if ok {
+		r.Level = &level
+	}
+
+	if v, ok := req["brightness_step"]; ok {
+		if r.LevelStep, ok = integer(v, -254, 254); !ok {
+			return r, fmt.Errorf("%w: brightness_step must be an integer between -254 and 254", device.ErrValidation)
+		}
+	}
+
+	if v, ok := req["brightness_move"]; ok {
+		rate := 0
+		if s, isStr := v.(string); isStr {
+			ok = strings.EqualFold(s, "stop")
+		} else {
+			rate, ok = integer(v, -255, 255)
+		}
+		if !ok {
+			return r, fmt.Errorf(`%w: brightness_move must be a rate between -255 and 255, or "stop"`, device.ErrValidation)
+		}
+		r.LevelMove = &rate
+	}
+
+	if v, ok := req["color_temp"]; ok {
+		mireds, ok := integer(v, 153, 500)
+		if !ok {
+			return r, fmt.Errorf("%w: color_temp must be an integer between 153 and 500", device.ErrValidation)
+		}
+		r.ColorTemp = &mireds
+	}
+
+	if v, ok := req["color_temp_step"]; ok {
+		if r.ColorTempStep, ok = integer(v, -347, 347); !ok {
+			return r, fmt.Errorf("%w: color_temp_step must be an integer between -347 and 347", device.ErrValidation)
+		}
+	}
+	return r, nil
+}
+
+// BuildStateCommands translates a SetDeviceState request into ZCL commands,
+// in the order they must be sent. Every key is validated before anything is
+// sent; see StateRequest for the keys handled. Other keys fail with
+// device.ErrUnsupported.
+func BuildStateCommands(req map[string]any) ([]StateCommand, error) {
+	for key := range req {
+		if !AdapterAccess[key].Has(device.AccessWrite) {
+			return nil, fmt.Errorf("%w: %q cannot be set through a Zigbee adapter", device.ErrUnsupported, key)
+		}
+	}
+	r, err := ParseStateRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	var cmds []StateCommand
+	if r.State != "" {
+		cmd := map[string]uint8{"ON": zclCmdOn, "OFF": zclCmdOff, "TOGGLE": zclCmdToggle}[r.State]
+		cmds = append(cmds, StateCommand{
+			Name:    "on/off",
+			Cluster: zclClusterOnOff,
+			Frame:   BuildOnOffCommand(cmd),
+			Apply: func(st device.DeviceState) {
+				if cmd == zclCmdToggle {
+					if cur, ok := st["state"].(string); ok {
+						st["state"] = boolToOnOff(cur != "ON")
+					}
+					return
+				}
+				st["state"] = r.State
+			},
+			Confirms: confirmsIf(cmd != zclCmdToggle, "state"),
+		})
+	}
+
+	if r.Level != nil {
+		level := *r.Level
+		cmds = append(cmds, StateCommand{
+			Name:     "level",
+			Cluster:  zclClusterLevelControl,
+			Frame:    BuildMoveToLevelCommand(level, r.Transition),
+			Apply:    func(st device.DeviceState) { st["brightness"] = int(level) },
+			Confirms: []string{"brightness"},
+		})
+	}
+
+	if step := r.LevelStep; step != 0 {
+		cmds = append(cmds, StateCommand{
+			Name:    "level",
+			Cluster: zclClusterLevelControl,
+			Frame:   BuildStepLevelCommand(step > 0, uint8(abs(step)), r.Transition),
+			Apply: func(st device.DeviceState) {
+				if cur, ok := number(st["brightness"]); ok {
+					st["brightness"] = min(254, max(0, int(cur)+step))
+				}
+				if step > 0 {
+					st["state"] = "ON"
+				}
+			},
+			Confirms: confirmsIf(step > 0, "state"),
+		})
+	}
+
+	if r.LevelMove != nil {
+		rate := *r.LevelMove
+		frame := BuildStopLevelCommand()
+		if rate != 0 {
+			frame = BuildMoveLevelCommand(rate > 0, uint8(abs(rate)))
+		}
+		cmds = append(cmds, StateCommand{
+			Name:    "level",
+			Cluster: zclClusterLevelControl,
+			Frame:   frame,
+			Apply: func(st device.DeviceState) {
+				// The level reached is only known once the device reports it.
+				delete(st, "brightness")
+				if rate > 0 {
+					st["state"] = "ON"
+				}
+			},
+			Confirms: confirmsIf(rate > 0, "state"),
+		})
+	}
+
+	if r.ColorTemp != nil {
+		mireds := *r.ColorTemp
+		cmds = append(cmds, StateCommand{
+			Name:     "color",
+			Cluster:  zclClusterColorControl,
+			Frame:    BuildMoveToColorTempCommand(uint16(mireds), r.Transition),
+			Apply:    func(st device.DeviceState) { st["color_temp"] = mireds },
+			Confirms: []string{"color_temp"},
+		})
+	}
+
+	if step := r.ColorTempStep; step != 0 {
+		cmds = append(cmds, StateCommand{
+			Name:    "color",
+			Cluster: zclClusterColorControl,
+			Frame:   BuildStepColorTempCommand(step > 0, uint16(abs(step)), r.Transition),
+			Apply: func(st device.DeviceState) {
+				if cur, ok := number(st["color_temp"]); ok {
+					st["color_temp"] = min(500, max(153, int(cur)+step))
+				}
+			},
+		})
+	}
+	return cmds, nil
+}
+
+// confirmsIf returns keys when cond holds.
+func confirmsIf(cond bool, keys ...string) []string {
+	if cond {
+		return keys
+	}
+	return nil
+}
+
+// absoluteLevel reads brightness or brightness_percent as a ZCL level.
+func absoluteLevel(req map[string]any) (uint8, bool, error) {
+	if v, ok := req["brightness"]; ok {
+		level, ok := integer(v, 0, 254)
+		if !ok {
+			return 0, false, fmt.Errorf("%w: brightness must be an integer between 0 and 254", device.ErrValidation)
+		}
+		return uint8(level), true, nil
+	}
+	if v, ok := req["brightness_percent"]; ok {
+		p, ok := number(v)
+		if !ok || p < 0 || p > 100 {
+			return 0, false, fmt.Errorf("%w: brightness_percent must be a number between 0 and 100", device.ErrValidation)
+		}
+		return uint8(math.Round(p * 254 / 100)), true, nil
+	}
+	return 0, false, nil
+}
+
+// exclusive rejects requests that set more than one of keys.
+func exclusive(req map[string]any, keys ...string) error {
+	var set []string
+	for _, k := range keys {
+		if _, ok := req[k]; ok {
+			set = append(set, k)
+		}
+	}
+	if len(set) > 1 {
+		return fmt.Errorf("%w: %s cannot be combined", device.ErrValidation, strings.Join(set, " and "))
+	}
+	return nil
+}
+
+// number converts a decoded JSON or Go numeric value.
+func number(v any) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case int:
+		return float64(n), true
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	default:
+		return 0, false
+	}
+}
+
+// integer converts v to a whole number within [lo, hi].
+func integer(v any, lo, hi int) (int, bool) {
+	f, ok := number(v)
+	if !ok || f != math.Trunc(f) || f < float64(lo) || f > float64(hi) {
+		return 0, false
+	}
+	return int(f), true
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
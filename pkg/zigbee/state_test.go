@@ -0,0 +1,87 @@
+package zigbee
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/urmzd/zigbee-skill/pkg/device"
+)
+
+func TestBuildStateCommands(t *testing.T) {
+	tests := []struct {
+		req     map[string]any
+		cluster uint16
+		payload []byte // after the 3-byte ZCL header
+		cmdID   uint8
+		want    device.DeviceState
+	}{
+		{map[string]any{"brightness": 200.0}, zclClusterLevelControl, []byte{200, 10, 0}, zclCmdMoveToLevelWithOnOff, device.DeviceState{"brightness": 200}},
+		{map[string]any{"brightness_percent": 50, "transition": 2.5}, zclClusterLevelControl, []byte{127, 25, 0}, zclCmdMoveToLevelWithOnOff, device.DeviceState{"brightness": 127}},
+		{map[string]any{"brightness_step": -30.0, "transition": 0}, zclClusterLevelControl, []byte{zclLevelModeDown, 30, 0, 0}, zclCmdStepWithOnOff, device.DeviceState{"brightness": 70}},
+		{map[string]any{"brightness_move": 40}, zclClusterLevelControl, []byte{zclLevelModeUp, 40}, zclCmdMoveWithOnOff, device.DeviceState{"state": "ON", "brightness": nil}},
+		{map[string]any{"brightness_move": "stop"}, zclClusterLevelControl, nil, zclCmdStopWithOnOff, device.DeviceState{"brightness": nil}},
+		{map[string]any{"color_temp_step": 50}, zclClusterColorControl, []byte{zclColorStepModeUp, 50, 0, 10, 0, 0, 0, 0, 0}, zclCmdStepColorTemperature, device.DeviceState{"brightness": 100, "color_temp": 300}},
+	}
+	for _, tt := range tests {
+		cmds, err := BuildStateCommands(tt.req)
+		if err != nil || len(cmds) != 1 {
+			t.Fatalf("%v: %d commands, err %v", tt.req, len(cmds), err)
+		}
+		cmd := cmds[0]
+		if cmd.Cluster != tt.cluster || cmd.Frame[2] != tt.cmdID || !bytes.Equal(cmd.Frame[3:], tt.payload) {
+			t.Errorf("%v: cluster 0x%04X frame % X", tt.req, cmd.Cluster, cmd.Frame)
+		}
+		st := device.DeviceState{"brightness": 100, "color_temp": 250}
+		cmd.Apply(st)
+		for k, v := range tt.want {
+			if st[k] != v {
+				t.Errorf("%v: state %s = %v, want %v", tt.req, k, st[k], v)
+			}
+		}
+	}
+
+	for _, bad := range []map[string]any{
+		{"brightness": 100, "brightness_step": 10},
+		{"brightness_step": 300},
+		{"brightness_move": "faster"},
+		{"transition": -1},
+		{"state": "DIM"},
+	} {
+		if _, err := BuildStateCommands(bad); !errors.Is(err, device.ErrValidation) {
+			t.Errorf("%v: err = %v, want validation error", bad, err)
+		}
+	}
+}
+
+func TestBuildStateCommandsUnsupported(t *testing.T) {
+	for _, req := range []map[string]any{
+		{"lock_state": "LOCK"},
+		{"state": "ON", "color": map[string]any{"x": 0.3, "y": 0.3}},
+	} {
+		if _, err := BuildStateCommands(req); !errors.Is(err, device.ErrUnsupported) {
+			t.Errorf("%v: err = %v, want ErrUnsupported", req, err)
+		}
+	}
+}
+
+func TestAdapterExposesMatchSchema(t *testing.T) {
+	clusters := []uint16{zclClusterOnOff, zclClusterLevelControl, zclClusterColorControl, zclClusterTemperature, zclClusterDoorLock}
+	props := BuildStateSchema(clusters, AdapterAccess)["properties"].(map[string]any)
+	for _, c := range BuildCapabilities(clusters, 1, AdapterAccess) {
+		if _, ok := props[c.Property]; !ok {
+			t.Errorf("%s exposes %q missing from the schema", c.Name, c.Property)
+		}
+		if c.Access.Has(device.AccessReport) {
+			t.Errorf("%s claims report", c.Name)
+		}
+		if c.Name == device.CapColorTemp && c.Access != device.AccessWrite {
+			t.Errorf("color_temp access = %v", c.Access)
+		}
+	}
+	for _, key := range []string{"color", "temperature", "lock_state"} {
+		if _, ok := props[key]; ok {
+			t.Errorf("schema has unsupported key %q", key)
+		}
+	}
+}
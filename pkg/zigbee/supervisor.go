@@ -0,0 +1,137 @@
+package zigbee
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/urmzd/zigbee-skill/pkg/device"
+)
+
+const (
+	// reconnectMinBackoff is the wait before the first reopen attempt after
+	// the link to the NCP is lost; it doubles up to reconnectMaxBackoff.
+	reconnectMinBackoff = 1 * time.Second
+	reconnectMaxBackoff = 30 * time.Second
+)
+
+// openTransport opens the serial port the supervisor reconnects on.
+var openTransport = func(portPath string) (Transport, error) { return OpenSerial(portPath) }
+
+// superviseLink watches the ASH link and, when it is lost (dongle unplugged,
+// NCP reset or ERROR frame), reopens the serial port with backoff, runs the
+// stack initialization again and re-resolves devices. Requests made while the
+// link is down fail with device.ErrNotConnected.
+func (c *Controller) superviseLink() {
+	for {
+		select {
+		case <-c.ash.Down():
+		case <-c.stopChan:
+			return
+		}
+
+		reason := "link lost"
+		if err := c.ash.Err(); err != nil {
+			reason = err.Error()
+		}
+		c.connMu.Lock()
+		c.connected = false
+		c.connMu.Unlock()
+		c.joinWindow.Close()
+		log.Warn().Str("reason", reason).Msg("Coordinator disconnected, reconnecting")
+		c.Publish(device.Event{
+			Type:      device.EventCoordinatorDisconnected,
+			Reason:    reason,
+			Timestamp: time.Now(),
+		})
+
+		if !c.reconnect() {
+			return
+		}
+		c.Publish(device.Event{
+			Type:      device.EventCoordinatorReconnected,
+			Timestamp: time.Now(),
+		})
+		go c.reresolveDevices()
+	}
+}
+
+// reconnect retries reopen with exponential backoff until it succeeds or the
+// controller is closed. Returns false if the controller was closed.
+func (c *Controller) reconnect() bool {
+	backoff := reconnectMinBackoff
+	for attempt := 1; ; attempt++ {
+		select {
+		case <-time.After(backoff):
+		case <-c.stopChan:
+			return false
+		}
+		err := c.reopen()
+		if err == nil {
+			log.Info().Int("attempt", attempt).Msg("Coordinator reconnected")
+			return true
+		}
+		log.Warn().Err(err).Int("attempt", attempt).Dur("retry_in", backoff).Msg("Coordinator reconnect failed")
+		backoff = min(backoff*2, reconnectMaxBackoff)
+	}
+}
+
+// reopen replaces the serial port, repeats the ASH handshake and runs
+// initStack, which restores stack configuration, Trust Center policies and the
+// coordinator endpoint before resuming the network from NCP storage.
+func (c *Controller) reopen() error {
+	if old := c.ash.port(); old != nil {
+		_ = old.Close()
+	}
+	s, err := openTransport(c.portPath)
+	if err != nil {
+		return fmt.Errorf("open serial: %w", err)
+	}
+	if err := c.ash.Reopen(s); err != nil {
+		return fmt.Errorf("ASH connect: %w", err)
+	}
+	if err := c.initStack(); err != nil {
+		return fmt.Errorf("init stack: %w", err)
+	}
+
+	c.connMu.Lock()
+	c.connected = true
+	c.connMu.Unlock()
+	return nil
+}
+
+// reresolveDevices refreshes device NodeIDs after a reconnect. The NCP address
+// table does not survive a reset, and devices may have rejoined elsewhere while
+// the coordinator was away.
+func (c *Controller) reresolveDevices() {
+	type entry struct {
+		ieee string
+		kd   *KnownDevice
+		eui  [8]byte
+	}
+	c.mu.RLock()
+	entries := make([]entry, 0, len(c.devices))
+	for ieee, kd := range c.devices {
+		entries = append(entries, entry{ieee, kd, kd.IEEEAddress})
+	}
+	c.mu.RUnlock()
+
+	for _, e := range entries {
+		if !c.IsConnected() {
+			return
+		}
+		nodeID, answered := c.lookupNodeID(e.eui)
+		if nodeID == 0 {
+			continue
+		}
+		c.mu.Lock()
+		e.kd.NodeID = nodeID
+		if answered {
+			e.kd.LastSeen = time.Now()
+		}
+		c.mu.Unlock()
+		if answered {
+			c.setAvailable(e.ieee, e.kd, true)
+		}
+	}
+}
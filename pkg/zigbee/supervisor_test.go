@@ -0,0 +1,78 @@
+package zigbee
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/urmzd/zigbee-skill/pkg/device"
+)
+
+func TestSupervisorReconnects(t *testing.T) {
+	const version = 13
+	e, ncp := newFakeNCP(t, version)
+	ok := func([]byte) []byte { return statusBytes(version, emberSuccess) }
+	ncp.handle(ezspVersion, func([]byte) []byte { return []byte{version, 0x02, 0x00, 0x07} })
+	ncp.handle(ezspAddEndpoint, ok)
+	ncp.handle(ezspSetInitialSecurityState, ok)
+	ncp.handle(ezspNetworkInit, ok)
+	// getNodeID is left unanswered so it is in flight when the link drops.
+	unblock := make(chan struct{})
+	t.Cleanup(func() { close(unblock) })
+	ncp.handle(ezspGetNodeID, func([]byte) []byte { <-unblock; return nil })
+
+	defer func(f func(string) (Transport, error)) { openTransport = f }(openTransport)
+	openTransport = func(string) (Transport, error) { return ncp.connect(t), nil }
+
+	stop := make(chan struct{})
+	t.Cleanup(func() { close(stop) })
+	c := &Controller{
+		ash: e.ash, ezsp: e, connected: true, stopChan: stop,
+	}
+	c.KnownDevices = NewKnownDevices(c)
+	events := c.Subscribe(device.EventFilter{Types: []string{device.EventCoordinatorReconnected}})
+	go c.superviseLink()
+
+	inFlight := make(chan error, 1)
+	go func() {
+		_, err := e.GetNodeID()
+		inFlight <- err
+	}()
+	for !slices.Contains(ncp.sent(), ezspGetNodeID) {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// Drop the line as if the dongle had been unplugged.
+	_ = e.ash.port().Close()
+	select {
+	case err := <-inFlight:
+		if !errors.Is(err, device.ErrNotConnected) {
+			t.Errorf("in-flight command = %v, want ErrNotConnected", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("in-flight command did not fail when the link dropped")
+	}
+
+	select {
+	case <-events:
+	case <-time.After(10 * time.Second):
+		t.Fatal("no coordinator_reconnected event")
+	}
+	if !c.IsConnected() {
+		t.Error("controller not connected after reconnect")
+	}
+	// The renegotiation starts in the legacy format and switches to extended.
+	ncp.mu.Lock()
+	legacy := ncp.legacy
+	ncp.mu.Unlock()
+	if legacy != 1 {
+		t.Errorf("%d commands sent with the legacy header, want 1", legacy)
+	}
+	if !e.extended() {
+		t.Error("extended frame format not restored after renegotiation")
+	}
+	if proto, _, stack := e.Version(); proto != version || stack != 0x0700 {
+		t.Errorf("Version() = v%d stack 0x%04X", proto, stack)
+	}
+}
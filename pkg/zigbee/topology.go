@@ -0,0 +1,247 @@
+package zigbee
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/urmzd/zigbee-skill/pkg/device"
+)
+
+// maxTablePages caps how many pages of a neighbor/routing table are fetched
+// from a single router, guarding against devices that report bogus totals.
+const maxTablePages = 16
+
+// neighborEntry is one record of a Mgmt_Lqi_rsp neighbor table.
+type neighborEntry struct {
+	ieee         [8]byte
+	nodeID       uint16
+	deviceType   uint8 // 0 = coordinator, 1 = router, 2 = end device, 3 = unknown
+	relationship uint8 // 0 = parent, 1 = child, 2 = sibling, 3 = none, 4 = previous child
+	depth        uint8
+	lqi          uint8
+}
+
+// routeEntry is one record of a Mgmt_Rtg_rsp routing table.
+type routeEntry struct {
+	destination uint16
+	status      uint8 // 0 = active, 1 = discovery underway, 2 = discovery failed, 3 = inactive
+	nextHop     uint16
+}
+
+// NetworkMap crawls neighbor tables (Mgmt_Lqi_req) and routing tables
+// (Mgmt_Rtg_req) breadth-first from the coordinator and returns the graph.
+func (c *Controller) NetworkMap(ctx context.Context) (*device.NetworkMap, error) {
+	if !c.IsConnected() {
+		return nil, device.ErrNotConnected
+	}
+	coordEUI, err := c.ezsp.GetEUI64()
+	if err != nil {
+		return nil, fmt.Errorf("get coordinator EUI64: %w", err)
+	}
+	coordID, err := c.ezsp.GetNodeID()
+	if err != nil {
+		return nil, fmt.Errorf("get coordinator NodeID: %w", err)
+	}
+
+	nodes := map[string]*device.NetworkNode{}
+	coordIEEE := FormatIEEE(coordEUI)
+	nodes[coordIEEE] = &device.NetworkNode{
+		IEEEAddress:    coordIEEE,
+		NetworkAddress: coordID,
+		Name:           "Coordinator",
+		Type:           device.NodeTypeCoordinator,
+	}
+
+	type hop struct {
+		ieee   string
+		nodeID uint16
+	}
+	queue := []hop{{coordIEEE, coordID}}
+	visited := map[string]bool{coordIEEE: true}
+	var links []device.NetworkLink
+
+	for len(queue) > 0 {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		cur := queue[0]
+		queue = queue[1:]
+
+		neighbors, err := c.fetchNeighborTable(ctx, cur.nodeID)
+		if err != nil {
+			log.Warn().Err(err).Str("node", cur.ieee).Msg("Mgmt_Lqi_req failed")
+			nodes[cur.ieee].Failed = true
+			continue
+		}
+		routes, err := c.fetchRoutingTable(ctx, cur.nodeID)
+		if err != nil {
+			// End-device-only routers and some firmware reject Mgmt_Rtg_req; links still stand.
+			log.Debug().Err(err).Str("node", cur.ieee).Msg("Mgmt_Rtg_req failed")
+		}
+
+		for _, n := range neighbors {
+			ieee := FormatIEEE(n.ieee)
+			node, ok := nodes[ieee]
+			if !ok {
+				node = &device.NetworkNode{
+					IEEEAddress:    ieee,
+					NetworkAddress: n.nodeID,
+					Type:           zdoNodeType(n.deviceType),
+					Depth:          int(n.depth),
+				}
+				nodes[ieee] = node
+			}
+			// Routers disagree about a node's depth, e.g. one that was once its
+			// parent; the shallowest report is its path to the coordinator.
+			node.Depth = min(node.Depth, int(n.depth))
+
+			link := device.NetworkLink{
+				Source:       cur.ieee,
+				Target:       ieee,
+				LinkQuality:  int(n.lqi),
+				Depth:        int(n.depth),
+				Relationship: zdoRelationship(n.relationship),
+			}
+			for _, r := range routes {
+				if r.status == 0 && r.nextHop == n.nodeID {
+					link.Routes = append(link.Routes, r.destination)
+				}
+			}
+			links = append(links, link)
+
+			if (n.deviceType == 0 || n.deviceType == 1) && !visited[ieee] {
+				visited[ieee] = true
+				queue = append(queue, hop{ieee, n.nodeID})
+			}
+		}
+	}
+
+	c.mu.RLock()
+	for ieee, n := range nodes {
+		if kd, ok := c.devices[ieee]; ok {
+			n.Name = kd.FriendlyName
+		}
+	}
+	c.mu.RUnlock()
+
+	m := &device.NetworkMap{Links: links, Timestamp: time.Now()}
+	for _, n := range nodes {
+		m.Nodes = append(m.Nodes, *n)
+	}
+	return m, nil
+}
+
+// fetchNeighborTable pages through a node's neighbor table via Mgmt_Lqi_req.
+func (c *Controller) fetchNeighborTable(ctx context.Context, nodeID uint16) ([]neighborEntry, error) {
+	var out []neighborEntry
+	start := 0
+	for range maxTablePages {
+		resp, err := c.zdoRequest(ctx, nodeID, zdoClusterMgmtLqiReq, []byte{byte(start)})
+		if err != nil {
+			return out, err
+		}
+		// Mgmt_Lqi_rsp: seq(1) + status(1) + total(1) + startIndex(1) + count(1) + entries(22 each)
+		if len(resp) < 2 || resp[1] != 0x00 {
+			return out, fmt.Errorf("Mgmt_Lqi_rsp status 0x%02X", statusByte(resp))
+		}
+		if len(resp) < 5 {
+			return out, fmt.Errorf("Mgmt_Lqi_rsp too short: %d bytes", len(resp))
+		}
+		total, count := int(resp[2]), int(resp[4])
+		entries := resp[5:]
+		for i := 0; i < count && (i+1)*22 <= len(entries); i++ {
+			out = append(out, parseNeighborEntry(entries[i*22:(i+1)*22]))
+		}
+		start += count
+		if count == 0 || start >= total {
+			break
+		}
+	}
+	return out, nil
+}
+
+// fetchRoutingTable pages through a node's routing table via Mgmt_Rtg_req.
+func (c *Controller) fetchRoutingTable(ctx context.Context, nodeID uint16) ([]routeEntry, error) {
+	var out []routeEntry
+	start := 0
+	for range maxTablePages {
+		resp, err := c.zdoRequest(ctx, nodeID, zdoClusterMgmtRtgReq, []byte{byte(start)})
+		if err != nil {
+			return out, err
+		}
+		// Mgmt_Rtg_rsp: seq(1) + status(1) + total(1) + startIndex(1) + count(1) + entries(5 each)
+		if len(resp) < 2 || resp[1] != 0x00 {
+			return out, fmt.Errorf("Mgmt_Rtg_rsp status 0x%02X", statusByte(resp))
+		}
+		if len(resp) < 5 {
+			return out, fmt.Errorf("Mgmt_Rtg_rsp too short: %d bytes", len(resp))
+		}
+		total, count := int(resp[2]), int(resp[4])
+		entries := resp[5:]
+		for i := 0; i < count && (i+1)*5 <= len(entries); i++ {
+			e := entries[i*5 : (i+1)*5]
+			out = append(out, routeEntry{
+				destination: binary.LittleEndian.Uint16(e[0:2]),
+				status:      e[2] & 0x07,
+				nextHop:     binary.LittleEndian.Uint16(e[3:5]),
+			})
+		}
+		start += count
+		if count == 0 || start >= total {
+			break
+		}
+	}
+	return out, nil
+}
+
+// parseNeighborEntry decodes a 22-byte Mgmt_Lqi_rsp neighbor table record:
+// extPanID(8) + IEEE(8) + NWK(2) + type/rxOn/relationship(1) + permitJoin(1) + depth(1) + LQI(1).
+func parseNeighborEntry(b []byte) neighborEntry {
+	var e neighborEntry
+	copy(e.ieee[:], b[8:16])
+	e.nodeID = binary.LittleEndian.Uint16(b[16:18])
+	e.deviceType = b[18] & 0x03
+	e.relationship = (b[18] >> 4) & 0x07
+	e.depth = b[20]
+	e.lqi = b[21]
+	return e
+}
+
+func zdoNodeType(t uint8) string {
+	switch t {
+	case 0:
+		return device.NodeTypeCoordinator
+	case 1:
+		return device.NodeTypeRouter
+	case 2:
+		return device.NodeTypeEndDevice
+	default:
+		return device.NodeTypeUnknown
+	}
+}
+
+func zdoRelationship(r uint8) string {
+	switch r {
+	case 0:
+		return "parent"
+	case 1:
+		return "child"
+	case 2:
+		return "sibling"
+	case 4:
+		return "previous_child"
+	default:
+		return "none"
+	}
+}
+
+// statusByte returns the status field of a ZDO response, or 0xFF if missing.
+func statusByte(resp []byte) byte {
+	if len(resp) < 2 {
+		return 0xFF
+	}
+	return resp[1]
+}
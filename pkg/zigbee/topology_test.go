@@ -0,0 +1,76 @@
+package zigbee
+
+import (
+	"context"
+	"encoding/binary"
+	"testing"
+)
+
+// neighborRecord builds a 22-byte Mgmt_Lqi_rsp neighbor table record.
+func neighborRecord(eui byte, nodeID uint16, deviceType, relationship, depth uint8) []byte {
+	b := make([]byte, 22)
+	b[8] = eui
+	binary.LittleEndian.PutUint16(b[16:18], nodeID)
+	b[18] = deviceType | relationship<<4
+	b[20] = depth
+	b[21] = 200
+	return b
+}
+
+func TestNetworkMapKeepsShallowestDepth(t *testing.T) {
+	e, ncp := newFakeNCP(t, 13)
+	stop := make(chan struct{})
+	t.Cleanup(func() { close(stop) })
+	c := &Controller{
+		ash: e.ash, ezsp: e, connected: true, stopChan: stop,
+		KnownDevices: NewKnownDevices(nil),
+		zdoWaiters:   make(map[zdoWaitKey]chan []byte),
+	}
+
+	// The coordinator has routers 0x1111 and 0x2222 as children at depth 1
+	// and 0x1111 has the end device 0x3333 at depth 2. 0x1111 also reports
+	// its sibling 0x2222, and 0x2222 its previous child 0x3333, one level
+	// too deep.
+	tables := map[uint16][][]byte{
+		0x0000: {neighborRecord(0x02, 0x1111, 1, 1, 1), neighborRecord(0x03, 0x2222, 1, 1, 1)},
+		0x1111: {neighborRecord(0x04, 0x3333, 2, 1, 2), neighborRecord(0x03, 0x2222, 1, 2, 3)},
+		0x2222: {neighborRecord(0x04, 0x3333, 2, 4, 3)},
+	}
+	ncp.handle(ezspGetEUI64, func([]byte) []byte { return []byte{0x01, 0, 0, 0, 0, 0, 0, 0} })
+	ncp.handle(ezspGetNodeID, func([]byte) []byte { return []byte{0x00, 0x00} })
+	// sendUnicast v13: type(1) + destination(2) + apsFrame(11) + tag(1) + length(1) + message
+	ncp.handle(ezspSendUnicast, func(p []byte) []byte {
+		dest := binary.LittleEndian.Uint16(p[1:3])
+		cluster := binary.LittleEndian.Uint16(p[5:7])
+		msg := p[16:]
+		rsp := []byte{msg[0], 0x84} // Mgmt_Rtg_req is not supported
+		if cluster == zdoClusterMgmtLqiReq {
+			entries := tables[dest]
+			rsp = []byte{msg[0], 0x00, byte(len(entries)), 0, byte(len(entries))}
+			for _, rec := range entries {
+				rsp = append(rsp, rec...)
+			}
+		}
+		c.deliverZDOResponse(dest, cluster|0x8000, rsp)
+		return []byte{0x00, 0x00}
+	})
+
+	m, err := c.NetworkMap(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int{
+		"00:00:00:00:00:00:00:01": 0,
+		"00:00:00:00:00:00:00:02": 1,
+		"00:00:00:00:00:00:00:03": 1,
+		"00:00:00:00:00:00:00:04": 2,
+	}
+	if len(m.Nodes) != len(want) {
+		t.Fatalf("nodes = %+v", m.Nodes)
+	}
+	for _, n := range m.Nodes {
+		if n.Depth != want[n.IEEEAddress] {
+			t.Errorf("%s depth = %d, want %d", n.IEEEAddress, n.Depth, want[n.IEEEAddress])
+		}
+	}
+}
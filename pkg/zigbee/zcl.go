@@ -1,9 +1,14 @@
 package zigbee
 
-import "encoding/binary"
+import (
+	"encoding/binary"
+	"sync/atomic"
+)
 
 // ZCL cluster IDs
 const (
+	zclClusterBasic             uint16 = 0x0000
+	zclClusterPowerConfig       uint16 = 0x0001
 	zclClusterOnOff             uint16 = 0x0006
 	zclClusterLevelControl      uint16 = 0x0008
 	zclClusterColorControl      uint16 = 0x0300
@@ -31,6 +36,24 @@ const (
 const (
 	zclCmdMoveToLevel          uint8 = 0x00
 	zclCmdMoveToLevelWithOnOff uint8 = 0x04
+	zclCmdMoveWithOnOff        uint8 = 0x05
+	zclCmdStepWithOnOff        uint8 = 0x06
+	zclCmdStopWithOnOff        uint8 = 0x07
+)
+
+// ZCL command IDs for Color Control cluster
+const (
+	zclCmdMoveToColorTemperature uint8 = 0x0A
+	zclCmdStepColorTemperature   uint8 = 0x4C
+)
+
+// Level Control move/step modes and Color Control step modes
+const (
+	zclLevelModeUp          uint8 = 0x00
+	zclLevelModeDown        uint8 = 0x01
+	zclColorStepModeUp      uint8 = 0x01
+	zclColorStepModeDown    uint8 = 0x03
+	zclLevelMoveRateDefault uint8 = 0xFF
 )
 
 // ZCL frame types
@@ -39,11 +62,17 @@ const (
 	zclFrameTypeClusterSpecific uint8 = 0x01
 )
 
+// zclFrameManufacturerSpecific marks a frame whose header carries a
+// manufacturer code before the sequence number.
+const zclFrameManufacturerSpecific uint8 = 0x04
+
 // ZCL global commands
 const (
 	zclGlobalReadAttributes         uint8 = 0x00
 	zclGlobalReadAttributesResponse uint8 = 0x01
 	zclGlobalConfigureReporting     uint8 = 0x06
+	zclGlobalReportAttributes       uint8 = 0x0A
+	zclGlobalDefaultResponse        uint8 = 0x0B
 )
 
 // ZCL direction
@@ -59,22 +88,49 @@ const (
 
 // ZCL attribute IDs
 const (
+	zclAttrZCLVersion   uint16 = 0x0000 // Basic cluster: ZCL version
 	zclAttrOnOff        uint16 = 0x0000 // On/Off cluster: on/off state
 	zclAttrCurrentLevel uint16 = 0x0000 // Level Control: current level
 )
 
 // ZCLHeader represents a ZCL frame header.
 type ZCLHeader struct {
-	FrameControl uint8
-	SeqNumber    uint8
-	CommandID    uint8
+	FrameControl     uint8
+	ManufacturerCode uint16 // only for manufacturer-specific frames
+	SeqNumber        uint8
+	CommandID        uint8
 }
 
-var zclSeqCounter uint8
+// ParseZCLHeader reads the header of a ZCL frame and returns the payload
+// after it.
+func ParseZCLHeader(frame []byte) (ZCLHeader, []byte, bool) {
+	var h ZCLHeader
+	if len(frame) < 3 {
+		return h, nil, false
+	}
+	h.FrameControl = frame[0]
+	off := 1
+	if h.FrameControl&zclFrameManufacturerSpecific != 0 {
+		if len(frame) < 5 {
+			return h, nil, false
+		}
+		h.ManufacturerCode = binary.LittleEndian.Uint16(frame[1:3])
+		off = 3
+	}
+	h.SeqNumber, h.CommandID = frame[off], frame[off+1]
+	return h, frame[off+2:], true
+}
+
+// IsDefaultResponse reports whether h is a ZCL Default Response.
+func (h ZCLHeader) IsDefaultResponse() bool {
+	return h.FrameControl&0x03 == zclFrameTypeGlobal && h.CommandID == zclGlobalDefaultResponse
+}
+
+// zclSeqCounter is shared by all senders; Default Responses are matched on it.
+var zclSeqCounter atomic.Uint32
 
 func nextZCLSeq() uint8 {
-	zclSeqCounter++
-	return zclSeqCounter
+	return uint8(zclSeqCounter.Add(1))
 }
 
 // EncodeZCLClusterCommand builds a ZCL cluster-specific command frame.
@@ -122,6 +178,55 @@ func BuildMoveToLevelCommand(level uint8, transitionTime uint16) []byte {
 	return EncodeZCLClusterCommand(zclCmdMoveToLevelWithOnOff, payload)
 }
 
+// BuildMoveLevelCommand builds a Level Control move-with-on/off command that
+// dims continuously at rate units per second until stopped.
+func BuildMoveLevelCommand(up bool, rate uint8) []byte {
+	mode := zclLevelModeDown
+	if up {
+		mode = zclLevelModeUp
+	}
+	return EncodeZCLClusterCommand(zclCmdMoveWithOnOff, []byte{mode, rate})
+}
+
+// BuildStepLevelCommand builds a Level Control step-with-on/off command.
+func BuildStepLevelCommand(up bool, size uint8, transitionTime uint16) []byte {
+	mode := zclLevelModeDown
+	if up {
+		mode = zclLevelModeUp
+	}
+	payload := []byte{mode, size, 0, 0}
+	binary.LittleEndian.PutUint16(payload[2:], transitionTime)
+	return EncodeZCLClusterCommand(zclCmdStepWithOnOff, payload)
+}
+
+// BuildStopLevelCommand builds a Level Control stop-with-on/off command.
+func BuildStopLevelCommand() []byte {
+	return EncodeZCLClusterCommand(zclCmdStopWithOnOff, nil)
+}
+
+// BuildMoveToColorTempCommand builds a Color Control move-to-color-temperature command.
+func BuildMoveToColorTempCommand(mireds, transitionTime uint16) []byte {
+	payload := make([]byte, 4)
+	binary.LittleEndian.PutUint16(payload[0:], mireds)
+	binary.LittleEndian.PutUint16(payload[2:], transitionTime)
+	return EncodeZCLClusterCommand(zclCmdMoveToColorTemperature, payload)
+}
+
+// BuildStepColorTempCommand builds a Color Control step-color-temperature
+// command. The device's own limits bound the result.
+func BuildStepColorTempCommand(up bool, size, transitionTime uint16) []byte {
+	mode := zclColorStepModeDown
+	if up {
+		mode = zclColorStepModeUp
+	}
+	// mode + size(2) + transition(2) + min(2) + max(2); 0 leaves the limits to the device
+	payload := make([]byte, 9)
+	payload[0] = mode
+	binary.LittleEndian.PutUint16(payload[1:], size)
+	binary.LittleEndian.PutUint16(payload[3:], transitionTime)
+	return EncodeZCLClusterCommand(zclCmdStepColorTemperature, payload)
+}
+
 // BuildReadAttributesCommand builds a ZCL Read Attributes command.
 func BuildReadAttributesCommand(attrIDs ...uint16) []byte {
 	payload := make([]byte, len(attrIDs)*2)
@@ -169,11 +274,50 @@ func ParseReadAttributesResponse(data []byte) map[uint16][]byte {
 	return result
 }
 
+// ParseReportAttributes extracts attribute values from a Report Attributes
+// command. Its records are those of a Read Attributes Response without the
+// status byte.
+func ParseReportAttributes(data []byte) map[uint16][]byte {
+	result := make(map[uint16][]byte)
+	offset := 0
+
+	for offset+3 <= len(data) {
+		attrID := binary.LittleEndian.Uint16(data[offset:])
+		dataType := data[offset+2]
+		offset += 3
+
+		valueLen := zclDataTypeLength(dataType, data[offset:])
+		if valueLen <= 0 || offset+valueLen > len(data) {
+			break
+		}
+
+		value := make([]byte, valueLen)
+		copy(value, data[offset:offset+valueLen])
+		result[attrID] = value
+		offset += valueLen
+	}
+
+	return result
+}
+
+// ParseDefaultResponse extracts the command ID and status from a ZCL Default
+// Response payload (the bytes after the ZCL header).
+func ParseDefaultResponse(data []byte) (cmdID uint8, status uint8, ok bool) {
+	if len(data) < 2 {
+		return 0, 0, false
+	}
+	return data[0], data[1], true
+}
+
 // zclDataTypeLength returns the byte length of a ZCL data type value.
 func zclDataTypeLength(dataType uint8, data []byte) int {
 	switch dataType {
 	case 0x10: // Boolean
 		return 1
+	case 0x18: // map8
+		return 1
+	case 0x19: // map16
+		return 2
 	case 0x20: // uint8
 		return 1
 	case 0x21: // uint16
@@ -186,6 +330,8 @@ func zclDataTypeLength(dataType uint8, data []byte) int {
 		return 1
 	case 0x29: // int16
 		return 2
+	case 0x2B: // int32
+		return 4
 	case 0x30: // enum8
 		return 1
 	case 0x31: // enum16
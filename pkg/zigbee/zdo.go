@@ -0,0 +1,86 @@
+package zigbee
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/urmzd/zigbee-skill/pkg/device"
+)
+
+// zdoRequestTimeout bounds the wait for a ZDO response.
+const zdoRequestTimeout = 10 * time.Second
+
+// zdoSeqCounter provides ZDO transaction sequence numbers.
+var zdoSeqCounter atomic.Uint32
+
+func nextZDOSeq() uint8 {
+	return uint8(zdoSeqCounter.Add(1))
+}
+
+// zdoWaitKey identifies an outstanding ZDO request by responder, response
+// cluster and transaction sequence number.
+type zdoWaitKey struct {
+	nodeID  uint16
+	cluster uint16
+	seq     uint8
+}
+
+// zdoRequest sends a ZDO request (payload without the transaction sequence
+// number) to nodeID and waits for the matching response. The returned bytes
+// start with the transaction sequence number, followed by the status.
+func (c *Controller) zdoRequest(ctx context.Context, nodeID, cluster uint16, payload []byte) ([]byte, error) {
+	seq := nextZDOSeq()
+	key := zdoWaitKey{nodeID: nodeID, cluster: cluster | 0x8000, seq: seq}
+	ch := make(chan []byte, 1)
+
+	c.zdoMu.Lock()
+	c.zdoWaiters[key] = ch
+	c.zdoMu.Unlock()
+	defer func() {
+		c.zdoMu.Lock()
+		delete(c.zdoWaiters, key)
+		c.zdoMu.Unlock()
+	}()
+
+	frame := make([]byte, 0, 1+len(payload))
+	frame = append(frame, seq)
+	frame = append(frame, payload...)
+	down := c.ash.Down()
+	if err := c.ezsp.SendUnicast(nodeID, zdoProfileID, cluster, 0, 0, frame); err != nil {
+		return nil, fmt.Errorf("send ZDO 0x%04X to 0x%04X: %w", cluster, nodeID, err)
+	}
+
+	select {
+	case resp := <-ch:
+		return resp, nil
+	case <-time.After(zdoRequestTimeout):
+		return nil, fmt.Errorf("%w: ZDO 0x%04X to 0x%04X", device.ErrTimeout, cluster, nodeID)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-down:
+		return nil, device.ErrNotConnected
+	case <-c.stopChan:
+		return nil, device.ErrNotConnected
+	}
+}
+
+// deliverZDOResponse hands a ZDO response to its waiter. Returns true if a
+// waiter consumed it.
+func (c *Controller) deliverZDOResponse(sender, cluster uint16, message []byte) bool {
+	if len(message) < 1 {
+		return false
+	}
+	c.zdoMu.Lock()
+	ch, ok := c.zdoWaiters[zdoWaitKey{nodeID: sender, cluster: cluster, seq: message[0]}]
+	c.zdoMu.Unlock()
+	if !ok {
+		return false
+	}
+	select {
+	case ch <- message:
+	default:
+	}
+	return true
+}
@@ -0,0 +1,614 @@
+package znp
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/urmzd/zigbee-skill/pkg/device"
+	"github.com/urmzd/zigbee-skill/pkg/zigbee"
+)
+
+// ZCL identifiers used by the ZNP controller.
+const (
+	zclClusterOnOff        uint16 = 0x0006
+	zclClusterLevelControl uint16 = 0x0008
+
+	zclAttrOnOff        uint16 = 0x0000
+	zclAttrCurrentLevel uint16 = 0x0000
+
+	zclCmdOff    uint8 = 0x00
+	zclCmdOn     uint8 = 0x01
+	zclCmdToggle uint8 = 0x02
+
+	zclGlobalReadAttributesResponse uint8 = 0x01
+	zclGlobalReportAttributes       uint8 = 0x0A
+	zclGlobalDefaultResponse        uint8 = 0x0B
+)
+
+const (
+	// coordinatorEndpoint is the endpoint registered with AF_REGISTER.
+	coordinatorEndpoint = 1
+
+	// afOptionsAckRequest requests an APS acknowledgement for AF_DATA_REQUEST.
+	afOptionsAckRequest = 0x10
+	afDefaultRadius     = 0x1E
+
+	// zdoResponseTimeout bounds the wait for a ZDO response indication.
+	zdoResponseTimeout = 10 * time.Second
+)
+
+// zclWaitKey identifies a ZCL transaction awaiting a Default Response.
+type zclWaitKey struct {
+	nodeID uint16
+	seq    uint8
+}
+
+// Options configures a Controller.
+type Options struct {
+	// Form holds the parameters used when the adapter has no network yet.
+	Form device.FormOptions
+}
+
+// Controller implements device.Controller and device.EventSubscriber for a
+// Z-Stack coordinator running the ZNP firmware.
+type Controller struct {
+	port zigbee.Transport
+	mt   *Layer
+	opts Options
+
+	*zigbee.KnownDevices
+
+	connected bool
+	connMu    sync.RWMutex
+
+	confirmWaiters map[uint8]chan uint32     // AF transaction ID -> AF_DATA_CONFIRM status
+	zclWaiters     map[zclWaitKey]chan uint8 // ZCL transaction -> Default Response status
+	nextTransID    uint8
+	sentMu         sync.Mutex
+
+	joinWindow zigbee.JoinWindow
+
+	coordIEEE string
+
+	onNetworkChange func(device.FormOptions)
+	stopChan        chan struct{}
+}
+
+// NewController opens the ZNP on portPath, resumes or forms its network and
+// registers the coordinator endpoint.
+func NewController(portPath string, opts Options) (*Controller, error) {
+	log.Info().Str("port", portPath).Msg("Initializing Z-Stack ZNP controller")
+	s, err := zigbee.OpenSerial(portPath)
+	if err != nil {
+		return nil, fmt.Errorf("open serial: %w", err)
+	}
+	c, err := newController(s, opts)
+	if err != nil {
+		_ = s.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// newController runs the ZNP startup sequence over an open transport.
+func newController(t zigbee.Transport, opts Options) (*Controller, error) {
+	mt := NewLayer(t)
+	c := &Controller{
+		port:           t,
+		mt:             mt,
+		opts:           opts,
+		confirmWaiters: make(map[uint8]chan uint32),
+		zclWaiters:     make(map[zclWaitKey]chan uint8),
+		stopChan:       make(chan struct{}),
+	}
+	c.KnownDevices = zigbee.NewKnownDevices(c)
+
+	mt.Listen(mtSubsysZDO, zdoTCDevInd, c.handleTCDevice)
+	mt.Listen(mtSubsysZDO, zdoEndDeviceAnnceInd, c.handleDeviceAnnce)
+	mt.Listen(mtSubsysZDO, zdoLeaveInd, c.handleLeave)
+	mt.Listen(mtSubsysAF, afIncomingMsg, c.handleIncomingMessage)
+	mt.Listen(mtSubsysAF, afDataConfirm, c.handleDataConfirm)
+	mt.Start()
+
+	if err := c.initStack(); err != nil {
+		mt.Close()
+		return nil, fmt.Errorf("init stack: %w", err)
+	}
+
+	c.connMu.Lock()
+	c.connected = true
+	c.connMu.Unlock()
+
+	go c.watchLink()
+
+	log.Info().Msg("Z-Stack ZNP controller initialized")
+	return c, nil
+}
+
+// initStack checks the ZNP answers, starts the network and registers the
+// coordinator endpoint.
+func (c *Controller) initStack() error {
+	if _, err := c.mt.Request(mtSubsysSYS, sysPing, nil); err != nil {
+		return fmt.Errorf("ping: %w", err)
+	}
+	if err := c.startNetwork(); err != nil {
+		return err
+	}
+
+	// AF_REGISTER: endpoint + profile(2) + deviceID(2) + version + latency +
+	// inCount + in(2n) + outCount + out(2n)
+	reg := []byte{coordinatorEndpoint, 0x04, 0x01, 0x05, 0x00, 0x00, 0x00} // HA profile, configuration tool
+	clusters := []byte{2, byte(zclClusterOnOff), 0, byte(zclClusterLevelControl), 0}
+	reg = append(reg, clusters...)
+	reg = append(reg, clusters...)
+	resp, err := c.mt.Request(mtSubsysAF, afRegister, reg)
+	if err != nil {
+		return fmt.Errorf("register endpoint: %w", err)
+	}
+	if len(resp) < 1 {
+		return fmt.Errorf("register endpoint: empty response")
+	}
+	// 0xB8 (ZApsDuplicateEntry): the endpoint survived a soft reset.
+	if resp[0] != 0x00 && resp[0] != 0xB8 {
+		return fmt.Errorf("register endpoint: status 0x%02X", resp[0])
+	}
+
+	// UTIL_GET_DEVICE_INFO: status + ieee(8) + shortAddr(2) + ...
+	if info, err := c.mt.Request(mtSubsysUTIL, utilGetDeviceInfo, nil); err == nil && len(info) >= 9 {
+		var ieee [8]byte
+		copy(ieee[:], info[1:9])
+		c.coordIEEE = zigbee.FormatIEEE(ieee)
+	}
+	return nil
+}
+
+// watchLink marks the controller disconnected when the serial link fails.
+func (c *Controller) watchLink() {
+	select {
+	case <-c.mt.Down():
+	case <-c.stopChan:
+		return
+	}
+	reason := "link lost"
+	if err := c.mt.Err(); err != nil {
+		reason = err.Error()
+	}
+	c.connMu.Lock()
+	c.connected = false
+	c.connMu.Unlock()
+	c.joinWindow.Close()
+	log.Warn().Str("reason", reason).Msg("ZNP coordinator disconnected")
+	c.Publish(device.Event{
+		Type:      device.EventCoordinatorDisconnected,
+		Reason:    reason,
+		Timestamp: time.Now(),
+	})
+}
+
+// SetOnNetworkChange registers a callback invoked after a network is formed.
+func (c *Controller) SetOnNetworkChange(fn func(device.FormOptions)) { c.onNetworkChange = fn }
+
+// LoadDevices pre-populates the device map from persistent storage and asks
+// each device for its current short address with ZDO_NWK_ADDR_REQ.
+func (c *Controller) LoadDevices(entries []zigbee.LoadEntry) {
+	for _, e := range entries {
+		ieee := zigbee.FormatIEEE(e.IEEEAddress)
+		ep := e.Endpoint
+		if ep == 0 {
+			ep = 1
+		}
+		nodeID, err := c.resolveNodeID(e.IEEEAddress)
+		lastSeen := e.LastSeen
+		if err == nil {
+			lastSeen = time.Now()
+		} else {
+			log.Warn().Str("ieee", ieee).Err(err).Msg("Could not resolve NodeID — device will need to rejoin")
+		}
+
+		kd := &zigbee.KnownDevice{
+			IEEEAddress:   e.IEEEAddress,
+			NodeID:        nodeID,
+			FriendlyName:  e.FriendlyName,
+			DeviceType:    e.DeviceType,
+			Endpoint:      ep,
+			Clusters:      e.Clusters,
+			Sleepy:        e.Sleepy,
+			LinkKeyStatus: e.LinkKeyStatus,
+			Available:     nodeID != 0,
+			LastSeen:      lastSeen,
+		}
+		kd.RestoreState(e.State, e.StateUpdatedAt)
+		c.Update(func(devices map[string]*zigbee.KnownDevice) { devices[ieee] = kd })
+	}
+}
+
+// resolveNodeID broadcasts ZDO_NWK_ADDR_REQ for ieee and waits for the answer.
+func (c *Controller) resolveNodeID(ieee [8]byte) (uint16, error) {
+	// ZDO_NWK_ADDR_RSP: status + ieee(8) + nwkAddr(2) + ...
+	wait, cancel := c.mt.Expect(mtSubsysZDO, zdoNWKAddrRsp, func(p []byte) bool {
+		return len(p) >= 11 && p[0] == 0x00 && [8]byte(p[1:9]) == ieee
+	})
+	defer cancel()
+	req := append(ieee[:], 0x00, 0x00) // single device response, start index
+	if err := c.mt.RequestStatus(mtSubsysZDO, zdoNWKAddrReq, req); err != nil {
+		return 0, err
+	}
+	p, err := wait(5 * time.Second)
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint16(p[9:11]), nil
+}
+
+// --- AREQ handlers (run on the reader goroutine) ---
+
+// handleTCDevice processes ZDO_TC_DEV_IND, sent when a device joins or rejoins
+// through the Trust Center.
+func (c *Controller) handleTCDevice(p []byte) {
+	// nwkAddr(2) + extAddr(8) + parentAddr(2)
+	if len(p) < 12 {
+		return
+	}
+	nodeID := binary.LittleEndian.Uint16(p[0:2])
+	var ieee [8]byte
+	copy(ieee[:], p[2:10])
+	parent := c.ieeeForNodeID(binary.LittleEndian.Uint16(p[10:12]))
+	ieeeStr := zigbee.FormatIEEE(ieee)
+
+	log.Info().Str("ieee", ieeeStr).Uint16("nodeID", nodeID).Str("parent", parent).Msg("Trust center device indication")
+
+	var (
+		kd                  *zigbee.KnownDevice
+		found, wasAvailable bool
+		dev                 device.Device
+	)
+	c.Update(func(devices map[string]*zigbee.KnownDevice) {
+		kd, found = devices[ieeeStr]
+		wasAvailable = found && kd.Available
+		if found {
+			kd.NodeID = nodeID
+			kd.LastSeen = time.Now()
+			kd.Available = true
+		} else {
+			kd = &zigbee.KnownDevice{
+				IEEEAddress:  ieee,
+				NodeID:       nodeID,
+				FriendlyName: ieeeStr,
+				DeviceType:   device.DeviceTypeLight,
+				Endpoint:     1,
+				State:        make(device.DeviceState),
+				Available:    true,
+				LastSeen:     time.Now(),
+			}
+			devices[ieeeStr] = kd
+		}
+		dev = zigbee.ToDevice(ieeeStr, kd)
+	})
+
+	if found && !wasAvailable {
+		c.PublishAvailability(ieeeStr, kd, true)
+	}
+	c.Publish(device.Event{
+		Type:      device.EventDeviceJoined,
+		Device:    &dev,
+		Parent:    parent,
+		Timestamp: time.Now(),
+	})
+	if !found {
+		c.NotifyDeviceChange()
+		go c.interview(kd)
+	}
+}
+
+// handleDeviceAnnce records a device's NodeID and power mode from
+// ZDO_END_DEVICE_ANNCE_IND.
+func (c *Controller) handleDeviceAnnce(p []byte) {
+	// srcAddr(2) + nwkAddr(2) + ieee(8) + capabilities(1)
+	if len(p) < 13 {
+		return
+	}
+	nodeID := binary.LittleEndian.Uint16(p[2:4])
+	var ieee [8]byte
+	copy(ieee[:], p[4:12])
+	ieeeStr := zigbee.FormatIEEE(ieee)
+
+	var kd *zigbee.KnownDevice
+	cameOnline := false
+	c.Update(func(devices map[string]*zigbee.KnownDevice) {
+		var ok bool
+		if kd, ok = devices[ieeeStr]; ok {
+			kd.NodeID = nodeID
+			// Capability bit 3: receiver on when idle.
+			kd.Sleepy = p[12]&0x08 == 0
+			kd.LastSeen = time.Now()
+			cameOnline = !kd.Available
+			kd.Available = true
+		}
+	})
+
+	if cameOnline {
+		c.PublishAvailability(ieeeStr, kd, true)
+	}
+}
+
+// handleLeave removes a device that left without intending to rejoin.
+func (c *Controller) handleLeave(p []byte) {
+	// srcAddr(2) + extAddr(8) + request + removeChildren + rejoin
+	if len(p) < 13 {
+		return
+	}
+	var ieee [8]byte
+	copy(ieee[:], p[2:10])
+	if p[12] != 0 {
+		return // the device will rejoin; keep it
+	}
+	ieeeStr := zigbee.FormatIEEE(ieee)
+
+	ok := false
+	c.Update(func(devices map[string]*zigbee.KnownDevice) {
+		_, ok = devices[ieeeStr]
+		delete(devices, ieeeStr)
+	})
+	if !ok {
+		return
+	}
+	c.Publish(device.Event{
+		Type:      device.EventDeviceLeft,
+		Device:    &device.Device{ID: ieeeStr},
+		Timestamp: time.Now(),
+	})
+	c.NotifyDeviceChange()
+}
+
+// handleIncomingMessage processes AF_INCOMING_MSG.
+func (c *Controller) handleIncomingMessage(p []byte) {
+	// groupId(2) + clusterId(2) + srcAddr(2) + srcEndpoint + dstEndpoint +
+	// wasBroadcast + linkQuality + securityUse + timestamp(4) + transSeqNum +
+	// len + data
+	if len(p) < 17 || len(p) < 17+int(p[16]) {
+		return
+	}
+	clusterID := binary.LittleEndian.Uint16(p[2:4])
+	sender := binary.LittleEndian.Uint16(p[4:6])
+	lqi := p[9]
+	message := p[17 : 17+int(p[16])]
+
+	log.Debug().
+		Uint16("cluster", clusterID).
+		Uint16("sender", sender).
+		Uint8("lqi", lqi).
+		Hex("message", message).
+		Msg("Incoming message")
+
+	c.MarkSeen(sender, lqi)
+	hdr, payload, ok := zigbee.ParseZCLHeader(message)
+	if !ok || hdr.FrameControl&0x03 != 0x00 {
+		return // only global commands carry state or default responses
+	}
+
+	switch hdr.CommandID {
+	case zclGlobalDefaultResponse:
+		if _, status, ok := zigbee.ParseDefaultResponse(payload); ok {
+			c.deliverDefaultResponse(sender, hdr.SeqNumber, status)
+		}
+	case zclGlobalReadAttributesResponse:
+		c.UpdateState(sender, clusterID, zigbee.ParseReadAttributesResponse(payload))
+	case zclGlobalReportAttributes:
+		c.UpdateState(sender, clusterID, zigbee.ParseReportAttributes(payload))
+	}
+}
+
+// handleDataConfirm wakes the sender waiting on an AF transaction.
+func (c *Controller) handleDataConfirm(p []byte) {
+	// status + endpoint + transId
+	if len(p) < 3 {
+		return
+	}
+	c.sentMu.Lock()
+	ch, ok := c.confirmWaiters[p[2]]
+	c.sentMu.Unlock()
+	if ok {
+		select {
+		case ch <- uint32(p[0]):
+		default:
+		}
+	}
+}
+
+func (c *Controller) deliverDefaultResponse(sender uint16, seq, status uint8) {
+	c.sentMu.Lock()
+	ch, ok := c.zclWaiters[zclWaitKey{nodeID: sender, seq: seq}]
+	c.sentMu.Unlock()
+	if ok {
+		select {
+		case ch <- status:
+		default:
+		}
+	}
+}
+
+// interview reads a new device's active endpoints and simple descriptors to
+// learn its clusters and type.
+func (c *Controller) interview(kd *zigbee.KnownDevice) {
+	var nodeID uint16
+	c.View(func(map[string]*zigbee.KnownDevice) { nodeID = kd.NodeID })
+	ieee := zigbee.FormatIEEE(kd.IEEEAddress)
+	c.PublishInterview(ieee, device.InterviewStarted, nil)
+
+	eps, err := c.activeEndpoints(nodeID)
+	if err != nil {
+		log.Warn().Err(err).Str("device", ieee).Msg("Active endpoints request failed")
+		c.PublishInterview(ieee, device.InterviewFailed, err)
+		return
+	}
+	var clusters []uint16
+	var endpoint uint8
+	for _, ep := range eps {
+		if ep == 0 || ep == 242 { // ZDO and Green Power
+			continue
+		}
+		in, err := c.simpleDescriptor(nodeID, ep)
+		if err != nil {
+			log.Warn().Err(err).Str("device", ieee).Uint8("endpoint", ep).Msg("Simple descriptor request failed")
+			continue
+		}
+		if endpoint == 0 {
+			endpoint = ep
+		}
+		for _, cl := range in {
+			if !slices.Contains(clusters, cl) {
+				clusters = append(clusters, cl)
+			}
+		}
+	}
+	if endpoint == 0 {
+		c.PublishInterview(ieee, device.InterviewFailed, fmt.Errorf("no application endpoint"))
+		return
+	}
+
+	deviceType := zigbee.DeviceTypeFromClusters(clusters)
+	c.Update(func(map[string]*zigbee.KnownDevice) {
+		kd.Endpoint = endpoint
+		kd.Clusters = clusters
+		kd.DeviceType = deviceType
+	})
+	c.NotifyDeviceChange()
+	c.PublishInterview(ieee, device.InterviewEndpoints, nil)
+	log.Info().Str("device", ieee).Int("clusters", len(clusters)).Str("type", deviceType).Msg("Device interview complete")
+	c.PublishInterview(ieee, device.InterviewCompleted, nil)
+}
+
+// activeEndpoints sends ZDO_ACTIVE_EP_REQ and returns the endpoint list.
+func (c *Controller) activeEndpoints(nodeID uint16) ([]uint8, error) {
+	// ZDO_ACTIVE_EP_RSP: srcAddr(2) + status + nwkAddr(2) + count + endpoints
+	wait, cancel := c.mt.Expect(mtSubsysZDO, zdoActiveEPRsp, func(p []byte) bool {
+		return len(p) >= 6 && binary.LittleEndian.Uint16(p[0:2]) == nodeID
+	})
+	defer cancel()
+	req := []byte{byte(nodeID), byte(nodeID >> 8), byte(nodeID), byte(nodeID >> 8)}
+	if err := c.mt.RequestStatus(mtSubsysZDO, zdoActiveEPReq, req); err != nil {
+		return nil, err
+	}
+	p, err := wait(zdoResponseTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if p[2] != 0x00 {
+		return nil, fmt.Errorf("%w: Active_EP_rsp status 0x%02X", device.ErrDeliveryFailed, p[2])
+	}
+	n := int(p[5])
+	if len(p) < 6+n {
+		return nil, fmt.Errorf("Active_EP_rsp truncated")
+	}
+	return p[6 : 6+n], nil
+}
+
+// simpleDescriptor sends ZDO_SIMPLE_DESC_REQ and returns the input clusters.
+func (c *Controller) simpleDescriptor(nodeID uint16, ep uint8) ([]uint16, error) {
+	// ZDO_SIMPLE_DESC_RSP: srcAddr(2) + status + nwkAddr(2) + len + endpoint +
+	// profile(2) + deviceID(2) + version + inCount + in(2n) + outCount + out(2n)
+	wait, cancel := c.mt.Expect(mtSubsysZDO, zdoSimpleDescRsp, func(p []byte) bool {
+		return len(p) >= 7 && binary.LittleEndian.Uint16(p[0:2]) == nodeID && p[6] == ep
+	})
+	defer cancel()
+	req := []byte{byte(nodeID), byte(nodeID >> 8), byte(nodeID), byte(nodeID >> 8), ep}
+	if err := c.mt.RequestStatus(mtSubsysZDO, zdoSimpleDescReq, req); err != nil {
+		return nil, err
+	}
+	p, err := wait(zdoResponseTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if p[2] != 0x00 {
+		return nil, fmt.Errorf("%w: Simple_Desc_rsp status 0x%02X", device.ErrDeliveryFailed, p[2])
+	}
+	if len(p) < 13 {
+		return nil, fmt.Errorf("Simple_Desc_rsp truncated")
+	}
+	n := int(p[12])
+	var in []uint16
+	for i := range n {
+		off := 13 + 2*i
+		if off+2 > len(p) {
+			break
+		}
+		in = append(in, binary.LittleEndian.Uint16(p[off:off+2]))
+	}
+	return in, nil
+}
+
+// --- Sending ---
+
+// nextTransaction allocates an AF transaction ID not in use by a waiter.
+func (c *Controller) nextTransaction() uint8 {
+	c.sentMu.Lock()
+	defer c.sentMu.Unlock()
+	for {
+		c.nextTransID++
+		if _, busy := c.confirmWaiters[c.nextTransID]; !busy {
+			return c.nextTransID
+		}
+	}
+}
+
+// SendZCL sends a ZCL frame with AF_DATA_REQUEST and waits for
+// AF_DATA_CONFIRM, handling a Default Response as zigbee.AwaitDelivery does.
+func (c *Controller) SendZCL(ctx context.Context, kd *zigbee.KnownDevice, clusterID uint16, frame []byte, expectDefaultResponse bool) error {
+	hdr, _, ok := zigbee.ParseZCLHeader(frame)
+	if !ok {
+		return fmt.Errorf("ZCL frame too short: %d bytes", len(frame))
+	}
+	var nodeID uint16
+	var endpoint uint8
+	c.View(func(map[string]*zigbee.KnownDevice) { nodeID, endpoint = kd.NodeID, kd.Endpoint })
+
+	transID := c.nextTransaction()
+	confirm := make(chan uint32, 1)
+	key := zclWaitKey{nodeID: nodeID, seq: hdr.SeqNumber}
+	var defaultResp chan uint8
+	c.sentMu.Lock()
+	c.confirmWaiters[transID] = confirm
+	if expectDefaultResponse {
+		defaultResp = make(chan uint8, 1)
+		c.zclWaiters[key] = defaultResp
+	}
+	c.sentMu.Unlock()
+	release := func() {
+		c.sentMu.Lock()
+		delete(c.confirmWaiters, transID)
+		if defaultResp != nil && c.zclWaiters[key] == defaultResp {
+			delete(c.zclWaiters, key)
+		}
+		c.sentMu.Unlock()
+	}
+
+	// dstAddr(2) + dstEndpoint + srcEndpoint + clusterId(2) + transId +
+	// options + radius + len + data
+	req := []byte{byte(nodeID), byte(nodeID >> 8), endpoint, coordinatorEndpoint,
+		byte(clusterID), byte(clusterID >> 8), transID, afOptionsAckRequest, afDefaultRadius, byte(len(frame))}
+	req = append(req, frame...)
+	if err := c.mt.RequestStatus(mtSubsysAF, afDataRequest, req); err != nil {
+		release()
+		return fmt.Errorf("%w: %v", device.ErrDeliveryFailed, err)
+	}
+	return zigbee.AwaitDelivery(ctx, nodeID, clusterID, confirm, defaultResp, c.mt.Down(), c.stopChan, release)
+}
+
+// --- Helpers ---
+
+// ieeeForNodeID maps a short address to the coordinator or a known device,
+// falling back to the hex short address.
+func (c *Controller) ieeeForNodeID(nodeID uint16) string {
+	if nodeID == 0x0000 && c.coordIEEE != "" {
+		return c.coordIEEE
+	}
+	if ieee, ok := c.IEEEForNodeID(nodeID); ok {
+		return ieee
+	}
+	return fmt.Sprintf("0x%04x", nodeID)
+}
@@ -0,0 +1,99 @@
+package znp
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/rs/zerolog/log"
+	"github.com/urmzd/zigbee-skill/pkg/device"
+	"github.com/urmzd/zigbee-skill/pkg/zigbee"
+)
+
+// --- device.Controller interface ---
+
+// SendLeave asks a device to leave with ZDO_MGMT_LEAVE_REQ.
+func (c *Controller) SendLeave(kd *zigbee.KnownDevice) error {
+	var nodeID uint16
+	c.View(func(map[string]*zigbee.KnownDevice) { nodeID = kd.NodeID })
+	// dstAddr(2) + deviceAddr(8) + removeChildren/rejoin flags
+	req := []byte{byte(nodeID), byte(nodeID >> 8)}
+	req = append(req, kd.IEEEAddress[:]...)
+	req = append(req, 0x00)
+	return c.mt.RequestStatus(mtSubsysZDO, zdoMgmtLeaveReq, req)
+}
+
+// PermitJoin opens joining on every router and the coordinator by
+// broadcasting ZDO_MGMT_PERMIT_JOIN_REQ, re-issuing it in 254s chunks.
+func (c *Controller) PermitJoin(_ context.Context, enable bool, duration int) error {
+	if !c.IsConnected() {
+		return device.ErrNotConnected
+	}
+	if !enable {
+		c.joinWindow.Close()
+		return c.permitJoin(0)
+	}
+	return c.joinWindow.Open(duration, c.permitJoin, c.stopChan)
+}
+
+func (c *Controller) permitJoin(duration uint8) error {
+	// addrMode + dstAddr(2) + duration + tcSignificance; mode 0x0F broadcasts
+	// to all routers and includes the coordinator.
+	req := []byte{0x0F, 0xFC, 0xFF, duration, 0x00}
+	if err := c.mt.RequestStatus(mtSubsysZDO, zdoMgmtPermitJoinReq, req); err != nil {
+		return fmt.Errorf("permit join: %w", err)
+	}
+	log.Info().Uint8("duration", duration).Msg("Permit joining set")
+	return nil
+}
+
+func (c *Controller) IsConnected() bool {
+	c.connMu.RLock()
+	defer c.connMu.RUnlock()
+	return c.connected
+}
+
+func (c *Controller) Close() {
+	c.connMu.Lock()
+	c.connected = false
+	select {
+	case <-c.stopChan:
+	default:
+		close(c.stopChan)
+	}
+	c.connMu.Unlock()
+
+	c.mt.Close()
+	if err := c.port.Close(); err != nil {
+		log.Warn().Err(err).Msg("Failed to close serial port")
+	}
+	log.Info().Msg("Z-Stack ZNP controller closed")
+}
+
+// NetworkInfo returns the running network's parameters and ZNP firmware version.
+func (c *Controller) NetworkInfo(_ context.Context) (*device.NetworkInfo, error) {
+	if !c.IsConnected() {
+		return nil, device.ErrNotConnected
+	}
+	channel, panID, ext, err := c.networkInfo()
+	if err != nil {
+		return nil, err
+	}
+	info := &device.NetworkInfo{
+		NetworkUp:       true,
+		Channel:         int(channel),
+		PanID:           fmt.Sprintf("0x%04x", panID),
+		ExtendedPanID:   zigbee.FormatIEEE(ext),
+		NodeType:        device.NodeTypeCoordinator,
+		CoordinatorIEEE: c.coordIEEE,
+		Adapter:         device.AdapterInfo{Protocol: "znp"},
+	}
+	// SYS_VERSION: transportRev + product + major + minor + maint [+ revision(4)]
+	if v, err := c.mt.Request(mtSubsysSYS, sysVersion, nil); err == nil && len(v) >= 5 {
+		info.Adapter.ProtocolVersion = int(v[0])
+		info.Adapter.StackVersion = fmt.Sprintf("%d.%d.%d", v[2], v[3], v[4])
+		if len(v) >= 9 {
+			info.Adapter.FirmwareBuild = int(uint32(v[5]) | uint32(v[6])<<8 | uint32(v[7])<<16 | uint32(v[8])<<24)
+		}
+	}
+	return info, nil
+}
@@ -0,0 +1,150 @@
+// Package znp drives Texas Instruments Z-Stack adapters (CC2652, CC1352)
+// running the Zigbee Network Processor firmware over the MT serial protocol.
+package znp
+
+import (
+	"fmt"
+	"io"
+)
+
+// MT frame: SOF(1) + length(1) + cmd0(1) + cmd1(1) + data(length) + FCS(1).
+// FCS is the XOR of length, cmd0, cmd1 and data.
+const (
+	mtSOF        = 0xFE
+	mtMaxPayload = 250
+)
+
+// MT command types (cmd0 bits 7-5).
+const (
+	mtTypeSREQ uint8 = 0x20 // synchronous request
+	mtTypeAREQ uint8 = 0x40 // asynchronous request/indication
+	mtTypeSRSP uint8 = 0x60 // synchronous response
+)
+
+// MT subsystems (cmd0 bits 4-0).
+const (
+	mtSubsysRPCError uint8 = 0x00
+	mtSubsysSYS      uint8 = 0x01
+	mtSubsysAF       uint8 = 0x04
+	mtSubsysZDO      uint8 = 0x05
+	mtSubsysUTIL     uint8 = 0x07
+	mtSubsysAPPCNF   uint8 = 0x0F
+)
+
+// SYS commands
+const (
+	sysResetReq       uint8 = 0x00 // AREQ
+	sysPing           uint8 = 0x01
+	sysVersion        uint8 = 0x02
+	sysOsalNVItemInit uint8 = 0x07
+	sysOsalNVRead     uint8 = 0x08
+	sysOsalNVWrite    uint8 = 0x09
+	sysResetInd       uint8 = 0x80 // AREQ
+)
+
+// AF commands
+const (
+	afRegister    uint8 = 0x00
+	afDataRequest uint8 = 0x01
+	afDataConfirm uint8 = 0x80 // AREQ
+	afIncomingMsg uint8 = 0x81 // AREQ
+)
+
+// ZDO commands
+const (
+	zdoNWKAddrReq        uint8 = 0x00
+	zdoSimpleDescReq     uint8 = 0x04
+	zdoActiveEPReq       uint8 = 0x05
+	zdoMgmtLeaveReq      uint8 = 0x34
+	zdoMgmtPermitJoinReq uint8 = 0x36
+	zdoStartupFromApp    uint8 = 0x40
+	zdoExtNwkInfo        uint8 = 0x50
+
+	zdoNWKAddrRsp        uint8 = 0x80 // AREQ
+	zdoSimpleDescRsp     uint8 = 0x84 // AREQ
+	zdoActiveEPRsp       uint8 = 0x85 // AREQ
+	zdoStateChangeInd    uint8 = 0xC0 // AREQ
+	zdoEndDeviceAnnceInd uint8 = 0xC1 // AREQ
+	zdoLeaveInd          uint8 = 0xC9 // AREQ
+	zdoTCDevInd          uint8 = 0xCA // AREQ
+)
+
+// UTIL commands
+const (
+	utilGetDeviceInfo uint8 = 0x00
+)
+
+// APP_CNF commands (Z-Stack 3.x BDB)
+const (
+	appCnfBDBStartCommissioning uint8 = 0x05
+	appCnfBDBSetChannel         uint8 = 0x08
+)
+
+// mtFrame is a decoded MT frame.
+type mtFrame struct {
+	typ     uint8
+	subsys  uint8
+	cmd     uint8
+	payload []byte
+}
+
+func (f mtFrame) String() string {
+	return fmt.Sprintf("type=0x%02X subsys=0x%02X cmd=0x%02X len=%d", f.typ, f.subsys, f.cmd, len(f.payload))
+}
+
+// encode serializes f with SOF and FCS.
+func (f mtFrame) encode() ([]byte, error) {
+	if len(f.payload) > mtMaxPayload {
+		return nil, fmt.Errorf("MT payload too long: %d bytes", len(f.payload))
+	}
+	b := make([]byte, 0, 5+len(f.payload))
+	b = append(b, mtSOF, byte(len(f.payload)), f.typ|f.subsys, f.cmd)
+	b = append(b, f.payload...)
+	return append(b, mtFCS(b[1:])), nil
+}
+
+// mtFCS is the XOR of every byte in b.
+func mtFCS(b []byte) byte {
+	var fcs byte
+	for _, x := range b {
+		fcs ^= x
+	}
+	return fcs
+}
+
+// readMTFrame reads the next valid frame from r, skipping bytes until a SOF
+// and dropping frames whose FCS does not match.
+func readMTFrame(r io.ByteReader) (mtFrame, error) {
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return mtFrame{}, err
+		}
+		if b != mtSOF {
+			continue
+		}
+		n, err := r.ReadByte()
+		if err != nil {
+			return mtFrame{}, err
+		}
+		if n > mtMaxPayload {
+			continue
+		}
+		body := make([]byte, int(n)+3) // cmd0 + cmd1 + data + FCS
+		for i := range body {
+			if body[i], err = r.ReadByte(); err != nil {
+				return mtFrame{}, err
+			}
+		}
+		fcs := body[len(body)-1]
+		if mtFCS(append([]byte{n}, body[:len(body)-1]...)) != fcs {
+			continue
+		}
+		return mtFrame{
+			typ:     body[0] & 0xE0,
+			subsys:  body[0] & 0x1F,
+			cmd:     body[1],
+			payload: body[2 : 2+int(n)],
+		}, nil
+	}
+}
@@ -0,0 +1,309 @@
+package znp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/urmzd/zigbee-skill/pkg/device"
+	"github.com/urmzd/zigbee-skill/pkg/zigbee"
+)
+
+// Z-Stack NV item IDs used for network formation.
+const (
+	nvStartupOption    uint16 = 0x0003
+	nvExtendedPanID    uint16 = 0x002D
+	nvPreCfgKey        uint16 = 0x0062
+	nvPreCfgKeysEnable uint16 = 0x0063
+	nvPanID            uint16 = 0x0083
+	nvChanList         uint16 = 0x0084
+	nvLogicalType      uint16 = 0x0087
+	nvZDODirectCB      uint16 = 0x008F
+
+	// nvHasConfigured marks an adapter this host has formed a network on.
+	nvHasConfigured uint16 = 0x0F00
+	hasConfiguredOK        = 0x55
+)
+
+const (
+	startupClearState  = 0x02 // ZCD_STARTOPT_DEFAULT_NETWORK_STATE
+	logicalCoordinator = 0x00
+
+	// devZBCoord is the ZDO state of a coordinator with a running network.
+	devZBCoord = 0x09
+
+	// BDB commissioning mode for network formation.
+	bdbFormation = 0x04
+
+	// nvItemCreated is returned by SYS_OSAL_NV_ITEM_INIT when it created the item.
+	nvItemCreated = 0x09
+
+	// bdbPrimaryChannelSet is the BDB primary channel set (11, 15, 20, 25).
+	bdbPrimaryChannelSet uint32 = 0x02108800
+
+	// networkStartTimeout bounds formation and resume. Formation includes an
+	// energy scan of every channel in the mask.
+	networkStartTimeout = 60 * time.Second
+)
+
+// readNV reads an NV item. It returns nil if the item does not exist.
+func (c *Controller) readNV(id uint16) ([]byte, error) {
+	resp, err := c.mt.Request(mtSubsysSYS, sysOsalNVRead, []byte{byte(id), byte(id >> 8), 0})
+	if err != nil {
+		return nil, err
+	}
+	// status(1) + len(1) + value
+	if len(resp) < 2 || resp[0] != 0x00 {
+		return nil, nil
+	}
+	n := int(resp[1])
+	if len(resp) < 2+n {
+		return nil, fmt.Errorf("NV read 0x%04X truncated", id)
+	}
+	return resp[2 : 2+n], nil
+}
+
+// writeNV writes an NV item, creating it first if needed.
+func (c *Controller) writeNV(id uint16, value []byte) error {
+	init := make([]byte, 0, 5+len(value))
+	init = append(init, byte(id), byte(id>>8), byte(len(value)), 0, byte(len(value)))
+	init = append(init, value...)
+	resp, err := c.mt.Request(mtSubsysSYS, sysOsalNVItemInit, init)
+	if err != nil {
+		return err
+	}
+	if len(resp) < 1 || (resp[0] != 0x00 && resp[0] != nvItemCreated) {
+		return fmt.Errorf("NV item init 0x%04X failed", id)
+	}
+
+	params := make([]byte, 0, 4+len(value))
+	params = append(params, byte(id), byte(id>>8), 0, byte(len(value)))
+	params = append(params, value...)
+	if err := c.mt.RequestStatus(mtSubsysSYS, sysOsalNVWrite, params); err != nil {
+		return fmt.Errorf("NV write 0x%04X: %w", id, err)
+	}
+	return nil
+}
+
+// resetZNP soft-resets the ZNP and waits for SYS_RESET_IND.
+func (c *Controller) resetZNP() error {
+	wait, cancel := c.mt.Expect(mtSubsysSYS, sysResetInd, nil)
+	defer cancel()
+	if err := c.mt.Send(mtSubsysSYS, sysResetReq, []byte{0x01}); err != nil {
+		return err
+	}
+	if _, err := wait(10 * time.Second); err != nil {
+		return fmt.Errorf("reset: %w", err)
+	}
+	return nil
+}
+
+// isConfigured reports whether a network formed by this host is stored in NV.
+func (c *Controller) isConfigured() (bool, error) {
+	v, err := c.readNV(nvHasConfigured)
+	if err != nil {
+		return false, err
+	}
+	return len(v) == 1 && v[0] == hasConfiguredOK, nil
+}
+
+// startNetwork resumes the network stored in NV, or forms a new one from
+// c.opts.Form when the adapter has not been configured.
+func (c *Controller) startNetwork() error {
+	configured, err := c.isConfigured()
+	if err != nil {
+		return fmt.Errorf("read NV: %w", err)
+	}
+	if !configured {
+		log.Info().Msg("No network in ZNP NV, forming new one")
+		return c.formNetwork(c.opts.Form)
+	}
+
+	log.Info().Msg("Resuming Zigbee network from ZNP NV")
+	wait, cancel := c.mt.Expect(mtSubsysZDO, zdoStateChangeInd, isCoordinatorState)
+	defer cancel()
+	if _, err := c.mt.Request(mtSubsysZDO, zdoStartupFromApp, []byte{100, 0}); err != nil {
+		return fmt.Errorf("startup from app: %w", err)
+	}
+	if _, err := wait(networkStartTimeout); err != nil {
+		return fmt.Errorf("network did not start: %w", err)
+	}
+	return nil
+}
+
+func isCoordinatorState(p []byte) bool { return len(p) >= 1 && p[0] == devZBCoord }
+
+// formParams is a fully resolved set of formation parameters.
+type formParams struct {
+	channelMask uint32
+	panID       uint16
+	extPanID    [8]byte
+	networkKey  [16]byte
+}
+
+// resolveForm validates opts and fills in random identifiers and key where
+// unset. An unset channel leaves the choice to BDB formation within the
+// primary channel set.
+func resolveForm(opts device.FormOptions) (*formParams, error) {
+	p := &formParams{channelMask: bdbPrimaryChannelSet}
+	switch {
+	case opts.Channel == 0:
+	case opts.Channel >= 11 && opts.Channel <= 26:
+		p.channelMask = 1 << opts.Channel
+	default:
+		return nil, fmt.Errorf("%w: channel must be 11-26, got %d", device.ErrValidation, opts.Channel)
+	}
+
+	if opts.PanID != "" {
+		pan, err := strconv.ParseUint(strings.TrimPrefix(strings.ToLower(opts.PanID), "0x"), 16, 16)
+		if err != nil || pan == 0xFFFF {
+			return nil, fmt.Errorf("%w: invalid PAN ID %q", device.ErrValidation, opts.PanID)
+		}
+		p.panID = uint16(pan)
+	} else {
+		var b [2]byte
+		_, _ = rand.Read(b[:])
+		p.panID = binary.LittleEndian.Uint16(b[:]) % 0xFFFE
+	}
+
+	if opts.ExtendedPanID != "" {
+		ext, err := hex.DecodeString(strings.ReplaceAll(opts.ExtendedPanID, ":", ""))
+		if err != nil || len(ext) != 8 {
+			return nil, fmt.Errorf("%w: invalid extended PAN ID %q", device.ErrValidation, opts.ExtendedPanID)
+		}
+		// Written most significant byte first; NV holds it little-endian.
+		for i := range 8 {
+			p.extPanID[i] = ext[7-i]
+		}
+	} else {
+		_, _ = rand.Read(p.extPanID[:])
+	}
+
+	if opts.NetworkKey != "" {
+		key, err := hex.DecodeString(strings.ReplaceAll(opts.NetworkKey, ":", ""))
+		if err != nil || len(key) != 16 {
+			return nil, fmt.Errorf("%w: network key must be 16 hex bytes", device.ErrValidation)
+		}
+		copy(p.networkKey[:], key)
+	} else {
+		_, _ = rand.Read(p.networkKey[:])
+	}
+	return p, nil
+}
+
+// formNetwork clears the ZNP network state, writes the formation parameters
+// to NV and runs BDB formation.
+func (c *Controller) formNetwork(opts device.FormOptions) error {
+	p, err := resolveForm(opts)
+	if err != nil {
+		return err
+	}
+
+	if err := c.writeNV(nvStartupOption, []byte{startupClearState}); err != nil {
+		return err
+	}
+	if err := c.resetZNP(); err != nil {
+		return err
+	}
+
+	var chanList, panID [4]byte
+	binary.LittleEndian.PutUint32(chanList[:], p.channelMask)
+	binary.LittleEndian.PutUint16(panID[:], p.panID)
+	items := []struct {
+		id    uint16
+		value []byte
+	}{
+		{nvLogicalType, []byte{logicalCoordinator}},
+		{nvPanID, panID[:2]},
+		{nvExtendedPanID, p.extPanID[:]},
+		{nvChanList, chanList[:]},
+		{nvPreCfgKey, p.networkKey[:]},
+		{nvPreCfgKeysEnable, []byte{0x01}},
+		{nvZDODirectCB, []byte{0x01}},
+	}
+	for _, it := range items {
+		if err := c.writeNV(it.id, it.value); err != nil {
+			return err
+		}
+	}
+
+	primary := append([]byte{0x01}, chanList[:]...)
+	if err := c.mt.RequestStatus(mtSubsysAPPCNF, appCnfBDBSetChannel, primary); err != nil {
+		return fmt.Errorf("set primary channels: %w", err)
+	}
+	if err := c.mt.RequestStatus(mtSubsysAPPCNF, appCnfBDBSetChannel, []byte{0x00, 0, 0, 0, 0}); err != nil {
+		return fmt.Errorf("set secondary channels: %w", err)
+	}
+
+	wait, cancel := c.mt.Expect(mtSubsysZDO, zdoStateChangeInd, isCoordinatorState)
+	defer cancel()
+	if err := c.mt.RequestStatus(mtSubsysAPPCNF, appCnfBDBStartCommissioning, []byte{bdbFormation}); err != nil {
+		return fmt.Errorf("start formation: %w", err)
+	}
+	if _, err := wait(networkStartTimeout); err != nil {
+		return fmt.Errorf("network formation did not complete: %w", err)
+	}
+
+	if err := c.writeNV(nvHasConfigured, []byte{hasConfiguredOK}); err != nil {
+		return err
+	}
+	log.Info().Uint16("panID", p.panID).Uint32("channels", p.channelMask).Msg("ZNP network formed")
+	c.notifyNetworkChange()
+	return nil
+}
+
+// ResetNetwork clears the network state in NV and resets the ZNP, so a new
+// network is formed on the next start.
+func (c *Controller) ResetNetwork() error {
+	log.Info().Msg("Clearing Zigbee network from ZNP NV")
+	if err := c.writeNV(nvHasConfigured, []byte{0x00}); err != nil {
+		return err
+	}
+	if err := c.writeNV(nvStartupOption, []byte{startupClearState}); err != nil {
+		return err
+	}
+	return c.resetZNP()
+}
+
+// networkInfo reads the running network's parameters with ZDO_EXT_NWK_INFO.
+func (c *Controller) networkInfo() (channel uint8, panID uint16, extPanID [8]byte, err error) {
+	// shortAddr(2) + devState(1) + panID(2) + parentAddr(2) + extPanID(8) +
+	// parentExtAddr(8) + channel(1)
+	resp, err := c.mt.Request(mtSubsysZDO, zdoExtNwkInfo, nil)
+	if err != nil {
+		return 0, 0, extPanID, err
+	}
+	if len(resp) < 24 {
+		return 0, 0, extPanID, fmt.Errorf("ZDO_EXT_NWK_INFO too short: %d bytes", len(resp))
+	}
+	copy(extPanID[:], resp[7:15])
+	return resp[23], binary.LittleEndian.Uint16(resp[3:5]), extPanID, nil
+}
+
+// notifyNetworkChange reads the current settings and passes them to the
+// registered callback.
+func (c *Controller) notifyNetworkChange() {
+	if c.onNetworkChange == nil {
+		return
+	}
+	channel, panID, ext, err := c.networkInfo()
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to read network parameters for persistence")
+		return
+	}
+	opts := device.FormOptions{
+		Channel:       int(channel),
+		PanID:         fmt.Sprintf("0x%04x", panID),
+		ExtendedPanID: zigbee.FormatIEEE(ext),
+	}
+	if key, err := c.readNV(nvPreCfgKey); err == nil && len(key) == 16 && !bytes.Equal(key, make([]byte, 16)) {
+		opts.NetworkKey = hex.EncodeToString(key)
+	}
+	c.onNetworkChange(opts)
+}
@@ -0,0 +1,50 @@
+package znp
+
+import (
+	"time"
+
+	"github.com/urmzd/zigbee-skill/pkg/zigbee"
+)
+
+// probeTimeout bounds the wait for the SYS_PING response while probing.
+const probeTimeout = 1500 * time.Millisecond
+
+// Probe reports whether a ZNP answers SYS_PING on portPath. The port is
+// closed before returning.
+func Probe(portPath string) bool {
+	s, err := zigbee.OpenSerial(portPath)
+	if err != nil {
+		return false
+	}
+	defer func() { _ = s.Close() }()
+	return probe(s, probeTimeout)
+}
+
+// probe sends SYS_PING over t and waits for its SRSP. Reads block, so a
+// transport that stays silent is abandoned to the caller's Close.
+func probe(t zigbee.Transport, timeout time.Duration) bool {
+	ping, _ := mtFrame{typ: mtTypeSREQ, subsys: mtSubsysSYS, cmd: sysPing}.encode()
+	if _, err := t.Write(ping); err != nil {
+		return false
+	}
+	got := make(chan bool, 1)
+	go func() {
+		for {
+			f, err := readMTFrame(t)
+			if err != nil {
+				got <- false
+				return
+			}
+			if f.typ == mtTypeSRSP && f.subsys == mtSubsysSYS && f.cmd == sysPing {
+				got <- true
+				return
+			}
+		}
+	}()
+	select {
+	case ok := <-got:
+		return ok
+	case <-time.After(timeout):
+		return false
+	}
+}
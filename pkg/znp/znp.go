@@ -0,0 +1,260 @@
+package znp
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/urmzd/zigbee-skill/pkg/device"
+	"github.com/urmzd/zigbee-skill/pkg/zigbee"
+)
+
+// sreqTimeout bounds the wait for an SRSP. Z-Stack answers within
+// milliseconds unless it is busy writing NV.
+const sreqTimeout = 6 * time.Second
+
+// errRPC is returned when the ZNP rejects an SREQ it does not understand.
+var errRPC = errors.New("MT RPC error")
+
+// mtListener receives AREQs of one subsystem and command.
+type mtListener struct {
+	fn func(payload []byte)
+}
+
+// Layer exchanges MT frames with a ZNP. Only one SREQ may be outstanding at a
+// time; AREQs are dispatched to listeners on the reader goroutine.
+type Layer struct {
+	t       zigbee.Transport
+	writeMu sync.Mutex
+
+	// sreqMu serializes SREQs; expect is the SRSP the current one waits for.
+	sreqMu   sync.Mutex
+	expect   uint16
+	expectMu sync.Mutex
+	srsp     chan mtFrame
+
+	listeners  map[uint16][]*mtListener
+	listenerMu sync.RWMutex
+
+	down     chan struct{}
+	downOnce sync.Once
+	err      error
+
+	stopChan chan struct{}
+}
+
+// NewLayer creates an MT layer over t. Call Start to begin reading.
+func NewLayer(t zigbee.Transport) *Layer {
+	return &Layer{
+		t:         t,
+		srsp:      make(chan mtFrame, 1),
+		listeners: make(map[uint16][]*mtListener),
+		down:      make(chan struct{}),
+		stopChan:  make(chan struct{}),
+	}
+}
+
+func mtKey(subsys, cmd uint8) uint16 { return uint16(subsys)<<8 | uint16(cmd) }
+
+// Start begins reading frames from the transport.
+func (l *Layer) Start() {
+	go l.readLoop()
+}
+
+// Down is closed when the transport fails.
+func (l *Layer) Down() <-chan struct{} { return l.down }
+
+// Err returns the error that took the link down, once Down is closed.
+func (l *Layer) Err() error {
+	select {
+	case <-l.down:
+		return l.err
+	default:
+		return nil
+	}
+}
+
+// Close stops the layer. The transport is closed by its owner.
+func (l *Layer) Close() {
+	select {
+	case <-l.stopChan:
+	default:
+		close(l.stopChan)
+	}
+}
+
+func (l *Layer) linkLost(err error) {
+	l.downOnce.Do(func() {
+		l.err = err
+		close(l.down)
+	})
+}
+
+func (l *Layer) readLoop() {
+	for {
+		f, err := readMTFrame(l.t)
+		if err != nil {
+			select {
+			case <-l.stopChan:
+			default:
+				log.Warn().Err(err).Msg("ZNP serial read failed")
+			}
+			l.linkLost(err)
+			return
+		}
+		l.processFrame(f)
+	}
+}
+
+func (l *Layer) processFrame(f mtFrame) {
+	switch f.typ {
+	case mtTypeSRSP:
+		l.expectMu.Lock()
+		want := l.expect
+		l.expectMu.Unlock()
+		if mtKey(f.subsys, f.cmd) != want && f.subsys != mtSubsysRPCError {
+			log.Debug().Stringer("frame", f).Msg("ZNP unexpected SRSP dropped")
+			return
+		}
+		select {
+		case l.srsp <- f:
+		default:
+		}
+	case mtTypeAREQ:
+		l.listenerMu.RLock()
+		ls := append([]*mtListener(nil), l.listeners[mtKey(f.subsys, f.cmd)]...)
+		l.listenerMu.RUnlock()
+		if len(ls) == 0 {
+			log.Debug().Stringer("frame", f).Msg("ZNP unhandled AREQ")
+		}
+		for _, x := range ls {
+			x.fn(f.payload)
+		}
+	}
+}
+
+// Listen registers fn for AREQs with the given subsystem and command and
+// returns a function that removes it. Listeners run on the reader goroutine
+// and must not block or send SREQs.
+func (l *Layer) Listen(subsys, cmd uint8, fn func(payload []byte)) (remove func()) {
+	key := mtKey(subsys, cmd)
+	x := &mtListener{fn: fn}
+	l.listenerMu.Lock()
+	l.listeners[key] = append(l.listeners[key], x)
+	l.listenerMu.Unlock()
+	return func() {
+		l.listenerMu.Lock()
+		defer l.listenerMu.Unlock()
+		ls := l.listeners[key]
+		for i, y := range ls {
+			if y == x {
+				l.listeners[key] = append(ls[:i:i], ls[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+func (l *Layer) write(f mtFrame) error {
+	b, err := f.encode()
+	if err != nil {
+		return err
+	}
+	l.writeMu.Lock()
+	defer l.writeMu.Unlock()
+	if _, err := l.t.Write(b); err != nil {
+		l.linkLost(err)
+		return fmt.Errorf("%w: write MT frame: %v", device.ErrNotConnected, err)
+	}
+	return nil
+}
+
+// Request sends an SREQ and returns the payload of its SRSP.
+func (l *Layer) Request(subsys, cmd uint8, payload []byte) ([]byte, error) {
+	l.sreqMu.Lock()
+	defer l.sreqMu.Unlock()
+
+	l.expectMu.Lock()
+	l.expect = mtKey(subsys, cmd)
+	l.expectMu.Unlock()
+	// Drop a late SRSP left over from a timed-out request.
+	select {
+	case <-l.srsp:
+	default:
+	}
+
+	if err := l.write(mtFrame{typ: mtTypeSREQ, subsys: subsys, cmd: cmd, payload: payload}); err != nil {
+		return nil, err
+	}
+	select {
+	case f := <-l.srsp:
+		if f.subsys == mtSubsysRPCError {
+			code := byte(0xFF)
+			if len(f.payload) > 0 {
+				code = f.payload[0]
+			}
+			return nil, fmt.Errorf("%w 0x%02X for SREQ 0x%02X/0x%02X", errRPC, code, subsys, cmd)
+		}
+		return f.payload, nil
+	case <-l.down:
+		return nil, fmt.Errorf("%w: link lost waiting for SRSP 0x%02X/0x%02X", device.ErrNotConnected, subsys, cmd)
+	case <-time.After(sreqTimeout):
+		return nil, fmt.Errorf("%w: no SRSP for 0x%02X/0x%02X", device.ErrTimeout, subsys, cmd)
+	case <-l.stopChan:
+		return nil, fmt.Errorf("stopped")
+	}
+}
+
+// RequestStatus sends an SREQ whose SRSP is a single status byte and returns
+// an error unless it is zero.
+func (l *Layer) RequestStatus(subsys, cmd uint8, payload []byte) error {
+	resp, err := l.Request(subsys, cmd, payload)
+	if err != nil {
+		return err
+	}
+	if len(resp) < 1 || resp[0] != 0x00 {
+		status := byte(0xFF)
+		if len(resp) >= 1 {
+			status = resp[0]
+		}
+		return fmt.Errorf("SREQ 0x%02X/0x%02X failed: status 0x%02X", subsys, cmd, status)
+	}
+	return nil
+}
+
+// Send writes an AREQ; nothing is returned synchronously.
+func (l *Layer) Send(subsys, cmd uint8, payload []byte) error {
+	return l.write(mtFrame{typ: mtTypeAREQ, subsys: subsys, cmd: cmd, payload: payload})
+}
+
+// Expect registers interest in an AREQ accepted by match and returns a
+// function that waits for it. Registering first avoids missing an AREQ the
+// ZNP sends right after the SRSP. Callers defer cancel so the listener is
+// removed when the request fails before wait is called.
+func (l *Layer) Expect(subsys, cmd uint8, match func([]byte) bool) (wait func(time.Duration) ([]byte, error), cancel func()) {
+	ch := make(chan []byte, 1)
+	remove := l.Listen(subsys, cmd, func(p []byte) {
+		if match == nil || match(p) {
+			select {
+			case ch <- p:
+			default:
+			}
+		}
+	})
+	wait = func(timeout time.Duration) ([]byte, error) {
+		defer remove()
+		select {
+		case p := <-ch:
+			return p, nil
+		case <-l.down:
+			return nil, fmt.Errorf("%w: link lost waiting for AREQ 0x%02X/0x%02X", device.ErrNotConnected, subsys, cmd)
+		case <-time.After(timeout):
+			return nil, fmt.Errorf("%w: no AREQ 0x%02X/0x%02X", device.ErrTimeout, subsys, cmd)
+		case <-l.stopChan:
+			return nil, fmt.Errorf("stopped")
+		}
+	}
+	return wait, remove
+}
@@ -0,0 +1,356 @@
+package znp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/urmzd/zigbee-skill/pkg/device"
+)
+
+// pipeTransport is the host side of an in-memory serial link.
+type pipeTransport struct {
+	r *bufio.Reader
+	w io.WriteCloser
+	c io.Closer
+}
+
+func (p *pipeTransport) Write(b []byte) (int, error) { return p.w.Write(b) }
+func (p *pipeTransport) ReadByte() (byte, error)     { return p.r.ReadByte() }
+func (p *pipeTransport) Close() error {
+	_ = p.w.Close()
+	return p.c.Close()
+}
+
+// emulator is a minimal ZNP: it keeps NV items, forms and resumes a network
+// and answers ZDO and AF requests for one on/off light.
+type emulator struct {
+	mu          sync.Mutex
+	nv          map[uint16][]byte
+	formations  int
+	lightOn     bool
+	lightNodeID uint16
+	lightIEEE   [8]byte
+	// srsps overrides the SRSP for an mtKey; no AREQ follows it.
+	srsps map[uint16][]byte
+
+	w io.Writer
+}
+
+func newEmulator() *emulator {
+	return &emulator{
+		nv:          make(map[uint16][]byte),
+		lightNodeID: 0x4A21,
+		lightIEEE:   [8]byte{0x08, 0x07, 0x06, 0x05, 0x04, 0x03, 0x02, 0x01},
+	}
+}
+
+// connect starts the emulator on a fresh link and returns the host side.
+func (e *emulator) connect() *pipeTransport {
+	hostR, znpW := io.Pipe()
+	znpR, hostW := io.Pipe()
+	e.mu.Lock()
+	e.w = znpW
+	e.mu.Unlock()
+	go e.serve(bufio.NewReader(znpR))
+	return &pipeTransport{r: bufio.NewReader(hostR), w: hostW, c: hostR}
+}
+
+func (e *emulator) send(typ, subsys, cmd uint8, payload []byte) {
+	b, _ := mtFrame{typ: typ, subsys: subsys, cmd: cmd, payload: payload}.encode()
+	_, _ = e.w.Write(b)
+}
+
+func (e *emulator) srsp(f mtFrame, payload ...byte) { e.send(mtTypeSRSP, f.subsys, f.cmd, payload) }
+
+func (e *emulator) areq(subsys, cmd uint8, payload []byte) { e.send(mtTypeAREQ, subsys, cmd, payload) }
+
+func (e *emulator) serve(r io.ByteReader) {
+	for {
+		f, err := readMTFrame(r)
+		if err != nil {
+			return
+		}
+		e.handle(f)
+	}
+}
+
+func (e *emulator) handle(f mtFrame) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	p := f.payload
+	if r, ok := e.srsps[mtKey(f.subsys, f.cmd)]; ok {
+		e.srsp(f, r...)
+		return
+	}
+	switch mtKey(f.subsys, f.cmd) {
+	case mtKey(mtSubsysSYS, sysPing):
+		e.srsp(f, 0x79, 0x01)
+	case mtKey(mtSubsysSYS, sysResetReq):
+		e.areq(mtSubsysSYS, sysResetInd, []byte{0x00, 0x02, 0x00, 0x02, 0x07, 0x01})
+	case mtKey(mtSubsysSYS, sysOsalNVItemInit):
+		id := binary.LittleEndian.Uint16(p)
+		if _, ok := e.nv[id]; ok {
+			e.srsp(f, 0x00)
+			return
+		}
+		e.nv[id] = make([]byte, binary.LittleEndian.Uint16(p[2:]))
+		e.srsp(f, nvItemCreated)
+	case mtKey(mtSubsysSYS, sysOsalNVWrite):
+		id := binary.LittleEndian.Uint16(p)
+		e.nv[id] = append([]byte(nil), p[4:4+int(p[3])]...)
+		e.srsp(f, 0x00)
+	case mtKey(mtSubsysSYS, sysOsalNVRead):
+		v, ok := e.nv[binary.LittleEndian.Uint16(p)]
+		if !ok {
+			e.srsp(f, 0x0A, 0x00)
+			return
+		}
+		e.srsp(f, append([]byte{0x00, byte(len(v))}, v...)...)
+	case mtKey(mtSubsysAPPCNF, appCnfBDBSetChannel):
+		e.srsp(f, 0x00)
+	case mtKey(mtSubsysAPPCNF, appCnfBDBStartCommissioning):
+		e.formations++
+		e.srsp(f, 0x00)
+		e.areq(mtSubsysZDO, zdoStateChangeInd, []byte{devZBCoord})
+	case mtKey(mtSubsysZDO, zdoStartupFromApp):
+		e.srsp(f, 0x00)
+		e.areq(mtSubsysZDO, zdoStateChangeInd, []byte{devZBCoord})
+	case mtKey(mtSubsysAF, afRegister):
+		e.srsp(f, 0x00)
+	case mtKey(mtSubsysUTIL, utilGetDeviceInfo):
+		e.srsp(f, 0x00, 0x11, 0x22, 0x33, 0x44, 0x55, 0x66, 0x77, 0x88, 0x00, 0x00, 0x07, 0x09, 0x00)
+	case mtKey(mtSubsysZDO, zdoExtNwkInfo):
+		resp := []byte{0x00, 0x00, devZBCoord}
+		resp = append(resp, e.nv[nvPanID]...)
+		resp = append(resp, 0x00, 0x00)
+		resp = append(resp, e.nv[nvExtendedPanID]...)
+		resp = append(resp, make([]byte, 8)...)
+		e.srsp(f, append(resp, 15)...)
+	case mtKey(mtSubsysZDO, zdoMgmtPermitJoinReq):
+		e.srsp(f, 0x00)
+		if p[3] > 0 {
+			ind := []byte{byte(e.lightNodeID), byte(e.lightNodeID >> 8)}
+			ind = append(ind, e.lightIEEE[:]...)
+			e.areq(mtSubsysZDO, zdoTCDevInd, append(ind, 0x00, 0x00))
+		}
+	case mtKey(mtSubsysZDO, zdoActiveEPReq):
+		e.srsp(f, 0x00)
+		e.areq(mtSubsysZDO, zdoActiveEPRsp, []byte{p[0], p[1], 0x00, p[0], p[1], 1, 1})
+	case mtKey(mtSubsysZDO, zdoSimpleDescReq):
+		e.srsp(f, 0x00)
+		desc := []byte{p[4], 0x04, 0x01, 0x00, 0x01, 0x01, 2, 0x06, 0x00, 0x08, 0x00, 0}
+		rsp := append([]byte{p[0], p[1], 0x00, p[0], p[1], byte(len(desc))}, desc...)
+		e.areq(mtSubsysZDO, zdoSimpleDescRsp, rsp)
+	case mtKey(mtSubsysAF, afDataRequest):
+		e.srsp(f, 0x00)
+		e.areq(mtSubsysAF, afDataConfirm, []byte{0x00, p[2], p[6]})
+		e.zcl(binary.LittleEndian.Uint16(p[4:6]), p[10:10+int(p[9])])
+	default:
+		e.srsp(f, 0x00)
+	}
+}
+
+// zcl answers a ZCL frame sent to the light.
+func (e *emulator) zcl(cluster uint16, frame []byte) {
+	seq, cmd := frame[1], frame[2]
+	var reply []byte
+	switch {
+	case cluster == zclClusterOnOff && frame[0]&0x03 == 0x01:
+		e.lightOn = cmd == zclCmdOn || (cmd == zclCmdToggle && !e.lightOn)
+		reply = []byte{0x18, seq, zclGlobalDefaultResponse, cmd, 0x00}
+	case cluster == zclClusterOnOff && cmd == 0x00: // Read Attributes
+		on := byte(0)
+		if e.lightOn {
+			on = 1
+		}
+		reply = []byte{0x18, seq, zclGlobalReadAttributesResponse, 0x00, 0x00, 0x00, 0x10, on}
+	default:
+		return
+	}
+	msg := []byte{0x00, 0x00, byte(cluster), byte(cluster >> 8), byte(e.lightNodeID), byte(e.lightNodeID >> 8),
+		1, coordinatorEndpoint, 0, 200, 0, 0, 0, 0, 0, 0, byte(len(reply))}
+	e.areq(mtSubsysAF, afIncomingMsg, append(msg, reply...))
+}
+
+func TestMTFrameDecode(t *testing.T) {
+	good, _ := mtFrame{typ: mtTypeSRSP, subsys: mtSubsysSYS, cmd: sysPing, payload: []byte{0x79, 0x01}}.encode()
+	bad := append([]byte(nil), good...)
+	bad[len(bad)-1] ^= 0xFF
+
+	// Line noise and a frame with a bad FCS precede the valid frame.
+	var stream []byte
+	stream = append(stream, 0x00, 0x42)
+	stream = append(stream, bad...)
+	stream = append(stream, good...)
+
+	f, err := readMTFrame(bytes.NewReader(stream))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.typ != mtTypeSRSP || f.subsys != mtSubsysSYS || f.cmd != sysPing || !bytes.Equal(f.payload, []byte{0x79, 0x01}) {
+		t.Errorf("decoded %v payload %x", f, f.payload)
+	}
+}
+
+func TestZNPFormsNetwork(t *testing.T) {
+	e := newEmulator()
+	c, err := newController(e.connect(), Options{Form: device.FormOptions{Channel: 15, PanID: "0x1a62"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.formations != 1 {
+		t.Fatalf("formations = %d, want 1", e.formations)
+	}
+	if got := binary.LittleEndian.Uint16(e.nv[nvPanID]); got != 0x1a62 {
+		t.Errorf("NV PAN ID = 0x%04x, want 0x1a62", got)
+	}
+	if got := binary.LittleEndian.Uint32(e.nv[nvChanList]); got != 1<<15 {
+		t.Errorf("NV channel list = 0x%08x, want channel 15", got)
+	}
+}
+
+func TestZNPResumeFromNV(t *testing.T) {
+	e := newEmulator()
+	e.nv[nvHasConfigured] = []byte{hasConfiguredOK}
+	e.nv[nvPanID] = []byte{0x62, 0x1a}
+	e.nv[nvExtendedPanID] = make([]byte, 8)
+
+	c, err := newController(e.connect(), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	e.mu.Lock()
+	formations := e.formations
+	e.mu.Unlock()
+	if formations != 0 {
+		t.Errorf("formations = %d, want resume without forming", formations)
+	}
+	info, err := c.NetworkInfo(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.PanID != "0x1a62" || info.CoordinatorIEEE != "88:77:66:55:44:33:22:11" {
+		t.Errorf("network info = %+v", info)
+	}
+}
+
+func TestZNPResetNetwork(t *testing.T) {
+	e := newEmulator()
+	c, err := newController(e.connect(), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.ResetNetwork(); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	// The next start forms a new network instead of resuming the old one.
+	c, err = newController(e.connect(), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.formations != 2 {
+		t.Errorf("formations = %d, want 2", e.formations)
+	}
+}
+
+func TestZNPShortRegisterResponse(t *testing.T) {
+	e := newEmulator()
+	e.srsps = map[uint16][]byte{mtKey(mtSubsysAF, afRegister): {}}
+	if _, err := newController(e.connect(), Options{}); err == nil {
+		t.Fatal("controller started with an empty AF_REGISTER response")
+	}
+}
+
+func TestZNPFailedRequestRemovesListener(t *testing.T) {
+	e := newEmulator()
+	c, err := newController(e.connect(), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	e.mu.Lock()
+	e.srsps = map[uint16][]byte{mtKey(mtSubsysZDO, zdoActiveEPReq): {0x01}}
+	e.mu.Unlock()
+	if _, err := c.activeEndpoints(0x4A21); err == nil {
+		t.Fatal("activeEndpoints succeeded after a failed SREQ")
+	}
+	c.mt.listenerMu.RLock()
+	n := len(c.mt.listeners[mtKey(mtSubsysZDO, zdoActiveEPRsp)])
+	c.mt.listenerMu.RUnlock()
+	if n != 0 {
+		t.Errorf("%d ZDO_ACTIVE_EP_RSP listeners left after the failed request", n)
+	}
+}
+
+func TestZNPJoinAndControl(t *testing.T) {
+	e := newEmulator()
+	c, err := newController(e.connect(), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	events := c.Subscribe(device.EventFilter{})
+	ctx := context.Background()
+	if err := c.PermitJoin(ctx, true, 60); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case evt := <-events:
+		if evt.Type != "device_joined" || evt.Device.ID != "01:02:03:04:05:06:07:08" {
+			t.Fatalf("event = %+v", evt)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no device_joined event")
+	}
+
+	// The interview learns On/Off and Level Control from the simple descriptor.
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		dev, err := c.GetDevice(ctx, "01:02:03:04:05:06:07:08")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dev.Type == device.DeviceTypeLight && len(c.ExportDevices()[0].Clusters) == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("interview incomplete: %+v", c.ExportDevices())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if _, err := c.SetDeviceState(ctx, "01:02:03:04:05:06:07:08", map[string]any{"state": "ON"}); err != nil {
+		t.Fatal(err)
+	}
+	e.mu.Lock()
+	on := e.lightOn
+	e.mu.Unlock()
+	if !on {
+		t.Error("light not switched on")
+	}
+	state, err := c.GetDeviceState(device.WithNoCache(ctx), "01:02:03:04:05:06:07:08")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state["state"] != "ON" {
+		t.Errorf("state = %v", state)
+	}
+}